@@ -4,6 +4,7 @@ package cfg
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 )
 
@@ -28,6 +29,13 @@ type TLS struct {
 	// MaxTLSVersion define the maximum TLS version supported by the listener.
 	// If zero, TLS 1.3 is the default.
 	MaxTLSVersion uint16 `json:"max_tls_version"`
+
+	// ReloadInterval define the interval in seconds between each check of the
+	// certificate files for changes. Changed certificates are reloaded without
+	// restarting the listener.
+	//
+	// The default ReloadInterval is 60 seconds.
+	ReloadInterval int `json:"reload_interval"`
 }
 
 // Listener is, essentially, a opened port on the server that will wait for
@@ -37,6 +45,16 @@ type Listener struct {
 	// "host:port".
 	Addr string `json:"addr"`
 
+	// Addrs define additional TCP addresses, e.g. the IPv6 one, bound by the
+	// listener on the "http" mode. The connections of all addresses share the
+	// handlers of the listener, and the rules still reference it by Addr.
+	Addrs []string `json:"addrs"`
+
+	// Interfaces define, if not empty, the network interfaces whose addresses
+	// are bound on the port of Addr, instead of the host of Addr, on the
+	// "http" mode.
+	Interfaces []string `json:"interfaces"`
+
 	// HTTP2 define if the support for HTTP2 should be enabled for this listener.
 	HTTP2 bool `json:"http2"`
 
@@ -44,27 +62,300 @@ type Listener struct {
 	//
 	// If TLS.Certificates has at least one certificate, the listener will use HTTPS.
 	TLS *TLS `json:"tls"`
+
+	// RequestTimeout define the total time in seconds that each request received
+	// by the listener has to be answered. If zero, there is no deadline.
+	RequestTimeout int `json:"request_timeout"`
+
+	// MaxHeaderBytes define the maximum size in bytes of the request header.
+	// If zero, 1 MB is used.
+	MaxHeaderBytes int `json:"max_header_bytes"`
+
+	// MaxHeaderCount define the maximum number of header fields of a request.
+	// If zero, there is no limit.
+	MaxHeaderCount int `json:"max_header_count"`
+
+	// MinUploadRate define the minimum rate in bytes per second at wich the
+	// clients must send the request bodies. If zero, there is no minimum.
+	MinUploadRate int `json:"min_upload_rate"`
+
+	// MinDownloadRate define the minimum rate in bytes per second at wich the
+	// clients must read the responses. If zero, there is no minimum.
+	MinDownloadRate int `json:"min_download_rate"`
+
+	// RateGracePeriod define the time in seconds that a connection can transfer
+	// below the minimum rates before being closed. If zero, 10 is used.
+	RateGracePeriod int `json:"rate_grace_period"`
+
+	// DisableKeepAlives define that each connection is closed after it's first
+	// request.
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+
+	// MaxConnRequests define the maximum number of HTTP/1.x requests answered
+	// through each connection. If zero, there is no limit.
+	MaxConnRequests int `json:"max_conn_requests"`
+
+	// RejectHTTP10 define that the HTTP/1.0 requests are answered with 505.
+	RejectHTTP10 bool `json:"reject_http10"`
+
+	// DefaultHost define the host of the requests without one, e.g. the
+	// HTTP/1.0 requests without the Host header, so they match the host
+	// conditions. If blank, such requests are kept without a host.
+	DefaultHost string `json:"default_host"`
+
+	// RuleMemoSize define the maximum number of rule evaluation results
+	// memoized by the method, the host and the path of the requests. The
+	// results are only memoized while the rules of the listener have only
+	// path, path pattern and host conditions. If zero, the results are not
+	// memoized.
+	RuleMemoSize int `json:"rule_memo_size"`
+
+	// DefaultNodeGroup define the node group to wich the requests that don't
+	// satisfy any rule of the listener are fowarded. If blank, they are
+	// rejected.
+	DefaultNodeGroup string `json:"default_node_group"`
+
+	// Mode define the mode of the listener: "http" (the default), wich
+	// terminates the connections and evaluates the rules over each request,
+	// or "sni", wich reads the TLS ClientHello without terminating the TLS and
+	// fowards the raw connection to the node group of the server name. On the
+	// "sni" mode, the connections whose server name doesn't match any route
+	// are fowarded to the DefaultNodeGroup.
+	Mode string `json:"mode"`
+
+	// SNIRoutes define the node group of each server name on the "sni" mode.
+	SNIRoutes []SNIRoute `json:"sni_routes"`
+
+	// Sniff define that the protocol of each connection is detected from it's
+	// first bytes, so the TLS and the plaintext HTTP connections are served on
+	// the same port.
+	Sniff bool `json:"sniff"`
+
+	// ProxyProtocol define that the connections may begin with a PROXY
+	// protocol v1 or v2 header, whose source address is used as the client
+	// address. It must only be enabled behind trusted proxies.
+	ProxyProtocol bool `json:"proxy_protocol"`
+
+	// TrustForwarded define that the X-Forwarded-For and X-Forwarded-Port
+	// headers are trusted to resolve the original client address and port,
+	// used by the IP and port conditions. It must only be enabled behind
+	// trusted proxies.
+	TrustForwarded bool `json:"trust_forwarded"`
+
+	// TrustedHops define, with TrustForwarded, the number of proxies in front
+	// of the listener, e.g. 2 behind a CDN and a cloud load balancer. The
+	// client address is the one appended to the X-Forwarded-For header by the
+	// outermost of them, and the addresses at the left of it, sent by the
+	// clients, are ignored. If zero, 1 is used.
+	TrustedHops int `json:"trusted_hops"`
+
+	// TrustedProxies define, with TrustForwarded, the networks, in CIDR
+	// notation, of the proxies trusted to set the forwarded headers. The
+	// X-Forwarded-For addresses are only walked through the trusted proxies,
+	// and the other forwarded headers are only trusted from a trusted peer.
+	// If empty, all the proxies are trusted.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// ForwardedHeaders define that the X-Forwarded-For, X-Forwarded-Proto,
+	// X-Forwarded-Host and X-Forwarded-Port headers are set on the requests
+	// fowarded to the nodes. The X-Forwarded-For addresses not trusted by the
+	// listener are dropped, so the nodes can trust the whole header.
+	ForwardedHeaders bool `json:"forwarded_headers"`
+
+	// SSHNodeGroup define, on the listeners with Sniff, the node group to wich
+	// the connections detected as SSH are fowarded. If blank, they are closed.
+	SSHNodeGroup string `json:"ssh_node_group"`
+
+	// UpstreamHeader define that the responses have the X-Statera-Upstream
+	// header, with the node group and the node that served the request.
+	UpstreamHeader bool `json:"upstream_header"`
+
+	// StatusPage define, if not nil, that the listener answers a minimal status
+	// page with the uptime, the version and the health of the node groups.
+	StatusPage *StatusPage `json:"status_page"`
+}
+
+// StatusPage define the status page of a listener.
+type StatusPage struct {
+	// Path define the path of the status page. If blank, "/statera-status"
+	// is used.
+	Path string `json:"path"`
+
+	// Allow define the networks, in CIDR notation, of the clients allowed to
+	// see the status page. The requests of the other clients are routed as
+	// usual. If empty, only the loopback clients are allowed.
+	Allow []string `json:"allow"`
+}
+
+// SNIRoute define the node group of the connections with a server name.
+type SNIRoute struct {
+	// ServerName define the server name indicated by the clients. A leading
+	// "*." matches exactly one label, e.g. "*.example.com".
+	ServerName string `json:"server_name"`
+
+	NodeGroup string `json:"node_group"`
+
+	// Port define, if not blank, the named port of the nodes to wich the
+	// connections are fowarded. If blank, the node port is used.
+	Port string `json:"port"`
+}
+
+// Fault define faults injected on the requests fowarded by a rule. Each
+// percentage is a value between 0 and 100.
+type Fault struct {
+	// DelayPercent define the percentage of requests that will be delayed.
+	DelayPercent float64 `json:"delay_percent"`
+
+	// Delay define the delay in milliseconds added to the delayed requests.
+	Delay int `json:"delay"`
+
+	// AbortPercent define the percentage of requests that will be aborted.
+	AbortPercent float64 `json:"abort_percent"`
+
+	// AbortStatusCode define the status code answered to aborted requests.
+	AbortStatusCode int `json:"abort_status_code"`
+
+	// DropPercent define the percentage of requests that will have the client
+	// connection dropped.
+	DropPercent float64 `json:"drop_percent"`
+}
+
+// ResponseFilter define the fields removed or masked from the JSON responses of
+// the requests fowarded by a rule. The fields are paths of keys separated by
+// dots, e.g. "user.email", where "*" matches any key and the arrays are
+// traversed, so "items.debug" matches the debug field of each item.
+type ResponseFilter struct {
+	// Remove hold the paths of the fields removed from the responses.
+	Remove []string `json:"remove"`
+
+	// Mask hold the paths of the fields whose values are replaced by
+	// MaskValue.
+	Mask []string `json:"mask"`
+
+	// MaskValue define the string that replaces the masked values. If blank,
+	// "***" is used.
+	MaskValue string `json:"mask_value"`
+}
+
+// Condition define a condition of a rule.
+type Condition struct {
+	Not       bool   `json:"not"`
+	Type      int    `json:"type"`
+	Key       string `json:"key"`
+	Operation int    `json:"operation"`
+	Value     string `json:"value"`
+
+	// Match define, on the condition types with keys, how the multiple
+	// values of the key are compared: 0 compares only the first value, 1
+	// is satisfied if any value matches and 2 if all values match.
+	Match int `json:"match"`
+
+	// Limit define, on the body condition types, how many bytes of the
+	// body are inspected. If zero, the whole body is inspected.
+	Limit int64 `json:"limit"`
 }
 
 type Rule struct {
-	Priority   int    `json:"priority"`
-	Listener   string `json:"listener"`
-	Conditions []struct {
-		Not       bool   `json:"not"`
-		Type      int    `json:"type"`
-		Key       string `json:"key"`
-		Operation int    `json:"operation"`
-		Value     string `json:"value"`
-	} `json:"conditions"`
-	Action struct {
+	// ID identifies the rule on the admin API and on the metrics. It must be
+	// unique across all listeners. If blank, an ID is generated from the
+	// listener and the order of the rule, wich changes when rules are added
+	// before it.
+	ID string `json:"id"`
+
+	Priority   int         `json:"priority"`
+	Listener   string      `json:"listener"`
+	Conditions []Condition `json:"conditions"`
+	Action     struct {
 		NodeGroup string `json:"node_group"`
 		Reject    struct {
 			StatusCode int    `json:"status_code"`
 			Message    string `json:"message"`
 		} `json:"reject"`
 		Redirect string `json:"redirect"`
+
+		// Rewrite define, if not blank, the path of the request fowarded to
+		// the node group. The parameters of path pattern conditions can be
+		// used on the form "{name}", e.g. "/v2/users/{id}".
+		Rewrite string `json:"rewrite"`
+
+		// SetHeaders define headers set on the request fowarded to the node
+		// group. The parameters can also be used on the values.
+		SetHeaders map[string]string `json:"set_headers"`
+
+		// Port define, if not blank, the named port of the nodes to wich
+		// the requests are fowarded, e.g. "metrics". If blank, the node
+		// port is used.
+		Port string `json:"port"`
+
+		Timeout int    `json:"timeout"`
+		Fault   *Fault `json:"fault"`
+
+		// Priority define the priority class of the requests fowarded to the
+		// node group: "high", "normal" or "low". When the LB is overloaded,
+		// the low priority requests are shed first and the high priority ones
+		// are never shed. If blank, "normal" is used.
+		Priority string `json:"priority"`
+
+		// Quota define, if not blank, the name of the quota that limits the
+		// requests of each client fowarded to the node group.
+		Quota string `json:"quota"`
+
+		// Tenant define, if not nil, how the tenant of the requests is
+		// derived. The metrics, the quotas and the access log are then kept
+		// by tenant.
+		Tenant *Tenant `json:"tenant"`
+
+		// ResponseFilter define, if not nil, the fields removed or masked
+		// from the JSON responses of the node group.
+		ResponseFilter *ResponseFilter `json:"response_filter"`
 	} `json:"action"`
 	Dynamic string `json:"dynamic"`
+
+	// Tags label the rule, e.g. to always log the requests it matches through
+	// the log sampling tags.
+	Tags []string `json:"tags"`
+
+	// Enabled define, if not nil, if the rule is evaluated. A disabled rule is
+	// kept on the listener, to be enabled at runtime through the admin API,
+	// e.g. an emergency block rule staged on the configuration. If nil, the
+	// rule is enabled.
+	Enabled *bool `json:"enabled"`
+}
+
+// StaticResponse define the canned response answered by a static node.
+type StaticResponse struct {
+	// StatusCode define the status code of the response. If zero, 200 is used.
+	StatusCode int `json:"status_code"`
+
+	// Headers define the headers of the response.
+	Headers map[string]string `json:"headers"`
+
+	// BodyFile define the path of the file holding the body of the response.
+	// If blank, the response has no body.
+	BodyFile string `json:"body_file"`
+}
+
+// Node is a target node server.
+type Node struct {
+	Host string `json:"host"`
+	Port uint16 `json:"port"`
+
+	Weight int `json:"weight"`
+
+	// Priority define the failover tier of the node. Only the healthy nodes of
+	// the lowest priority of the group receive requests. If zero on all
+	// nodes, all nodes are on the same tier.
+	Priority int `json:"priority"`
+
+	// Static define, if not nil, that the node is a static node, answering
+	// the requests with a canned response instead of being reached through
+	// the network.
+	Static *StaticResponse `json:"static"`
+
+	// Ports define the named ports of the node, e.g. {"metrics": 9100}, for
+	// the nodes that serve several services. The rules, the health check
+	// probes and the sni routes may reference them by name.
+	Ports map[string]uint16 `json:"ports"`
 }
 
 // NodeGroup is a group of target nodes servers.
@@ -72,21 +363,167 @@ type NodeGroup struct {
 	// Name specifies the name of the group.
 	Name string `json:"name"`
 
-	// Nodes hold the address of the target nodes.
-	Nodes []struct {
-		Host string `json:"host"`
-		Port uint16 `json:"port"`
+	// Template define, if not blank, the group template inherited by the
+	// group. The settings of the group override the ones of the template.
+	Template string `json:"template"`
 
-		Weight int `json:"weight"`
-	} `json:"nodes"`
+	// Nodes hold the address of the target nodes.
+	Nodes []Node `json:"nodes"`
 
 	// HTTPS define if the connections to this group must use HTTPS.
 	HTTPS bool `json:"https"`
 
+	// DetectProtocol define that the protocol of each node, HTTPS or plain
+	// HTTP/1.1, is detected when the node is added, ignoring HTTPS.
+	DetectProtocol bool `json:"detect_protocol"`
+
 	// Algorithm define the load balancing algorithm used to route requests to
-	// this group.
+	// this group: "rr" (round-robin), "wrr" (weighted round-robin), "lc"
+	// (least-connections) or "ch" (consistent hashing).
 	Algorithm string `json:"algorithm"`
 
+	// Hash define the key hashed by the "ch" algorithm. If nil, the client IP
+	// is hashed.
+	Hash *Hash `json:"hash"`
+
+	// WarmUpConns define the number of idle connections opened to each node
+	// when it becomes healthy.
+	WarmUpConns int `json:"warm_up_conns"`
+
+	// LocalAddr define the local IP address used as the source of the
+	// connections to the nodes.
+	LocalAddr string `json:"local_addr"`
+
+	// FallbackDelay define the head start in milliseconds of the connections
+	// to the preferred address family of the nodes with both IPv6 and IPv4
+	// addresses, before the other family is attempted in parallel. If zero,
+	// 300 is used. If negative, the other family is attempted only on failure.
+	FallbackDelay int `json:"fallback_delay"`
+
+	// HeaderTimeout define the time in milliseconds that the nodes have to
+	// answer the response header, so stalled nodes are detected before the
+	// request deadline. If zero, there is no limit.
+	HeaderTimeout int `json:"header_timeout"`
+
+	// TLSSessionCache define the number of TLS sessions to the nodes cached to
+	// be resumed by the new connections. If zero, the sessions are not resumed.
+	TLSSessionCache int `json:"tls_session_cache"`
+
+	// MaxConnAge define the maximum time in seconds that a connection to a
+	// node is reused, so the nodes rebalance the long-lived keep-alive
+	// connections. If zero, there is no limit.
+	MaxConnAge int `json:"max_conn_age"`
+
+	// MaxConnRequests define the maximum number of requests sent on a
+	// connection to a node. If zero, there is no limit.
+	MaxConnRequests int `json:"max_conn_requests"`
+
+	// ZeroCopy define that the data of the TCP passthrough and of the served
+	// files is copied by the kernel, with splice(2) and sendfile(2). It's
+	// experimental and only supported on Linux.
+	ZeroCopy bool `json:"zero_copy"`
+
+	// Proxy define the URL of the egress proxy used to reach the nodes. The
+	// supported schemes are "http", "https" and "socks5".
+	Proxy string `json:"proxy"`
+
+	// Encoding define the Accept-Encoding sent to the nodes: "passthrough"
+	// fowards the one of the client, "identity" asks for uncompressed
+	// responses and "gzip" asks for gzip responses, decompressing them for
+	// the clients that don't accept gzip. If blank, "passthrough" is used.
+	Encoding string `json:"encoding"`
+
+	// DisableRanges define that the range requests are answered with the
+	// complete response, for nodes that don't handle ranges correctly.
+	DisableRanges bool `json:"disable_ranges"`
+
+	// ETag define if the LB generates the ETag of the responses with a
+	// Content-Length up to 1 MB and without ETag and Last-Modified, other
+	// than the event streams, answering 304 to the clients that
+	// already hold them: "off", "strong" or "weak". If blank, "off" is used.
+	ETag string `json:"etag"`
+
+	// Signing define, if not nil, the signature added to the requests
+	// fowarded to the nodes, so they can reject the requests that didn't pass
+	// through the LB.
+	Signing *RequestSigning `json:"signing"`
+
+	// TraceAttempts define if the responses have the X-Statera-Attempts
+	// header, listing the node, the status or error and the duration of each
+	// attempt made to foward the request. The attempts are also written on
+	// the access log.
+	TraceAttempts bool `json:"trace_attempts"`
+
+	// ConnAffinity define that each client connection is pinned to a single
+	// node connection for it's lifetime, as needed by NTLM and other protocols
+	// that authenticate the connection.
+	ConnAffinity bool `json:"conn_affinity"`
+
+	// AffinityDrain define what happens to the connections pinned to a node
+	// when it's drained: "honor" (the default) keeps them on the node for
+	// AffinityDrainTTL seconds, or until closed if zero, and "repin" pins
+	// them to another node on their next request.
+	AffinityDrain    string `json:"affinity_drain"`
+	AffinityDrainTTL int    `json:"affinity_drain_ttl"`
+
+	// Standby define that the group is a standby pool, e.g. for disaster
+	// recovery: it's nodes are health checked, but the group serves requests
+	// only after being activated through the admin API.
+	Standby bool `json:"standby"`
+
+	// Failover define, if not blank, the standby group that serves the
+	// requests of the group when activated, or when the group has no healthy
+	// node.
+	Failover string `json:"failover"`
+
+	// AllDown define, if not nil, what the group answers when it has no
+	// healthy node. If nil, it answers 502.
+	AllDown *AllDown `json:"all_down"`
+
+	// MaxUploadRate define the maximum rate in bytes per second at wich the
+	// request bodies are sent to the nodes of the group. If zero, there is no
+	// limit.
+	MaxUploadRate int64 `json:"max_upload_rate"`
+
+	// MaxDownloadRate define the maximum rate in bytes per second at wich the
+	// responses of the group are sent to the clients. If zero, there is no
+	// limit.
+	MaxDownloadRate int64 `json:"max_download_rate"`
+
+	// SRV define, if not nil, that the nodes of the group are discovered from
+	// the DNS SRV records of a name. The weight and priority of each record
+	// are imported as the weight and the failover tier of the node.
+	SRV *SRV `json:"srv"`
+
+	// Cache define, if not nil, that the responses of the group are cached by
+	// the LB.
+	Cache *CachePolicy `json:"cache"`
+
+	// Idempotency define, if not nil, that the unsafe requests of the group
+	// with an Idempotency-Key header are fowarded to the nodes at most once:
+	// the duplicates are answered with the stored response, or with 409
+	// while the first is in progress.
+	Idempotency *Idempotency `json:"idempotency"`
+
+	// SLOs define the service level objectives of the group, measured from
+	// it's metrics, whose burn rate alerts are notified to the webhooks.
+	SLOs []SLO `json:"slos"`
+
+	// Files define, if not nil, that the group serves the files of a local
+	// directory instead of fowarding the requests to nodes.
+	Files *struct {
+		// Root define the path of the directory whose files will be served.
+		Root string `json:"root"`
+
+		// Index define the name of the file served when a directory is
+		// requested. If blank, "index.html" is used.
+		Index string `json:"index"`
+
+		// MaxAge define the value in seconds of the Cache-Control max-age
+		// directive sent with the files.
+		MaxAge int `json:"max_age"`
+	} `json:"files"`
+
 	// HealthCheck define the health check configuration of the group.
 	HealthCheck struct {
 		// Path define the path to wich the health check requests should be
@@ -100,14 +537,788 @@ type NodeGroup struct {
 		// Timeout define the time in seconds to a health check request be
 		// considered failed.
 		Timeout int `json:"timeout"`
+
+		// Headers define headers sent on each health check request, e.g. an
+		// Authorization header with a bearer token.
+		Headers map[string]string `json:"headers"`
+
+		// UserAgent define the User-Agent of the health check requests. If
+		// blank, "statera-healthcheck/1.0" is used.
+		UserAgent string `json:"user_agent"`
+
+		// ClientCert define, if not nil, the certificate presented by the
+		// health checks to the nodes that require mTLS.
+		ClientCert *Certificate `json:"client_cert"`
+
+		// Scheme define the scheme of the health check requests, "http" or
+		// "https". If blank, the scheme of the traffic is used.
+		Scheme string `json:"scheme"`
+
+		// InsecureSkipVerify define that the health checks don't verify the
+		// certificate of the nodes. It doesn't affect the traffic.
+		InsecureSkipVerify bool `json:"insecure_skip_verify"`
+
+		// Probes define, if not empty, the probes done on each health check.
+		// If empty, the health check is a single HTTP probe of Path.
+		Probes []Probe `json:"probes"`
+
+		// Mode define how the results of the Probes are combined: "all" (the
+		// default), "any" or "quorum".
+		Mode string `json:"mode"`
+
+		// Quorum define the number of Probes that must pass on the "quorum"
+		// mode. If zero, the majority of the Probes must pass.
+		Quorum int `json:"quorum"`
 	} `json:"health_check"`
 }
 
+// GroupTemplate define the settings shared by the node groups that inherit it.
+type GroupTemplate struct {
+	// Name specifies the name of the template, referenced by the groups.
+	Name string `json:"name"`
+
+	// Group hold the settings of the template, in the same format of a node
+	// group. The objects are merged with the ones of the groups, so a group
+	// may override a single setting of e.g. the health check, while the
+	// lists are replaced. A template can't inherit an other template.
+	Group json.RawMessage `json:"group"`
+}
+
+// Probe define a probe of a health check.
+type Probe struct {
+	// Type define the type of the probe: "http" (the default) or "tcp".
+	Type string `json:"type"`
+
+	// Path define the path to wich the requests of a "http" probe should be
+	// sent.
+	Path string `json:"path"`
+
+	// Port define the port of the node probed. If zero, the node port is
+	// probed.
+	Port uint16 `json:"port"`
+
+	// PortName define, if not blank, the named port of the node probed,
+	// instead of port. The probe fails on the nodes without the port.
+	PortName string `json:"port_name"`
+}
+
+// Admin define the configuration of the admin listener. The admin listener serves
+// the operational endpoints of statera, like the readiness and shutdown status.
+type Admin struct {
+	// Addr specifies the TCP address for the admin listener to listen on, in the
+	// form "host:port".
+	Addr string `json:"addr"`
+
+	// TLS define the TLS configuration of the admin listener. If nil, the
+	// admin listener uses plain HTTP.
+	TLS *AdminTLS `json:"tls"`
+
+	// Tokens hold the static tokens accepted by the admin listener, sent on the
+	// "Authorization: Bearer <token>" header.
+	Tokens []AdminToken `json:"tokens"`
+
+	// Identities maps the client certificates, verified against the client CA
+	// of the admin TLS configuration, to roles.
+	//
+	// If there is no Tokens nor Identities, the admin listener doesn't require
+	// authentication.
+	Identities []AdminIdentity `json:"identities"`
+
+	// Registration define how the backends that register themselves on the
+	// admin listener are handled. If nil, the defaults are used.
+	Registration *Registration `json:"registration"`
+}
+
+// Registration define the node auto-registration, where the backends announce
+// themselves to the admin listener and keep heartbeating to remain on the group.
+type Registration struct {
+	// DefaultTTL define the time in seconds that a registered node remains on
+	// it's group without a heartbeat, when the registration doesn't specify
+	// one. If zero, 30 seconds are used.
+	DefaultTTL int `json:"default_ttl"`
+
+	// MaxTTL define the maximum TTL in seconds that a registration may
+	// specify. If zero, 300 seconds are used.
+	MaxTTL int `json:"max_ttl"`
+
+	// Groups hold the node groups that accept registrations. If empty, all
+	// groups accept them.
+	Groups []string `json:"groups"`
+}
+
+// AdminTLS define the TLS configuration of the admin listener.
+type AdminTLS struct {
+	Certificate
+
+	// ClientCAFile hold the CA certificates file path location used to verify
+	// the client certificates.
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// AdminToken define a static token of the admin listener.
+//
+// Role can be "read-only", wich can only read the state of statera, "operator",
+// wich can also drain and change the nodes, or "admin", wich can also change the
+// rules.
+type AdminToken struct {
+	// Name identifies the owner of the token on the audit log.
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// AdminIdentity maps the common name of a client certificate to a role. See
+// AdminToken for the roles.
+type AdminIdentity struct {
+	CommonName string `json:"common_name"`
+	Role       string `json:"role"`
+}
+
+// Shutdown define how statera should behave when a shutdown signal is received.
+type Shutdown struct {
+	// PreStopDelay define the time in seconds that statera will wait, after being
+	// marked as not ready, before it stops accepting new connections. It gives
+	// time for external load balancers and DNS to stop sending traffic.
+	PreStopDelay int `json:"pre_stop_delay"`
+
+	// DrainTimeout define the maximum time in seconds that statera will wait for
+	// in-flight requests to finish after it stops accepting new connections.
+	//
+	// The default DrainTimeout is 30 seconds.
+	DrainTimeout int `json:"drain_timeout"`
+}
+
+// HA define the active/passive high availability of two statera instances. The
+// instances advertise their state to each other over UDP and only the master
+// binds the listeners; the backup takes over when the master stops advertising.
+type HA struct {
+	// Addr define the UDP address where the adverts of the peer are received.
+	Addr string `json:"addr"`
+
+	// Peer define the UDP address of the other instance.
+	Peer string `json:"peer"`
+
+	// Priority define the priority of the instance, from 1 to 255. The
+	// instance with the higher priority becomes master first.
+	//
+	// The default Priority is 100.
+	Priority int `json:"priority"`
+
+	// AdvertInterval define the time in milliseconds between the adverts.
+	//
+	// The default AdvertInterval is 1000 milliseconds.
+	AdvertInterval int `json:"advert_interval"`
+
+	// DeadIntervals define the number of advert intervals without an advert of
+	// the master after wich the backup takes over.
+	//
+	// The default DeadIntervals is 3.
+	DeadIntervals int `json:"dead_intervals"`
+
+	// Preempt define that the master yields to a backup with a higher priority.
+	Preempt bool `json:"preempt"`
+
+	// Secret define, if not blank, the key that authenticates the adverts. Both
+	// instances must have the same Secret.
+	Secret string `json:"secret"`
+
+	// OnMaster and OnBackup define, if not blank, the shell commands run when
+	// the instance becomes master and when it goes back to backup, e.g. to move
+	// the public address between the hosts. The virtual IP is not managed by
+	// statera itself.
+	OnMaster string `json:"on_master"`
+	OnBackup string `json:"on_backup"`
+}
+
+// Log define the logging configuration of the application.
+type Log struct {
+	// AccessLog define the path of the file where each request will be logged.
+	// If blank, the access log is disabled.
+	AccessLog string `json:"access_log"`
+
+	// ErrorLog define the path of the file where the application errors will
+	// be logged. If blank, the errors are logged to the standard error.
+	ErrorLog string `json:"error_log"`
+
+	// AuditLog define the path of the file where every runtime change made
+	// through the admin listener will be recorded. If blank, the audit log is
+	// disabled.
+	AuditLog string `json:"audit_log"`
+
+	// AccessSink and ErrorSink define remote endpoints where the access and the
+	// error logs are shipped to, besides the files. If nil, the log is not
+	// shipped.
+	AccessSink *LogSink `json:"access_sink"`
+	ErrorSink  *LogSink `json:"error_sink"`
+
+	// Sampling define, if not nil, wich requests are recorded on the access
+	// log and on the attempt traces of the node groups with trace_attempts.
+	// If nil, every request is recorded.
+	Sampling *Sampling `json:"sampling"`
+
+	// Debug define, if not nil, that the request bodies inspected by the body
+	// conditions are logged on the error log, as one JSON object per line, to
+	// troubleshoot the rules. It's off by default, as the bodies may hold
+	// sensitive data.
+	Debug *Debug `json:"debug"`
+}
+
+// Debug define the debug logging of the bodies inspected by the rules. The values
+// of the form and JSON fields named password, secret, token and similar are
+// always redacted.
+type Debug struct {
+	// RedactFields define the names of more form and JSON fields whose values
+	// are redacted.
+	RedactFields []string `json:"redact_fields"`
+
+	// RedactPatterns define regular expressions whose matches are redacted,
+	// e.g. card numbers.
+	RedactPatterns []string `json:"redact_patterns"`
+}
+
+// ExternalData define the refresh of the external data files.
+type ExternalData struct {
+	// RefreshInterval define the interval in seconds between the checks for
+	// changes of the files. If zero, 60 is used.
+	RefreshInterval int `json:"refresh_interval"`
+}
+
+// Exemplars define how the trace IDs of the requests are found.
+type Exemplars struct {
+	// TraceHeader define the request header with the trace ID. The
+	// "traceparent" header of the W3C Trace Context is parsed and only it's
+	// sampled traces are used, while the value of any other header is the
+	// trace ID itself. If blank, "traceparent" is used.
+	TraceHeader string `json:"trace_header"`
+}
+
+// Sampling define wich requests are recorded by the access log and the attempt
+// traces. The requests answered with a status of 400 or above are always
+// recorded.
+type Sampling struct {
+	// SuccessPercent define the percentage of the successful requests that
+	// are recorded, e.g. 1 records one in a hundred.
+	SuccessPercent float64 `json:"success_percent"`
+
+	// Tags define the rule tags whose requests are always recorded.
+	Tags []string `json:"tags"`
+}
+
+// LogSink define a remote endpoint where log lines are shipped to. Exactly one of
+// Syslog or HTTP must be set.
+//
+// The lines are held on a buffer while they are shipped, so a slow or unavailable
+// endpoint never blocks the requests. When the buffer is full, new lines are
+// dropped.
+type LogSink struct {
+	// Syslog define a syslog server that receives each line as a RFC 5424
+	// message.
+	Syslog *struct {
+		// Network define the transport: "udp", "tcp" or "tls".
+		Network string `json:"network"`
+
+		// Addr define the address of the syslog server, in the form
+		// "host:port".
+		Addr string `json:"addr"`
+
+		// Tag define the application name of the messages. The default Tag
+		// is "statera".
+		Tag string `json:"tag"`
+
+		// Facility define the syslog facility of the messages. The default
+		// Facility is 16 (local0).
+		Facility int `json:"facility"`
+	} `json:"syslog"`
+
+	// HTTP define a HTTP endpoint that receives batches of lines on the body
+	// of POST requests, one line per row.
+	HTTP *struct {
+		URL string `json:"url"`
+
+		// Headers are added to each request, e.g. to authenticate on the
+		// endpoint.
+		Headers map[string]string `json:"headers"`
+
+		// Retries define how many times a failed batch is retried before
+		// being dropped.
+		Retries int `json:"retries"`
+	} `json:"http"`
+
+	// BufferSize define how many lines can wait to be shipped. The default
+	// BufferSize is 10000.
+	BufferSize int `json:"buffer_size"`
+
+	// BatchSize define the maximum number of lines shipped at once. The default
+	// BatchSize is 100 for HTTP and 1 for syslog.
+	BatchSize int `json:"batch_size"`
+
+	// FlushInterval define the maximum time in milliseconds that a line waits
+	// for the batch to be filled. The default FlushInterval is 1000.
+	FlushInterval int `json:"flush_interval"`
+}
+
+// Quota define the maximum number of requests of each client on each hour, day
+// or month.
+type Quota struct {
+	// Name define the name of the quota, referenced by the rule actions.
+	Name string `json:"name"`
+
+	// Limit define the number of requests of each client on each period.
+	Limit int64 `json:"limit"`
+
+	// Period define the period of the limit: "hour", "day" or "month". The
+	// periods start on the UTC hour, day or month.
+	Period string `json:"period"`
+
+	// Header define, if not blank, the header that identifies the client, e.g.
+	// "X-Api-Key". If blank, or missing on a request, the client IP is used.
+	Header string `json:"header"`
+
+	// Keys hold the known values of the header, required with a header. The
+	// requests with an unknown value are identified by the client IP.
+	Keys []string `json:"keys"`
+
+	// ByTenant define that the requests with a tenant are identified by the
+	// tenant, so all the clients of a tenant share the limit.
+	ByTenant bool `json:"by_tenant"`
+}
+
+// Tenant define how the tenant of the requests matched by a rule is derived.
+type Tenant struct {
+	// Source define the part of the request from wich the tenant is derived:
+	// "header", "claim" (a claim of the JWT bearer token, whose signature is
+	// not verified) or "host".
+	Source string `json:"source"`
+
+	// Key define the header name, the claim name or, on the "host" source, the
+	// suffix stripped from the host, e.g. ".example.com".
+	Key string `json:"key"`
+
+	// Default define the tenant of the requests from wich no tenant is
+	// derived. If blank, such requests have no tenant.
+	Default string `json:"default"`
+}
+
+// HealthState define the persistence of the node health across restarts.
+type HealthState struct {
+	// File define the path of the state file.
+	File string `json:"file"`
+
+	// RestoreAge define the maximum age in seconds of a saved state for the
+	// nodes that were healthy to start healthy, skipping the wait for their
+	// first health check. If zero, all nodes start unhealthy. The nodes that
+	// were unhealthy always start unhealthy.
+	RestoreAge int `json:"restore_age"`
+}
+
+// Webhook define a HTTP endpoint notified of the LB events: "node_healthy" and
+// "node_unhealthy".
+type Webhook struct {
+	// URL define the endpoint that receives the events on POST requests.
+	URL string `json:"url"`
+
+	// Headers are added to each request, e.g. to authenticate on the endpoint.
+	Headers map[string]string `json:"headers"`
+
+	// Template define the body of the requests, as a Go text/template executed
+	// with the event fields .Type, .Group, .Node and .Time, and .SLO, .Window
+	// and .BurnRate on the SLO events. If blank, the event is sent as JSON.
+	Template string `json:"template"`
+
+	// Events define the event types notified. If empty, all are notified.
+	Events []string `json:"events"`
+
+	// Retries define how many times a failed notification is retried.
+	Retries int `json:"retries"`
+}
+
+// RequestSigning define the signature of the requests fowarded to a node group.
+type RequestSigning struct {
+	// Type define the type of the signature: "hmac" or "sigv4". The "hmac"
+	// signature is the hex HMAC-SHA256 of the method, the path with query and
+	// the unix timestamp, joined by "\n".
+	Type string `json:"type"`
+
+	// Key define the secret of the "hmac" signature.
+	Key string `json:"key"`
+
+	// SignatureHeader and TimestampHeader define the headers of the "hmac"
+	// signature. If blank, "X-Statera-Signature" and "X-Statera-Timestamp"
+	// are used.
+	SignatureHeader string `json:"signature_header"`
+	TimestampHeader string `json:"timestamp_header"`
+
+	// AccessKeyID, SecretAccessKey and SessionToken define the AWS credentials
+	// of the "sigv4" signature.
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+
+	// Region and Service define the AWS region and service of the "sigv4"
+	// signature.
+	Region  string `json:"region"`
+	Service string `json:"service"`
+}
+
+// AllDown define what a node group answers when it has no healthy node.
+type AllDown struct {
+	// Policy define the answer: "bad_gateway" (the default) answers 502,
+	// "unavailable" answers 503 with Retry-After, "stale" answers the cached
+	// responses even if expired, or 503 with Retry-After, "fallback" fowards
+	// the requests to Group and "fail_open" fowards them to the node that
+	// was healthy most recently anyway.
+	Policy string `json:"policy"`
+
+	// RetryAfter define the Retry-After in seconds of the 503 responses. If
+	// zero, 5 is used.
+	RetryAfter int `json:"retry_after"`
+
+	// Group define the node group of the "fallback" policy.
+	Group string `json:"group"`
+}
+
+// CachePolicy define how the responses of a node group are cached.
+type CachePolicy struct {
+	// TTL define the time in seconds that the responses without a max-age or
+	// s-maxage Cache-Control directive are cached. If zero, only the responses
+	// with one of the directives are cached.
+	TTL int `json:"ttl"`
+
+	// Key define the template of the cache key, e.g.
+	// "{host}{path}?{query:page}{header:Accept-Language}{cookie:ab}". If blank,
+	// "{host}{path}?{query}" is used.
+	Key string `json:"key"`
+
+	// MaxBodyBytes define the maximum size in bytes of a cached response body.
+	// If zero, 1 MB is used.
+	MaxBodyBytes int `json:"max_body_bytes"`
+
+	// StaleWhileRevalidate define the time in seconds, after a response
+	// expires, that it's still answered while it's refreshed in the
+	// background, for the responses without the stale-while-revalidate
+	// Cache-Control directive.
+	StaleWhileRevalidate int `json:"stale_while_revalidate"`
+
+	// StaleIfError define the time in seconds, after a response expires, that
+	// it's answered when the nodes fail or answer 5xx, for the responses
+	// without the stale-if-error Cache-Control directive.
+	StaleIfError int `json:"stale_if_error"`
+}
+
+// Idempotency define the at-most-once guard of the unsafe requests of a node
+// group, keyed on a request header.
+type Idempotency struct {
+	// Header define the request header holding the key. If blank,
+	// "Idempotency-Key" is used.
+	Header string `json:"header"`
+
+	// TTL define the time in seconds that the responses are stored and
+	// answered to the duplicate requests. If zero, 86400 is used.
+	TTL int `json:"ttl"`
+
+	// Require define that the unsafe requests without the key are answered
+	// with 400.
+	Require bool `json:"require"`
+
+	// MaxBodyBytes define the maximum size in bytes of a stored response body.
+	// The duplicates of a request with a bigger response are answered with
+	// 409. If zero, 64 KB is used.
+	MaxBodyBytes int `json:"max_body_bytes"`
+}
+
+// SLO define a service level objective of a node group.
+type SLO struct {
+	// Kind define what is measured: "availability", the percentage of the
+	// requests not failed or answered with 5xx, or "latency", the percentage
+	// of the requests answered within the LatencyThreshold.
+	Kind string `json:"kind"`
+
+	// Target define the percentage of good requests, e.g. 99.9.
+	Target float64 `json:"target"`
+
+	// LatencyThreshold define, on the latency objectives, the time in
+	// milliseconds to answer a good request.
+	LatencyThreshold int `json:"latency_threshold"`
+
+	// Window define the window of the objective in seconds. If zero, 30 days
+	// is used.
+	Window int `json:"window"`
+
+	// Alerts define when the burn rate of the error budget is alerted. If
+	// empty, a fast burn of 14.4 on 1 hour and 5 minutes and a slow burn of 6
+	// on 6 hours and 30 minutes are alerted.
+	Alerts []BurnRateAlert `json:"alerts"`
+}
+
+// BurnRateAlert define an alert of the burn rate of an objective, firing when
+// the burn rate is at or above BurnRate on both windows.
+type BurnRateAlert struct {
+	// LongWindow and ShortWindow define the windows in seconds.
+	LongWindow  int `json:"long_window"`
+	ShortWindow int `json:"short_window"`
+
+	// BurnRate define the rate, where 1 spends the whole error budget in the
+	// objective window.
+	BurnRate float64 `json:"burn_rate"`
+}
+
+// Hash define the key hashed by the consistent-hashing algorithm.
+type Hash struct {
+	// Key define the part of the request hashed: "client_ip" (the default),
+	// "header" or "cookie". The requests without the header or the cookie
+	// are hashed by the client IP.
+	Key string `json:"key"`
+
+	// Name define the name of the header or the cookie hashed.
+	Name string `json:"name"`
+
+	// VirtualNodes define the number of points of each node of weight 1 on
+	// the hash ring. More points spread the keys more evenly. If zero, 160 is
+	// used.
+	VirtualNodes int `json:"virtual_nodes"`
+}
+
+// SRV define the discovery of the nodes of a node group through DNS SRV records.
+type SRV struct {
+	// Name define the SRV name looked up, e.g. "_http._tcp.api.example.com".
+	Name string `json:"name"`
+
+	// Interval define the interval in seconds between each lookup. If zero,
+	// 30 seconds is used.
+	Interval int `json:"interval"`
+}
+
+// XDS define the configuration of the xDS client mode, where the nodes of the
+// node groups are discovered from a service mesh management server. Each cluster
+// of the management server is mapped to the node group with the same name.
+type XDS struct {
+	// Server define the base URL of the management server REST-JSON API.
+	Server string `json:"server"`
+
+	// NodeID and Cluster identify statera to the management server.
+	NodeID  string `json:"node_id"`
+	Cluster string `json:"cluster"`
+
+	// Interval define the interval in seconds between each poll of the
+	// management server. If zero, 30 seconds is used.
+	Interval int `json:"interval"`
+}
+
+// UDP define the balancing of UDP datagrams, e.g. DNS or syslog, across groups
+// of UDP nodes.
+type UDP struct {
+	Groups    []UDPGroup    `json:"groups"`
+	Listeners []UDPListener `json:"listeners"`
+}
+
+// UDPGroup define a group of UDP nodes. The datagrams of a client are kept on
+// the same node, chosen by the hash of the client IP.
+type UDPGroup struct {
+	Name  string    `json:"name"`
+	Nodes []UDPNode `json:"nodes"`
+
+	// HealthCheck define, if not nil, the health check of the nodes.
+	HealthCheck *UDPHealthCheck `json:"health_check"`
+}
+
+// UDPNode define a node of a UDP group.
+type UDPNode struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// UDPHealthCheck define the health check of the nodes of a UDP group.
+type UDPHealthCheck struct {
+	// Type define the probe: "udp" (the default), wich sends the payload to
+	// the node port, or "icmp", wich sends an ICMP echo request and needs the
+	// CAP_NET_RAW capability.
+	Type string `json:"type"`
+
+	// Interval and Timeout define the interval between each check and the
+	// time to answer, in seconds. If zero, 5 and 2 are used.
+	Interval int `json:"interval"`
+	Timeout  int `json:"timeout"`
+
+	// Payload define the datagram sent by the "udp" probe.
+	Payload string `json:"payload"`
+
+	// Expect define, if not blank, the text that the reply of the "udp" probe
+	// must contain. If blank, the node is healthy unless the port is reported
+	// as unreachable.
+	Expect string `json:"expect"`
+}
+
+// UDPListener define a UDP port whose datagrams are balanced across a group.
+type UDPListener struct {
+	Addr      string `json:"addr"`
+	NodeGroup string `json:"node_group"`
+
+	// SessionTimeout define the time in seconds that a client is kept on it's
+	// node without datagrams. If zero, 60 is used.
+	SessionTimeout int `json:"session_timeout"`
+
+	// MaxSessions define the maximum number of client sessions, each holding a
+	// socket to the node. The datagrams of new clients above it are dropped.
+	// If zero, 10000 is used.
+	MaxSessions int `json:"max_sessions"`
+}
+
+// LoadShedding define when the requests are shed by the priority class of their
+// rule, answered with 503 and Retry-After, to keep the high priority requests
+// responsive under pressure.
+type LoadShedding struct {
+	// LowInFlight define the number of requests in flight to the nodes from
+	// wich the low priority requests are shed.
+	LowInFlight int64 `json:"low_in_flight"`
+
+	// NormalInFlight define the number of requests in flight to the nodes
+	// from wich the normal and low priority requests are shed.
+	NormalInFlight int64 `json:"normal_in_flight"`
+
+	// RetryAfter define the Retry-After in seconds of the shed requests. If
+	// zero, 5 is used.
+	RetryAfter int `json:"retry_after"`
+
+	// Overload define, if not nil, the limits of the resources of the LB
+	// process itself. When any resource is above it's limit, the low priority
+	// requests are shed, and when above twice the limit, the normal priority
+	// requests are also shed.
+	Overload *Overload `json:"overload"`
+}
+
+// Overload define the limits of the resources of the LB process. A zero limit is
+// not monitored.
+type Overload struct {
+	// MaxGoroutines define the limit of goroutines.
+	MaxGoroutines int `json:"max_goroutines"`
+
+	// MaxHeapBytes define the limit of allocated heap bytes.
+	MaxHeapBytes uint64 `json:"max_heap_bytes"`
+
+	// MaxSchedulingDelay define the limit in microseconds of the time a new
+	// goroutine waits to run, wich grows when the LB lacks CPU.
+	MaxSchedulingDelay int `json:"max_scheduling_delay"`
+
+	// Interval define the interval in milliseconds between each sample of
+	// the resources. If zero, 1000 is used.
+	Interval int `json:"interval"`
+}
+
 // Config is a struct describing the complete configuration of the application.
 type Config struct {
 	Listeners  []Listener  `json:"listeners"`
 	NodeGroups []NodeGroup `json:"node_groups"`
+
+	// GroupTemplates define the templates inherited by the node groups.
+	GroupTemplates []GroupTemplate `json:"group_templates"`
+
 	Rules      []Rule      `json:"rules"`
+	RuleGroups []RuleGroup `json:"rule_groups"`
+	Admin      *Admin      `json:"admin"`
+	Shutdown   Shutdown    `json:"shutdown"`
+	Log        Log         `json:"log"`
+	XDS        *XDS        `json:"xds"`
+	Webhooks   []Webhook   `json:"webhooks"`
+	UDP        *UDP        `json:"udp"`
+
+	// HA define, if not nil, that the instance runs in active/passive pair with
+	// an other instance, binding the listeners only while it's the master.
+	HA *HA `json:"ha"`
+
+	// Quotas define the request quotas referenced by the rule actions.
+	Quotas []Quota `json:"quotas"`
+
+	// QuotaFile define, if not blank, the path of the file where the quota
+	// counters are persisted across restarts.
+	QuotaFile string `json:"quota_file"`
+
+	// QuotaMaxCounters define the maximum number of quota counters held. The
+	// requests of the clients above it are not limited. If zero, 100000 is
+	// used.
+	QuotaMaxCounters int `json:"quota_max_counters"`
+
+	// MaxTenants define the maximum number of tenants on the metrics. The
+	// requests of the tenants above it are measured as "other". If zero, 1000
+	// is used.
+	MaxTenants int `json:"max_tenants"`
+
+	// CacheMaxEntries define the maximum number of responses held by the cache
+	// of the node groups. If zero, 10000 is used.
+	CacheMaxEntries int `json:"cache_max_entries"`
+
+	// IdempotencyMaxEntries define the maximum number of idempotency keys held
+	// by the guard of the node groups. If zero, 10000 is used.
+	IdempotencyMaxEntries int `json:"idempotency_max_entries"`
+
+	// HealthState define, if not nil, that the node health is persisted on a
+	// local file, to be known after a restart.
+	HealthState *HealthState `json:"health_state"`
+
+	// LoadShedding define, if not nil, when the requests are shed by their
+	// priority class.
+	LoadShedding *LoadShedding `json:"load_shedding"`
+
+	// Exemplars define, if not nil, that the latency histograms have exemplars
+	// with the trace IDs of the requests, linking the latency spikes to
+	// example traces. They are exposed when the metrics are scraped on the
+	// OpenMetrics format.
+	Exemplars *Exemplars `json:"exemplars"`
+
+	// ExternalData define how the external data files, like the IP lists of
+	// the rule conditions, are refreshed. If nil, they are refreshed every
+	// minute.
+	ExternalData *ExternalData `json:"external_data"`
+
+	// RandomSeed define, if not zero, the seed of the random decisions, like
+	// the fault injection, so the routing behaviour can be reproduced.
+	RandomSeed int64 `json:"random_seed"`
+
+	// SlowConditionThreshold define the p99 evaluation time, in microseconds,
+	// above wich a rule condition is reported as slow. If zero, 1000 is used.
+	SlowConditionThreshold int `json:"slow_condition_threshold"`
+}
+
+// RuleGroup define a set of rules that share common conditions. The conditions
+// of the group are declared once and applied to all child rules, e.g. a Host
+// condition shared by all the rules of an API.
+type RuleGroup struct {
+	// Name identifies the group.
+	Name string `json:"name"`
+
+	// Listener define the listener of the child rules that don't define one.
+	Listener string `json:"listener"`
+
+	// Conditions are evaluated before the conditions of each child rule.
+	Conditions []Condition `json:"conditions"`
+
+	Rules []Rule `json:"rules"`
+}
+
+// Expand returns the child rules of the group with the group conditions and
+// listener applied.
+func (g RuleGroup) Expand() []Rule {
+	ret := make([]Rule, 0, len(g.Rules))
+	for _, r := range g.Rules {
+		conds := make([]Condition, 0, len(g.Conditions)+len(r.Conditions))
+		conds = append(conds, g.Conditions...)
+		r.Conditions = append(conds, r.Conditions...)
+		if r.Listener == "" {
+			r.Listener = g.Listener
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// AllRules returns the rules of the configuration, followed by the expanded rules
+// of each rule group.
+func (c *Config) AllRules() []Rule {
+	ret := make([]Rule, 0, len(c.Rules))
+	ret = append(ret, c.Rules...)
+	for _, g := range c.RuleGroups {
+		ret = append(ret, g.Expand()...)
+	}
+	return ret
 }
 
 // Load the configuration JSON from Reader and parse it.
@@ -120,9 +1331,54 @@ func Load(r io.Reader) (*Config, error) {
 	if err := json.Unmarshal(b, &ret); err != nil {
 		return nil, err
 	}
+	if err := ret.applyTemplates(b); err != nil {
+		return nil, err
+	}
 	return &ret, nil
 }
 
+// applyTemplates decodes again the node groups that inherit a template, from
+// the configuration JSON b, over the settings of the template.
+func (c *Config) applyTemplates(b []byte) error {
+	if len(c.GroupTemplates) == 0 {
+		return nil
+	}
+	tmpls := make(map[string]json.RawMessage, len(c.GroupTemplates))
+	for _, t := range c.GroupTemplates {
+		if _, ok := tmpls[t.Name]; ok || t.Name == "" {
+			return fmt.Errorf("cfg: invalid group template %q", t.Name)
+		}
+		tmpls[t.Name] = t.Group
+	}
+
+	var raw struct {
+		NodeGroups []json.RawMessage `json:"node_groups"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	for i, ng := range c.NodeGroups {
+		if ng.Template == "" {
+			continue
+		}
+		t, ok := tmpls[ng.Template]
+		if !ok {
+			return fmt.Errorf("cfg: node group %q inherits unknown template %q", ng.Name, ng.Template)
+		}
+		var merged NodeGroup
+		if len(t) > 0 {
+			if err := json.Unmarshal(t, &merged); err != nil {
+				return fmt.Errorf("cfg: group template %q: %w", ng.Template, err)
+			}
+		}
+		if err := json.Unmarshal(raw.NodeGroups[i], &merged); err != nil {
+			return err
+		}
+		c.NodeGroups[i] = merged
+	}
+	return nil
+}
+
 // Write the configuration JSON to Writer.
 func (c *Config) Write(w io.Writer) error {
 	buf := &bytes.Buffer{}
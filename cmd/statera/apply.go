@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/evaluator"
+)
+
+var errApplyFailed = errors.New("some changes could not be applied")
+
+// applyNode is the node on the nodes endpoint of the admin listener.
+type applyNode struct {
+	Group    string `json:"group"`
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Weight   int    `json:"weight"`
+	Priority int    `json:"priority"`
+}
+
+// applyUpdate is an update pushed to the stream endpoint of the admin listener.
+type applyUpdate struct {
+	Op    string    `json:"op"`
+	ID    string    `json:"id,omitempty"`
+	Group string    `json:"group,omitempty"`
+	Rule  *cfg.Rule `json:"rule,omitempty"`
+	Node  *cfg.Node `json:"node,omitempty"`
+
+	// desc describes the update on the plan.
+	desc string
+}
+
+// applyResult is the result of an update answered by the stream endpoint.
+type applyResult struct {
+	Op    string `json:"op"`
+	Error string `json:"error"`
+}
+
+// adminClient makes the requests to the admin listener.
+type adminClient struct {
+	c     *http.Client
+	addr  string
+	token string
+}
+
+// do makes the request to the admin listener and decodes the JSON response on v.
+func (ac *adminClient) do(method, path string, body io.Reader, v any) error {
+	res, err := ac.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// request sends the request to the admin listener. An error is returned if the
+// response is not a 200, otherwise the response body must be closed.
+func (ac *adminClient) request(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, ac.addr+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if ac.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.token)
+	}
+	res, err := ac.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		res.Body.Close()
+		return nil, fmt.Errorf("admin answered %s on %s: %s", res.Status, path, strings.TrimSpace(string(b)))
+	}
+	return res, nil
+}
+
+// stream pushes the updates encoded on body through the stream endpoint and
+// returns the result of each one.
+func (ac *adminClient) stream(body io.Reader) ([]applyResult, error) {
+	res, err := ac.request("POST", "/stream", body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var results []applyResult
+	dec := json.NewDecoder(res.Body)
+	for {
+		var r applyResult
+		if err := dec.Decode(&r); err == io.EOF {
+			return results, nil
+		} else if err != nil {
+			return results, err
+		}
+		results = append(results, r)
+	}
+}
+
+// cfgRule returns the cfg.Rule described by the evaluator.Rule.
+func cfgRule(r evaluator.Rule) cfg.Rule {
+	var c cfg.Rule
+	c.ID = r.ID
+	c.Priority = r.Priority
+	c.Listener = r.Listener
+	c.Dynamic = r.Dynamic
+	c.Tags = r.Tags
+	if r.Disabled {
+		enabled := false
+		c.Enabled = &enabled
+	}
+	for _, rc := range r.Conditions {
+		c.Conditions = append(c.Conditions, cfg.Condition{
+			Not:       rc.Not,
+			Type:      int(rc.Type),
+			Key:       rc.Key,
+			Operation: int(rc.Operation),
+			Match:     int(rc.Match),
+			Value:     rc.Value,
+			Limit:     rc.Limit,
+		})
+	}
+	c.Action.NodeGroup = r.Action.NodeGroup
+	c.Action.Reject.StatusCode = r.Action.Reject.StatusCode
+	c.Action.Reject.Message = r.Action.Reject.Message
+	c.Action.Redirect = r.Action.Redirect
+	c.Action.Rewrite = r.Action.Rewrite
+	c.Action.SetHeaders = r.Action.SetHeaders
+	c.Action.Port = r.Action.Port
+	c.Action.Timeout = r.Action.Timeout
+	c.Action.Quota = r.Action.Quota
+	if r.Action.Priority != evaluator.PriorityNormal {
+		c.Action.Priority = r.Action.Priority.String()
+	}
+	if t := r.Action.Tenant; t != nil {
+		c.Action.Tenant = &cfg.Tenant{Source: t.Source.String(), Key: t.Key, Default: t.Default}
+	}
+	if f := r.Action.ResponseFilter; f != nil {
+		c.Action.ResponseFilter = &cfg.ResponseFilter{
+			Remove:    f.Remove,
+			Mask:      f.Mask,
+			MaskValue: f.MaskValue,
+		}
+	}
+	if f := r.Action.Fault; f != nil {
+		c.Action.Fault = &cfg.Fault{
+			DelayPercent:    f.DelayPercent,
+			Delay:           f.Delay,
+			AbortPercent:    f.AbortPercent,
+			AbortStatusCode: f.AbortStatusCode,
+			DropPercent:     f.DropPercent,
+		}
+	}
+	return c
+}
+
+// ruleKey returns the compact JSON of the rule, without the ID. Rules with the
+// same key are equal, regardless of nil and empty fields.
+func ruleKey(r cfg.Rule) string {
+	r.ID = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return ""
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return ""
+	}
+	b, _ = json.Marshal(compact(v))
+	return string(b)
+}
+
+// planRules returns the updates that turn the running rules in the desired ones.
+// A desired rule with an ID is kept only by the running rule with the same ID
+// and content, while a desired rule without ID is kept by any running rule with
+// the same content. The running rules that are not kept are deleted by their
+// ID, and only then the missing rules are added.
+func planRules(running []evaluator.Rule, desired []cfg.Rule) []applyUpdate {
+	want := make(map[string]int)
+	for _, r := range desired {
+		want[r.ID+" "+ruleKey(r)]++
+	}
+
+	var ups []applyUpdate
+	for _, rr := range running {
+		k := ruleKey(cfgRule(rr))
+		switch {
+		case want[rr.ID+" "+k] > 0:
+			want[rr.ID+" "+k]--
+		case want[" "+k] > 0:
+			want[" "+k]--
+		default:
+			ups = append(ups, applyUpdate{Op: "delete_rule", ID: rr.ID, desc: "- rule " + rr.ID + " " + k})
+		}
+	}
+	for _, r := range desired {
+		k := r.ID + " " + ruleKey(r)
+		if want[k] == 0 {
+			continue
+		}
+		want[k]--
+		r := r
+		ups = append(ups, applyUpdate{Op: "add_rule", Rule: &r, desc: "+ rule " + strings.TrimSpace(k)})
+	}
+	return ups
+}
+
+// planNodes returns the updates that turn the running nodes of each desired node
+// group in the desired nodes. Node groups can't be created at runtime, so a
+// desired group that is not running is an error.
+func planNodes(running []applyNode, desired []cfg.NodeGroup) ([]applyUpdate, error) {
+	byGroup := make(map[string]map[string]applyNode)
+	for _, n := range running {
+		if byGroup[n.Group] == nil {
+			byGroup[n.Group] = make(map[string]applyNode)
+		}
+		byGroup[n.Group][fmt.Sprintf("%s:%d", n.Host, n.Port)] = n
+	}
+
+	var ups []applyUpdate
+	for _, g := range desired {
+		cur, ok := byGroup[g.Name]
+		if !ok && len(g.Nodes) > 0 {
+			return nil, fmt.Errorf("node group %s is not running, node groups can only be created by a restart", g.Name)
+		}
+		seen := make(map[string]bool)
+		for _, n := range g.Nodes {
+			n := n
+			addr := fmt.Sprintf("%s:%d", n.Host, n.Port)
+			seen[addr] = true
+			rn, ok := cur[addr]
+			switch {
+			case !ok:
+				ups = append(ups, applyUpdate{Op: "add_node", Group: g.Name, Node: &n,
+					desc: fmt.Sprintf("+ node %s/%s weight %d", g.Name, addr, n.Weight)})
+			case rn.Weight != n.Weight || rn.Priority != n.Priority:
+				ups = append(ups, applyUpdate{Op: "update_node", Group: g.Name, Node: &n,
+					desc: fmt.Sprintf("~ node %s/%s weight %d -> %d, priority %d -> %d", g.Name, addr, rn.Weight, n.Weight, rn.Priority, n.Priority)})
+			}
+		}
+
+		addrs := make([]string, 0, len(cur))
+		for addr := range cur {
+			if !seen[addr] {
+				addrs = append(addrs, addr)
+			}
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			rn := cur[addr]
+			ups = append(ups, applyUpdate{Op: "delete_node", Group: g.Name,
+				Node: &cfg.Node{Host: rn.Host, Port: rn.Port},
+				desc: fmt.Sprintf("- node %s/%s", g.Name, addr)})
+		}
+	}
+	return ups, nil
+}
+
+// apply implements the apply subcommand. It reads the desired configuration,
+// computes the difference to the rules and nodes running on the load balancer
+// and applies only the changes through the admin listener, on a single stream.
+//
+// Listeners, node group settings and the other sections of the configuration
+// can't be changed at runtime and are not compared.
+func apply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	file := fs.String("f", "", "file with the desired configuration")
+	addr := fs.String("admin", "http://127.0.0.1:8081", "address of the statera admin listener")
+	token := fs.String("token", os.Getenv("STATERA_ADMIN_TOKEN"), "token of the admin listener, if it requires authentication")
+	dryRun := fs.Bool("dry-run", false, "only show the changes that would be applied")
+	fs.Parse(args)
+	if *file == "" {
+		fmt.Fprintln(fs.Output(), "usage: statera apply -f <file> [-dry-run]")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	if !strings.Contains(*addr, "://") {
+		*addr = "http://" + *addr
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	desired, err := cfg.Load(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	ac := &adminClient{c: &http.Client{Timeout: 30 * time.Second}, addr: *addr, token: *token}
+	var rules []evaluator.Rule
+	if err := ac.do("GET", "/rules", nil, &rules); err != nil {
+		return err
+	}
+	var nodes []applyNode
+	if err := ac.do("GET", "/nodes", nil, &nodes); err != nil {
+		return err
+	}
+
+	ups, err := planNodes(nodes, desired.NodeGroups)
+	if err != nil {
+		return err
+	}
+	// the nodes are changed before the rules, so the added rules can route to
+	// the added nodes.
+	ups = append(ups, planRules(rules, desired.AllRules())...)
+	if len(ups) == 0 {
+		fmt.Println("no changes")
+		return nil
+	}
+	for _, u := range ups {
+		fmt.Println(u.desc)
+	}
+	if *dryRun {
+		fmt.Printf("%d changes, none applied (dry run)\n", len(ups))
+		return nil
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, u := range ups {
+		if err := enc.Encode(u); err != nil {
+			return err
+		}
+	}
+	results, err := ac.stream(&body)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for i, res := range results {
+		if res.Error == "" {
+			continue
+		}
+		failed++
+		if i < len(ups) {
+			fmt.Fprintf(os.Stderr, "failed: %s: %s\n", ups[i].desc, res.Error)
+		} else {
+			fmt.Fprintf(os.Stderr, "failed: %s\n", res.Error)
+		}
+	}
+	fmt.Printf("%d changes, %d applied\n", len(ups), len(results)-failed)
+	if failed > 0 {
+		return errApplyFailed
+	}
+	return nil
+}
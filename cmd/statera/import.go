@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mhef/statera/cfg"
+)
+
+var errImportFormat = errors.New("the format must be nginx or haproxy")
+
+// Condition types and operations used by the imported rules. They mirror the
+// values of the evaluator package.
+const (
+	condPath   = 0
+	condHeader = 4
+	condIP     = 5
+	condHost   = 11
+
+	opEqual     = 0
+	opBeginWith = 1
+	opRegex     = 2
+	opRange     = 3
+)
+
+// importer accumulates the configuration being imported. Directives that can't
+// be translated are reported as warnings.
+type importer struct {
+	c        cfg.Config
+	groups   map[string]*cfg.NodeGroup
+	lnrs     map[string]*cfg.Listener
+	warnings []string
+}
+
+func newImporter() *importer {
+	return &importer{
+		groups: make(map[string]*cfg.NodeGroup),
+		lnrs:   make(map[string]*cfg.Listener),
+	}
+}
+
+// warn records a warning about a directive that was not imported.
+func (im *importer) warn(format string, a ...any) {
+	im.warnings = append(im.warnings, fmt.Sprintf(format, a...))
+}
+
+// group returns the node group with the name, creating it if it doesn't exist.
+func (im *importer) group(name string) *cfg.NodeGroup {
+	if g, ok := im.groups[name]; ok {
+		return g
+	}
+	g := &cfg.NodeGroup{Name: name, Algorithm: "rr"}
+	g.HealthCheck.Interval = 5
+	g.HealthCheck.Timeout = 3
+	im.groups[name] = g
+	return g
+}
+
+// listener returns the listener with the address, creating it if it doesn't
+// exist.
+func (im *importer) listener(addr string) *cfg.Listener {
+	if l, ok := im.lnrs[addr]; ok {
+		return l
+	}
+	l := &cfg.Listener{Addr: addr}
+	im.lnrs[addr] = l
+	return l
+}
+
+// addNode adds the node on the address "host:port" to the group.
+func (im *importer) addNode(g *cfg.NodeGroup, addr string, weight int) error {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return fmt.Errorf("node %s has no port", addr)
+	}
+	port, err := strconv.ParseUint(addr[i+1:], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port on node %s", addr)
+	}
+	if weight != 1 && g.Algorithm == "rr" {
+		g.Algorithm = "wrr"
+	}
+	g.Nodes = append(g.Nodes, cfg.Node{Host: addr[:i], Port: uint16(port), Weight: weight})
+	return nil
+}
+
+// listenAddr normalizes a listen address, that can be only a port or have a
+// "*" host, to the "host:port" form.
+func listenAddr(s string) string {
+	s = strings.TrimPrefix(s, "*:")
+	if !strings.Contains(s, ":") {
+		return "0.0.0.0:" + s
+	}
+	return s
+}
+
+// anyOf returns a regex that matches any of the values, anchored as the op.
+func anyOf(values []string, op int) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = regexp.QuoteMeta(v)
+	}
+	re := "^(" + strings.Join(quoted, "|") + ")"
+	if op == opEqual {
+		re += "$"
+	}
+	return re
+}
+
+// cond returns a condition comparing with one of the values.
+func cond(typ int, key string, op int, values []string) cfg.Condition {
+	if len(values) == 1 {
+		return cfg.Condition{Type: typ, Key: key, Operation: op, Value: values[0]}
+	}
+	return cfg.Condition{Type: typ, Key: key, Operation: opRegex, Value: anyOf(values, op)}
+}
+
+// config returns the imported configuration, with the listeners and node groups
+// ordered by address and name.
+func (im *importer) config() *cfg.Config {
+	c := im.c
+	addrs := make([]string, 0, len(im.lnrs))
+	for a := range im.lnrs {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+	for _, a := range addrs {
+		c.Listeners = append(c.Listeners, *im.lnrs[a])
+	}
+	names := make([]string, 0, len(im.groups))
+	for n := range im.groups {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		c.NodeGroups = append(c.NodeGroups, *im.groups[n])
+	}
+	return &c
+}
+
+// compact removes the null, false, zero and empty values from the decoded JSON
+// v, as they are the defaults of the configuration.
+func compact(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, e := range t {
+			e = compact(e)
+			if isEmpty(e) {
+				delete(t, k)
+				continue
+			}
+			t[k] = e
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = compact(e)
+		}
+	}
+	return v
+}
+
+// isEmpty returns if the decoded JSON value is the default of it's type.
+func isEmpty(v any) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !t
+	case float64:
+		return t == 0
+	case string:
+		return t == ""
+	case map[string]any:
+		return len(t) == 0
+	case []any:
+		return len(t) == 0
+	}
+	return false
+}
+
+// writeConfig writes the configuration as indented JSON, without the fields with
+// default values.
+func writeConfig(w io.Writer, c *cfg.Config) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	b, err = json.MarshalIndent(compact(v), "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// importCmd implements the import subcommand. It parses a nginx or HAProxy
+// configuration file and writes the equivalent statera configuration on the
+// standard output. Directives that can't be translated are reported on the
+// standard error.
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "format of the imported file: nginx or haproxy")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: statera import -format nginx|haproxy <file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	im := newImporter()
+	switch *format {
+	case "nginx":
+		err = im.nginx(string(b))
+	case "haproxy":
+		err = im.haproxy(string(b))
+	default:
+		return errImportFormat
+	}
+	if err != nil {
+		return err
+	}
+	for _, w := range im.warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	return writeConfig(os.Stdout, im.config())
+}
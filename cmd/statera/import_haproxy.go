@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mhef/statera/cfg"
+)
+
+// haproxySection is a section of a HAProxy configuration, like a frontend or a
+// backend, with it's lines split on words.
+type haproxySection struct {
+	kind  string
+	name  string
+	lines []haproxyLine
+}
+
+// haproxyLine is a line of a HAProxy section.
+type haproxyLine struct {
+	words []string
+	num   int
+}
+
+// sectionKinds are the keywords that begin a HAProxy section.
+var sectionKinds = map[string]bool{
+	"global": true, "defaults": true, "frontend": true, "backend": true,
+	"listen": true, "resolvers": true, "peers": true, "userlist": true,
+}
+
+// splitHAProxy splits a HAProxy configuration on it's sections, removing the
+// comments.
+func splitHAProxy(src string) []haproxySection {
+	var secs []haproxySection
+	for i, l := range strings.Split(src, "\n") {
+		if j := strings.Index(l, "#"); j >= 0 {
+			l = l[:j]
+		}
+		words := strings.Fields(l)
+		if len(words) == 0 {
+			continue
+		}
+		if sectionKinds[words[0]] {
+			s := haproxySection{kind: words[0]}
+			if len(words) > 1 {
+				s.name = words[1]
+			}
+			if s.kind == "listen" {
+				// a listen section is a frontend and a backend with the
+				// same name.
+				s.lines = append(s.lines, haproxyLine{[]string{"default_backend", s.name}, i + 1})
+			}
+			secs = append(secs, s)
+			continue
+		}
+		if len(secs) == 0 {
+			continue
+		}
+		secs[len(secs)-1].lines = append(secs[len(secs)-1].lines, haproxyLine{words, i + 1})
+	}
+	return secs
+}
+
+// haproxy imports the backends of a HAProxy configuration as node groups and the
+// frontends as listeners with rules. listen sections are imported as both.
+func (im *importer) haproxy(src string) error {
+	secs := splitHAProxy(src)
+	for _, s := range secs {
+		if s.kind == "backend" || s.kind == "listen" {
+			if err := im.haproxyBackend(s); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range secs {
+		switch s.kind {
+		case "frontend", "listen":
+			if err := im.haproxyFrontend(s); err != nil {
+				return err
+			}
+		case "backend", "global", "defaults":
+		default:
+			im.warn("section %s %s ignored", s.kind, s.name)
+		}
+	}
+	return nil
+}
+
+// haproxyBackend imports a backend as a node group.
+func (im *importer) haproxyBackend(s haproxySection) error {
+	g := im.group(s.name)
+	for _, l := range s.lines {
+		w := l.words
+		switch w[0] {
+		case "server":
+			if len(w) < 3 {
+				return fmt.Errorf("line %d: server without address", l.num)
+			}
+			weight := 1
+			for i := 3; i < len(w); i++ {
+				switch w[i] {
+				case "weight":
+					if i+1 < len(w) {
+						v, err := strconv.Atoi(w[i+1])
+						if err != nil {
+							return fmt.Errorf("line %d: invalid weight", l.num)
+						}
+						weight = v
+						i++
+					}
+				case "ssl":
+					g.HTTPS = true
+				case "check":
+				default:
+					im.warn("line %d: server parameter %s ignored", l.num, w[i])
+				}
+			}
+			if err := im.addNode(g, w[2], weight); err != nil {
+				return fmt.Errorf("line %d: %w", l.num, err)
+			}
+		case "balance":
+			if len(w) > 1 && w[1] == "leastconn" {
+				g.Algorithm = "lc"
+			} else if len(w) > 1 && w[1] != "roundrobin" && w[1] != "static-rr" {
+				im.warn("line %d: balance %s becomes round-robin", l.num, w[1])
+			}
+		case "option":
+			if len(w) > 2 && w[1] == "httpchk" {
+				p := w[len(w)-1]
+				g.HealthCheck.Path = strings.TrimPrefix(p, "/")
+			}
+		case "bind", "mode", "default_backend", "use_backend", "acl", "http-request", "timeout":
+			// frontend lines of listen sections are imported as a frontend.
+		default:
+			im.warn("line %d: backend keyword %s ignored", l.num, w[0])
+		}
+	}
+	return nil
+}
+
+// haproxyACL translates the criterion and values of an ACL to a condition.
+// ok is false if the criterion is not supported.
+func haproxyACL(words []string) (c cfg.Condition, ok bool) {
+	if len(words) < 2 {
+		return c, false
+	}
+	crit := words[0]
+	var values []string
+	for _, v := range words[1:] {
+		// flags like -i (case insensitive) are the default on statera.
+		if strings.HasPrefix(v, "-") {
+			continue
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return c, false
+	}
+
+	switch {
+	case crit == "path":
+		return cond(condPath, "", opEqual, values), true
+	case crit == "path_beg":
+		return cond(condPath, "", opBeginWith, values), true
+	case crit == "path_reg":
+		return cfg.Condition{Type: condPath, Operation: opRegex, Value: strings.Join(values, "|")}, true
+	case crit == "src":
+		if len(values) != 1 {
+			return c, false
+		}
+		v := values[0]
+		if !strings.Contains(v, "/") {
+			v += "/32"
+		}
+		return cfg.Condition{Type: condIP, Operation: opRange, Value: v}, true
+	case crit == "hdr(host)" || crit == "hdr_dom(host)":
+		return cond(condHost, "", opEqual, values), true
+	case crit == "hdr_beg(host)":
+		return cond(condHost, "", opBeginWith, values), true
+	case strings.HasPrefix(crit, "hdr(") && strings.HasSuffix(crit, ")"):
+		return cond(condHeader, crit[4:len(crit)-1], opEqual, values), true
+	case strings.HasPrefix(crit, "hdr_beg(") && strings.HasSuffix(crit, ")"):
+		return cond(condHeader, crit[8:len(crit)-1], opBeginWith, values), true
+	}
+	return c, false
+}
+
+// haproxyConds translates the ACL names of an "if" clause to the conditions of a
+// rule. ok is false if an ACL can't be translated.
+func (im *importer) haproxyConds(names []string, acls map[string]*cfg.Condition, num int) (conds []cfg.Condition, ok bool) {
+	conds = make([]cfg.Condition, 0)
+	for _, n := range names {
+		if n == "if" {
+			continue
+		}
+		not := strings.HasPrefix(n, "!")
+		n = strings.TrimPrefix(n, "!")
+		if n == "unless" || n == "||" || n == "or" {
+			im.warn("line %d: only \"if\" clauses with and'ed ACLs are supported", num)
+			return nil, false
+		}
+		c, found := acls[n]
+		if !found || c == nil {
+			im.warn("line %d: unknown or unsupported acl %s", num, n)
+			return nil, false
+		}
+		cc := *c
+		cc.Not = not
+		conds = append(conds, cc)
+	}
+	return conds, true
+}
+
+// haproxyFrontend imports a frontend as a listener for each bind, with one rule
+// for each use_backend, redirect and deny line.
+func (im *importer) haproxyFrontend(s haproxySection) error {
+	var addrs []string
+	var rules []cfg.Rule
+	// acls hold the translated ACLs by name. ACLs that can't be translated are
+	// held as nil.
+	acls := make(map[string]*cfg.Condition)
+	defaultBackend := ""
+	for _, l := range s.lines {
+		w := l.words
+		switch w[0] {
+		case "bind":
+			if len(w) < 2 {
+				return fmt.Errorf("line %d: bind without address", l.num)
+			}
+			addrs = append(addrs, listenAddr(w[1]))
+			if len(w) > 2 {
+				im.warn("line %d: bind parameters ignored, the listener TLS must be configured manually", l.num)
+			}
+		case "acl":
+			if len(w) < 3 {
+				return fmt.Errorf("line %d: invalid acl", l.num)
+			}
+			if _, found := acls[w[1]]; found {
+				// HAProxy ORs the lines of an ACL declared more than once,
+				// wich the rule conditions can't express.
+				im.warn("line %d: acl %s declared more than once ignored", l.num, w[1])
+				acls[w[1]] = nil
+				continue
+			}
+			c, ok := haproxyACL(w[2:])
+			if !ok {
+				im.warn("line %d: acl %s with criterion %s ignored", l.num, w[1], w[2])
+				acls[w[1]] = nil
+				continue
+			}
+			acls[w[1]] = &c
+		case "use_backend":
+			if len(w) < 2 {
+				return fmt.Errorf("line %d: use_backend without backend", l.num)
+			}
+			conds, ok := im.haproxyConds(w[2:], acls, l.num)
+			if !ok {
+				continue
+			}
+			// HAProxy evaluates the http-request lines before the
+			// use_backend lines.
+			r := cfg.Rule{Priority: 1, Conditions: conds}
+			r.Action.NodeGroup = im.group(w[1]).Name
+			rules = append(rules, r)
+		case "default_backend":
+			if len(w) > 1 {
+				defaultBackend = im.group(w[1]).Name
+			}
+		case "http-request":
+			r, ok := im.haproxyHTTPRequest(w, acls, l.num)
+			if ok {
+				rules = append(rules, r)
+			}
+		case "mode", "timeout", "option", "maxconn", "log":
+		case "server", "balance":
+			// backend lines of listen sections are imported as a backend.
+		default:
+			im.warn("line %d: frontend keyword %s ignored", l.num, w[0])
+		}
+	}
+
+	for _, a := range addrs {
+		lnr := im.listener(a)
+		lnr.DefaultNodeGroup = defaultBackend
+		for _, r := range rules {
+			r.Listener = a
+			im.c.Rules = append(im.c.Rules, r)
+		}
+	}
+	return nil
+}
+
+// haproxyHTTPRequest translates the "http-request redirect" and "http-request
+// deny" lines to rules. ok is false if the line can't be translated.
+func (im *importer) haproxyHTTPRequest(w []string, acls map[string]*cfg.Condition, num int) (r cfg.Rule, ok bool) {
+	if len(w) < 2 {
+		return r, false
+	}
+	cut := len(w)
+	for i, v := range w {
+		if v == "if" || v == "unless" {
+			cut = i
+			break
+		}
+	}
+	conds, ok := im.haproxyConds(w[cut:], acls, num)
+	if !ok {
+		return r, false
+	}
+	r.Conditions = conds
+	switch w[1] {
+	case "redirect":
+		for i := 2; i+1 < cut; i++ {
+			if w[i] == "location" {
+				r.Action.Redirect = w[i+1]
+				return r, true
+			}
+		}
+	case "deny":
+		r.Action.Reject.StatusCode = 403
+		for i := 2; i+1 < cut; i++ {
+			if w[i] == "deny_status" {
+				if code, err := strconv.Atoi(w[i+1]); err == nil {
+					r.Action.Reject.StatusCode = code
+				}
+			}
+		}
+		return r, true
+	}
+	im.warn("line %d: http-request %s ignored", num, w[1])
+	return r, false
+}
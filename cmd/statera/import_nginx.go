@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mhef/statera/cfg"
+)
+
+var errNginxSyntax = errors.New("invalid nginx configuration syntax")
+
+// nginxDirective is a directive of a nginx configuration, with it's block if it
+// has one.
+type nginxDirective struct {
+	name  string
+	args  []string
+	block []nginxDirective
+	line  int
+}
+
+// nginxToken is a token of a nginx configuration: a word, "{", "}" or ";".
+type nginxToken struct {
+	s    string
+	line int
+}
+
+// tokenizeNginx splits a nginx configuration on it's tokens, removing the
+// comments and the quotes.
+func tokenizeNginx(src string) []nginxToken {
+	var toks []nginxToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			toks = append(toks, nginxToken{string(c), line})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j > len(src) {
+				j = len(src)
+			}
+			toks = append(toks, nginxToken{src[i+1 : j], line})
+			i = j + 1
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\r\n{};", rune(src[j])) {
+				j++
+			}
+			toks = append(toks, nginxToken{src[i:j], line})
+			i = j
+		}
+	}
+	return toks
+}
+
+// parseNginx parses the tokens on directives, until the end of the current
+// block.
+func parseNginx(toks []nginxToken, pos *int) ([]nginxDirective, error) {
+	var ds []nginxDirective
+	for *pos < len(toks) {
+		t := toks[*pos]
+		if t.s == "}" {
+			*pos++
+			return ds, nil
+		}
+		d := nginxDirective{name: t.s, line: t.line}
+		*pos++
+		for {
+			if *pos >= len(toks) {
+				return nil, fmt.Errorf("%w: line %d: unexpected end of file", errNginxSyntax, t.line)
+			}
+			a := toks[*pos]
+			*pos++
+			if a.s == ";" {
+				break
+			}
+			if a.s == "{" {
+				b, err := parseNginx(toks, pos)
+				if err != nil {
+					return nil, err
+				}
+				d.block = b
+				break
+			}
+			if a.s == "}" {
+				return nil, fmt.Errorf("%w: line %d: unexpected }", errNginxSyntax, a.line)
+			}
+			d.args = append(d.args, a.s)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// nginxLocation is a location block translated to a rule, with the information
+// needed to order it as nginx would.
+type nginxLocation struct {
+	rule cfg.Rule
+
+	// class hold the precedence of the location modifier: exact matches first,
+	// then "^~" prefixes, then regexes and then the plain prefixes.
+	class int
+
+	// prefix is the location path, used to order the prefixes by length.
+	prefix string
+}
+
+// nginx imports the upstream and server blocks of a nginx configuration. The
+// blocks may be on the top level or inside a http block.
+func (im *importer) nginx(src string) error {
+	pos := 0
+	ds, err := parseNginx(tokenizeNginx(src), &pos)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if d.name == "http" {
+			ds = append(ds, d.block...)
+		}
+	}
+	for _, d := range ds {
+		if d.name == "upstream" {
+			if err := im.nginxUpstream(d); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range ds {
+		switch d.name {
+		case "server":
+			if err := im.nginxServer(d); err != nil {
+				return err
+			}
+		case "http", "upstream", "events", "user", "worker_processes", "pid", "error_log":
+		default:
+			im.warn("line %d: directive %s ignored", d.line, d.name)
+		}
+	}
+	return nil
+}
+
+// nginxUpstream imports an upstream block as a node group.
+func (im *importer) nginxUpstream(d nginxDirective) error {
+	if len(d.args) != 1 {
+		return fmt.Errorf("%w: line %d: upstream without name", errNginxSyntax, d.line)
+	}
+	g := im.group(d.args[0])
+	for _, sd := range d.block {
+		switch sd.name {
+		case "server":
+			if len(sd.args) == 0 {
+				return fmt.Errorf("%w: line %d: server without address", errNginxSyntax, sd.line)
+			}
+			weight := 1
+			for _, a := range sd.args[1:] {
+				if strings.HasPrefix(a, "weight=") {
+					w, err := strconv.Atoi(strings.TrimPrefix(a, "weight="))
+					if err != nil {
+						return fmt.Errorf("%w: line %d: invalid weight", errNginxSyntax, sd.line)
+					}
+					weight = w
+				} else {
+					im.warn("line %d: server parameter %s ignored", sd.line, a)
+				}
+			}
+			if err := im.addNode(g, sd.args[0], weight); err != nil {
+				return fmt.Errorf("line %d: %w", sd.line, err)
+			}
+		case "least_conn":
+			if g.Algorithm == "wrr" {
+				im.warn("line %d: least_conn ignores the server weights", sd.line)
+			}
+			g.Algorithm = "lc"
+		default:
+			im.warn("line %d: upstream directive %s ignored", sd.line, sd.name)
+		}
+	}
+	return nil
+}
+
+// nginxServer imports a server block as a listener for each listen directive and
+// one rule for each location. The rules match the server names with a Host
+// condition.
+func (im *importer) nginxServer(d nginxDirective) error {
+	var addrs, names []string
+	var locs []nginxDirective
+	for _, sd := range d.block {
+		switch sd.name {
+		case "listen":
+			if len(sd.args) == 0 {
+				return fmt.Errorf("%w: line %d: listen without address", errNginxSyntax, sd.line)
+			}
+			addrs = append(addrs, listenAddr(sd.args[0]))
+			for _, a := range sd.args[1:] {
+				if a != "default_server" {
+					im.warn("line %d: listen parameter %s ignored, the listener TLS must be configured manually", sd.line, a)
+				}
+			}
+		case "server_name":
+			for _, n := range sd.args {
+				if n != "_" && n != "" {
+					names = append(names, n)
+				}
+			}
+		case "location":
+			locs = append(locs, sd)
+		default:
+			im.warn("line %d: server directive %s ignored", sd.line, sd.name)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = []string{"0.0.0.0:80"}
+	}
+
+	var rules []nginxLocation
+	for _, ld := range locs {
+		loc, ok := im.nginxLocation(ld)
+		if !ok {
+			continue
+		}
+		if len(names) > 0 {
+			host := cond(condHost, "", opEqual, names)
+			loc.rule.Conditions = append([]cfg.Condition{host}, loc.rule.Conditions...)
+		}
+		rules = append(rules, loc)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].class != rules[j].class {
+			return rules[i].class < rules[j].class
+		}
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+
+	for _, a := range addrs {
+		im.listener(a)
+		for _, l := range rules {
+			r := l.rule
+			r.Listener = a
+			r.Priority = l.class
+			im.c.Rules = append(im.c.Rules, r)
+		}
+	}
+	return nil
+}
+
+// nginxLocation translates a location block to a rule. ok is false if the
+// location can't be translated.
+func (im *importer) nginxLocation(d nginxDirective) (loc nginxLocation, ok bool) {
+	if len(d.args) == 0 {
+		im.warn("line %d: location without path ignored", d.line)
+		return loc, false
+	}
+	mod, p := "", d.args[0]
+	if len(d.args) == 2 {
+		mod, p = d.args[0], d.args[1]
+	}
+	c := cfg.Condition{Type: condPath, Value: p}
+	switch mod {
+	case "=":
+		loc.class = 0
+		c.Operation = opEqual
+	case "^~":
+		loc.class = 1
+		c.Operation = opBeginWith
+		loc.prefix = p
+	case "~", "~*":
+		// statera string conditions are case insensitive.
+		loc.class = 2
+		c.Operation = opRegex
+	case "":
+		loc.class = 3
+		c.Operation = opBeginWith
+		loc.prefix = p
+	default:
+		im.warn("line %d: location modifier %s ignored", d.line, mod)
+		return loc, false
+	}
+	if c.Operation == opBeginWith && p == "/" {
+		// every path begins with /, so no condition is needed.
+		loc.rule.Conditions = []cfg.Condition{}
+	} else {
+		loc.rule.Conditions = []cfg.Condition{c}
+	}
+
+	hasAction := false
+	for _, sd := range d.block {
+		switch sd.name {
+		case "proxy_pass":
+			if len(sd.args) != 1 {
+				continue
+			}
+			loc.rule.Action.NodeGroup = im.nginxProxyPass(sd)
+			hasAction = true
+		case "return":
+			hasAction = im.nginxReturn(sd, &loc.rule)
+		default:
+			im.warn("line %d: location directive %s ignored", sd.line, sd.name)
+		}
+	}
+	if !hasAction {
+		im.warn("line %d: location %s without proxy_pass or return ignored", d.line, p)
+		return loc, false
+	}
+	return loc, true
+}
+
+// nginxProxyPass returns the node group of the proxy_pass target. Targets that
+// are not an upstream become a node group with a single node.
+func (im *importer) nginxProxyPass(d nginxDirective) string {
+	target := d.args[0]
+	https := strings.HasPrefix(target, "https://")
+	target = strings.TrimPrefix(strings.TrimPrefix(target, "http://"), "https://")
+	if i := strings.Index(target, "/"); i >= 0 {
+		im.warn("line %d: proxy_pass URI %s ignored, use the rule rewrite", d.line, target[i:])
+		target = target[:i]
+	}
+	if g, ok := im.groups[target]; ok {
+		g.HTTPS = g.HTTPS || https
+		return g.Name
+	}
+	addr := target
+	if !strings.Contains(addr, ":") {
+		addr += ":80"
+		if https {
+			addr = target + ":443"
+		}
+	}
+	g := im.group(addr)
+	g.HTTPS = https
+	if len(g.Nodes) == 0 {
+		if err := im.addNode(g, addr, 1); err != nil {
+			im.warn("line %d: %v", d.line, err)
+		}
+	}
+	return g.Name
+}
+
+// nginxReturn translates a return directive to a redirect or reject action.
+func (im *importer) nginxReturn(d nginxDirective, r *cfg.Rule) bool {
+	if len(d.args) == 0 {
+		return false
+	}
+	code, err := strconv.Atoi(d.args[0])
+	if err != nil {
+		im.warn("line %d: return %s ignored", d.line, d.args[0])
+		return false
+	}
+	msg := ""
+	if len(d.args) > 1 {
+		msg = d.args[1]
+	}
+	if code >= 300 && code < 400 {
+		if code != 302 {
+			im.warn("line %d: redirect status %d becomes 302", d.line, code)
+		}
+		r.Action.Redirect = msg
+		return msg != ""
+	}
+	r.Action.Reject.StatusCode = code
+	r.Action.Reject.Message = msg
+	return true
+}
@@ -18,6 +18,7 @@ func loadConfig() (*cfg.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer r.Close()
 	cfg, err := cfg.Load(r)
 	if err != nil {
 		return nil, err
@@ -26,6 +27,24 @@ func loadConfig() (*cfg.Config, error) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var cmd func([]string) error
+		switch os.Args[1] {
+		case "top":
+			cmd = top
+		case "import":
+			cmd = importCmd
+		case "apply":
+			cmd = apply
+		}
+		if cmd != nil {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		}
+	}
+
 	log.Println("Statera started")
 	defer log.Println("Statera stopped")
 	defer func() {
@@ -40,5 +59,7 @@ func main() {
 		return
 	}
 
-	lb.Start(lcfg)
+	if err := lb.Start(lcfg, loadConfig); err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// topNode is the node on the stats endpoint of the admin listener.
+type topNode struct {
+	Host    string `json:"host"`
+	Port    uint16 `json:"port"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+}
+
+// topGroup is the node group on the stats endpoint of the admin listener.
+type topGroup struct {
+	Name     string                    `json:"name"`
+	Requests int64                     `json:"requests"`
+	Errors   int64                     `json:"errors"`
+	Latency  metrics.HistogramSnapshot `json:"latency"`
+	Nodes    []topNode                 `json:"nodes"`
+}
+
+// topStats is the response of the stats endpoint of the admin listener.
+type topStats struct {
+	InFlight int64      `json:"in_flight"`
+	Groups   []topGroup `json:"groups"`
+}
+
+// fetchStats gets the stats from the admin listener on addr, authenticating with
+// token if not empty.
+func fetchStats(c *http.Client, addr string, token string) (*topStats, error) {
+	req, err := http.NewRequest("GET", addr+"/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin answered %s", res.Status)
+	}
+	var st topStats
+	if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// renderTop writes the live view of the stats on the terminal. The rates and
+// the latency percentiles are calculated over the observations made between the
+// prev and cur stats, taken elapsed apart.
+func renderTop(cur, prev *topStats, elapsed time.Duration) {
+	prevGroups := make(map[string]topGroup)
+	if prev != nil {
+		for _, g := range prev.Groups {
+			prevGroups[g.Name] = g
+		}
+	}
+
+	// move the cursor to the top-left corner and clear the screen.
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("statera top - %s - %d in-flight requests\n\n", time.Now().Format("15:04:05"), cur.InFlight)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tRPS\tERR%\tP50\tP90\tP99\tHEALTHY")
+	for _, g := range cur.Groups {
+		p := prevGroups[g.Name]
+		reqs := g.Requests - p.Requests
+		errs := g.Errors - p.Errors
+		lat := g.Latency.Sub(p.Latency)
+
+		errPct := 0.0
+		if reqs > 0 {
+			errPct = float64(errs) / float64(reqs) * 100
+		}
+		healthy := 0
+		for _, n := range g.Nodes {
+			if n.Healthy {
+				healthy++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%.1f\t%.1f\t%s\t%s\t%s\t%d/%d\n",
+			g.Name,
+			float64(reqs)/elapsed.Seconds(),
+			errPct,
+			fmtSeconds(lat.Quantile(.5)),
+			fmtSeconds(lat.Quantile(.9)),
+			fmtSeconds(lat.Quantile(.99)),
+			healthy, len(g.Nodes),
+		)
+	}
+	tw.Flush()
+
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tNODE\tWEIGHT\tSTATE")
+	for _, g := range cur.Groups {
+		for _, n := range g.Nodes {
+			state := "unhealthy"
+			if n.Healthy {
+				state = "healthy"
+			}
+			fmt.Fprintf(tw, "%s\t%s:%d\t%d\t%s\n", g.Name, n.Host, n.Port, n.Weight, state)
+		}
+	}
+	tw.Flush()
+}
+
+// fmtSeconds formats a duration in seconds as milliseconds.
+func fmtSeconds(s float64) string {
+	return fmt.Sprintf("%.1fms", s*1000)
+}
+
+// top implements the top subcommand. It polls the stats from the admin listener
+// and renders a live view of the node groups on the terminal.
+//
+// This func blocks until the program is interrupted or the stats can't be fetched.
+func top(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	addr := fs.String("admin", "http://127.0.0.1:8081", "address of the statera admin listener")
+	interval := fs.Duration("interval", time.Second, "interval between each refresh")
+	token := fs.String("token", os.Getenv("STATERA_ADMIN_TOKEN"), "token of the admin listener, if it requires authentication")
+	fs.Parse(args)
+	if !strings.Contains(*addr, "://") {
+		*addr = "http://" + *addr
+	}
+
+	c := &http.Client{Timeout: 5 * time.Second}
+	var prev *topStats
+	last := time.Now()
+	for {
+		cur, err := fetchStats(c, *addr, *token)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if prev != nil {
+			renderTop(cur, prev, now.Sub(last))
+		}
+		prev, last = cur, now
+		time.Sleep(*interval)
+	}
+}
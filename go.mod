@@ -1,3 +1,3 @@
 module github.com/mhef/statera
 
-go 1.18
+go 1.21
@@ -0,0 +1,153 @@
+// Package admin implements the admin listener of statera. The admin listener is
+// a HTTP server, separated from the traffic listeners, that exposes the operational
+// endpoints of the load balancer.
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var errNoClientCA = errors.New("lb/admin: no certificate found on the client CA file")
+
+// TLS define the TLS configuration of the admin server.
+type TLS struct {
+	// CertFile and KeyFile hold the certificate of the admin server.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile hold the CA certificates used to verify the client
+	// certificates. If empty, client certificates are not requested.
+	ClientCAFile string
+}
+
+// Server is the admin HTTP server. The endpoints are registered by the other
+// statera components through Handle and HandleFunc.
+type Server struct {
+	// Addr specifies the TCP address for the admin server to listen on, in the
+	// form "host:port".
+	Addr string
+
+	// TLS define the TLS configuration of the admin server. If nil, the admin
+	// server uses plain HTTP.
+	TLS *TLS
+
+	// Tokens hold the static tokens accepted by the admin server.
+	Tokens []Token
+
+	// ClientIdentities maps the common name of verified client certificates to
+	// their roles.
+	//
+	// If there is no Tokens nor ClientIdentities, authentication is disabled
+	// and every request is allowed.
+	ClientIdentities map[string]Role
+
+	mux *http.ServeMux
+
+	server   *http.Server
+	serverMu sync.Mutex // guards server
+}
+
+// New returns an initialized instance of Server that will listen on addr.
+func New(addr string) *Server {
+	return &Server{
+		Addr: addr,
+		mux:  http.NewServeMux(),
+	}
+}
+
+// Handle registers the handler for the given pattern on the admin server. Only
+// requests made by identities with the roles required by p reach the handler.
+func (s *Server) Handle(pattern string, p Permission, h http.Handler) {
+	s.mux.Handle(pattern, s.authorize(p, h))
+}
+
+// HandleFunc registers the handler func for the given pattern on the admin server.
+// Only requests made by identities with the roles required by p reach the handler.
+func (s *Server) HandleFunc(pattern string, p Permission, h func(http.ResponseWriter, *http.Request)) {
+	s.Handle(pattern, p, http.HandlerFunc(h))
+}
+
+// tlsConfig returns the TLS configuration of the admin HTTP server.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{}
+	if s.TLS.ClientCAFile == "" {
+		return c, nil
+	}
+	pem, err := os.ReadFile(s.TLS.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errNoClientCA
+	}
+	c.ClientCAs = pool
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+	return c, nil
+}
+
+// ListenAndServe starts the admin HTTP server.
+//
+// This func blocks until the server is shut down.
+func (s *Server) ListenAndServe() error {
+	s.serverMu.Lock()
+	s.server = &http.Server{
+		Addr:    s.Addr,
+		Handler: s.mux,
+	}
+	srv := s.server
+	s.serverMu.Unlock()
+
+	var err error
+	if s.TLS != nil {
+		if srv.TLSConfig, err = s.tlsConfig(); err != nil {
+			return err
+		}
+		err = srv.ListenAndServeTLS(s.TLS.CertFile, s.TLS.KeyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully shuts down the admin HTTP server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
+
+// Close immediately closes the admin HTTP server and it's connections, e.g. the
+// long-lived ones left by a Shutdown whose context expired.
+func (s *Server) Close() error {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+// WriteJSON is a helper func that writes v, encoded as JSON, to the ResponseWriter
+// with the provided status code.
+func WriteJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("lb/admin: failed to write the response:", err)
+	}
+}
@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Role define what an identity is allowed to do on the admin server. Each role
+// is allowed to do everything the previous roles do.
+type Role int
+
+// Roles of the admin server, in increasing order of privilege.
+const (
+	// RoleNone is the role of unauthenticated requests.
+	RoleNone Role = iota
+
+	// RoleReadOnly can read the state of the load balancer, e.g. monitoring
+	// systems.
+	RoleReadOnly
+
+	// RoleOperator can also operate the nodes, e.g. drain nodes and change
+	// their weights.
+	RoleOperator
+
+	// RoleAdmin can do everything, including changing the rules.
+	RoleAdmin
+)
+
+// ParseRole returns the Role named s: "read-only", "operator" or "admin". ok is
+// false if s is not a role name.
+func ParseRole(s string) (r Role, ok bool) {
+	switch s {
+	case "read-only":
+		return RoleReadOnly, true
+	case "operator":
+		return RoleOperator, true
+	case "admin":
+		return RoleAdmin, true
+	}
+	return RoleNone, false
+}
+
+// Permission define the roles required to access an endpoint. Read is required
+// for GET and HEAD requests and Write for the other methods.
+type Permission struct {
+	Read  Role
+	Write Role
+}
+
+// Common permissions of the endpoints.
+var (
+	// Public endpoints can be accessed without authentication.
+	Public = Permission{Read: RoleNone, Write: RoleNone}
+
+	// Operate endpoints can be read by any identity and changed by operators.
+	Operate = Permission{Read: RoleReadOnly, Write: RoleOperator}
+
+	// Manage endpoints can be read by any identity and changed by admins.
+	Manage = Permission{Read: RoleReadOnly, Write: RoleAdmin}
+)
+
+// Token is a static token that authenticates an identity through the
+// "Authorization: Bearer <token>" header.
+type Token struct {
+	// Name identifies the owner of the token, e.g. on the audit log.
+	Name  string
+	Token string
+	Role  Role
+}
+
+// Identity is the authenticated identity of an admin request.
+type Identity struct {
+	Name string
+	Role Role
+}
+
+// ctxIdentityKey is the type used to define the identity key.
+type ctxIdentityKey struct{}
+
+// identityKey is the key that holds the identity of the admin request.
+var identityKey ctxIdentityKey
+
+// IdentityFromRequest returns the identity that made the admin request, if one.
+//
+// The ok bool must be checked before using the identity.
+func IdentityFromRequest(r *http.Request) (id Identity, ok bool) {
+	id, ok = r.Context().Value(identityKey).(Identity)
+	return
+}
+
+// authEnabled returns if any way of authentication is configured. When disabled,
+// every request is treated as made by an admin.
+func (s *Server) authEnabled() bool {
+	return len(s.Tokens) > 0 || len(s.ClientIdentities) > 0
+}
+
+// authenticate returns the identity of the request. Requests without valid
+// credentials have the RoleNone.
+func (s *Server) authenticate(r *http.Request) Identity {
+	if !s.authEnabled() {
+		return Identity{Name: "anonymous", Role: RoleAdmin}
+	}
+
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		tok := []byte(strings.TrimPrefix(h, "Bearer "))
+		for _, t := range s.Tokens {
+			if subtle.ConstantTimeCompare(tok, []byte(t.Token)) == 1 {
+				return Identity{Name: t.Name, Role: t.Role}
+			}
+		}
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if role, ok := s.ClientIdentities[cn]; ok {
+			return Identity{Name: cn, Role: role}
+		}
+	}
+	return Identity{Role: RoleNone}
+}
+
+// authorize wraps the handler to only allow requests made by identities with the
+// roles required by the permission.
+func (s *Server) authorize(p Permission, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		required := p.Write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			required = p.Read
+		}
+
+		id := s.authenticate(r)
+		if id.Role < required {
+			if id.Role == RoleNone {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), identityKey, id)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(fn)
+}
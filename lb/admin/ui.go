@@ -0,0 +1,22 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// UIHandler returns the handler that serves the embedded admin web UI. The UI is
+// a single page that uses the admin endpoints, so it must be served by the same
+// admin server.
+func UIHandler() http.Handler {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		// We panic here because the ui directory is embedded on compile time.
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
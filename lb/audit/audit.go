@@ -0,0 +1,67 @@
+// Package audit implements the audit log of statera. Every runtime change made to
+// the load balancer is recorded as a JSON line on an append-only log, with the
+// time, the actor responsible for the change and the state before and after it.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Entry is a change recorded on the audit log.
+type Entry struct {
+	Time time.Time `json:"time"`
+
+	// Actor identifies who made the change.
+	Actor string `json:"actor"`
+
+	// Op is the operation that made the change.
+	Op string `json:"op"`
+
+	// Target identifies what was changed.
+	Target string `json:"target"`
+
+	// Before and After hold the state of the target before and after the
+	// change. Before is nil when the target was created and After is nil when
+	// it was deleted.
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// Log is the audit log. It is safe for concurrent use.
+type Log struct {
+	w  io.Writer
+	mu sync.Mutex // guards w
+}
+
+// New returns a Log that writes the entries on w. w should be opened in append
+// mode.
+func New(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// Record writes the entry on the log. If the entry has no time, the current time
+// is used.
+//
+// Record on a nil Log does nothing, so components can record the changes without
+// verifying if the audit log is enabled.
+func (l *Log) Record(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(b)
+	return err
+}
@@ -0,0 +1,488 @@
+// Package cache implements the response cache of statera. The responses of the
+// node groups with a cache Policy are held in memory and answered by the LB,
+// without reaching the nodes, until they expire or are purged.
+//
+// The entries can be tagged by the nodes with the Surrogate-Key response header,
+// holding space separated tags, so all the entries of a tag can be purged at once,
+// e.g. on a deploy.
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/metrics"
+	"github.com/mhef/statera/lb/record"
+	"github.com/mhef/statera/lb/router"
+)
+
+// Defaults of the cache.
+const (
+	defaultMaxEntries   = 10000
+	defaultMaxBodyBytes = 1 << 20
+)
+
+// surrogateKeyHeader is the response header holding the tags of the entry. It's
+// not sent to the clients.
+const surrogateKeyHeader = "Surrogate-Key"
+
+// Policy define how the responses of a node group are cached.
+type Policy struct {
+	// TTL define the time in seconds that the responses without a max-age or
+	// s-maxage Cache-Control directive are cached. If zero, only the responses
+	// with one of the directives are cached.
+	TTL int
+
+	// Key define the template of the cache key of the requests. The requests
+	// with the same key share the entry. The placeholders are "{method}",
+	// "{host}", "{path}", "{query}", "{query:name}", "{header:Name}" and
+	// "{cookie:name}", e.g. "{host}{path}?{query:page}{header:Accept-Language}".
+	//
+	// The default Key is DefaultKey.
+	Key string
+
+	// MaxBodyBytes define the maximum size in bytes of a cached response body.
+	//
+	// The default MaxBodyBytes is 1 MB.
+	MaxBodyBytes int
+
+	// StaleWhileRevalidate define the time in seconds, after a response
+	// expires, that it's still answered while it's refreshed in the
+	// background, when the response doesn't have the stale-while-revalidate
+	// Cache-Control directive. If zero, only the responses with the directive
+	// are answered stale.
+	StaleWhileRevalidate int
+
+	// StaleIfError define the time in seconds, after a response expires, that
+	// it's answered when the nodes fail or answer 5xx, when the response
+	// doesn't have the stale-if-error Cache-Control directive. If zero, only
+	// the responses with the directive are answered on errors.
+	StaleIfError int
+
+	key []keyPart
+}
+
+// entry is a cached response.
+type entry struct {
+	key string
+
+	// host and uri are the URL of the request that stored the entry, used by
+	// the purges by URL.
+	host string
+	uri  string
+
+	status int
+	header http.Header
+	body   []byte
+	tags   []string
+
+	stored  time.Time
+	expires time.Time
+
+	// revalidateUntil and errorUntil define until when the expired entry is
+	// answered while it's refreshed and when the nodes fail.
+	revalidateUntil time.Time
+	errorUntil      time.Time
+
+	// revalidating define if the entry is being refreshed in the background.
+	// It's guarded by the Cache mu.
+	revalidating bool
+
+	elem *list.Element
+}
+
+// entryState is the state of an entry when it's looked up.
+type entryState int
+
+const (
+	// stateMissing means that there is no usable entry.
+	stateMissing entryState = iota
+
+	// stateFresh means that the entry is not expired.
+	stateFresh
+
+	// stateRevalidate means that the entry is expired, but can be answered
+	// while it's refreshed.
+	stateRevalidate
+
+	// stateError means that the entry is expired, but can be answered if the
+	// nodes fail.
+	stateError
+)
+
+// Cache is the response cache. It's safe for concurrent use.
+type Cache struct {
+	// MaxEntries define the maximum number of entries. The least recently used
+	// entries are evicted to hold the new ones.
+	//
+	// The default MaxEntries is 10000.
+	MaxEntries int
+
+	// ServeStale define, if not nil, if the expired entries of a group are
+	// answered when it's nodes fail even after the StaleIfError time, e.g.
+	// while the group has no node available. The entries are kept until
+	// evicted while it returns true.
+	ServeStale func(group string) bool
+
+	policies map[string]*Policy
+
+	entries map[string]*entry
+	tags    map[string]map[*entry]struct{}
+	lru     *list.List // most recently used first
+	mu      sync.Mutex // guards entries, tags and lru
+
+	hits   metrics.Counter
+	misses metrics.Counter
+	stale  metrics.Counter
+}
+
+// New returns a Cache with the policy of each node group, by group name. An error
+// is returned if a key template is invalid.
+func New(policies map[string]*Policy) (*Cache, error) {
+	for name, p := range policies {
+		tmpl := p.Key
+		if tmpl == "" {
+			tmpl = DefaultKey
+		}
+		parts, err := parseKey(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("%w of group %s: %s", err, name, p.Key)
+		}
+		p.key = parts
+	}
+	return &Cache{
+		policies: policies,
+		entries:  make(map[string]*entry),
+		tags:     make(map[string]map[*entry]struct{}),
+		lru:      list.New(),
+	}, nil
+}
+
+// Handler answers the cached responses of the requests to the groups with a
+// Policy and caches the responses of the misses. It must be chained after the
+// evaluator handler and before the router.
+func (c *Cache) Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		e, ok := evaluator.EvaluationResultFromRequest(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, ok := c.policies[e.NodeGroup]
+		if !ok || !cacheableRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := buildKey(p.key, r)
+		var stale *entry
+		if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			keep := c.ServeStale != nil && c.ServeStale(e.NodeGroup)
+			ent, st := c.get(key, keep)
+			switch st {
+			case stateFresh:
+				c.hits.Inc()
+				writeEntry(w, r, ent, "HIT")
+				return
+			case stateRevalidate:
+				c.stale.Inc()
+				if c.startRevalidation(ent) {
+					req := r.Clone(detach(r.Context()))
+					go c.revalidate(next, req, p, key, ent)
+				}
+				writeEntry(w, r, ent, "STALE")
+				return
+			case stateError:
+				stale = ent
+			}
+		}
+		c.misses.Inc()
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := newRecorder(w, p, stale != nil)
+		next.ServeHTTP(rec, router.RequirePlaintext(r))
+		if rec.Discarded() {
+			c.stale.Inc()
+			writeEntry(w, r, stale, "STALE")
+			return
+		}
+		if r.Method == http.MethodGet && r.Context().Err() == nil {
+			c.store(key, r, p, rec)
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+// store caches the response recorded by rec, if it's complete and cacheable.
+func (c *Cache) store(key string, r *http.Request, p *Policy, rec *recorder) {
+	if !rec.Complete() {
+		return
+	}
+	f, ok := p.freshness(rec.Status(), rec.RecordedHeader())
+	if !ok {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(f.ttl)
+	c.put(&entry{
+		key:             key,
+		host:            r.Host,
+		uri:             r.URL.RequestURI(),
+		status:          rec.Status(),
+		header:          rec.RecordedHeader(),
+		body:            rec.Body(),
+		tags:            rec.tags,
+		stored:          now,
+		expires:         expires,
+		revalidateUntil: expires.Add(f.staleWhileRevalidate),
+		errorUntil:      expires.Add(f.staleIfError),
+	})
+}
+
+// cacheableRequest returns if the request can be answered from the cache.
+// Authenticated and range requests always reach the nodes.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("Authorization") == "" && r.Header.Get("Range") == ""
+}
+
+// maxBodyBytes returns the maximum size of a cached response body.
+func (p *Policy) maxBodyBytes() int {
+	if p.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return p.MaxBodyBytes
+}
+
+// freshness define for how long a response is fresh and for how long it can be
+// answered after it expires.
+type freshness struct {
+	ttl                  time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+// freshness returns the freshness of a response. ok is false if the response
+// can't be cached.
+func (p *Policy) freshness(status int, h http.Header) (f freshness, ok bool) {
+	if status != http.StatusOK && status != http.StatusMovedPermanently {
+		return f, false
+	}
+	if h.Get("Set-Cookie") != "" {
+		return f, false
+	}
+	// the variations of the responses are described by the key template.
+	for _, v := range h.Values("Vary") {
+		for _, v := range strings.Split(v, ",") {
+			if v = strings.TrimSpace(v); v != "" && !strings.EqualFold(v, "Accept-Encoding") {
+				return f, false
+			}
+		}
+	}
+
+	secs, maxAge := -1, -1
+	swr, sie := p.StaleWhileRevalidate, p.StaleIfError
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return f, false
+		case "s-maxage":
+			secs, _ = strconv.Atoi(value)
+		case "max-age":
+			maxAge, _ = strconv.Atoi(value)
+		case "stale-while-revalidate":
+			swr, _ = strconv.Atoi(value)
+		case "stale-if-error":
+			sie, _ = strconv.Atoi(value)
+		}
+	}
+	if secs < 0 {
+		secs = maxAge
+	}
+	if secs < 0 {
+		secs = p.TTL
+	}
+	if secs <= 0 {
+		return f, false
+	}
+	f.ttl = time.Duration(secs) * time.Second
+	f.staleWhileRevalidate = time.Duration(swr) * time.Second
+	f.staleIfError = time.Duration(sie) * time.Second
+	return f, true
+}
+
+// writeEntry answers the request with the cached response. xCache is the
+// X-Cache header of the answer.
+func writeEntry(w http.ResponseWriter, r *http.Request, ent *entry, xCache string) {
+	h := w.Header()
+	for k, vv := range ent.header {
+		h[k] = append([]string(nil), vv...)
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(ent.stored).Seconds())))
+	h.Set("X-Cache", xCache)
+	if router.NoneMatch(r, ent.header.Get("ETag")) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(ent.status)
+	if r.Method != http.MethodHead {
+		w.Write(ent.body)
+	}
+}
+
+// get returns the entry of the key, if one, and it's state. The entries that
+// can't be answered anymore are removed, unless keep is true, in wich case they
+// are returned as stateError.
+func (c *Cache) get(key string, keep bool) (*entry, entryState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent, ok := c.entries[key]
+	if !ok {
+		return nil, stateMissing
+	}
+	now := time.Now()
+	st := stateMissing
+	switch {
+	case now.Before(ent.expires):
+		st = stateFresh
+	case now.Before(ent.revalidateUntil):
+		st = stateRevalidate
+	case now.Before(ent.errorUntil), keep:
+		st = stateError
+	default:
+		c.remove(ent)
+		return nil, stateMissing
+	}
+	c.lru.MoveToFront(ent.elem)
+	return ent, st
+}
+
+// put stores the entry, replacing the entry of the same key and evicting the
+// least recently used entries above MaxEntries.
+func (c *Cache) put(ent *entry) {
+	limit := c.MaxEntries
+	if limit <= 0 {
+		limit = defaultMaxEntries
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[ent.key]; ok {
+		c.remove(old)
+	}
+	ent.elem = c.lru.PushFront(ent)
+	c.entries[ent.key] = ent
+	for _, t := range ent.tags {
+		if c.tags[t] == nil {
+			c.tags[t] = make(map[*entry]struct{})
+		}
+		c.tags[t][ent] = struct{}{}
+	}
+	for c.lru.Len() > limit {
+		c.remove(c.lru.Back().Value.(*entry))
+	}
+}
+
+// remove removes the entry. c.mu must be held.
+func (c *Cache) remove(ent *entry) {
+	delete(c.entries, ent.key)
+	c.lru.Remove(ent.elem)
+	for _, t := range ent.tags {
+		delete(c.tags[t], ent)
+		if len(c.tags[t]) == 0 {
+			delete(c.tags, t)
+		}
+	}
+}
+
+// PurgeTag removes the entries tagged with the tag and returns how many were
+// removed.
+func (c *Cache) PurgeTag(tag string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for ent := range c.tags[tag] {
+		c.remove(ent)
+		n++
+	}
+	return n
+}
+
+// PurgeURL removes the entries stored by the requests for the URL and returns how
+// many were removed. The URL may be absolute, e.g. "http://example.com/a?b=1",
+// or only the path and query, to purge the URL of every host.
+func (c *Cache) PurgeURL(rawURL string) (int, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	uri := u.RequestURI()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, ent := range c.entries {
+		if ent.uri == uri && (u.Host == "" || ent.host == u.Host) {
+			c.remove(ent)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Len returns the number of entries.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// WriteMetrics writes the cache metrics on mw.
+func (c *Cache) WriteMetrics(mw *metrics.Writer) {
+	mw.Counter("statera_cache_hits_total", "Requests answered from the cache.", nil, c.hits.Value())
+	mw.Counter("statera_cache_misses_total", "Cacheable requests fowarded to the nodes.", nil, c.misses.Value())
+	mw.Counter("statera_cache_stale_total", "Requests answered with an expired response, while it was refreshed or because the nodes failed.",
+		nil, c.stale.Value())
+	mw.Gauge("statera_cache_entries", "Responses held by the cache.", nil, float64(c.Len()))
+}
+
+// recorder records the responses of the cache misses and of the refreshes.
+type recorder struct {
+	record.Recorder
+
+	// tags hold the surrogate keys of the response, wich are not answered.
+	tags []string
+}
+
+// newRecorder returns a recorder answering the response on w. If discardErrors
+// is true, the 5xx responses are not answered, so the client can be answered
+// with a stale entry.
+func newRecorder(w http.ResponseWriter, p *Policy, discardErrors bool) *recorder {
+	rec := &recorder{}
+	rec.ResponseWriter = w
+	rec.Limit = p.maxBodyBytes()
+	rec.Exclude = []string{"X-Cache"}
+	rec.OnHeader = func(status int, h http.Header) bool {
+		if discardErrors && status >= 500 {
+			for k := range h {
+				delete(h, k)
+			}
+			return false
+		}
+		rec.tags = strings.Fields(h.Get(surrogateKeyHeader))
+		h.Del(surrogateKeyHeader)
+		return true
+	}
+	return rec
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// DefaultKey is the key template used when Policy.Key is blank. The requests for
+// the same URL share the entry.
+const DefaultKey = "{host}{path}?{query}"
+
+var errInvalidKey = errors.New("lb/cache: invalid key template")
+
+// keyPart is a part of a key template: a literal or a placeholder.
+type keyPart struct {
+	// kind is blank for the literals.
+	kind string
+	// value is the literal, or the name of the header, cookie or query param
+	// of the placeholder.
+	value string
+}
+
+// parseKey parses a key template. The placeholders are "{method}", "{host}",
+// "{path}", "{query}" (the whole query), "{query:name}", "{header:Name}" and
+// "{cookie:name}"; the rest of the template is kept literally.
+func parseKey(tmpl string) ([]keyPart, error) {
+	var parts []keyPart
+	for tmpl != "" {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			parts = append(parts, keyPart{value: tmpl})
+			break
+		}
+		if i > 0 {
+			parts = append(parts, keyPart{value: tmpl[:i]})
+		}
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			return nil, errInvalidKey
+		}
+		kind, name, hasName := strings.Cut(tmpl[i+1:i+j], ":")
+		switch kind {
+		case "method", "host", "path":
+			if hasName {
+				return nil, errInvalidKey
+			}
+		case "query":
+		case "header", "cookie":
+			if name == "" {
+				return nil, errInvalidKey
+			}
+		default:
+			return nil, errInvalidKey
+		}
+		parts = append(parts, keyPart{kind: kind, value: name})
+		tmpl = tmpl[i+j+1:]
+	}
+	return parts, nil
+}
+
+// buildKey returns the key of the request described by the parts.
+func buildKey(parts []keyPart, r *http.Request) string {
+	var b strings.Builder
+	for _, p := range parts {
+		switch p.kind {
+		case "":
+			b.WriteString(p.value)
+		case "method":
+			b.WriteString(r.Method)
+		case "host":
+			b.WriteString(r.Host)
+		case "path":
+			b.WriteString(r.URL.Path)
+		case "query":
+			if p.value == "" {
+				b.WriteString(r.URL.RawQuery)
+			} else {
+				b.WriteString(r.URL.Query().Get(p.value))
+			}
+		case "header":
+			b.WriteString(r.Header.Get(p.value))
+		case "cookie":
+			if c, err := r.Cookie(p.value); err == nil {
+				b.WriteString(c.Value)
+			}
+		}
+		// the separator keeps the values of adjacent placeholders apart.
+		b.WriteByte(0)
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mhef/statera/lb/router"
+)
+
+// revalidateTimeout is the time in seconds that a background refresh has to be
+// answered by the node.
+const revalidateTimeout = 30
+
+// startRevalidation marks the entry as being refreshed and returns true, or
+// returns false if it's already being refreshed.
+func (c *Cache) startRevalidation(ent *entry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ent.revalidating {
+		return false
+	}
+	ent.revalidating = true
+	return true
+}
+
+// revalidate refreshes the entry of the key in the background, fowarding the
+// request through next. If the refresh fails, the stale entry is kept and the
+// next request starts a new refresh.
+func (c *Cache) revalidate(next http.Handler, r *http.Request, p *Policy, key string, ent *entry) {
+	defer func() {
+		c.mu.Lock()
+		ent.revalidating = false
+		c.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), revalidateTimeout*time.Second)
+	defer cancel()
+	r = router.RequirePlaintext(r.WithContext(ctx))
+	r.Header.Del("Cache-Control")
+
+	rec := newRecorder(&discardWriter{header: make(http.Header)}, p, false)
+	next.ServeHTTP(rec, r)
+	if rec.Status() >= 500 || ctx.Err() != nil {
+		log.Println("lb/cache: failed to refresh", r.Host+ent.uri)
+		return
+	}
+	c.store(key, r, p, rec)
+}
+
+// detachedContext holds the values of the parent context, but it's never done,
+// so the background refreshes outlive the client request that started them.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+func (detachedContext) Done() <-chan struct{}                   { return nil }
+func (detachedContext) Err() error                              { return nil }
+
+// detach returns a context with the values of ctx that is never done.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+// discardWriter is the http.ResponseWriter of the background refreshes, that
+// have no client to answer.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,623 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/admin"
+	"github.com/mhef/statera/lb/audit"
+	"github.com/mhef/statera/lb/cache"
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/ha"
+	"github.com/mhef/statera/lb/idempotency"
+	"github.com/mhef/statera/lb/quota"
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/slo"
+	"github.com/mhef/statera/lb/tenant"
+	"github.com/mhef/statera/lb/udprouter"
+)
+
+var (
+	errRuleNotFound     = errors.New("lb/control: rule not found")
+	errListenerNotFound = errors.New("lb/control: listener not found")
+	errGroupNotFound    = errors.New("lb/control: node group not found")
+	errInvalidOp        = errors.New("lb/control: invalid update operation")
+	errStreamFullDuplex = errors.New("lb/control: the update stream needs a full duplex connection")
+)
+
+// controlPlane implements the admin endpoints that allow the rules and the nodes
+// to be changed at runtime.
+type controlPlane struct {
+	// evs hold the evaluator of each listener, by listener address.
+	evs map[string]*evaluator.Evaluator
+	r   *router.Router
+
+	// cache is the response cache of the node groups. It may be nil.
+	cache *cache.Cache
+
+	// idempotency is the idempotency guard of the node groups. It may be nil.
+	idempotency *idempotency.Guard
+
+	// quota enforces the request quotas. It may be nil.
+	quota *quota.Manager
+
+	// tenants measures the requests of each tenant.
+	tenants *tenant.Stats
+
+	// udp is the router of the UDP groups. It may be nil.
+	udp *udprouter.Router
+
+	// errors counts the errors published by the components.
+	errors *errorStats
+
+	// audit records the changes applied by the control plane. It may be nil.
+	audit *audit.Log
+
+	// ha elects the instance that binds the listeners. It may be nil.
+	ha *ha.Elector
+
+	// recovery counts the panics of the listener handlers.
+	recovery *recovery
+
+	// slo monitors the service level objectives of the node groups. It may
+	// be nil.
+	slo *slo.Monitor
+}
+
+// nodeView is the representation of a node on the control plane endpoints.
+type nodeView struct {
+	Group    string `json:"group"`
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Weight   int    `json:"weight"`
+	Priority int    `json:"priority"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining"`
+	Static   bool   `json:"static"`
+	InFlight int64  `json:"in_flight"`
+	Protocol string `json:"protocol"`
+
+	Ports map[string]uint16 `json:"ports,omitempty"`
+}
+
+// newNodeView returns the view of the node n of the group.
+func newNodeView(group string, n *router.Node) nodeView {
+	return nodeView{
+		Group:    group,
+		Host:     n.Host,
+		Port:     n.Port,
+		Weight:   n.CurrentWeight(),
+		Priority: n.Priority,
+		Healthy:  n.Healthy(),
+		Draining: n.Draining(),
+		Static:   n.Static != nil,
+		InFlight: n.InFlight(),
+		Protocol: n.Protocol().String(),
+		Ports:    n.Ports,
+	}
+}
+
+// Operations accepted by the control plane on an update.
+const (
+	opAddRule     = "add_rule"
+	opDeleteRule  = "delete_rule"
+	opAddNode     = "add_node"
+	opUpdateNode  = "update_node"
+	opDeleteNode  = "delete_node"
+	opDrainNode   = "drain_node"
+	opUndrainNode = "undrain_node"
+
+	opActivateGroup   = "activate_group"
+	opDeactivateGroup = "deactivate_group"
+
+	opEnableRule  = "enable_rule"
+	opDisableRule = "disable_rule"
+)
+
+// update is a change to be applied by the control plane.
+type update struct {
+	// Op define the operation of the update.
+	Op string `json:"op"`
+
+	// ID define the id of the rule, on the delete_rule, enable_rule and
+	// disable_rule operations.
+	ID string `json:"id"`
+
+	// Index define the index of the rule, on the delete_rule operation
+	// without ID. The index changes as rules are added and deleted, so the ID
+	// should be preferred.
+	Index int `json:"index"`
+
+	// Group define the node group of the node, on the node operations, or
+	// the standby group, on the group operations.
+	Group string `json:"group"`
+
+	// Rule define the rule to be added, on the add_rule operation.
+	Rule *cfg.Rule `json:"rule"`
+
+	// Node define the node, on the node operations. On the delete_node
+	// operation, only the host and port are used.
+	Node *cfg.Node `json:"node"`
+}
+
+// rules returns the rules of all listeners, ordered by listener address and then
+// by priority. The index of a rule on this list identifies it on the control
+// plane.
+func (cp *controlPlane) rules() []*evaluator.Rule {
+	lnrs := make([]string, 0, len(cp.evs))
+	for l := range cp.evs {
+		lnrs = append(lnrs, l)
+	}
+	sort.Strings(lnrs)
+	ret := make([]*evaluator.Rule, 0)
+	for _, l := range lnrs {
+		ret = append(ret, cp.evs[l].Rules()...)
+	}
+	return ret
+}
+
+// rule returns the rule identified by the update, by it's ID or, if blank, by
+// it's index, or nil if there is no such rule.
+func (cp *controlPlane) rule(u update) *evaluator.Rule {
+	if u.ID != "" {
+		for _, e := range cp.evs {
+			if r, ok := e.Rule(u.ID); ok {
+				return r
+			}
+		}
+		return nil
+	}
+	rules := cp.rules()
+	if u.Index < 0 || u.Index >= len(rules) {
+		return nil
+	}
+	return rules[u.Index]
+}
+
+// actorFromRequest identifies who made the admin request: the name of the
+// authenticated identity, followed by the remote address.
+func actorFromRequest(r *http.Request) string {
+	if id, ok := admin.IdentityFromRequest(r); ok && id.Name != "" {
+		return id.Name + "@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
+
+// target returns the identification of the target of the update and it's current
+// state, or nil if it doesn't exist.
+func (cp *controlPlane) target(u update) (string, any) {
+	switch u.Op {
+	case opAddRule:
+		return "rule", nil
+	case opDeleteRule, opEnableRule, opDisableRule:
+		r := cp.rule(u)
+		switch {
+		case r != nil:
+			return "rule " + r.ID, r
+		case u.ID != "":
+			return "rule " + u.ID, nil
+		}
+		return fmt.Sprintf("rule %d", u.Index), nil
+	case opActivateGroup, opDeactivateGroup:
+		t := "group " + u.Group
+		ng, ok := cp.r.NodeGroup(u.Group)
+		if !ok {
+			return t, nil
+		}
+		return t, map[string]bool{"active": ng.Active()}
+	}
+
+	if u.Node == nil {
+		return "", nil
+	}
+	nk := router.NodeKey{Host: u.Node.Host, Port: u.Node.Port}
+	t := fmt.Sprintf("node %s/%s", u.Group, nk)
+	ng, ok := cp.r.NodeGroup(u.Group)
+	if !ok {
+		return t, nil
+	}
+	for _, n := range ng.Nodes() {
+		if n.NodeKey == nk {
+			return t, newNodeView(ng.Name, n)
+		}
+	}
+	return t, nil
+}
+
+// applyAudited applies the update and records it on the audit log, on behalf of
+// the actor.
+func (cp *controlPlane) applyAudited(actor string, u update) error {
+	t, before := cp.target(u)
+	if err := cp.apply(u); err != nil {
+		return err
+	}
+	var after any
+	switch u.Op {
+	case opAddRule:
+		after = u.Rule
+	case opDeleteRule, opDeleteNode:
+	default:
+		_, after = cp.target(u)
+	}
+
+	err := cp.audit.Record(audit.Entry{
+		Actor:  actor,
+		Op:     u.Op,
+		Target: t,
+		Before: before,
+		After:  after,
+	})
+	if err != nil {
+		log.Println("failed to record audit entry:", err)
+	}
+	return nil
+}
+
+// apply applies the update on the evaluator or on the router.
+func (cp *controlPlane) apply(u update) error {
+	switch u.Op {
+	case opAddRule:
+		if u.Rule == nil {
+			return errInvalidOp
+		}
+		if g := u.Rule.Action.NodeGroup; g != "" {
+			if _, ok := cp.r.NodeGroup(g); !ok {
+				return errGroupNotFound
+			}
+		}
+		r := newRule(*u.Rule)
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		e, ok := cp.evs[r.Listener]
+		if !ok {
+			return errListenerNotFound
+		}
+		// the ids are unique across the listeners, while each evaluator
+		// only knows it's own rules.
+		if r.ID != "" && cp.rule(update{ID: r.ID}) != nil {
+			return evaluator.ErrDuplicateRule
+		}
+		if err := e.AddRule(r); err != nil {
+			return err
+		}
+		// the generated id is recorded on the audit log.
+		u.Rule.ID = r.ID
+		return nil
+	case opDeleteRule:
+		r := cp.rule(u)
+		if r == nil {
+			return errRuleNotFound
+		}
+		return cp.evs[r.Listener].DeleteRule(r.ID)
+	case opEnableRule, opDisableRule:
+		r := cp.rule(u)
+		if r == nil {
+			return errRuleNotFound
+		}
+		return cp.evs[r.Listener].SetRuleEnabled(r.ID, u.Op == opEnableRule)
+	case opActivateGroup, opDeactivateGroup:
+		ng, ok := cp.r.NodeGroup(u.Group)
+		if !ok {
+			return errGroupNotFound
+		}
+		if u.Op == opActivateGroup {
+			return ng.Activate()
+		}
+		return ng.Deactivate()
+	}
+
+	if u.Node == nil {
+		return errInvalidOp
+	}
+	ng, ok := cp.r.NodeGroup(u.Group)
+	if !ok {
+		return errGroupNotFound
+	}
+	nk := router.NodeKey{Host: u.Node.Host, Port: u.Node.Port}
+	switch u.Op {
+	case opAddNode:
+		n, err := newNode(*u.Node)
+		if err != nil {
+			return err
+		}
+		return ng.AddNode(n)
+	case opUpdateNode:
+		if err := ng.SetNodeWeight(nk, u.Node.Weight); err != nil {
+			return err
+		}
+		return ng.SetNodePriority(nk, u.Node.Priority)
+	case opDeleteNode:
+		return ng.DeleteNode(nk)
+	case opDrainNode:
+		return ng.DrainNode(nk)
+	case opUndrainNode:
+		return ng.UndrainNode(nk)
+	}
+	return errInvalidOp
+}
+
+// writeUpdateError writes the error returned by apply to the client.
+func writeUpdateError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	if err == errRuleNotFound || err == evaluator.ErrRuleNotFound || err == errGroupNotFound || err == errListenerNotFound || err == router.ErrNodeNotFound {
+		code = http.StatusNotFound
+	}
+	if err == router.ErrDuplicateNode || err == evaluator.ErrDuplicateRule {
+		code = http.StatusConflict
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// rulesHandler lists the rules on GET, adds the rule on the body on POST and
+// deletes the rule on the id query parameter, or on the index one, on DELETE.
+func (cp *controlPlane) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	var u update
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, cp.rules())
+		return
+	case http.MethodPost:
+		u.Op = opAddRule
+		if err := json.NewDecoder(r.Body).Decode(&u.Rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		u.Op = opDeleteRule
+		if u.ID = r.URL.Query().Get("id"); u.ID != "" {
+			break
+		}
+		i, err := strconv.Atoi(r.URL.Query().Get("index"))
+		if err != nil {
+			http.Error(w, "invalid index", http.StatusBadRequest)
+			return
+		}
+		u.Index = i
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := cp.applyAudited(actorFromRequest(r), u); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// nodesHandler lists the nodes of all groups, or of the group on the group query
+// parameter, on GET. The node on the body is added on POST, has it's weight
+// updated on PUT and is deleted on DELETE.
+func (cp *controlPlane) nodesHandler(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	if r.Method == http.MethodGet {
+		views := make([]nodeView, 0)
+		for _, ng := range cp.r.NodeGroups() {
+			if group != "" && ng.Name != group {
+				continue
+			}
+			for _, n := range ng.Nodes() {
+				views = append(views, newNodeView(ng.Name, n))
+			}
+		}
+		admin.WriteJSON(w, http.StatusOK, views)
+		return
+	}
+
+	u := update{Group: group}
+	switch r.Method {
+	case http.MethodPost:
+		u.Op = opAddNode
+	case http.MethodPut:
+		u.Op = opUpdateNode
+	case http.MethodDelete:
+		u.Op = opDeleteNode
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&u.Node); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := cp.applyAudited(actorFromRequest(r), u); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// drainHandler drains the node on the body on POST and undrains it on DELETE.
+func (cp *controlPlane) drainHandler(w http.ResponseWriter, r *http.Request) {
+	u := update{Group: r.URL.Query().Get("group")}
+	switch r.Method {
+	case http.MethodPost:
+		u.Op = opDrainNode
+	case http.MethodDelete:
+		u.Op = opUndrainNode
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&u.Node); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := cp.applyAudited(actorFromRequest(r), u); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// enableRuleHandler enables the rule on the id query parameter on POST and
+// disables it on DELETE.
+func (cp *controlPlane) enableRuleHandler(w http.ResponseWriter, r *http.Request) {
+	u := update{ID: r.URL.Query().Get("id")}
+	switch r.Method {
+	case http.MethodPost:
+		u.Op = opEnableRule
+	case http.MethodDelete:
+		u.Op = opDisableRule
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if u.ID == "" {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if err := cp.applyAudited(actorFromRequest(r), u); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// activateHandler activates the standby group on the group query parameter on
+// POST and puts it back on standby on DELETE.
+func (cp *controlPlane) activateHandler(w http.ResponseWriter, r *http.Request) {
+	u := update{Group: r.URL.Query().Get("group")}
+	switch r.Method {
+	case http.MethodPost:
+		u.Op = opActivateGroup
+	case http.MethodDelete:
+		u.Op = opDeactivateGroup
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := cp.applyAudited(actorFromRequest(r), u); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// purgeRequest is the body of a purge of the cache.
+type purgeRequest struct {
+	// URL define, if not blank, the URL whose entries are purged. Without a
+	// host, the URL is purged on every host.
+	URL string `json:"url"`
+
+	// Tag define, if not blank, the surrogate key whose entries are purged.
+	Tag string `json:"tag"`
+}
+
+// purgeHandler removes from the cache the entries of the URL or of the tag on the
+// body, and answers how many were removed.
+func (cp *controlPlane) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var pr purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (pr.URL == "") == (pr.Tag == "") {
+		http.Error(w, "exactly one of url and tag must be set", http.StatusBadRequest)
+		return
+	}
+	if cp.cache == nil {
+		http.Error(w, "there is no cache", http.StatusNotFound)
+		return
+	}
+
+	var n int
+	target := "tag " + pr.Tag
+	if pr.URL != "" {
+		var err error
+		if n, err = cp.cache.PurgeURL(pr.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		target = "url " + pr.URL
+	} else {
+		n = cp.cache.PurgeTag(pr.Tag)
+	}
+	err := cp.audit.Record(audit.Entry{
+		Actor:  actorFromRequest(r),
+		Op:     "purge_cache",
+		Target: target,
+	})
+	if err != nil {
+		log.Println("failed to record audit entry:", err)
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+// updateResult is the result of an update pushed through the stream.
+type updateResult struct {
+	Op    string `json:"op"`
+	Error string `json:"error,omitempty"`
+}
+
+// streamHandler receives a stream of updates, encoded as concatenated JSON
+// objects, and applies each one as soon as it arrives. It allows the deployment
+// tooling to keep a connection open and push the changes, instead of polling.
+//
+// The result of each update is answered, as a JSON object on it's own line, as
+// soon as the update is applied, so the stream may be kept open indefinitely.
+func (cp *controlPlane) streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the HTTP/1.x server forbids reading the request body after the response
+	// is flushed, unless full duplex is enabled. The HTTP/2 requests are
+	// always full duplex.
+	if r.ProtoMajor < 2 {
+		if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+			http.Error(w, errStreamFullDuplex.Error(), http.StatusHTTPVersionNotSupported)
+			return
+		}
+	}
+	// the response is written only after the first update is read, as the
+	// server closes the body of the requests expecting a 100-continue that
+	// are answered before it's read.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	dec := json.NewDecoder(r.Body)
+	enc := json.NewEncoder(w)
+	for {
+		var u update
+		err := dec.Decode(&u)
+		if err == io.EOF {
+			return
+		}
+		res := updateResult{Op: u.Op}
+		decodeErr := err
+		if decodeErr != nil {
+			res.Error = decodeErr.Error()
+		} else if err := cp.applyAudited(actorFromRequest(r), u); err != nil {
+			res.Error = err.Error()
+			log.Printf("control plane update %s failed: %v", u.Op, err)
+		}
+		if err := enc.Encode(res); err != nil {
+			// the client is gone.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if decodeErr != nil {
+			// the stream can't be decoded past an invalid object.
+			return
+		}
+	}
+}
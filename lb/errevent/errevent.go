@@ -0,0 +1,90 @@
+// Package errevent is the subscription to the errors of the LB components. The
+// router, the evaluator and the server publish the errors of the requests and
+// connections on a Bus, so the embedders and the metrics layer can react to
+// specific failure classes, checking the typed errors with errors.Is and
+// errors.As, instead of parsing the log lines.
+package errevent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// DefaultBuffer is the default number of events buffered for each subscriber.
+const DefaultBuffer = 256
+
+// Event is an error published by a component.
+type Event struct {
+	// Time is the time the error happened.
+	Time time.Time
+
+	// Component is the component that published the error, e.g. "router",
+	// "evaluator" or "server".
+	Component string
+
+	// Err is the error.
+	Err error
+}
+
+// Bus delivers the published events to it's subscribers. The zero value is
+// ready to use, and a nil Bus discards the events.
+type Bus struct {
+	subs map[chan Event]struct{}
+	mu   sync.RWMutex // guards subs
+
+	// dropped hold the events dropped because a subscriber buffer was full.
+	dropped metrics.Counter
+}
+
+// Publish delivers an event with the error to the subscribers. It never blocks:
+// the event is dropped for the subscribers whose buffer is full.
+func (b *Bus) Publish(component string, err error) {
+	if b == nil || err == nil {
+		return
+	}
+	ev := Event{Time: time.Now(), Component: component, Err: err}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			b.dropped.Inc()
+		}
+	}
+}
+
+// Subscribe returns a channel that receives the events published from now on,
+// buffering up to buffer events, and a func that cancels the subscription and
+// closes the channel. If buffer is not positive, DefaultBuffer is used.
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// Dropped returns the number of events dropped because a subscriber buffer was
+// full.
+func (b *Bus) Dropped() int64 {
+	return b.dropped.Value()
+}
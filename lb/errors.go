@@ -0,0 +1,94 @@
+package lb
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/mhef/statera/lb/errevent"
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/metrics"
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/server"
+)
+
+// errorClass returns the class of an error published by the component, used as
+// the label of the error metrics. The errors of the router to reach the nodes
+// are classified by their router.UpstreamErrorClass, e.g. "upstream_refused".
+func errorClass(component string, err error) string {
+	var timeout *router.ErrUpstreamTimeout
+	var eval *evaluator.ErrRuleEvalFailed
+	var slow *server.ErrSlowConnection
+	switch {
+	case errors.Is(err, router.ErrNoHealthyNode):
+		return "no_healthy_node"
+	case errors.As(err, &timeout):
+		return "upstream_timeout"
+	case errors.As(err, &eval):
+		return "rule_eval_failed"
+	case errors.As(err, &slow):
+		return "slow_connection"
+	}
+	if component == "router" {
+		if c := router.ClassifyUpstreamError(err); c != router.UpstreamOther {
+			return "upstream_" + string(c)
+		}
+	}
+	return "other"
+}
+
+// errorKey is the key of the error counters.
+type errorKey struct {
+	component string
+	class     string
+}
+
+// errorStats counts the errors published on a bus, by component and class.
+type errorStats struct {
+	bus    *errevent.Bus
+	counts map[errorKey]int64
+	mu     sync.Mutex // guards counts
+}
+
+// errorControl returns the errorStats holding the bus where the components
+// publish their errors, and starts counting them for the metrics.
+func errorControl() *errorStats {
+	es := &errorStats{bus: &errevent.Bus{}, counts: make(map[errorKey]int64)}
+	events, _ := es.bus.Subscribe(0)
+	go func() {
+		for ev := range events {
+			k := errorKey{component: ev.Component, class: errorClass(ev.Component, ev.Err)}
+			es.mu.Lock()
+			es.counts[k]++
+			es.mu.Unlock()
+		}
+	}()
+	return es
+}
+
+// WriteMetrics writes the error counters on mw.
+func (es *errorStats) WriteMetrics(mw *metrics.Writer) {
+	es.mu.Lock()
+	keys := make([]errorKey, 0, len(es.counts))
+	for k := range es.counts {
+		keys = append(keys, k)
+	}
+	counts := make(map[errorKey]int64, len(es.counts))
+	for k, v := range es.counts {
+		counts[k] = v
+	}
+	es.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].component != keys[j].component {
+			return keys[i].component < keys[j].component
+		}
+		return keys[i].class < keys[j].class
+	})
+
+	for _, k := range keys {
+		mw.Counter("statera_errors_total", "Errors published by the components, by class.",
+			metrics.Labels{"component": k.component, "class": k.class}, counts[k])
+	}
+	mw.Counter("statera_error_events_dropped_total", "Error events dropped because a subscriber was behind.",
+		nil, es.bus.Dropped())
+}
@@ -0,0 +1,85 @@
+package evaluator
+
+import (
+	"io"
+	"net/http"
+)
+
+// replayBody wraps the body of a request whose first bytes were peeked by the
+// conditions. The peeked bytes are read again before the rest of the original
+// body, so the next readers, e.g. the router, receive the body untouched.
+//
+// Only the bytes needed by the conditions are buffered: a condition that inspects
+// the first N bytes of a huge upload doesn't make the whole upload be held on
+// memory.
+type replayBody struct {
+	// buf hold the bytes peeked from the original body.
+	buf []byte
+
+	// off hold the read offset on buf.
+	off int
+
+	// rc is the original body, with the peeked bytes already consumed.
+	rc io.ReadCloser
+
+	// eof define if the original body was completely read while peeking.
+	eof bool
+}
+
+// Read reads the peeked bytes and then the rest of the original body.
+func (b *replayBody) Read(p []byte) (int, error) {
+	if b.off < len(b.buf) {
+		n := copy(p, b.buf[b.off:])
+		b.off += n
+		return n, nil
+	}
+	if b.eof {
+		return 0, io.EOF
+	}
+	return b.rc.Read(p)
+}
+
+// Close closes the original body.
+func (b *replayBody) Close() error {
+	return b.rc.Close()
+}
+
+// peek returns up to the first n bytes of the body, or the whole body if n is
+// not positive, reading from the original body only the bytes not peeked yet.
+func (b *replayBody) peek(n int64) ([]byte, error) {
+	if !b.eof && (n <= 0 || int64(len(b.buf)) < n) {
+		var src io.Reader = b.rc
+		if n > 0 {
+			src = io.LimitReader(b.rc, n-int64(len(b.buf)))
+		}
+		rest, err := io.ReadAll(src)
+		b.buf = append(b.buf, rest...)
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 || int64(len(b.buf)) < n {
+			b.eof = true
+		}
+	}
+	if n > 0 && int64(len(b.buf)) > n {
+		return b.buf[:n], nil
+	}
+	return b.buf, nil
+}
+
+// peekBody returns up to the first n bytes of the request body, or the whole body
+// if n is not positive, without consuming them. The request body is replaced by
+// a replayBody on the first peek.
+//
+// peekBody must be called before the body starts to be read by other readers.
+func peekBody(r *http.Request, n int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	rb, ok := r.Body.(*replayBody)
+	if !ok {
+		rb = &replayBody{rc: r.Body}
+		r.Body = rb
+	}
+	return rb.peek(n)
+}
@@ -0,0 +1,74 @@
+package evaluator_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/mhef/statera/lb/evaluator"
+)
+
+// formBody is a form body far bigger than the limits of the conditions.
+var formBody = "user=alice&action=buy&padding=" + strings.Repeat("x", 100000)
+
+func TestBodyConditions(t *testing.T) {
+	form := func(key, value string, limit int64) evaluator.Condition {
+		return evaluator.Condition{Type: evaluator.BodyForm, Key: key, Operation: evaluator.Equal, Value: value, Limit: limit}
+	}
+	str := func(prefix string, limit int64) evaluator.Condition {
+		return evaluator.Condition{Type: evaluator.BodyString, Operation: evaluator.BeginWith, Value: prefix, Limit: limit}
+	}
+	tests := []struct {
+		name  string
+		conds []evaluator.Condition
+		group string
+	}{
+		{"whole body", []evaluator.Condition{form("action", "buy", 0), str("user=alice&action=buy&padding=xxx", 0)}, "matched"},
+		{"limits smaller than the body", []evaluator.Condition{form("user", "alice", 16), str("user=al", 7)}, "matched"},
+		{"string limit before a bigger form limit", []evaluator.Condition{str("user=al", 7), form("action", "buy", 32)}, "matched"},
+		{"form limit before a smaller string limit", []evaluator.Condition{form("action", "buy", 32), str("user=al", 7)}, "matched"},
+		{"string limit before a whole form", []evaluator.Condition{str("user=al", 7), form("padding", formBody[30:], 0)}, "matched"},
+		{"field cut by the form limit", []evaluator.Condition{str("user=al", 7), form("action", "buy", 12)}, "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := evaluator.New()
+			e.Default = &evaluator.Action{NodeGroup: "default"}
+			r := &evaluator.Rule{Conditions: tt.conds}
+			r.Action.NodeGroup = "matched"
+			if err := e.AddRule(r); err != nil {
+				t.Fatal(err)
+			}
+
+			var group, body string
+			h := e.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				res, _ := evaluator.EvaluationResultFromRequest(r)
+				group = res.NodeGroup
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Errorf("reading the body after the evaluator: %v", err)
+				}
+				body = string(b)
+			}))
+			req := httptest.NewRequest("POST", "http://statera/", nil)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			// the body is read one byte at a time, as a slow upload.
+			req.Body = io.NopCloser(iotest.OneByteReader(strings.NewReader(formBody)))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("answered %d: %s", w.Code, w.Body)
+			}
+			if group != tt.group {
+				t.Errorf("fowarded to %q, want %q", group, tt.group)
+			}
+			if body != formBody {
+				t.Errorf("the next handler read %d bytes of the body, want the %d bytes unchanged", len(body), len(formBody))
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package evaluator
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// preferredLanguage parses the Accept-Language header and returns the language
+// tag with the highest quality, lowercased, e.g. "pt-br". On a tie, the first
+// tag wins. The wildcard "*" is ignored.
+//
+// Returns a blank string if there is no language.
+func preferredLanguage(h string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(h, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if !strings.HasPrefix(f, "q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(f[2:], 64)
+			if err != nil {
+				v = 0
+			}
+			q = v
+		}
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// User agent families of the Device condition.
+const (
+	deviceBot     = "bot"
+	deviceMobile  = "mobile"
+	deviceDesktop = "desktop"
+)
+
+// botTokens are the User-Agent substrings that identify crawlers, monitoring
+// tools and HTTP libraries.
+var botTokens = []string{
+	"bot", "crawler", "spider", "slurp", "curl/", "wget/", "python-requests",
+	"go-http-client", "java/", "okhttp", "headless", "lighthouse", "monitor",
+}
+
+// mobileTokens are the User-Agent substrings that identify mobile devices.
+var mobileTokens = []string{
+	"mobile", "android", "iphone", "ipad", "ipod", "windows phone", "opera mini",
+	"blackberry", "kindle", "silk/",
+}
+
+// deviceFamily classifies the User-Agent on "bot", "mobile" or "desktop". A
+// blank User-Agent is classified as bot.
+func deviceFamily(ua string) string {
+	ua = strings.ToLower(ua)
+	if ua == "" {
+		return deviceBot
+	}
+	for _, t := range botTokens {
+		if strings.Contains(ua, t) {
+			return deviceBot
+		}
+	}
+	for _, t := range mobileTokens {
+		if strings.Contains(ua, t) {
+			return deviceMobile
+		}
+	}
+	return deviceDesktop
+}
+
+// evaluateCondLanguage takes a request and a condition and uses the preferred
+// language of the request to evaluate the condition. The BeginWith operation
+// allows a value like "pt" to match the "pt-br" language.
+func evaluateCondLanguage(r *http.Request, c Condition) (bool, error) {
+	return doStrCondOp(c.Operation, preferredLanguage(r.Header.Get("Accept-Language")), c.Value)
+}
+
+// evaluateCondDevice takes a request and a condition and uses the User-Agent
+// family of the request to evaluate the condition.
+func evaluateCondDevice(r *http.Request, c Condition) (bool, error) {
+	return doStrCondOp(c.Operation, deviceFamily(r.UserAgent()), c.Value)
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/mhef/statera/lb/server"
 )
 
 // CondType is a type used to define condition types.
@@ -22,6 +26,42 @@ const (
 	BodyForm
 	Header
 	IP
+
+	// PathPattern matches the path against a pattern, like
+	// "/users/{id}/orders", extracting the parameters to the request variables.
+	PathPattern
+
+	// Protocol compares the request HTTP version: "1.0", "1.1" or "2".
+	Protocol
+
+	// Scheme compares the scheme through wich the request arrived: "https" if
+	// it arrived over TLS, "http" otherwise.
+	Scheme
+
+	// Language compares the preferred language of the Accept-Language header,
+	// lowercased, e.g. "pt-br".
+	Language
+
+	// Device compares the family of the User-Agent: "mobile", "desktop" or
+	// "bot".
+	Device
+
+	// Host compares the request host, without the port.
+	Host
+
+	// LocalIP compares the original destination IP of the request, as
+	// resolved by the listener, against a CIDR range.
+	LocalIP
+
+	// Port compares the original destination port of the request, as
+	// resolved by the listener. The Range operation takes a range in the
+	// form "low-high", e.g. "8000-8999".
+	Port
+
+	// IPList compares the client IP, like IP, against the ranges of an IP
+	// list file, whose path is the value. The file is refreshed
+	// periodically, so the list is updated without restarts.
+	IPList
 )
 
 // CondOp is a type used to define condition operations.
@@ -35,6 +75,49 @@ const (
 	Range
 )
 
+// MatchMode is a type used to define how the conditions with keys match the
+// multiple values a key can have.
+type MatchMode int
+
+// Currently implemented match modes.
+const (
+	// MatchFirst compares only the first value of the key.
+	MatchFirst MatchMode = iota
+
+	// MatchAny is satisfied if any value of the key satisfies the operation.
+	MatchAny
+
+	// MatchAll is satisfied if every value of the key satisfies the operation.
+	MatchAll
+)
+
+// doStrCondOpValues does the condition operation over the values of a key, as
+// defined by the condition match mode. It returns false if there is no value.
+func doStrCondOpValues(c Condition, values []string) (bool, error) {
+	if len(values) == 0 {
+		return false, nil
+	}
+	switch c.Match {
+	case MatchAny:
+		for _, v := range values {
+			ok, err := doStrCondOp(c.Operation, v, c.Value)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case MatchAll:
+		for _, v := range values {
+			ok, err := doStrCondOp(c.Operation, v, c.Value)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return doStrCondOp(c.Operation, values[0], c.Value)
+}
+
 // doStrCondOp is a generic help function that do comparison operations between two
 // strings. The func is case insensitive.
 //
@@ -67,48 +150,105 @@ func evaluateCondPath(r *http.Request, c Condition) (bool, error) {
 // evaluateCondQuery takes a request and a condition and uses the request query
 // to evaluate the condition.
 func evaluateCondQuery(r *http.Request, c Condition) (bool, error) {
-	q := r.URL.Query()
-	if _, ok := q[c.Key]; !ok {
-		return false, nil
-	}
-	return doStrCondOp(c.Operation, q[c.Key][0], c.Value)
+	return doStrCondOpValues(c, r.URL.Query()[c.Key])
 }
 
 // evaluateCondQuery takes a request and a condition and uses the request body
-// as a string to evaluate the condition.
+// as a string to evaluate the condition. If the condition has a Limit, only the
+// first Limit bytes of the body are used.
 func evaluateCondBodyString(r *http.Request, c Condition) (bool, error) {
-	body, err := io.ReadAll(r.Body)
+	body, err := peekBody(r, c.Limit)
 	if err != nil {
 		return false, err
 	}
-	r.Body = io.NopCloser(bytes.NewReader(body)) // reset request body buffer
-	fmt.Println(string(body))
 	return doStrCondOp(c.Operation, string(body), c.Value)
 }
 
+// maxFormSize is the maximum size of the body parsed by a BodyForm condition
+// without Limit, the same limit of the http.Request ParseForm.
+const maxFormSize = 10 << 20
+
+// errFormTooLarge is returned when the body of a BodyForm condition without Limit
+// exceeds maxFormSize.
+var errFormTooLarge = errors.New("evaluator/condition: form body too large")
+
 // evaluateCondBodyForm takes a request and a condition and uses the request body
-// as a form to evaluate the condition.
+// as a form to evaluate the condition. If the condition has a Limit, only the
+// fields on the first Limit bytes of the body are used, and a field cut by the
+// limit is discarded.
+//
+// The form is parsed from a buffered copy of the body, so the body is still
+// fowarded to the node and the next body conditions inspect it again.
 func evaluateCondBodyForm(r *http.Request, c Condition) (bool, error) {
-	if err := r.ParseForm(); err != nil {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "application/x-www-form-urlencoded" {
+		return false, nil
+	}
+	limit := c.Limit
+	if limit <= 0 {
+		limit = maxFormSize + 1
+	}
+	body, err := peekBody(r, limit)
+	if err != nil {
 		return false, err
 	}
-	if _, ok := r.PostForm[c.Key]; !ok {
-		return false, nil
+	if int64(len(body)) == limit {
+		if c.Limit <= 0 {
+			return false, errFormTooLarge
+		}
+		if i := bytes.LastIndexByte(body, '&'); i >= 0 {
+			body = body[:i]
+		} else {
+			body = nil
+		}
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return false, err
 	}
-	return doStrCondOp(c.Operation, r.PostForm[c.Key][0], c.Value)
+	return doStrCondOpValues(c, form[c.Key])
 }
 
-// evaluateCondBodyForm takes a request and a condition and uses the request header
-// to evaluate the condition.
+// evaluateCondHeader takes a request and a condition and uses the request header
+// to evaluate the condition. The key is canonicalized, so "x-api-key" matches
+// the "X-Api-Key" header.
 func evaluateCondHeader(r *http.Request, c Condition) (bool, error) {
-	if _, ok := r.Header[c.Key]; !ok {
-		return false, nil
+	return doStrCondOpValues(c, r.Header.Values(c.Key))
+}
+
+// evaluateCondProtocol takes a request and a condition and uses the request HTTP
+// version to evaluate the condition.
+func evaluateCondProtocol(r *http.Request, c Condition) (bool, error) {
+	v := fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+	if r.ProtoMajor >= 2 {
+		v = fmt.Sprint(r.ProtoMajor)
+	}
+	return doStrCondOp(c.Operation, v, c.Value)
+}
+
+// evaluateCondScheme takes a request and a condition and uses the scheme through
+// wich the request arrived to evaluate the condition.
+func evaluateCondScheme(r *http.Request, c Condition) (bool, error) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return doStrCondOp(c.Operation, scheme, c.Value)
+}
+
+// evaluateCondHost takes a request and a condition and uses the request host,
+// without the port, to evaluate the condition.
+func evaluateCondHost(r *http.Request, c Condition) (bool, error) {
+	h := r.Host
+	if hp, _, err := net.SplitHostPort(h); err == nil {
+		h = hp
 	}
-	return doStrCondOp(c.Operation, r.Header[c.Key][0], c.Value)
+	return doStrCondOp(c.Operation, h, c.Value)
 }
 
 // evaluateCondIP takes a request and a condition and uses the request client IP to
-// evaluate the condition.
+// evaluate the condition. The client IP is the original source resolved by the
+// listener, if known, or the peer address.
 func evaluateCondIP(r *http.Request, c Condition) (bool, error) {
 	if c.Operation != Range {
 		return false, errors.New("evaluator/condition: invalid operation for IP type")
@@ -117,14 +257,144 @@ func evaluateCondIP(r *http.Request, c Condition) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	rIP := strings.Split(r.RemoteAddr, ":") // remove the port
-	ip := net.ParseIP(rIP[0])
-	return ipNet.Contains(ip), nil
+	return ipNet.Contains(sourceIP(r)), nil
+}
+
+// sourceIP returns the client IP of the request: the original source resolved by
+// the listener, if known, or the peer address.
+func sourceIP(r *http.Request) net.IP {
+	if a, ok := server.SourceAddrFromRequest(r); ok {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr) // remove the port
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// evaluateCondLocalIP takes a request and a condition and uses the original
+// destination IP of the request to evaluate the condition. It's not satisfied if
+// the destination is unknown.
+func evaluateCondLocalIP(r *http.Request, c Condition) (bool, error) {
+	if c.Operation != Range {
+		return false, errors.New("evaluator/condition: invalid operation for local IP type")
+	}
+	_, ipNet, err := net.ParseCIDR(c.Value)
+	if err != nil {
+		return false, err
+	}
+	a, ok := server.DestinationAddrFromRequest(r)
+	if !ok {
+		return false, nil
+	}
+	return ipNet.Contains(a.IP), nil
+}
+
+// evaluateCondPort takes a request and a condition and uses the original
+// destination port of the request to evaluate the condition. It's not satisfied
+// if the destination is unknown.
+func evaluateCondPort(r *http.Request, c Condition) (bool, error) {
+	a, ok := server.DestinationAddrFromRequest(r)
+	if !ok {
+		return false, nil
+	}
+	if c.Operation != Range {
+		return doStrCondOp(c.Operation, strconv.Itoa(a.Port), c.Value)
+	}
+	low, high, err := parsePortRange(c.Value)
+	if err != nil {
+		return false, err
+	}
+	return a.Port >= low && a.Port <= high, nil
+}
+
+// parsePortRange parses a port range in the form "low-high".
+func parsePortRange(s string) (low, high int, err error) {
+	l, h, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("evaluator/condition: invalid port range %q", s)
+	}
+	lp, err := strconv.ParseUint(l, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("evaluator/condition: invalid port range %q", s)
+	}
+	hp, err := strconv.ParseUint(h, 10, 16)
+	if err != nil || hp < lp {
+		return 0, 0, fmt.Errorf("evaluator/condition: invalid port range %q", s)
+	}
+	return int(lp), int(hp), nil
+}
+
+// validate verifies if the condition is well formed, returning an error
+// describing the problem if not.
+func (c Condition) validate() error {
+	if c.Type < Path || c.Type > IPList {
+		return fmt.Errorf("evaluator/condition: invalid type %d", c.Type)
+	}
+	if c.Operation < Equal || c.Operation > Range {
+		return fmt.Errorf("evaluator/condition: invalid operation %d", c.Operation)
+	}
+	switch c.Type {
+	case Query, BodyForm, Header:
+		if c.Key == "" {
+			return errors.New("evaluator/condition: key is required for the condition type")
+		}
+	default:
+		if c.Match != MatchFirst {
+			return errors.New("evaluator/condition: match mode is only allowed on types with keys")
+		}
+	}
+	if c.Match < MatchFirst || c.Match > MatchAll {
+		return fmt.Errorf("evaluator/condition: invalid match mode %d", c.Match)
+	}
+	if c.Type == PathPattern {
+		if c.Operation != Equal && c.Operation != BeginWith {
+			return errors.New("evaluator/condition: invalid operation for path pattern type")
+		}
+		return validatePathPattern(c.Value)
+	}
+	if c.Type == IP || c.Type == LocalIP {
+		if c.Operation != Range {
+			return errors.New("evaluator/condition: invalid operation for IP type")
+		}
+		if _, _, err := net.ParseCIDR(c.Value); err != nil {
+			return err
+		}
+		return nil
+	}
+	if c.Type == IPList {
+		if c.Operation != Range {
+			return errors.New("evaluator/condition: invalid operation for IP list type")
+		}
+		_, err := loadIPList(c.Value)
+		return err
+	}
+	if c.Type == Port && c.Operation == Range {
+		_, _, err := parsePortRange(c.Value)
+		return err
+	}
+	if c.Limit < 0 {
+		return errors.New("evaluator/condition: limit can't be negative")
+	}
+	if c.Limit > 0 && c.Type != BodyString && c.Type != BodyForm {
+		return errors.New("evaluator/condition: limit is only allowed on body conditions")
+	}
+	if c.Operation == Range {
+		return errors.New("evaluator/condition: invalid operation for string type")
+	}
+	if c.Operation == Regex {
+		if _, err := regexp.Compile(strings.ToLower(c.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // evaluateCondition takes a Request and a Condition and then evaluate the
-// condition over the Request.
-func evaluateCondition(r *http.Request, c Condition) (ret bool, err error) {
+// condition over the Request. Variables extracted by the condition are set on
+// vars.
+func evaluateCondition(r *http.Request, c Condition, vars map[string]string) (ret bool, err error) {
 	switch c.Type {
 	case Path:
 		ret, err = evaluateCondPath(r, c)
@@ -138,6 +408,24 @@ func evaluateCondition(r *http.Request, c Condition) (ret bool, err error) {
 		ret, err = evaluateCondHeader(r, c)
 	case IP:
 		ret, err = evaluateCondIP(r, c)
+	case PathPattern:
+		ret, err = evaluateCondPathPattern(r, c, vars)
+	case Protocol:
+		ret, err = evaluateCondProtocol(r, c)
+	case Scheme:
+		ret, err = evaluateCondScheme(r, c)
+	case Language:
+		ret, err = evaluateCondLanguage(r, c)
+	case Device:
+		ret, err = evaluateCondDevice(r, c)
+	case Host:
+		ret, err = evaluateCondHost(r, c)
+	case LocalIP:
+		ret, err = evaluateCondLocalIP(r, c)
+	case Port:
+		ret, err = evaluateCondPort(r, c)
+	case IPList:
+		ret, err = evaluateCondIPList(r, c)
 	}
 	ret = ret != c.Not // ret != c.Not  ==  ret XOR c.Not
 	return
@@ -1,6 +1,7 @@
 package evaluator
 
 import (
+	"context"
 	"net/http"
 )
 
@@ -20,3 +21,59 @@ func EvaluationResultFromRequest(r *http.Request) (e EvaluationResult, ok bool)
 	e, ok = r.Context().Value(evaluationResultKey).(EvaluationResult)
 	return
 }
+
+// ContextWithEvaluationResult returns a copy of ctx holding the evaluation
+// result, as the Evaluator Handler does for the requests fowarded to a node
+// group.
+func ContextWithEvaluationResult(ctx context.Context, e EvaluationResult) context.Context {
+	return context.WithValue(ctx, evaluationResultKey, e)
+}
+
+// ctxRuleSlotKey is the type used to define the rule slot key.
+type ctxRuleSlotKey struct{}
+
+// ruleSlotKey is the key that holds the slot of the matched rule ID.
+var ruleSlotKey ctxRuleSlotKey
+
+// ruleSlot hold the rule matched by a tracked request.
+type ruleSlot struct {
+	id   string
+	tags []string
+}
+
+// TrackRule returns the request with a slot for the matched rule on it's
+// context, if it has none yet. It must be called before the request is evaluated
+// by the handlers that need the matched rule after the rest of the chain handles
+// the request, e.g. the access log.
+func TrackRule(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(ruleSlotKey).(*ruleSlot); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), ruleSlotKey, &ruleSlot{}))
+}
+
+// MatchedRule returns the ID of the rule matched by the request, or a blank
+// string if no rule matched or the request is not tracked.
+func MatchedRule(r *http.Request) string {
+	if s, ok := r.Context().Value(ruleSlotKey).(*ruleSlot); ok {
+		return s.id
+	}
+	return ""
+}
+
+// MatchedTags returns the tags of the rule matched by the request, or nil if no
+// rule matched or the request is not tracked.
+func MatchedTags(r *http.Request) []string {
+	if s, ok := r.Context().Value(ruleSlotKey).(*ruleSlot); ok {
+		return s.tags
+	}
+	return nil
+}
+
+// setMatchedRule define the rule matched by the request, if the request is
+// tracked.
+func setMatchedRule(r *http.Request, rule *Rule) {
+	if s, ok := r.Context().Value(ruleSlotKey).(*ruleSlot); ok {
+		s.id, s.tags = rule.ID, rule.Tags
+	}
+}
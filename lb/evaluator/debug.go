@@ -0,0 +1,184 @@
+package evaluator
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// redacted replaces the redacted values on the debug log.
+const redacted = "[REDACTED]"
+
+// DefaultRedactFields are the fields always redacted by the Debug.
+var DefaultRedactFields = []string{"password", "passwd", "secret", "token", "access_token", "api_key", "authorization"}
+
+// Debug logs the bodies inspected by the body conditions, to troubleshoot the
+// rules. The values of the sensitive fields are redacted before being logged.
+//
+// It's meant for troubleshooting only: even redacted, the bodies may hold
+// personal data.
+type Debug struct {
+	// Output define where the records are written, as one JSON object per
+	// line. If nil, the output of the standard logger, the error log, is used.
+	Output io.Writer
+
+	// fields hold the lower case names of the sensitive fields.
+	fields map[string]bool
+
+	// cutFields match the sensitive fields of the JSON bodies that can't be
+	// parsed, e.g. because they were cut by the limit of the condition, with
+	// the name on the group, so only the value is redacted.
+	cutFields []*regexp.Regexp
+
+	// patterns match the sensitive values.
+	patterns []*regexp.Regexp
+}
+
+// NewDebug returns a Debug that redacts the values of the form and JSON fields
+// with the names, besides the DefaultRedactFields, and the matches of the
+// patterns. An error is returned if a pattern is not a valid regular expression.
+func NewDebug(fields []string, patterns []string) (*Debug, error) {
+	d := &Debug{fields: make(map[string]bool)}
+	for _, f := range append(DefaultRedactFields, fields...) {
+		d.fields[strings.ToLower(f)] = true
+		// the value is a string, possibly cut, a number or a literal, or an
+		// object or an array, redacted up to the end of the body.
+		d.cutFields = append(d.cutFields, regexp.MustCompile(
+			`(?i)("`+regexp.QuoteMeta(f)+`"\s*:\s*)(?:"(?:[^"\\]|\\.)*"?|[\[{][\s\S]*|[^,}\]\s]+)`))
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		d.patterns = append(d.patterns, re)
+	}
+	return d, nil
+}
+
+// Redact returns the body with the sensitive values redacted. A JSON body has
+// the value of the sensitive fields redacted whatever the type, and a form body
+// has the fields matched by the decoded name.
+func (d *Debug) Redact(body []byte) string {
+	s, ok := d.redactJSON(body)
+	if !ok {
+		s = d.redactForm(string(body))
+		for _, re := range d.cutFields {
+			s = re.ReplaceAllString(s, `${1}"`+redacted+`"`)
+		}
+	}
+	for _, re := range d.patterns {
+		s = re.ReplaceAllLiteralString(s, redacted)
+	}
+	return s
+}
+
+// redactJSON returns the JSON body with the values of the sensitive fields
+// redacted, at any depth. ok is false if the body is not valid JSON.
+func (d *Debug) redactJSON(body []byte) (s string, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return "", false
+	}
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(d.redactValue(v)); err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(b.String(), "\n"), true
+}
+
+// redactValue returns the decoded JSON value with the values of the sensitive
+// fields replaced.
+func (d *Debug) redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if d.fields[strings.ToLower(k)] {
+				v[k] = redacted
+				continue
+			}
+			v[k] = d.redactValue(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = d.redactValue(e)
+		}
+	}
+	return v
+}
+
+// redactForm returns the form body with the values of the sensitive fields
+// redacted. The names are compared decoded, so an encoded name, e.g.
+// pass%77ord, is redacted too.
+func (d *Debug) redactForm(s string) string {
+	pairs := strings.Split(s, "&")
+	for i, p := range pairs {
+		name, _, ok := strings.Cut(p, "=")
+		if !ok {
+			continue
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if d.fields[strings.ToLower(strings.TrimSpace(name))] {
+			pairs[i] = p[:strings.IndexByte(p, '=')+1] + redacted
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// debugRecord is the record of a body inspected by a condition.
+type debugRecord struct {
+	Time      time.Time `json:"time"`
+	Message   string    `json:"msg"`
+	Rule      string    `json:"rule"`
+	Condition int       `json:"condition"`
+	Source    string    `json:"source"`
+	Matched   bool      `json:"matched"`
+	Body      string    `json:"body"`
+}
+
+// logCondition logs the body inspected by the condition of the rule, if it's a
+// body condition.
+func (d *Debug) logCondition(r *http.Request, rule *Rule, i int, ret bool) {
+	c := rule.Conditions[i]
+	if c.Type != BodyString && c.Type != BodyForm {
+		return
+	}
+	body, err := peekBody(r, c.Limit)
+	if err != nil {
+		return
+	}
+	rec := debugRecord{
+		Time:      time.Now(),
+		Message:   "evaluator debug",
+		Rule:      rule.ID,
+		Condition: i,
+		Matched:   ret,
+		Body:      d.Redact(body),
+	}
+	if ip := sourceIP(r); ip != nil {
+		rec.Source = ip.String()
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(rec); err != nil {
+		return
+	}
+	w := d.Output
+	if w == nil {
+		w = log.Writer()
+	}
+	w.Write(b.Bytes())
+}
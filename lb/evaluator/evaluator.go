@@ -3,13 +3,19 @@
 package evaluator
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/mhef/statera/lb/errevent"
 	"github.com/mhef/statera/lb/server"
+	"github.com/mhef/statera/lb/tenant"
 )
 
 // Condition define a condition for a rule.
@@ -26,8 +32,17 @@ type Condition struct {
 	// Operation define the comparison operation that will be made.
 	Operation CondOp
 
+	// Match define, on types that have keys, how the multiple values of the key
+	// are compared. By default, only the first value is compared.
+	Match MatchMode
+
 	// Value define the value waited to the condition be satisfied.
 	Value string
+
+	// Limit define, on the body types, how many bytes of the body are inspected.
+	// Only the first Limit bytes are read and matched, so a rule doesn't make
+	// huge uploads be buffered. If zero, the whole body is inspected.
+	Limit int64
 }
 
 // Action define the behaviour that should be taken if a rule is satisfied.
@@ -43,22 +58,215 @@ type Action struct {
 
 	// Redirect indicate that the client will be redirect to this address.
 	Redirect string
+
+	// Rewrite define, if not blank, the path of the request fowarded to the
+	// NodeGroup. Variables extracted by the conditions can be used on the form
+	// "{name}", e.g. "/v2/users/{id}".
+	Rewrite string
+
+	// SetHeaders define headers set on the request fowarded to the NodeGroup.
+	// Variables can be used on the values, e.g. "X-User-Id": "{id}".
+	SetHeaders map[string]string
+
+	// Port define, if not blank, the named port of the nodes to wich the
+	// requests are fowarded, e.g. "metrics". If blank, the node port is used.
+	Port string
+
+	// Timeout define the total time in seconds that a request fowarded to the
+	// NodeGroup has to be answered. The deadline is propagated to the node.
+	//
+	// If zero, only the listener deadline, if one, is applied.
+	Timeout int
+
+	// Fault define the faults that will be injected on the requests fowarded to
+	// the NodeGroup. If nil, no fault is injected.
+	Fault *Fault
+
+	// Priority define the priority class of the requests fowarded to the
+	// NodeGroup, used to choose wich requests are shed when the LB is
+	// overloaded.
+	//
+	// The default Priority is PriorityNormal.
+	Priority PriorityClass
+
+	// Quota define, if not blank, the name of the quota that limits the
+	// requests of each client fowarded to the NodeGroup.
+	Quota string
+
+	// Tenant define, if not nil, how the tenant of the requests is derived.
+	// The metrics, the quotas and the access log are then kept by tenant.
+	Tenant *tenant.Extractor
+
+	// ResponseFilter define, if not nil, the fields removed or masked from the
+	// JSON responses of the NodeGroup.
+	ResponseFilter *ResponseFilter
+}
+
+// ResponseFilter define the fields removed or masked from the JSON responses of
+// the requests fowarded by a rule.
+//
+// The fields are paths of object keys separated by dots, e.g. "user.email",
+// where a "*" segment matches any key. The arrays are traversed transparently,
+// so "items.debug" matches the debug field of each element of items.
+type ResponseFilter struct {
+	// Remove hold the paths of the fields removed from the responses.
+	Remove []string
+
+	// Mask hold the paths of the fields whose values are replaced by
+	// MaskValue.
+	Mask []string
+
+	// MaskValue define the string that replaces the masked values.
+	//
+	// The default MaskValue is "***".
+	MaskValue string
+
+	// Compiled hold, if not nil, the filter compiled by the handler that
+	// applies it, so it's compiled once when the rule is loaded instead of on
+	// each request. It's opaque to the evaluator.
+	Compiled any
+}
+
+// Fault define faults injected on fowarded requests, allowing the clients to be
+// chaos tested through the LB. Each percentage is a value between 0 and 100.
+type Fault struct {
+	// DelayPercent define the percentage of requests that will be delayed.
+	DelayPercent float64
+
+	// Delay define the delay in milliseconds added to the delayed requests.
+	Delay int
+
+	// AbortPercent define the percentage of requests that will be aborted with
+	// AbortStatusCode, without being fowarded.
+	AbortPercent float64
+
+	// AbortStatusCode define the status code answered to aborted requests.
+	//
+	// The default AbortStatusCode is 503.
+	AbortStatusCode int
+
+	// DropPercent define the percentage of requests that will have the client
+	// connection dropped, without any answer.
+	DropPercent float64
 }
 
 // Rule define a rule that will be evaluated by the evaluator.
 type Rule struct {
+	// ID identifies the rule on the Evaluator, e.g. to delete it. If blank,
+	// AddRule generates one from the Listener and the order the rules were
+	// added, so the IDs are stable only while the rules are.
+	ID string
+
 	Priority   int
 	Listener   string
 	Conditions []Condition
 	Action     Action
 	Dynamic    string
+
+	// Tags label the rule, e.g. to always log the requests it matches.
+	Tags []string
+
+	// Disabled define that the rule is not evaluated, e.g. an emergency rule
+	// staged to be enabled during an incident. Once the rule is added, it's
+	// switched through Evaluator.SetRuleEnabled.
+	Disabled bool
+
+	// stats hold the evaluation statistics of the conditions. It's created when
+	// the rule is added to an Evaluator.
+	stats *ruleStats
+}
+
+// Validate verifies if the rule is well formed: all conditions must be valid and
+// the action must have exactly one behaviour. ErrActionBehaviours is only
+// returned when the rest of the rule is valid.
+func (r *Rule) Validate() error {
+	for _, c := range r.Conditions {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+
+	behaviours := 0
+	if r.Action.NodeGroup != "" {
+		behaviours++
+	}
+	if r.Action.Reject.StatusCode != 0 {
+		if r.Action.Reject.StatusCode < 100 || r.Action.Reject.StatusCode > 599 {
+			return errors.New("evaluator: invalid reject status code")
+		}
+		behaviours++
+	}
+	if r.Action.Redirect != "" {
+		behaviours++
+	}
+	if (r.Action.Rewrite != "" || len(r.Action.SetHeaders) > 0 || r.Action.Port != "" || r.Action.ResponseFilter != nil) && r.Action.NodeGroup == "" {
+		return errors.New("evaluator: rewrite, set headers, port and response filter are only allowed on node group actions")
+	}
+	if f := r.Action.ResponseFilter; f != nil {
+		for _, p := range append(append([]string(nil), f.Remove...), f.Mask...) {
+			if p == "" || strings.HasPrefix(p, ".") || strings.HasSuffix(p, ".") || strings.Contains(p, "..") {
+				return fmt.Errorf("evaluator: invalid response filter field %q", p)
+			}
+		}
+	}
+	if r.Action.Priority < PriorityNormal || r.Action.Priority > PriorityLow {
+		return errors.New("evaluator: invalid priority class")
+	}
+	if r.Action.Rewrite != "" && !strings.HasPrefix(r.Action.Rewrite, "/") {
+		return errors.New("evaluator: rewrite must begin with /")
+	}
+	if t := r.Action.Tenant; t != nil {
+		if t.Source < tenant.SourceHeader || t.Source > tenant.SourceHost {
+			return errors.New("evaluator: invalid tenant source")
+		}
+		if t.Source != tenant.SourceHost && t.Key == "" {
+			return errors.New("evaluator: the tenant header or claim must be defined")
+		}
+	}
+	if behaviours != 1 {
+		return ErrActionBehaviours
+	}
+	return nil
 }
 
 // Evaluator is the component in charge of evaluating each request, using the
-// rules defined before by the LB admin.
+// rules defined before by the LB admin. Each listener has it's own Evaluator,
+// holding only the rules of the listener.
 type Evaluator struct {
-	r  []*Rule
-	mu sync.RWMutex
+	// Default define the action taken when no rule is satisfied. If nil, the
+	// request is rejected.
+	//
+	// Default must not be changed after the Evaluator starts handling requests.
+	Default *Action
+
+	// SlowThreshold define the p99 evaluation time above wich a condition is
+	// reported as slow, e.g. a complex regex or a body scan.
+	//
+	// The default SlowThreshold is DefaultSlowThreshold.
+	SlowThreshold time.Duration
+
+	// Errors is, if not nil, the bus where the evaluation errors are
+	// published, as *ErrRuleEvalFailed.
+	Errors *errevent.Bus
+
+	// Debug define, if not nil, that the bodies inspected by the body
+	// conditions are logged, with the sensitive values redacted.
+	Debug *Debug
+
+	// MemoSize define the maximum number of evaluation results memoized by
+	// the method, the host and the path of the requests. The results are only
+	// memoized while all the conditions of the enabled rules are of the Path,
+	// PathPattern or Host types, so the hot endpoints skip the evaluation of
+	// the rules. The memo is dropped on each change of the rules.
+	//
+	// If zero, the results are not memoized. MemoSize must not be changed
+	// after the first rule is added.
+	MemoSize int
+
+	r      []*Rule
+	nextID int
+	memo   memo
+	mu     sync.RWMutex // guards r and nextID
 }
 
 // New return a new instance of Evaluator.
@@ -66,46 +274,225 @@ func New() *Evaluator {
 	return &Evaluator{}
 }
 
-// AddRule adds the provided rule to the Evaluator.
-func (e *Evaluator) AddRule(r *Rule) {
+var (
+	// ErrDuplicateRule is returned by AddRule when the Evaluator already holds
+	// a rule with the same ID.
+	ErrDuplicateRule = errors.New("evaluator: there is already a rule with the same id")
+
+	// ErrRuleNotFound is returned when the Evaluator holds no rule with the ID.
+	ErrRuleNotFound = errors.New("evaluator: rule not found")
+
+	// ErrActionBehaviours is returned by Validate when the rule action has
+	// no behaviour or more than one. Such rules are evaluated as before the
+	// validation: the node group takes precedence over the reject, and the
+	// reject over the redirect.
+	ErrActionBehaviours = errors.New("evaluator: the rule action must have exactly one behaviour")
+)
+
+// AddRule adds the provided rule to the Evaluator. If the rule has no ID, one is
+// generated. ErrDuplicateRule is returned if the ID is already in use.
+func (e *Evaluator) AddRule(r *Rule) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	if r.ID == "" {
+		for r.ID == "" || e.rule(r.ID) != nil {
+			r.ID = fmt.Sprintf("%s#%d", r.Listener, e.nextID)
+			e.nextID++
+		}
+	} else if e.rule(r.ID) != nil {
+		return ErrDuplicateRule
+	}
+	if r.stats == nil {
+		r.stats = newRuleStats(r)
+	}
 	e.r = append(e.r, r)
 	sort.SliceStable(e.r, func(i, j int) bool {
 		return e.r[i].Priority < e.r[j].Priority
 	})
+	e.resetMemo()
+	return nil
 }
 
-// DeleteRule deletes the provided rule from the Evaluator.
-func (e *Evaluator) DeleteRule(r *Rule) {
+// ReplaceRules replaces all the rules of the Evaluator by rules at once, so the
+// requests are evaluated either by the old rules or by the new ones. The rules
+// without ID have one generated, as on AddRule. ErrDuplicateRule is returned,
+// and the rules are kept, if two rules have the same ID.
+func (e *Evaluator) ReplaceRules(rules []*Rule) error {
+	ids := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if r.ID == "" {
+			continue
+		}
+		if ids[r.ID] {
+			return ErrDuplicateRule
+		}
+		ids[r.ID] = true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// the ids are generated again from the start, so the rules without ID
+	// have the same ones they had when the Evaluator was created.
+	e.nextID = 0
+	nr := make([]*Rule, 0, len(rules))
+	for _, r := range rules {
+		for r.ID == "" {
+			id := fmt.Sprintf("%s#%d", r.Listener, e.nextID)
+			e.nextID++
+			if !ids[id] {
+				r.ID = id
+				ids[id] = true
+			}
+		}
+		if r.stats == nil {
+			r.stats = newRuleStats(r)
+		}
+		nr = append(nr, r)
+	}
+	sort.SliceStable(nr, func(i, j int) bool {
+		return nr[i].Priority < nr[j].Priority
+	})
+	e.r = nr
+	e.resetMemo()
+	return nil
+}
+
+// DeleteRule deletes the rule with the ID from the Evaluator.
+func (e *Evaluator) DeleteRule(id string) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	for i, v := range e.r {
-		if v == r {
+		if v.ID == id {
 			e.r = append(e.r[:i], e.r[i+1:]...)
-			return
+			e.resetMemo()
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// SetRuleEnabled enables or disables the rule with the ID. The rule held by the
+// Evaluator is replaced by a copy with the new state, so the rules returned
+// before are not modified.
+func (e *Evaluator) SetRuleEnabled(id string, enabled bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, v := range e.r {
+		if v.ID == id {
+			if v.Disabled == !enabled {
+				return nil
+			}
+			nr := *v
+			nr.Disabled = !enabled
+			e.r[i] = &nr
+			e.resetMemo()
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// Rule returns the rule with the ID, if one. The rule is the same held by the
+// Evaluator and must not be modified.
+func (e *Evaluator) Rule(id string) (*Rule, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	r := e.rule(id)
+	return r, r != nil
+}
+
+// rule returns the rule with the ID, or nil. e.mu must be held.
+func (e *Evaluator) rule(id string) *Rule {
+	for _, r := range e.r {
+		if r.ID == id {
+			return r
 		}
 	}
+	return nil
+}
+
+// Rules returns the rules of the Evaluator, ordered by priority.
+//
+// The returned slice is a copy, but the rules are the same held by the Evaluator
+// and must not be modified.
+func (e *Evaluator) Rules() []*Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	ret := make([]*Rule, len(e.r))
+	copy(ret, e.r)
+	return ret
+}
+
+// ErrRuleEvalFailed is returned when a condition of a rule can't be evaluated,
+// e.g. when the request body can't be read.
+type ErrRuleEvalFailed struct {
+	Rule *Rule
+
+	// Condition is the index of the condition on the rule.
+	Condition int
+
+	Err error
+}
+
+func (e *ErrRuleEvalFailed) Error() string {
+	return fmt.Sprintf("evaluator: condition %d of the rule %s failed: %s", e.Condition, e.Rule.ID, e.Err)
+}
+
+func (e *ErrRuleEvalFailed) Unwrap() error {
+	return e.Err
 }
 
 // evaluateRequest takes a request and then evaluate all rules present on the
-// Evaluator until a match, then return the Action of the matched rule. A rule
-// is considered satisfied, if all of it's conditions are satisfied.
-func (e *Evaluator) evaluateRequest(r *http.Request) (Action, error) {
+// Evaluator until a match, then return the matched rule, it's Action and the
+// variables extracted by it's conditions. The rule is nil if no rule matched. A rule is considered satisfied, if all
+// of it's conditions are satisfied.
+//
+// If the rule set is memoizable, the memoized result of the request is returned,
+// if one.
+func (e *Evaluator) evaluateRequest(r *http.Request) (*Rule, Action, map[string]string, error) {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
+	res, k, ok := e.lookupMemo(r)
+	if !ok {
+		var err error
+		res.rule, res.action, res.vars, err = e.evaluateRules(r)
+		if err != nil {
+			return nil, Action{}, nil, err
+		}
+		e.storeMemo(k, res)
+	}
+	// the variables are copied, so the memoized ones are not shared.
+	var vars map[string]string
+	if res.vars != nil {
+		vars = make(map[string]string, len(res.vars))
+		for name, v := range res.vars {
+			vars[name] = v
+		}
+	}
+	return res.rule, res.action, vars, nil
+}
+
+// evaluateRules evaluates the rules over the request, as described by
+// evaluateRequest. e.mu must be held.
+func (e *Evaluator) evaluateRules(r *http.Request) (*Rule, Action, map[string]string, error) {
 	for _, rule := range e.r {
-		lnr, ok := server.ListenerFromRequest(r)
-		if !ok || lnr != rule.Listener {
+		if rule.Disabled {
 			continue
 		}
 		allCondsTrue := true
-		for _, cnd := range rule.Conditions {
-			ret, err := evaluateCondition(r, cnd)
+		vars := make(map[string]string)
+		for i, cnd := range rule.Conditions {
+			start := time.Now()
+			ret, err := evaluateCondition(r, cnd, vars)
+			rule.stats.observe(i, time.Since(start), ret)
+			if e.Debug != nil && err == nil {
+				e.Debug.logCondition(r, rule, i, ret)
+			}
 			if err != nil {
-				return Action{}, err
+				return nil, Action{}, nil, &ErrRuleEvalFailed{Rule: rule, Condition: i, Err: err}
 			}
 			if !ret {
 				allCondsTrue = false
@@ -113,12 +500,15 @@ func (e *Evaluator) evaluateRequest(r *http.Request) (Action, error) {
 			}
 		}
 		if allCondsTrue {
-			return rule.Action, nil
+			return rule, rule.Action, vars, nil
 		}
 	}
 
 	// if the code execution reach this point, it means that no rule was satisfied.
-	return Action{
+	if e.Default != nil {
+		return nil, *e.Default, nil, nil
+	}
+	return nil, Action{
 		Reject: struct {
 			StatusCode int
 			Message    string
@@ -126,32 +516,100 @@ func (e *Evaluator) evaluateRequest(r *http.Request) (Action, error) {
 			StatusCode: 500,
 			Message:    "no rule was satisfied",
 		},
-	}, nil
+	}, nil, nil
 }
 
 // EvaluationResult hold the evaluation result of a request that evaluated to be
 // fowarded.
 type EvaluationResult struct {
 	NodeGroup string
+
+	// Rule hold the ID of the matched rule, or blank if the request was
+	// fowarded to the listener default node group.
+	Rule string
+
+	// Tags hold the Tags of the matched rule.
+	Tags []string
+
+	// Timeout hold the Timeout of the matched rule action.
+	Timeout int
+
+	// Fault hold the Fault of the matched rule action.
+	Fault *Fault
+
+	// Priority hold the Priority of the matched rule action.
+	Priority PriorityClass
+
+	// Quota hold the Quota of the matched rule action.
+	Quota string
+
+	// Tenant hold the tenant of the request, derived as defined by the
+	// matched rule action, if one.
+	Tenant string
+
+	// Port hold the named port of the matched rule action.
+	Port string
+
+	// ResponseFilter hold the ResponseFilter of the matched rule action.
+	ResponseFilter *ResponseFilter
+
+	// Vars hold the variables extracted by the conditions of the matched rule,
+	// e.g. the path pattern parameters.
+	Vars map[string]string
 }
 
 // Handler will evaluate each request with the Evaluator rules and then will take
 // the action of the matched rule.
 func (e *Evaluator) Handler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		a, err := e.evaluateRequest(r)
+		rule, a, vars, err := e.evaluateRequest(r)
 		if err != nil {
+			e.Errors.Publish("evaluator", err)
 			log.Println(err)
 			server.WriteError(w, http.StatusBadGateway, "rule evaluation failed")
 			return
 		}
 
+		if rule != nil {
+			setMatchedRule(r, rule)
+		}
+
+		var t string
+		if a.Tenant != nil {
+			t = a.Tenant.Extract(r)
+			tenant.Set(r, t)
+		}
+
 		if a.NodeGroup != "" {
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, evaluationResultKey, EvaluationResult{
+			var id string
+			var tags []string
+			if rule != nil {
+				id, tags = rule.ID, rule.Tags
+			}
+			ctx := ContextWithEvaluationResult(r.Context(), EvaluationResult{
 				NodeGroup: a.NodeGroup,
+				Rule:      id,
+				Tags:      tags,
+				Timeout:   a.Timeout,
+				Fault:     a.Fault,
+				Priority:  a.Priority,
+				Quota:     a.Quota,
+				Tenant:    t,
+				Port:      a.Port,
+				Vars:      vars,
+
+				ResponseFilter: a.ResponseFilter,
 			})
-			next.ServeHTTP(w, r.WithContext(ctx))
+			r = r.WithContext(ctx)
+			if a.Rewrite != "" || len(a.SetHeaders) > 0 {
+				// the URL and the header are shared with the original
+				// request, so they are copied before being changed.
+				u := *r.URL
+				r.URL = &u
+				r.Header = r.Header.Clone()
+				applyRewrite(r, a, vars)
+			}
+			next.ServeHTTP(w, r)
 			return
 		}
 
@@ -161,7 +619,7 @@ func (e *Evaluator) Handler(next http.Handler) http.Handler {
 		}
 
 		if a.Redirect != "" {
-			http.Redirect(w, r, a.Redirect, http.StatusFound)
+			http.Redirect(w, r, expandVars(a.Redirect, vars, url.PathEscape), http.StatusFound)
 			return
 		}
 
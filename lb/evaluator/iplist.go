@@ -0,0 +1,75 @@
+package evaluator
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mhef/statera/lb/extdata"
+)
+
+// ipListKind is the kind of the IP list files on the extdata resources.
+const ipListKind = "ip_list"
+
+// parseIPList parses an IP list file: one IP or CIDR range per line. The blank
+// lines and the lines beginning with "#" are ignored.
+func parseIPList(b []byte) (any, error) {
+	var nets []*net.IPNet
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q on line %d", s, line)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q on line %d", s, line)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, sc.Err()
+}
+
+// loadIPList returns the IP list of the file, loaded by the extdata package.
+func loadIPList(path string) (*extdata.Resource, error) {
+	return extdata.Load(ipListKind, path, parseIPList)
+}
+
+// evaluateCondIPList takes a request and a condition and uses the request client
+// IP, like the IP condition, to evaluate the condition. It's satisfied if the IP
+// is on any range of the list file of the condition value.
+func evaluateCondIPList(r *http.Request, c Condition) (bool, error) {
+	if c.Operation != Range {
+		return false, errors.New("evaluator/condition: invalid operation for IP list type")
+	}
+	rs, err := loadIPList(c.Value)
+	if err != nil {
+		return false, err
+	}
+	ip := sourceIP(r)
+	if ip == nil {
+		return false, nil
+	}
+	for _, n := range rs.Value().([]*net.IPNet) {
+		if n.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,104 @@
+package evaluator
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// memoKey identifies the requests that evaluate to the same result on a rule set
+// that is memoizable. The listener is implicit, as each listener has it's own
+// Evaluator.
+type memoKey struct {
+	method string
+	host   string
+	path   string
+}
+
+// memoResult is a memoized evaluation result.
+type memoResult struct {
+	rule   *Rule
+	action Action
+	vars   map[string]string
+}
+
+// memo hold the evaluation results of the requests, for the rule sets whose
+// conditions only depend on the method, the host and the path of the requests.
+type memo struct {
+	// active define if the current rule set is memoizable. It's guarded by
+	// the Evaluator mu.
+	active bool
+
+	entries map[memoKey]memoResult
+	mu      sync.Mutex // guards entries
+
+	hits   metrics.Counter
+	misses metrics.Counter
+}
+
+// memoizable returns if the result of the rules depends only on the method, the
+// host and the path of the requests, so it can be memoized.
+func memoizable(rules []*Rule) bool {
+	for _, r := range rules {
+		if r.Disabled {
+			continue
+		}
+		for _, c := range r.Conditions {
+			switch c.Type {
+			case Path, PathPattern, Host:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resetMemo drops the memoized results and checks if the new rule set is
+// memoizable. It must be called on each change of the rules, with e.mu held.
+func (e *Evaluator) resetMemo() {
+	e.memo.mu.Lock()
+	defer e.memo.mu.Unlock()
+	e.memo.entries = nil
+	e.memo.active = e.MemoSize > 0 && memoizable(e.r)
+}
+
+// lookupMemo returns the memoized result of the request, if one. e.mu must be
+// held.
+func (e *Evaluator) lookupMemo(r *http.Request) (memoResult, memoKey, bool) {
+	if !e.memo.active {
+		return memoResult{}, memoKey{}, false
+	}
+	k := memoKey{method: r.Method, host: r.Host, path: r.URL.EscapedPath()}
+	e.memo.mu.Lock()
+	res, ok := e.memo.entries[k]
+	e.memo.mu.Unlock()
+	if ok {
+		e.memo.hits.Inc()
+	} else {
+		e.memo.misses.Inc()
+	}
+	return res, k, ok
+}
+
+// storeMemo memoizes the result of the requests with the key. When the memo is
+// full, it's cleared, so the hot endpoints are memoized again on their next
+// requests. e.mu must be held.
+func (e *Evaluator) storeMemo(k memoKey, res memoResult) {
+	if !e.memo.active {
+		return
+	}
+	e.memo.mu.Lock()
+	defer e.memo.mu.Unlock()
+	if e.memo.entries == nil || len(e.memo.entries) >= e.MemoSize {
+		e.memo.entries = make(map[memoKey]memoResult)
+	}
+	e.memo.entries[k] = res
+}
+
+// MemoStats returns the number of evaluations answered by the memo and the
+// number of evaluations of memoizable rule sets that missed it.
+func (e *Evaluator) MemoStats() (hits, misses int64) {
+	return e.memo.hits.Value(), e.memo.misses.Value()
+}
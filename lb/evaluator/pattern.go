@@ -0,0 +1,146 @@
+package evaluator
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// splitPath splits an URL path on it's segments, ignoring the leading slash.
+func splitPath(p string) []string {
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+// patternParam returns the name of the parameter of a path pattern segment, if
+// the segment is a parameter, e.g. "id" on "{id}".
+func patternParam(seg string) (name string, ok bool) {
+	if len(seg) < 3 || seg[0] != '{' || seg[len(seg)-1] != '}' {
+		return "", false
+	}
+	return seg[1 : len(seg)-1], true
+}
+
+// validatePathPattern verifies if the path pattern is well formed.
+func validatePathPattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return errors.New("evaluator/condition: path pattern must begin with /")
+	}
+	seen := make(map[string]bool)
+	for _, seg := range splitPath(pattern) {
+		if strings.ContainsAny(seg, "{}") {
+			name, ok := patternParam(seg)
+			if !ok || strings.ContainsAny(name, "{}") {
+				return errors.New("evaluator/condition: path pattern parameters must take a whole segment")
+			}
+			if seen[name] {
+				return errors.New("evaluator/condition: duplicated path pattern parameter " + name)
+			}
+			seen[name] = true
+		}
+	}
+	return nil
+}
+
+// matchPathPattern matches the escaped path p against the pattern, where each
+// "{name}" segment matches any non-empty segment. Literal segments are compared
+// case insensitively. If prefix is true, the pattern only needs to match the
+// first segments of the path.
+//
+// The values of the parameters, unescaped, are set on vars when the path matches.
+func matchPathPattern(pattern string, p string, prefix bool, vars map[string]string) bool {
+	ps := splitPath(pattern)
+	segs := splitPath(p)
+	if len(segs) < len(ps) || (!prefix && len(segs) != len(ps)) {
+		return false
+	}
+
+	params := make(map[string]string)
+	for i, seg := range ps {
+		if name, ok := patternParam(seg); ok {
+			if segs[i] == "" {
+				return false
+			}
+			v, err := url.PathUnescape(segs[i])
+			if err != nil {
+				return false
+			}
+			params[name] = v
+			continue
+		}
+		if !strings.EqualFold(seg, segs[i]) {
+			return false
+		}
+	}
+	for k, v := range params {
+		vars[k] = v
+	}
+	return true
+}
+
+// evaluateCondPathPattern takes a request and a condition and matches the request
+// path against the path pattern on the condition value. The Equal operation
+// requires the whole path to match and the BeginWith operation only it's first
+// segments.
+func evaluateCondPathPattern(r *http.Request, c Condition, vars map[string]string) (bool, error) {
+	switch c.Operation {
+	case Equal:
+		return matchPathPattern(c.Value, r.URL.EscapedPath(), false, vars), nil
+	case BeginWith:
+		return matchPathPattern(c.Value, r.URL.EscapedPath(), true, vars), nil
+	}
+	return false, errors.New("evaluator/condition: invalid operation for path pattern type")
+}
+
+// expandVars replaces each "{name}" on s by the value of the variable name, passed
+// through escape. Unknown variables are kept as they are.
+func expandVars(s string, vars map[string]string, escape func(string) string) string {
+	if len(vars) == 0 || !strings.Contains(s, "{") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		name := s[i+1 : i+j]
+		b.WriteString(s[:i])
+		if v, ok := vars[name]; ok {
+			b.WriteString(escape(v))
+		} else {
+			b.WriteString(s[i : i+j+1])
+		}
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// headerValue escapes a variable to be used on a header value, removing the line
+// breaks.
+func headerValue(v string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(v)
+}
+
+// applyRewrite applies the Rewrite and SetHeaders of the action on the request,
+// expanding the variables of the evaluation.
+func applyRewrite(r *http.Request, a Action, vars map[string]string) {
+	if a.Rewrite != "" {
+		p := expandVars(a.Rewrite, vars, url.PathEscape)
+		if up, err := url.PathUnescape(p); err == nil {
+			r.URL.Path = up
+			r.URL.RawPath = ""
+			if up != p {
+				r.URL.RawPath = p
+			}
+		}
+	}
+	for k, v := range a.SetHeaders {
+		r.Header.Set(k, expandVars(v, vars, headerValue))
+	}
+}
@@ -0,0 +1,38 @@
+package evaluator
+
+// PriorityClass define the priority of the requests of a rule when the LB is
+// overloaded. The low priority requests are shed first and the high priority
+// requests are never shed.
+type PriorityClass int
+
+// Currently implemented priority classes.
+const (
+	PriorityNormal PriorityClass = iota
+	PriorityHigh
+	PriorityLow
+)
+
+// ParsePriorityClass returns the PriorityClass with the name: "normal" (or
+// blank), "high" or "low".
+func ParsePriorityClass(s string) (p PriorityClass, ok bool) {
+	switch s {
+	case "", "normal":
+		return PriorityNormal, true
+	case "high":
+		return PriorityHigh, true
+	case "low":
+		return PriorityLow, true
+	}
+	return 0, false
+}
+
+// String returns the name of the priority class.
+func (p PriorityClass) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
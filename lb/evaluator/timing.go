@@ -0,0 +1,99 @@
+package evaluator
+
+import (
+	"time"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// ConditionBuckets are the upper bounds, in seconds, of the histogram buckets
+// used to measure the condition evaluation time. Most conditions are evaluated
+// in microseconds.
+var ConditionBuckets = []float64{.000001, .000005, .00001, .00005, .0001, .0005, .001, .005, .01, .05, .1}
+
+// DefaultSlowThreshold is the p99 evaluation time above wich a condition is
+// considered slow, when Evaluator.SlowThreshold is not set.
+const DefaultSlowThreshold = time.Millisecond
+
+// conditionStats hold the evaluation statistics of a condition of a rule.
+type conditionStats struct {
+	// duration measure the time in seconds to evaluate the condition.
+	duration *metrics.Histogram
+
+	// shortCircuits count the evaluations where the condition was not
+	// satisfied, skipping the rest of the rule.
+	shortCircuits metrics.Counter
+}
+
+// ruleStats hold the statistics of each condition of a rule, by the condition
+// index.
+type ruleStats struct {
+	conds []*conditionStats
+}
+
+// newRuleStats returns the statistics of the conditions of the rule.
+func newRuleStats(r *Rule) *ruleStats {
+	rs := &ruleStats{conds: make([]*conditionStats, len(r.Conditions))}
+	for i := range rs.conds {
+		rs.conds[i] = &conditionStats{duration: metrics.NewHistogram(ConditionBuckets)}
+	}
+	return rs
+}
+
+// observe records an evaluation of the condition on the index i, that took d and
+// returned ok.
+func (rs *ruleStats) observe(i int, d time.Duration, ok bool) {
+	if rs == nil || i >= len(rs.conds) {
+		return
+	}
+	cs := rs.conds[i]
+	cs.duration.Observe(d.Seconds())
+	if !ok {
+		cs.shortCircuits.Inc()
+	}
+}
+
+// ConditionReport is the evaluation statistics of a condition of a rule.
+type ConditionReport struct {
+	Rule *Rule
+
+	// Index is the index of the condition on the rule conditions.
+	Index int
+
+	// Duration hold the time in seconds taken by the evaluations.
+	Duration metrics.HistogramSnapshot
+
+	// ShortCircuits count the evaluations where the condition was not satisfied,
+	// skipping the rest of the rule.
+	ShortCircuits int64
+
+	// Slow is true if the p99 of the evaluation time exceeds the evaluator
+	// SlowThreshold.
+	Slow bool
+}
+
+// ConditionReports returns the evaluation statistics of the conditions of each
+// rule, in the rules order.
+func (e *Evaluator) ConditionReports() []ConditionReport {
+	threshold := e.SlowThreshold
+	if threshold <= 0 {
+		threshold = DefaultSlowThreshold
+	}
+	ret := make([]ConditionReport, 0)
+	for _, r := range e.Rules() {
+		if r.stats == nil {
+			continue
+		}
+		for i, cs := range r.stats.conds {
+			s := cs.duration.Snapshot()
+			ret = append(ret, ConditionReport{
+				Rule:          r,
+				Index:         i,
+				Duration:      s,
+				ShortCircuits: cs.shortCircuits.Value(),
+				Slow:          s.Quantile(.99) > threshold.Seconds(),
+			})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,180 @@
+// Package extdata holds the external data files used by statera, like the IP
+// lists of the rule conditions. The files are loaded once by all the components
+// that use them and refreshed periodically: a file whose checksum changed is
+// parsed again and replaces the previous data, while a file that fails to be
+// read or parsed keeps the previous data, so the security data stays current
+// without restarts and a broken update never drops it.
+package extdata
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// DefaultInterval is the interval between the refreshes of the files, when Run
+// is called with zero.
+const DefaultInterval = time.Minute
+
+// ParseFunc parses the content of a file into the data used by the components.
+type ParseFunc func(b []byte) (any, error)
+
+// Resource is an external data file, parsed by a ParseFunc.
+type Resource struct {
+	Kind string
+	Path string
+
+	parse ParseFunc
+
+	// value hold the parsed data, wrapped in a holder.
+	value atomic.Value
+
+	mu sync.Mutex // guards the fields below
+	// sum is the checksum of the loaded content.
+	sum [sha256.Size]byte
+	// refreshed is the time of the last refresh that succeeded, changing the
+	// data or not.
+	refreshed time.Time
+	// loaded is the time the current data was loaded.
+	loaded time.Time
+
+	reloads metrics.Counter
+	errors  metrics.Counter
+}
+
+// holder wraps the parsed data, as an atomic.Value requires a consistent type.
+type holder struct {
+	v any
+}
+
+// Value returns the parsed data of the file.
+func (rs *Resource) Value() any {
+	return rs.value.Load().(holder).v
+}
+
+// refresh reads the file and, if it's checksum changed, parses it again. On
+// failure, the previous data is kept.
+func (rs *Resource) refresh(now time.Time) error {
+	b, err := os.ReadFile(rs.Path)
+	if err != nil {
+		rs.errors.Inc()
+		return err
+	}
+	sum := sha256.Sum256(b)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if sum == rs.sum && !rs.loaded.IsZero() {
+		rs.refreshed = now
+		return nil
+	}
+	v, err := rs.parse(b)
+	if err != nil {
+		rs.errors.Inc()
+		return err
+	}
+	rs.value.Store(holder{v})
+	if !rs.loaded.IsZero() {
+		rs.reloads.Inc()
+	}
+	rs.sum, rs.loaded, rs.refreshed = sum, now, now
+	return nil
+}
+
+var (
+	resources = make(map[string]*Resource)
+	mu        sync.Mutex // guards resources
+)
+
+// Load returns the resource of the file of the kind, loading it if it's the
+// first time the file is used. The same file of the same kind is shared by all
+// it's users. An error is returned if the file fails to be loaded for the first
+// time.
+func Load(kind, path string, parse ParseFunc) (*Resource, error) {
+	k := kind + "\x00" + path
+	mu.Lock()
+	defer mu.Unlock()
+	if rs, ok := resources[k]; ok {
+		return rs, nil
+	}
+	rs := &Resource{Kind: kind, Path: path, parse: parse}
+	if err := rs.refresh(time.Now()); err != nil {
+		return nil, fmt.Errorf("lb/extdata: failed to load the %s %s: %w", kind, path, err)
+	}
+	resources[k] = rs
+	return rs, nil
+}
+
+// all returns the resources, ordered by kind and path.
+func all() []*Resource {
+	mu.Lock()
+	ret := make([]*Resource, 0, len(resources))
+	for _, rs := range resources {
+		ret = append(ret, rs)
+	}
+	mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Kind != ret[j].Kind {
+			return ret[i].Kind < ret[j].Kind
+		}
+		return ret[i].Path < ret[j].Path
+	})
+	return ret
+}
+
+// Refresh refreshes all the resources, logging the failures.
+func Refresh(now time.Time) {
+	for _, rs := range all() {
+		if err := rs.refresh(now); err != nil {
+			log.Printf("failed to refresh the %s %s, keeping the previous data: %s", rs.Kind, rs.Path, err)
+		}
+	}
+}
+
+// Run refreshes the resources on each interval. If interval is zero,
+// DefaultInterval is used. It never returns.
+func Run(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for now := range t.C {
+		Refresh(now)
+	}
+}
+
+// WriteMetrics writes the metrics of the resources on mw.
+func WriteMetrics(mw *metrics.Writer) {
+	rss := all()
+	now := time.Now()
+	for _, rs := range rss {
+		rs.mu.Lock()
+		refreshed := rs.refreshed
+		rs.mu.Unlock()
+		mw.Gauge("statera_extdata_staleness_seconds", "Time since the external data file was last refreshed successfully.",
+			metrics.Labels{"kind": rs.Kind, "path": rs.Path}, now.Sub(refreshed).Seconds())
+	}
+	for _, rs := range rss {
+		rs.mu.Lock()
+		loaded := rs.loaded
+		rs.mu.Unlock()
+		mw.Gauge("statera_extdata_loaded_timestamp_seconds", "Time the current data of the external data file was loaded.",
+			metrics.Labels{"kind": rs.Kind, "path": rs.Path}, float64(loaded.Unix()))
+	}
+	for _, rs := range rss {
+		mw.Counter("statera_extdata_reloads_total", "Changes of the external data file loaded.",
+			metrics.Labels{"kind": rs.Kind, "path": rs.Path}, rs.reloads.Value())
+	}
+	for _, rs := range rss {
+		mw.Counter("statera_extdata_refresh_errors_total", "Refreshes of the external data file that failed to read or parse it.",
+			metrics.Labels{"kind": rs.Kind, "path": rs.Path}, rs.errors.Value())
+	}
+}
@@ -0,0 +1,58 @@
+// Package fault implements the fault injection of statera. It delays, aborts or
+// drops the requests fowarded by the rules that have a fault configured, allowing
+// the clients to be chaos tested through the LB without touching the nodes.
+package fault
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/random"
+	"github.com/mhef/statera/lb/server"
+)
+
+// hit returns true with a probability of percent/100.
+func hit(percent float64) bool {
+	return percent > 0 && random.Float64()*100 < percent
+}
+
+// Handler injects the faults of the matched rule on the request, if one. It must
+// be chained after the evaluator handler.
+func Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		e, ok := evaluator.EvaluationResultFromRequest(r)
+		if !ok || e.Fault == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f := e.Fault
+
+		if hit(f.DropPercent) {
+			// ErrAbortHandler closes the client connection without an answer.
+			panic(http.ErrAbortHandler)
+		}
+
+		if hit(f.AbortPercent) {
+			code := f.AbortStatusCode
+			if code == 0 {
+				code = http.StatusServiceUnavailable
+			}
+			server.WriteError(w, code, "fault injected")
+			return
+		}
+
+		if hit(f.DelayPercent) {
+			t := time.NewTimer(time.Duration(f.Delay) * time.Millisecond)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
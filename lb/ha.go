@@ -0,0 +1,162 @@
+package lb
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/admin"
+	"github.com/mhef/statera/lb/ha"
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// haHookTimeout is the maximum time of the OnMaster and OnBackup commands.
+const haHookTimeout = 30 * time.Second
+
+// listenerSet hold the public listeners of the load balancer. Without HA the
+// listeners are started once; with HA they are built and started each time the
+// instance becomes master, and shut down when it goes back to backup, as the
+// l4 and udp listeners can't be started again after a shutdown.
+type listenerSet struct {
+	build func() []listener
+
+	lnrs   []listener
+	wg     *sync.WaitGroup
+	closed bool
+	mu     sync.Mutex // guards lnrs, wg and closed
+}
+
+// start builds and starts the listeners, if they are not running.
+func (ls *listenerSet) start() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.closed || ls.lnrs != nil {
+		return
+	}
+	ls.lnrs = ls.build()
+	ls.wg = startListeners(ls.lnrs)
+}
+
+// stop shuts down the running listeners, waiting for the in-flight requests
+// until the context is done. The listeners can be started again.
+func (ls *listenerSet) stop(ctx context.Context) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.shutdown(ctx)
+}
+
+// close shuts down the running listeners, like stop, but they are not started
+// again.
+func (ls *listenerSet) close(ctx context.Context) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.closed = true
+	ls.shutdown(ctx)
+}
+
+// shutdown shuts down the listeners and waits for them to return. ls.mu must be
+// held.
+func (ls *listenerSet) shutdown(ctx context.Context) {
+	if ls.lnrs == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(ls.lnrs))
+	for _, l := range ls.lnrs {
+		go func(il listener) {
+			defer wg.Done()
+			if err := il.Shutdown(ctx); err != nil {
+				log.Println("listener", listenerAddr(il), "shutdown:", err)
+			}
+		}(l)
+	}
+	wg.Wait()
+	ls.wg.Wait()
+	ls.lnrs, ls.wg = nil, nil
+}
+
+// haControl takes the HA configuration and returns the ha.Elector that starts
+// the listeners when the instance becomes master and stops them when it goes
+// back to backup. If there is no HA configuration, the listeners are started
+// right away and nil is returned. It panics if the configuration is invalid.
+func haControl(cfgHA *cfg.HA, ls *listenerSet, sCfg cfg.Shutdown) *ha.Elector {
+	if cfgHA == nil {
+		ls.start()
+		return nil
+	}
+	if cfgHA.Addr == "" || cfgHA.Peer == "" {
+		panic("invalid ha configuration: addr and peer are required")
+	}
+	if cfgHA.Priority < 0 || cfgHA.Priority > 255 {
+		panic("invalid ha configuration: priority must be from 1 to 255, or 0 for the default")
+	}
+	drainTimeout := sCfg.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	return &ha.Elector{
+		Addr:           cfgHA.Addr,
+		Peer:           cfgHA.Peer,
+		Priority:       cfgHA.Priority,
+		AdvertInterval: time.Duration(cfgHA.AdvertInterval) * time.Millisecond,
+		DeadIntervals:  cfgHA.DeadIntervals,
+		Preempt:        cfgHA.Preempt,
+		Secret:         []byte(cfgHA.Secret),
+		OnMaster: func() {
+			runHAHook("on_master", cfgHA.OnMaster)
+			ls.start()
+		},
+		OnBackup: func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+			defer cancel()
+			ls.stop(ctx)
+			runHAHook("on_backup", cfgHA.OnBackup)
+		},
+	}
+}
+
+// runHAHook runs the shell command of a HA hook, if not blank.
+func runHAHook(name, command string) {
+	if command == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), haHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Println("ha", name, "hook failed:", err)
+	}
+}
+
+// haStatus is the response of the HA endpoint.
+type haStatus struct {
+	State string `json:"state"`
+	Peer  string `json:"peer"`
+}
+
+// haHandler reports the HA state of the instance.
+func (cp *controlPlane) haHandler(w http.ResponseWriter, r *http.Request) {
+	if cp.ha == nil {
+		http.Error(w, "ha is not configured", http.StatusNotFound)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, haStatus{State: cp.ha.State().String(), Peer: cp.ha.Peer})
+}
+
+// writeHAMetrics writes the HA state of the instance, if HA is configured.
+func (cp *controlPlane) writeHAMetrics(mw *metrics.Writer) {
+	if cp.ha == nil {
+		return
+	}
+	var master float64
+	if cp.ha.State() == ha.StateMaster {
+		master = 1
+	}
+	mw.Gauge("statera_ha_master", "If the instance is the HA master (1) or the backup (0).", nil, master)
+}
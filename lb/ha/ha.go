@@ -0,0 +1,321 @@
+// Package ha implements the active/passive high availability of two statera
+// instances. The instances advertise their state and priority to each other over
+// UDP, VRRP style, and elect a single master, the only one that binds the public
+// listeners. When the master stops advertising, the backup takes over within a
+// few advert intervals.
+//
+// No virtual IP is managed and no gratuitous ARP is sent: the public address is
+// moved by the OnMaster and OnBackup hooks, e.g. by a script updating a route or
+// a cloud elastic IP, or the listeners bind an address routed to both hosts.
+package ha
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// State is the state of an instance.
+type State int32
+
+// States of an instance.
+const (
+	// StateBackup is the state of the instance that waits for the master to
+	// fail. The instances start as backup.
+	StateBackup State = iota
+
+	// StateMaster is the state of the instance that binds the listeners.
+	StateMaster
+)
+
+func (s State) String() string {
+	if s == StateMaster {
+		return "master"
+	}
+	return "backup"
+}
+
+// Defaults of the Elector.
+const (
+	DefaultAdvertInterval = time.Second
+	DefaultDeadIntervals  = 3
+	DefaultPriority       = 100
+)
+
+var (
+	errInvalidAdvert = errors.New("lb/ha: invalid advert")
+	errAdvertAuth    = errors.New("lb/ha: advert authentication failed")
+)
+
+// advertMagic identifies the adverts.
+var advertMagic = []byte("STHA")
+
+// advertVersion is the version of the advert format.
+const advertVersion = 1
+
+// advertLen is the length of the advert without the HMAC.
+const advertLen = 16
+
+// advert is the state advertised by an instance.
+type advert struct {
+	state    State
+	priority int
+}
+
+// Elector elects the master of the pair of instances.
+type Elector struct {
+	// Addr specifies the UDP address where the adverts of the peer are
+	// received, in the form "host:port".
+	Addr string
+
+	// Peer specifies the UDP address of the peer, in the form "host:port".
+	Peer string
+
+	// Priority define the priority of the instance, from 1 to 255. When both
+	// instances are backup, the one with the higher priority becomes master
+	// first; on a tie, the one with the greater Addr.
+	//
+	// The default Priority is DefaultPriority.
+	Priority int
+
+	// AdvertInterval define the interval between the adverts.
+	//
+	// The default AdvertInterval is DefaultAdvertInterval.
+	AdvertInterval time.Duration
+
+	// DeadIntervals define the number of advert intervals without an advert
+	// of the master after wich the backup takes over. The instances with a
+	// lower priority wait up to one more interval.
+	//
+	// The default DeadIntervals is DefaultDeadIntervals.
+	DeadIntervals int
+
+	// Preempt define that the master yields to a backup with a higher
+	// priority, e.g. to return to the primary host after it recovers.
+	Preempt bool
+
+	// Secret define, if not empty, the key of the HMAC-SHA256 that
+	// authenticates the adverts. The adverts without a valid HMAC are
+	// dropped.
+	Secret []byte
+
+	// OnMaster and OnBackup are called, if not nil, when the instance becomes
+	// master and when it goes back to backup. They are called by the Elector
+	// goroutine, so the adverts wait for them to return.
+	OnMaster func()
+	OnBackup func()
+
+	state int32
+	pc    net.PacketConn
+	peer  net.Addr
+}
+
+// State returns the current state of the instance.
+func (e *Elector) State() State {
+	return State(atomic.LoadInt32(&e.state))
+}
+
+// Run elects the master until the context is done. The instance starts as
+// backup. When the context is done, a master resigns, advertising the priority
+// 0 so the peer takes over right away, and OnBackup is called.
+func (e *Elector) Run(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", e.Addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	peer, err := net.ResolveUDPAddr("udp", e.Peer)
+	if err != nil {
+		return err
+	}
+	e.pc, e.peer = pc, peer
+
+	adverts := make(chan advert)
+	go e.receive(ctx, adverts)
+
+	interval := e.advertInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	down := time.NewTimer(e.masterDownInterval())
+	defer down.Stop()
+	resetDown := func(d time.Duration) {
+		if !down.Stop() {
+			select {
+			case <-down.C:
+			default:
+			}
+		}
+		down.Reset(d)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if e.State() == StateMaster {
+				e.send(advert{state: StateBackup, priority: 0})
+				e.setState(StateBackup)
+			}
+			return nil
+		case <-ticker.C:
+			e.send(advert{state: e.State(), priority: e.priority()})
+		case <-down.C:
+			if e.State() == StateBackup {
+				e.setState(StateMaster)
+				e.send(advert{state: StateMaster, priority: e.priority()})
+			}
+		case a := <-adverts:
+			if e.State() == StateBackup {
+				switch {
+				case a.priority == 0:
+					// the master resigned.
+					resetDown(0)
+				case a.state == StateMaster || e.outranked(a):
+					resetDown(e.masterDownInterval())
+				}
+				continue
+			}
+			yield := a.state == StateMaster && e.outranked(a)
+			if a.state == StateBackup && e.Preempt && a.priority > e.priority() {
+				yield = true
+			}
+			if yield {
+				e.setState(StateBackup)
+				resetDown(e.masterDownInterval())
+			}
+		}
+	}
+}
+
+// setState changes the state of the instance and calls the hook of the new state.
+func (e *Elector) setState(s State) {
+	if State(atomic.SwapInt32(&e.state, int32(s))) == s {
+		return
+	}
+	log.Println("lb/ha: instance is now", s)
+	if s == StateMaster && e.OnMaster != nil {
+		e.OnMaster()
+	}
+	if s == StateBackup && e.OnBackup != nil {
+		e.OnBackup()
+	}
+}
+
+// outranked returns if the peer that sent the advert has precedence over the
+// instance.
+func (e *Elector) outranked(a advert) bool {
+	if a.priority != e.priority() {
+		return a.priority > e.priority()
+	}
+	return e.Peer > e.Addr
+}
+
+// receive reads the adverts of the peer until the context is done.
+func (e *Elector) receive(ctx context.Context, adverts chan<- advert) {
+	buf := make([]byte, 512)
+	for {
+		e.pc.SetReadDeadline(time.Now().Add(e.advertInterval()))
+		n, _, err := e.pc.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			log.Println("lb/ha:", err)
+			return
+		}
+		a, err := e.decode(buf[:n])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		select {
+		case adverts <- a:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send sends the advert to the peer.
+func (e *Elector) send(a advert) {
+	if _, err := e.pc.WriteTo(e.encode(a), e.peer); err != nil {
+		log.Println("lb/ha:", err)
+	}
+}
+
+// encode returns the advert on the wire format: the magic, the version, the
+// state, the priority, a reserved byte and the unix time in nanoseconds,
+// followed by the HMAC, if there is a Secret.
+func (e *Elector) encode(a advert) []byte {
+	b := make([]byte, advertLen)
+	copy(b, advertMagic)
+	b[4] = advertVersion
+	b[5] = byte(a.state)
+	b[6] = byte(a.priority)
+	binary.BigEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+	if len(e.Secret) > 0 {
+		b = append(b, e.mac(b)...)
+	}
+	return b
+}
+
+// decode parses and authenticates an advert.
+func (e *Elector) decode(b []byte) (advert, error) {
+	if len(b) < advertLen || !bytes.Equal(b[:4], advertMagic) || b[4] != advertVersion {
+		return advert{}, errInvalidAdvert
+	}
+	if len(e.Secret) > 0 && !hmac.Equal(b[advertLen:], e.mac(b[:advertLen])) {
+		return advert{}, errAdvertAuth
+	}
+	s := State(b[5])
+	if s != StateBackup && s != StateMaster {
+		return advert{}, errInvalidAdvert
+	}
+	return advert{state: s, priority: int(b[6])}, nil
+}
+
+// mac returns the HMAC of the advert.
+func (e *Elector) mac(b []byte) []byte {
+	h := hmac.New(sha256.New, e.Secret)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func (e *Elector) priority() int {
+	if e.Priority <= 0 {
+		return DefaultPriority
+	}
+	if e.Priority > 255 {
+		return 255
+	}
+	return e.Priority
+}
+
+func (e *Elector) advertInterval() time.Duration {
+	if e.AdvertInterval <= 0 {
+		return DefaultAdvertInterval
+	}
+	return e.AdvertInterval
+}
+
+// masterDownInterval returns the time without adverts of the master after
+// wich the backup takes over. As on VRRP, the instances with a lower priority
+// wait longer, so the higher one takes over first.
+func (e *Elector) masterDownInterval() time.Duration {
+	dead := e.DeadIntervals
+	if dead <= 0 {
+		dead = DefaultDeadIntervals
+	}
+	interval := e.advertInterval()
+	skew := interval * time.Duration(256-e.priority()) / 256
+	return time.Duration(dead)*interval + skew
+}
@@ -0,0 +1,135 @@
+package lb
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/atomicfile"
+	"github.com/mhef/statera/lb/router"
+)
+
+// nodeHealthState is the health of a node on the health state file.
+type nodeHealthState struct {
+	Group   string    `json:"group"`
+	Host    string    `json:"host"`
+	Port    uint16    `json:"port"`
+	Healthy bool      `json:"healthy"`
+	Since   time.Time `json:"since"`
+}
+
+// healthState is the content of the health state file.
+type healthState struct {
+	Saved time.Time         `json:"saved"`
+	Nodes []nodeHealthState `json:"nodes"`
+}
+
+// healthStore persists the last known health of the nodes on a local file, so
+// it's known after a restart.
+type healthStore struct {
+	file string
+
+	// restoreAge define the maximum age of a healthy state restored as healthy.
+	restoreAge time.Duration
+
+	// changed signals that the health of some node changed and the file must
+	// be saved.
+	changed chan struct{}
+}
+
+// newHealthStore returns the healthStore of the configuration, or nil if there
+// is no health state file.
+func newHealthStore(c *cfg.HealthState) *healthStore {
+	if c == nil || c.File == "" {
+		return nil
+	}
+	return &healthStore{
+		file:       c.File,
+		restoreAge: time.Duration(c.RestoreAge) * time.Second,
+		changed:    make(chan struct{}, 1),
+	}
+}
+
+// notify signals that the health of a node changed.
+func (hs *healthStore) notify() {
+	select {
+	case hs.changed <- struct{}{}:
+	default:
+	}
+}
+
+// restore loads the state file and restores as healthy the nodes that were
+// healthy, if the state is not older than the restore age. The nodes that were
+// unhealthy stay unhealthy until their health checks pass, as they would
+// without the restart. A missing file is not an error.
+func (hs *healthStore) restore(r *router.Router) {
+	b, err := os.ReadFile(hs.file)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Println("failed to read the health state file:", err)
+		return
+	}
+	var st healthState
+	if err := json.Unmarshal(b, &st); err != nil {
+		log.Println("failed to parse the health state file:", err)
+		return
+	}
+	if hs.restoreAge <= 0 || time.Since(st.Saved) > hs.restoreAge {
+		return
+	}
+	for _, ns := range st.Nodes {
+		if !ns.Healthy {
+			continue
+		}
+		ng, ok := r.NodeGroup(ns.Group)
+		if !ok {
+			continue
+		}
+		nk := router.NodeKey{Host: ns.Host, Port: ns.Port}
+		if err := ng.RestoreHealth(nk, true, ns.Since); err == nil {
+			log.Println(nk, "restored as healthy")
+		}
+	}
+}
+
+// run saves the state file each time the health of a node changes, and also on
+// each interval, so the saved time stays recent.
+func (hs *healthStore) run(r *router.Router, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-hs.changed:
+		case <-t.C:
+		}
+		if err := hs.save(r); err != nil {
+			log.Println("failed to save the health state file:", err)
+		}
+	}
+}
+
+// save writes the health of the nodes on the state file, replacing it
+// atomically.
+func (hs *healthStore) save(r *router.Router) error {
+	st := healthState{Saved: time.Now(), Nodes: make([]nodeHealthState, 0)}
+	for _, ng := range r.NodeGroups() {
+		for _, n := range ng.Nodes() {
+			st.Nodes = append(st.Nodes, nodeHealthState{
+				Group:   ng.Name,
+				Host:    n.Host,
+				Port:    n.Port,
+				Healthy: n.Healthy(),
+				Since:   n.HealthSince(),
+			})
+		}
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(hs.file, b)
+}
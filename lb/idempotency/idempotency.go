@@ -0,0 +1,313 @@
+// Package idempotency implements the at-most-once guard of statera. The requests
+// to the node groups with a Policy that carry an Idempotency-Key header are
+// fowarded to the nodes only once: a duplicate that arrives while the first
+// request is in progress is answered with 409, and one that arrives after it
+// completed is answered with the stored response, so the client retries don't
+// reach the nodes again.
+package idempotency
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/metrics"
+	"github.com/mhef/statera/lb/record"
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/server"
+)
+
+// Defaults of the guard.
+const (
+	DefaultHeader       = "Idempotency-Key"
+	defaultTTL          = 24 * time.Hour
+	defaultMaxEntries   = 10000
+	defaultMaxBodyBytes = 64 << 10
+)
+
+// ReplayedHeader is the response header set on the stored responses answered to
+// the duplicate requests.
+const ReplayedHeader = "Idempotency-Replayed"
+
+// Policy define how the requests of a node group are guarded.
+type Policy struct {
+	// Header define the request header holding the key.
+	//
+	// The default Header is DefaultHeader.
+	Header string
+
+	// TTL define the time in seconds that the responses are stored.
+	//
+	// The default TTL is 24 hours.
+	TTL int
+
+	// Require define that the guarded requests without the key are answered
+	// with 400, instead of being fowarded without the guard.
+	Require bool
+
+	// MaxBodyBytes define the maximum size in bytes of a stored response
+	// body. The duplicates of a request whose response is bigger are
+	// answered with 409.
+	//
+	// The default MaxBodyBytes is 64 KB.
+	MaxBodyBytes int
+}
+
+// header returns the request header holding the key.
+func (p *Policy) header() string {
+	if p.Header == "" {
+		return DefaultHeader
+	}
+	return p.Header
+}
+
+// ttl returns the time that the responses are stored.
+func (p *Policy) ttl() time.Duration {
+	if p.TTL <= 0 {
+		return defaultTTL
+	}
+	return time.Duration(p.TTL) * time.Second
+}
+
+// maxBodyBytes returns the maximum size of a stored response body.
+func (p *Policy) maxBodyBytes() int {
+	if p.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return p.MaxBodyBytes
+}
+
+// entry is the request of a key, in progress or completed.
+type entry struct {
+	key string
+
+	// request identifies the method and the URI of the request, so a key
+	// reused with a different request is rejected.
+	request string
+
+	// done define if the request completed. It's guarded by the Guard mu.
+	done bool
+
+	// stored define if the response was recorded. If false on a completed
+	// request, the duplicates are answered with 409.
+	stored bool
+	status int
+	header http.Header
+	body   []byte
+
+	expires time.Time
+	elem    *list.Element
+}
+
+// Guard is the idempotency guard. It's safe for concurrent use.
+type Guard struct {
+	// MaxEntries define the maximum number of keys held. The oldest keys are
+	// evicted to hold the new ones.
+	//
+	// The default MaxEntries is 10000.
+	MaxEntries int
+
+	policies map[string]*Policy
+
+	entries map[string]*entry
+	order   *list.List // newest first
+	mu      sync.Mutex // guards entries and order
+
+	replays   metrics.Counter
+	conflicts metrics.Counter
+}
+
+// New returns a Guard with the policy of each node group, by group name.
+func New(policies map[string]*Policy) *Guard {
+	return &Guard{
+		policies: policies,
+		entries:  make(map[string]*entry),
+		order:    list.New(),
+	}
+}
+
+// Handler guards the unsafe requests to the groups with a Policy. It must be
+// chained after the evaluator handler and before the router.
+func (g *Guard) Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		e, ok := evaluator.EvaluationResultFromRequest(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, ok := g.policies[e.NodeGroup]
+		if !ok || safeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		k := r.Header.Get(p.header())
+		if k == "" {
+			if p.Require {
+				server.WriteError(w, http.StatusBadRequest, "the "+p.header()+" header is required")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := scopedKey(e.NodeGroup, e.Tenant, k, r)
+		req := r.Method + " " + r.URL.RequestURI()
+		ent, dup := g.begin(key, req, p.ttl())
+		if dup {
+			g.answerDuplicate(w, r, ent, req, p)
+			return
+		}
+
+		rec := &record.Recorder{ResponseWriter: w, Limit: p.maxBodyBytes(), Exclude: privateHeaders}
+		r = router.TrackUpstream(r)
+		finished := false
+		defer func() {
+			// a request whose handler panicked, e.g. to abort the
+			// response, may be retried.
+			if !finished {
+				g.finish(ent, rec, true)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+		// a request that reached no node, e.g. because the group had no
+		// healthy node, or that got no response, because the client gave
+		// up, may be retried.
+		_, reached := router.UpstreamFromRequest(r)
+		g.finish(ent, rec, !reached || !rec.WroteHeader())
+		finished = true
+	}
+	return http.HandlerFunc(fn)
+}
+
+// scopedKey returns the key of the entry of the request. The keys are generated
+// by the clients, so they are scoped by the group, the tenant, the client
+// address and every credential of the client, so a client never gets the
+// response of an other.
+func scopedKey(group, tenant, key string, r *http.Request) string {
+	client := r.RemoteAddr
+	if src, ok := server.SourceAddrFromRequest(r); ok {
+		client = src.IP.String()
+	} else if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	h := sha256.New()
+	for _, v := range []string{tenant, client, r.Header.Get("Authorization"), strings.Join(r.Header.Values("Cookie"), "; ")} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return group + "\x00" + hex.EncodeToString(h.Sum(nil)) + "\x00" + key
+}
+
+// privateHeaders are the response headers specific to the client of the first
+// request, wich are never stored nor replayed.
+var privateHeaders = []string{"Set-Cookie", "Set-Cookie2", "Authentication-Info", "Proxy-Authentication-Info"}
+
+// safeMethod returns if the method is safe, and thus don't need the guard.
+func safeMethod(m string) bool {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// begin returns the entry of the key and true if there is one, or stores a new
+// entry for the request and returns it and false. The entries expire after the
+// ttl even if the request is still in progress, so a stuck request doesn't
+// block the retries forever.
+func (g *Guard) begin(key, req string, ttl time.Duration) (*entry, bool) {
+	limit := g.MaxEntries
+	if limit <= 0 {
+		limit = defaultMaxEntries
+	}
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ent, ok := g.entries[key]; ok {
+		if now.Before(ent.expires) {
+			return ent, true
+		}
+		g.remove(ent)
+	}
+	ent := &entry{key: key, request: req, expires: now.Add(ttl)}
+	ent.elem = g.order.PushFront(ent)
+	g.entries[key] = ent
+	for g.order.Len() > limit {
+		g.remove(g.order.Back().Value.(*entry))
+	}
+	return ent, false
+}
+
+// finish records the response of the entry request. If discard is true, the
+// entry is removed instead.
+func (g *Guard) finish(ent *entry, rec *record.Recorder, discard bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if discard {
+		if g.entries[ent.key] == ent {
+			g.remove(ent)
+		}
+		return
+	}
+	ent.done = true
+	if rec.Complete() {
+		ent.stored = true
+		ent.status, ent.header, ent.body = rec.Status(), rec.RecordedHeader(), rec.Body()
+	}
+}
+
+// answerDuplicate answers a duplicate of the entry request.
+func (g *Guard) answerDuplicate(w http.ResponseWriter, r *http.Request, ent *entry, req string, p *Policy) {
+	g.mu.Lock()
+	done, stored := ent.done, ent.stored
+	g.mu.Unlock()
+
+	switch {
+	case ent.request != req:
+		g.conflicts.Inc()
+		server.WriteError(w, http.StatusUnprocessableEntity, "the "+p.header()+" was used on a different request")
+	case !done:
+		g.conflicts.Inc()
+		server.WriteError(w, http.StatusConflict, "a request with the same "+p.header()+" is in progress")
+	case !stored:
+		g.conflicts.Inc()
+		server.WriteError(w, http.StatusConflict, "a request with the same "+p.header()+" was already processed")
+	default:
+		g.replays.Inc()
+		h := w.Header()
+		for k, vv := range ent.header {
+			h[k] = append([]string(nil), vv...)
+		}
+		h.Set(ReplayedHeader, "true")
+		w.WriteHeader(ent.status)
+		w.Write(ent.body)
+	}
+}
+
+// remove removes the entry. g.mu must be held.
+func (g *Guard) remove(ent *entry) {
+	delete(g.entries, ent.key)
+	g.order.Remove(ent.elem)
+}
+
+// Len returns the number of keys held.
+func (g *Guard) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.entries)
+}
+
+// WriteMetrics writes the guard metrics on mw.
+func (g *Guard) WriteMetrics(mw *metrics.Writer) {
+	mw.Counter("statera_idempotency_replays_total", "Duplicate requests answered with the stored response.", nil, g.replays.Value())
+	mw.Counter("statera_idempotency_conflicts_total", "Duplicate requests rejected, because the first was in progress, had no stored response or was different.",
+		nil, g.conflicts.Value())
+	mw.Gauge("statera_idempotency_keys", "Idempotency keys held by the guard.", nil, float64(g.Len()))
+}
@@ -0,0 +1,372 @@
+// Package jsonfilter implements the response filter of statera. The JSON
+// responses of the requests fowarded by the rules with a response filter have the
+// configured fields removed or masked before they reach the clients, e.g. to
+// strip internal debug fields or to mask emails.
+//
+// The responses are processed as a stream of tokens, so the memory used doesn't
+// depend on the size of the responses.
+package jsonfilter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/router"
+)
+
+// defaultMaskValue is the string that replaces the masked values, when the
+// filter doesn't define one.
+const defaultMaskValue = "***"
+
+// maxDepth is the maximum nesting of the filtered responses.
+const maxDepth = 1000
+
+var errTooDeep = errors.New("lb/jsonfilter: response nested too deep")
+
+// action is what is done to a field.
+type action int
+
+const (
+	keep action = iota
+	mask
+	remove
+)
+
+// path is a compiled field path of a filter.
+type path struct {
+	segments []string
+	action   action
+}
+
+// state is a path partially matched by the keys of the current field.
+type state struct {
+	p *path
+	i int // index of the next segment to match
+}
+
+// filter is a compiled evaluator.ResponseFilter.
+type filter struct {
+	paths []*path
+	mask  []byte
+}
+
+// Compile compiles the filter f and sets it as it's Compiled, so the requests
+// don't compile it again. It must be called before the rule is added on the
+// evaluator.
+func Compile(f *evaluator.ResponseFilter) {
+	f.Compiled = compile(f)
+}
+
+// compile returns the filter described by f.
+func compile(f *evaluator.ResponseFilter) *filter {
+	ft := &filter{}
+	for _, p := range f.Mask {
+		ft.paths = append(ft.paths, &path{segments: strings.Split(p, "."), action: mask})
+	}
+	// the removals are after the masks, so they win when both match.
+	for _, p := range f.Remove {
+		ft.paths = append(ft.paths, &path{segments: strings.Split(p, "."), action: remove})
+	}
+	mv := f.MaskValue
+	if mv == "" {
+		mv = defaultMaskValue
+	}
+	ft.mask, _ = json.Marshal(mv)
+	return ft
+}
+
+// Handler filters the JSON responses of the requests whose matched rule has a
+// response filter. It must be chained after the evaluator handler.
+func Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		e, ok := evaluator.EvaluationResultFromRequest(r)
+		if !ok || e.ResponseFilter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ft, ok := e.ResponseFilter.Compiled.(*filter)
+		if !ok {
+			ft = compile(e.ResponseFilter)
+		}
+		// the compressed responses can't be filtered, so the router
+		// decodes them.
+		r = router.RequirePlaintext(r)
+
+		fw := &filterWriter{ResponseWriter: w, filter: ft}
+		defer func() {
+			if v := recover(); v != nil {
+				// the filter goroutine must not write after the handler
+				// returns.
+				fw.abort()
+				panic(v)
+			}
+		}()
+		next.ServeHTTP(fw, r)
+		if err := fw.close(); err != nil {
+			log.Println("failed to filter the response of", r.URL.Path+":", err)
+			// the response is truncated, so the client connection is
+			// closed for the client to notice it.
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+// filterWriter is the http.ResponseWriter of the filtered requests. The JSON
+// bodies are written through a pipe to the goroutine that filters them.
+type filterWriter struct {
+	http.ResponseWriter
+	filter *filter
+
+	wroteHeader bool
+	filtering   bool
+
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (fw *filterWriter) WriteHeader(status int) {
+	if fw.wroteHeader {
+		return
+	}
+	fw.wroteHeader = true
+	h := fw.ResponseWriter.Header()
+	if isJSON(h.Get("Content-Type")) && (h.Get("Content-Encoding") == "" || h.Get("Content-Encoding") == "identity") {
+		fw.filtering = true
+		h.Del("Content-Length")
+		h.Del("ETag")
+		h.Del("Content-MD5")
+	}
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+func (fw *filterWriter) Write(b []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+	if !fw.filtering {
+		return fw.ResponseWriter.Write(b)
+	}
+	if fw.pw == nil {
+		pr, pw := io.Pipe()
+		fw.pw, fw.done = pw, make(chan error, 1)
+		go func() {
+			err := fw.filter.stream(pr, fw.ResponseWriter)
+			// the rest of the body is discarded, so the writes don't block.
+			pr.CloseWithError(err)
+			fw.done <- err
+		}()
+	}
+	return fw.pw.Write(b)
+}
+
+// close ends the body of the response and waits for it to be filtered. It
+// returns the error of the filter, if one.
+func (fw *filterWriter) close() error {
+	if fw.pw == nil {
+		return nil
+	}
+	fw.pw.Close()
+	fw.pw = nil
+	return <-fw.done
+}
+
+// abort stops the filter of the body, if started, and waits for it.
+func (fw *filterWriter) abort() {
+	if fw.pw == nil {
+		return
+	}
+	fw.pw.CloseWithError(io.ErrUnexpectedEOF)
+	<-fw.done
+}
+
+// Flush sends the buffered data to the client, if the client ResponseWriter
+// supports it. The filtered responses are flushed only when complete.
+func (fw *filterWriter) Flush() {
+	if fw.filtering {
+		return
+	}
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// isJSON returns if the content type is JSON, e.g. "application/json" or
+// "application/problem+json".
+func isJSON(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || (strings.HasPrefix(mt, "application/") && strings.HasSuffix(mt, "+json"))
+}
+
+// stream writes the JSON values read from r on w, without the removed fields and
+// with the masked ones replaced. The values are written compacted.
+func (f *filter) stream(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	bw := bufio.NewWriter(w)
+	states := make([]state, 0, len(f.paths))
+	for _, p := range f.paths {
+		states = append(states, state{p: p})
+	}
+	for first := true; ; first = false {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !first {
+			bw.WriteByte('\n')
+		}
+		if err := f.value(dec, bw, tok, states, 0); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// value writes the value that begins with tok, applying the states of the paths
+// that matched it's parents.
+func (f *filter) value(dec *json.Decoder, w *bufio.Writer, tok json.Token, states []state, depth int) error {
+	if depth > maxDepth {
+		return errTooDeep
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '[' {
+			w.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				// the arrays are traversed transparently.
+				if err := f.value(dec, w, tok, states, depth+1); err != nil {
+					return err
+				}
+			}
+			if _, err := dec.Token(); err != nil {
+				return err
+			}
+			w.WriteByte(']')
+			return nil
+		}
+		return f.object(dec, w, states, depth)
+	case string:
+		b, _ := json.Marshal(v)
+		w.Write(b)
+	case json.Number:
+		w.WriteString(v.String())
+	case bool:
+		if v {
+			w.WriteString("true")
+		} else {
+			w.WriteString("false")
+		}
+	case nil:
+		w.WriteString("null")
+	}
+	return nil
+}
+
+// object writes the object whose opening delimiter was read.
+func (f *filter) object(dec *json.Decoder, w *bufio.Writer, states []state, depth int) error {
+	w.WriteByte('{')
+	written := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		next, act := advance(states, key)
+		if act == remove {
+			if err := skip(dec); err != nil {
+				return err
+			}
+			continue
+		}
+		if written > 0 {
+			w.WriteByte(',')
+		}
+		written++
+		b, _ := json.Marshal(key)
+		w.Write(b)
+		w.WriteByte(':')
+		if act == mask {
+			if err := skip(dec); err != nil {
+				return err
+			}
+			w.Write(f.mask)
+			continue
+		}
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := f.value(dec, w, tok, next, depth+1); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	w.WriteByte('}')
+	return nil
+}
+
+// advance returns the states of the paths that match the field with the key, and
+// the action of the paths completely matched by it, if any.
+func advance(states []state, key string) ([]state, action) {
+	var next []state
+	act := keep
+	for _, s := range states {
+		seg := s.p.segments[s.i]
+		if seg != "*" && seg != key {
+			continue
+		}
+		if s.i+1 == len(s.p.segments) {
+			if s.p.action > act {
+				act = s.p.action
+			}
+			continue
+		}
+		next = append(next, state{p: s.p, i: s.i + 1})
+	}
+	return next, act
+}
+
+// skip reads the next value without writing it.
+func skip(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
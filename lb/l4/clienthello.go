@@ -0,0 +1,141 @@
+package l4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+var errInvalidClientHello = errors.New("lb/l4: invalid TLS ClientHello")
+
+// maxClientHelloBytes is the maximum size of the ClientHello handshake message
+// read from the clients. A ClientHello is usually smaller than 2 KB, but the post
+// quantum key shares can make it span more than one TLS record.
+const maxClientHelloBytes = 64 << 10
+
+// Types of the TLS records, handshake messages and extensions read by
+// readClientHello.
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+	extensionServerName      = 0
+	serverNameTypeHostName   = 0
+)
+
+// readClientHello reads the TLS records holding the ClientHello of a connection
+// and returns the server name indicated by the client, lowercased, and the raw
+// bytes read, that must be fowarded to the node before the rest of the
+// connection. The server name is blank if the client sent none.
+func readClientHello(r io.Reader) (serverName string, raw []byte, err error) {
+	var msg []byte
+	hdr := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return "", raw, err
+		}
+		raw = append(raw, hdr...)
+		if hdr[0] != recordTypeHandshake {
+			return "", raw, errInvalidClientHello
+		}
+		n := int(binary.BigEndian.Uint16(hdr[3:5]))
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return "", raw, err
+		}
+		raw = append(raw, body...)
+		msg = append(msg, body...)
+		if len(raw) > 2*maxClientHelloBytes {
+			return "", raw, errInvalidClientHello
+		}
+
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != handshakeTypeClientHello {
+			return "", raw, errInvalidClientHello
+		}
+		msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if msgLen > maxClientHelloBytes {
+			return "", raw, errInvalidClientHello
+		}
+		if len(msg)-4 >= msgLen {
+			serverName, err = parseServerName(msg[4 : 4+msgLen])
+			return serverName, raw, err
+		}
+	}
+}
+
+// parseServerName returns the host name of the server_name extension of the
+// ClientHello message body, if one.
+func parseServerName(b []byte) (string, error) {
+	// client_version and random.
+	if len(b) < 34 {
+		return "", errInvalidClientHello
+	}
+	b = b[34:]
+	// session_id, cipher_suites and compression_methods.
+	for _, lenBytes := range []int{1, 2, 1} {
+		b = skipVector(b, lenBytes)
+		if b == nil {
+			return "", errInvalidClientHello
+		}
+	}
+	if len(b) == 0 {
+		// there are no extensions.
+		return "", nil
+	}
+	if len(b) < 2 {
+		return "", errInvalidClientHello
+	}
+	exts := b[2:]
+	if int(binary.BigEndian.Uint16(b)) != len(exts) {
+		return "", errInvalidClientHello
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		n := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			return "", errInvalidClientHello
+		}
+		data := exts[4 : 4+n]
+		exts = exts[4+n:]
+		if typ != extensionServerName {
+			continue
+		}
+		// server_name_list.
+		if len(data) < 2 {
+			return "", errInvalidClientHello
+		}
+		list := data[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			nameLen := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+nameLen {
+				return "", errInvalidClientHello
+			}
+			if nameType == serverNameTypeHostName {
+				return strings.ToLower(strings.TrimSuffix(string(list[3:3+nameLen]), ".")), nil
+			}
+			list = list[3+nameLen:]
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// skipVector returns b after the vector at it's beginning, whose length is
+// encoded on lenBytes bytes. Returns nil if b is too short.
+func skipVector(b []byte, lenBytes int) []byte {
+	if len(b) < lenBytes {
+		return nil
+	}
+	n := 0
+	for _, c := range b[:lenBytes] {
+		n = n<<8 | int(c)
+	}
+	if len(b) < lenBytes+n {
+		return nil
+	}
+	return b[lenBytes+n:]
+}
@@ -0,0 +1,104 @@
+package l4
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/router"
+)
+
+// dialTimeout is the time that a node has to accept a fowarded connection.
+const dialTimeout = 10 * time.Second
+
+// ForwardConn fowards the raw connection c to a node of the group, picked by the
+// group Balancer, until both sides are done. host is the host, if known, given to
+// the Balancer, port is the named port of the node, or blank for the node port,
+// and first are the bytes already read from c, written to the node before the
+// rest of the connection.
+//
+// ForwardConn doesn't close c.
+func ForwardConn(c net.Conn, ng *router.NodeGroup, host, port string, first []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	// the balancers take a request, so the connection is described by a
+	// synthetic one.
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: host},
+		Host:       host,
+		Header:     make(http.Header),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	r = r.WithContext(evaluator.ContextWithEvaluationResult(ctx, evaluator.EvaluationResult{NodeGroup: ng.Name, Port: port}))
+	nc, err := ng.DialNode(ctx, r)
+	cancel()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer nc.Close()
+	if len(first) > 0 {
+		if _, err := nc.Write(first); err != nil {
+			return
+		}
+	}
+	pipe(c, nc, ng.ZeroCopy)
+}
+
+// pipe copies the data between the two connections until both directions are
+// done. When a side stops sending, the write side of the other is shut down, so
+// the half-closed connections keep working. If a copy fails, e.g. because a
+// connection was closed, both connections are closed.
+//
+// If zc is true, the data is copied by the kernel, when supported.
+func pipe(a, b net.Conn, zc bool) {
+	done := make(chan struct{})
+	go func() {
+		copyHalf(b, a, zc)
+		close(done)
+	}()
+	copyHalf(a, b, zc)
+	<-done
+}
+
+// copyHalf copies the data from src to dst, until src stops sending.
+func copyHalf(dst, src net.Conn, zc bool) {
+	var err error
+	ok := false
+	if zc {
+		_, err, ok = zeroCopy(dst, src)
+	}
+	if !ok {
+		_, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	closeWrite(dst)
+}
+
+// tcpConn returns the TCP connection of c, or nil if c is not TCP. The node
+// connections of the router wrap the TCP connection.
+func tcpConn(c net.Conn) *net.TCPConn {
+	switch c := c.(type) {
+	case *net.TCPConn:
+		return c
+	case interface{ TCPConn() *net.TCPConn }:
+		return c.TCPConn()
+	}
+	return nil
+}
+
+// closeWrite shuts down the write side of the connection, if supported.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
@@ -0,0 +1,212 @@
+// Package l4 implements the layer 4 listeners of statera. They foward whole
+// connections to the node groups, without terminating them, e.g. so the nodes
+// can terminate their own TLS.
+package l4
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/server"
+)
+
+// defaultHandshakeTimeout is the time in seconds that a client has to send the
+// ClientHello, when SNIListener.HandshakeTimeout is not set.
+const defaultHandshakeTimeout = 10
+
+// SNIRoute define the node group of the connections with a server name.
+type SNIRoute struct {
+	// ServerName define the server name indicated by the clients. A leading
+	// "*." matches exactly one label, e.g. "*.example.com" matches
+	// "api.example.com" but not "example.com".
+	ServerName string
+
+	// NodeGroup define the group to wich the connections are fowarded.
+	NodeGroup string
+
+	// Port define, if not blank, the named port of the nodes to wich the
+	// connections are fowarded. If blank, the node port is used.
+	Port string
+}
+
+// SNIListener is a listener that reads the TLS ClientHello of each connection,
+// without terminating the TLS, and fowards the raw connection to the node group
+// routed by the server name indicated by the client.
+type SNIListener struct {
+	// Addr specifies the TCP address for the listener to listen on, in the form
+	// "host:port".
+	Addr string
+
+	// Routes define the node group of each server name. The exact server names
+	// are matched before the wildcards.
+	Routes []SNIRoute
+
+	// DefaultNodeGroup define the group of the connections whose server name,
+	// or it's absence, doesn't match any route. If blank, such connections are
+	// closed.
+	DefaultNodeGroup string
+
+	// Router holds the node groups of the routes.
+	Router *router.Router
+
+	// HandshakeTimeout define the time in seconds that a client has to send the
+	// ClientHello.
+	//
+	// The default HandshakeTimeout is 10 seconds.
+	HandshakeTimeout int
+
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+	mu     sync.Mutex // guards ln, conns and closed
+}
+
+// route returns the route of the server name, or a route to the
+// DefaultNodeGroup if there is none.
+func (l *SNIListener) route(serverName string) SNIRoute {
+	for _, rt := range l.Routes {
+		if strings.EqualFold(rt.ServerName, serverName) {
+			return rt
+		}
+	}
+	if i := strings.IndexByte(serverName, '.'); i > 0 {
+		wildcard := "*" + serverName[i:]
+		for _, rt := range l.Routes {
+			if strings.EqualFold(rt.ServerName, wildcard) {
+				return rt
+			}
+		}
+	}
+	return SNIRoute{NodeGroup: l.DefaultNodeGroup}
+}
+
+// ListenAndServe listens on the Addr and fowards each accepted connection.
+//
+// This func blocks until the listener is shut down through Shutdown.
+func (l *SNIListener) ListenAndServe() error {
+	ln, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	l.ln = ln
+	l.conns = make(map[net.Conn]struct{})
+	l.mu.Unlock()
+
+	var b server.AcceptBackoff
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if b.Retry(err) {
+				continue
+			}
+			return err
+		}
+		b.Reset()
+		if !l.track(c) {
+			c.Close()
+			return nil
+		}
+		go func() {
+			defer l.untrack(c)
+			l.serveConn(c)
+		}()
+	}
+}
+
+// track adds the connection to the active ones. It returns false if the
+// listener is closed.
+func (l *SNIListener) track(c net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[c] = struct{}{}
+	l.wg.Add(1)
+	return true
+}
+
+// untrack closes the connection and removes it from the active ones.
+func (l *SNIListener) untrack(c net.Conn) {
+	c.Close()
+	l.mu.Lock()
+	delete(l.conns, c)
+	l.mu.Unlock()
+	l.wg.Done()
+}
+
+// serveConn reads the ClientHello of the connection and fowards it to a node of
+// the routed group.
+func (l *SNIListener) serveConn(c net.Conn) {
+	timeout := l.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	c.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	serverName, hello, err := readClientHello(c)
+	if err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	rt := l.route(serverName)
+	if rt.NodeGroup == "" {
+		log.Printf("lb/l4: there is no node group for the server name %q", serverName)
+		return
+	}
+	ng, ok := l.Router.NodeGroup(rt.NodeGroup)
+	if !ok {
+		log.Println("lb/l4: node group not found:", rt.NodeGroup)
+		return
+	}
+
+	ForwardConn(c, ng, serverName, rt.Port, hello)
+}
+
+// Shutdown stops accepting new connections and waits for the active ones to be
+// closed by the peers. When the context is done, the active connections are
+// closed.
+func (l *SNIListener) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	l.closed = true
+	if l.ln != nil {
+		l.ln.Close()
+	}
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		for c := range l.conns {
+			c.Close()
+		}
+		l.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package l4
+
+import (
+	"net"
+	"syscall"
+)
+
+// Flags of splice(2).
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+)
+
+// maxSpliceSize is the maximum number of bytes moved by each splice, the default
+// capacity of a pipe.
+const maxSpliceSize = 64 << 10
+
+// zeroCopy copies the data from src to dst with splice(2) through a pipe, so the
+// data is moved by the kernel without being copied to the user space, until src
+// stops sending. ok is false if any of the connections is not TCP, in wich case
+// nothing is copied.
+func zeroCopy(dst, src net.Conn) (written int64, err error, ok bool) {
+	sc, dc := tcpConn(src), tcpConn(dst)
+	if sc == nil || dc == nil {
+		return 0, nil, false
+	}
+	srcRaw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, nil, false
+	}
+	dstRaw, err := dc.SyscallConn()
+	if err != nil {
+		return 0, nil, false
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, nil, false
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	for {
+		// the pipe is always empty here, so EAGAIN means that src has no
+		// data yet.
+		var n int64
+		var serr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			n, serr = splice(int(fd), p[1], maxSpliceSize)
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return written, err, true
+		}
+		if n == 0 {
+			return written, nil, true
+		}
+		for n > 0 {
+			var m int64
+			err := dstRaw.Write(func(fd uintptr) bool {
+				m, serr = splice(p[0], int(fd), int(n))
+				return serr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				return written, err, true
+			}
+			n -= m
+			written += m
+		}
+	}
+}
+
+// splice moves up to n bytes from rfd to wfd, retrying the interrupted calls.
+func splice(rfd, wfd, n int) (int64, error) {
+	for {
+		m, err := syscall.Splice(rfd, nil, wfd, nil, n, spliceMove|spliceNonblock)
+		if err != syscall.EINTR {
+			return m, err
+		}
+	}
+}
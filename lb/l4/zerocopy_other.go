@@ -0,0 +1,11 @@
+//go:build !linux
+
+package l4
+
+import "net"
+
+// zeroCopy is only supported on Linux. Elsewhere ok is always false, and the
+// connections are copied through the user space.
+func zeroCopy(dst, src net.Conn) (written int64, err error, ok bool) {
+	return 0, nil, false
+}
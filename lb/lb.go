@@ -3,34 +3,158 @@
 package lb
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/admin"
+	"github.com/mhef/statera/lb/cache"
+	"github.com/mhef/statera/lb/errevent"
 	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/extdata"
+	"github.com/mhef/statera/lb/fault"
+	"github.com/mhef/statera/lb/idempotency"
+	"github.com/mhef/statera/lb/jsonfilter"
+	"github.com/mhef/statera/lb/l4"
+	"github.com/mhef/statera/lb/overload"
+	"github.com/mhef/statera/lb/quota"
+	"github.com/mhef/statera/lb/random"
 	"github.com/mhef/statera/lb/router"
 	"github.com/mhef/statera/lb/router/algo"
 	"github.com/mhef/statera/lb/server"
+	"github.com/mhef/statera/lb/slo"
+	"github.com/mhef/statera/lb/srv"
+	"github.com/mhef/statera/lb/tenant"
+	"github.com/mhef/statera/lb/udprouter"
+	"github.com/mhef/statera/lb/webhook"
+	"github.com/mhef/statera/lb/xds"
 )
 
-// listenerControl takes a Mux and a slice of cfg.Listener and start each listener,
-// attaching the Mux as the handler of the listeners.
-//
-// This func blocks, returning only when a kill signal is received by the program.
-func listenerControl(m *Mux, cfgLnr []cfg.Listener) {
+// newListenerMux returns the Mux that handles the requests of a listener. The
+// requests pass through the panic recovery, the tenant metrics, the access log,
+// the status page, if sp is not nil, the listener evaluator, the quotas, the fault injection, the response filter,
+// the idempotency guard, the cache and the router. If upstreamHeader is true,
+// the router sets the router.UpstreamHeader on the responses.
+func newListenerMux(rc *recovery, lf *logFiles, ts *tenant.Stats, sp *statusPage, e *evaluator.Evaluator, qm *quota.Manager, ig *idempotency.Guard, cc *cache.Cache, r *router.Router, upstreamHeader bool) *Mux {
+	m := NewMux()
+	m.Chain(rc.Handler)
+	m.Chain(ts.Handler)
+	if lf.accessLog != nil {
+		m.Chain(lf.accessLog)
+	}
+	if sp != nil {
+		m.Chain(sp.Handler)
+	}
+	m.Chain(e.Handler)
+	if qm != nil {
+		m.Chain(qm.Handler)
+	}
+	m.Chain(fault.Handler)
+	m.Chain(jsonfilter.Handler)
+	if ig != nil {
+		m.Chain(ig.Handler)
+	}
+	if cc != nil {
+		m.Chain(cc.Handler)
+	}
+	if upstreamHeader {
+		m.Chain(router.ExposeUpstream)
+	}
+	m.Chain(r.Handler)
+	return m
+}
+
+// listener is a listener of the load balancer, serving HTTP or fowarding whole
+// connections.
+type listener interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+// listenerAddr returns the address of the listener.
+func listenerAddr(l listener) string {
+	switch l := l.(type) {
+	case *server.Listener:
+		return l.Addr
+	case *l4.SNIListener:
+		return l.Addr
+	case *udprouter.Listener:
+		return l.Addr
+	}
+	return ""
+}
+
+// listenerControl takes a slice of cfg.Listener and creates each listener,
+// attaching a Mux with the listener evaluator as the handler of the HTTP
+// listeners.
+func listenerControl(cfgLnr []cfg.Listener, rc *recovery, lf *logFiles, ts *tenant.Stats, evs map[string]*evaluator.Evaluator, qm *quota.Manager, ig *idempotency.Guard, cc *cache.Cache, r *router.Router, errs *errevent.Bus) []listener {
 	// Create each listener
-	listeners := make([]*server.Listener, 0)
+	listeners := make([]listener, 0)
 	for _, l := range cfgLnr {
+		switch l.Mode {
+		case "", "http":
+		case "sni":
+			if len(l.Addrs) > 0 || len(l.Interfaces) > 0 {
+				panic(fmt.Sprintf("invalid listener %s: the sni mode binds a single address", l.Addr))
+			}
+			listeners = append(listeners, newSNIListener(l, r))
+			continue
+		default:
+			panic(fmt.Sprintf("invalid mode %q on listener %s", l.Mode, l.Addr))
+		}
 		serverLnr := &server.Listener{
-			Addr:    l.Addr,
-			Handler: m,
-			HTTP2:   l.HTTP2,
+			Addr:           l.Addr,
+			Addrs:          l.Addrs,
+			Interfaces:     l.Interfaces,
+			Handler:        newListenerMux(rc, lf, ts, newStatusPage(l.StatusPage, r), evs[l.Addr], qm, ig, cc, r, l.UpstreamHeader),
+			HTTP2:          l.HTTP2,
+			RequestTimeout: l.RequestTimeout,
+			MaxHeaderBytes: l.MaxHeaderBytes,
+			MaxHeaderCount: l.MaxHeaderCount,
+
+			MinUploadRate:   l.MinUploadRate,
+			MinDownloadRate: l.MinDownloadRate,
+			RateGracePeriod: l.RateGracePeriod,
+
+			DisableKeepAlives: l.DisableKeepAlives,
+			MaxConnRequests:   l.MaxConnRequests,
+			RejectHTTP10:      l.RejectHTTP10,
+			DefaultHost:       l.DefaultHost,
+
+			Sniff:          l.Sniff,
+			ProxyProtocol:  l.ProxyProtocol,
+			TrustForwarded: l.TrustForwarded,
+			TrustedHops:    l.TrustedHops,
+			TrustedProxies: trustedProxies(l),
+
+			ForwardedHeaders: l.ForwardedHeaders,
+			Errors:           errs,
+		}
+		if l.SSHNodeGroup != "" {
+			ng, ok := r.NodeGroup(l.SSHNodeGroup)
+			if !ok {
+				panic(fmt.Sprintf("invalid listener %s: there is no node group %s", l.Addr, l.SSHNodeGroup))
+			}
+			serverLnr.SSH = func(c net.Conn) {
+				defer c.Close()
+				l4.ForwardConn(c, ng, "", "", nil)
+			}
 		}
 		if l.TLS != nil && len(l.TLS.Certs) > 0 {
 			// If cfg.Listener has TLS config, import that config.
 			serverLnr.TLS = &server.TLS{
-				MinTLSVersion: l.TLS.MinTLSVersion,
-				MaxTLSVersion: l.TLS.MaxTLSVersion,
+				MinTLSVersion:  l.TLS.MinTLSVersion,
+				MaxTLSVersion:  l.TLS.MaxTLSVersion,
+				ReloadInterval: l.TLS.ReloadInterval,
 			}
 			serverLnr.TLS.Certs = make([]server.Certificate, 0)
 			for _, cert := range l.TLS.Certs {
@@ -42,93 +166,1008 @@ func listenerControl(m *Mux, cfgLnr []cfg.Listener) {
 		}
 		listeners = append(listeners, serverLnr)
 	}
+	return listeners
+}
+
+// trustedProxies returns the networks of the proxies trusted by the listener to
+// set the forwarded headers.
+func trustedProxies(l cfg.Listener) []*net.IPNet {
+	if l.TrustedHops < 0 {
+		panic(fmt.Sprintf("invalid trusted hops %d on listener %s", l.TrustedHops, l.Addr))
+	}
+	var ret []*net.IPNet
+	for _, p := range l.TrustedProxies {
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			panic(fmt.Sprintf("invalid trusted proxy network %s on listener %s", p, l.Addr))
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret
+}
 
-	// start each listener and wait indefinitely until all of them are shut down.
-	var wg sync.WaitGroup
+// startListeners starts each listener. It returns a WaitGroup that is done when
+// all of them are shut down.
+func startListeners(listeners []listener) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
 	wg.Add(len(listeners))
 	for _, l := range listeners {
-		go func(il *server.Listener) {
+		go func(il listener) {
 			defer wg.Done()
 			if err := il.ListenAndServe(); err != nil {
 				panic(err)
 			}
 		}(l)
 	}
-	wg.Wait()
+	return wg
 }
 
-// evaluatorControl takes a mux and a slice of cfg.Rule, then create the evaluator
-// and attachs it's handler on the mux chain.
-func evaluatorControl(m *Mux, cfgRules []cfg.Rule) {
-	e := evaluator.New()
+// newSNIListener takes a cfg.Listener on the "sni" mode and returns the
+// l4.SNIListener described by it. It panics if a route references an unknown
+// node group.
+func newSNIListener(l cfg.Listener, r *router.Router) *l4.SNIListener {
+	sl := &l4.SNIListener{
+		Addr:             l.Addr,
+		DefaultNodeGroup: l.DefaultNodeGroup,
+		Router:           r,
+	}
+	for _, rt := range l.SNIRoutes {
+		if rt.ServerName == "" {
+			panic(fmt.Sprintf("invalid sni route without server name on listener %s", l.Addr))
+		}
+		if _, ok := r.NodeGroup(rt.NodeGroup); !ok {
+			panic(fmt.Sprintf("invalid sni route on listener %s: there is no node group %s", l.Addr, rt.NodeGroup))
+		}
+		sl.Routes = append(sl.Routes, l4.SNIRoute{ServerName: rt.ServerName, NodeGroup: rt.NodeGroup, Port: rt.Port})
+	}
+	if g := l.DefaultNodeGroup; g != "" {
+		if _, ok := r.NodeGroup(g); !ok {
+			panic(fmt.Sprintf("invalid listener %s: there is no node group %s", l.Addr, g))
+		}
+	}
+	return sl
+}
+
+// newRule takes a cfg.Rule and returns the evaluator.Rule described by it.
+func newRule(rCfg cfg.Rule) *evaluator.Rule {
+	r := &evaluator.Rule{
+		ID:       rCfg.ID,
+		Priority: rCfg.Priority,
+		Listener: rCfg.Listener,
+		Action: evaluator.Action{
+			NodeGroup:  rCfg.Action.NodeGroup,
+			Redirect:   rCfg.Action.Redirect,
+			Rewrite:    rCfg.Action.Rewrite,
+			SetHeaders: rCfg.Action.SetHeaders,
+			Port:       rCfg.Action.Port,
+			Timeout:    rCfg.Action.Timeout,
+			Quota:      rCfg.Action.Quota,
+		},
+		Dynamic:  rCfg.Dynamic,
+		Tags:     rCfg.Tags,
+		Disabled: rCfg.Enabled != nil && !*rCfg.Enabled,
+	}
+	r.Action.Reject.StatusCode = rCfg.Action.Reject.StatusCode
+	r.Action.Reject.Message = rCfg.Action.Reject.Message
+	if p, ok := evaluator.ParsePriorityClass(rCfg.Action.Priority); ok {
+		r.Action.Priority = p
+	} else {
+		// an unknown class is kept invalid, so the rule fails the validation.
+		r.Action.Priority = -1
+	}
+	if t := rCfg.Action.Tenant; t != nil {
+		r.Action.Tenant = &tenant.Extractor{Key: t.Key, Default: t.Default}
+		if src, ok := tenant.ParseSource(t.Source); ok {
+			r.Action.Tenant.Source = src
+		} else {
+			// an unknown source is kept invalid, so the rule fails the
+			// validation.
+			r.Action.Tenant.Source = -1
+		}
+	}
+	if f := rCfg.Action.ResponseFilter; f != nil {
+		r.Action.ResponseFilter = &evaluator.ResponseFilter{
+			Remove:    f.Remove,
+			Mask:      f.Mask,
+			MaskValue: f.MaskValue,
+		}
+		jsonfilter.Compile(r.Action.ResponseFilter)
+	}
+	if f := rCfg.Action.Fault; f != nil {
+		r.Action.Fault = &evaluator.Fault{
+			DelayPercent:    f.DelayPercent,
+			Delay:           f.Delay,
+			AbortPercent:    f.AbortPercent,
+			AbortStatusCode: f.AbortStatusCode,
+			DropPercent:     f.DropPercent,
+		}
+	}
+	r.Conditions = make([]evaluator.Condition, 0, len(rCfg.Conditions))
+	for _, c := range rCfg.Conditions {
+		r.Conditions = append(r.Conditions, evaluator.Condition{
+			Not:       c.Not,
+			Type:      evaluator.CondType(c.Type),
+			Key:       c.Key,
+			Operation: evaluator.CondOp(c.Operation),
+			Match:     evaluator.MatchMode(c.Match),
+			Value:     c.Value,
+			Limit:     c.Limit,
+		})
+	}
+	return r
+}
+
+// evaluatorControl takes the slices of cfg.Listener and cfg.Rule, then create one
+// evaluator for each listener, holding only the rules of the listener. slow define
+// the threshold in microseconds of the slow conditions.
+//
+// It returns the evaluators by listener address.
+func evaluatorControl(cfgLnrs []cfg.Listener, cfgRules []cfg.Rule, slow int, cfgDebug *cfg.Debug, errs *errevent.Bus) map[string]*evaluator.Evaluator {
+	var debug *evaluator.Debug
+	if cfgDebug != nil {
+		var err error
+		debug, err = evaluator.NewDebug(cfgDebug.RedactFields, cfgDebug.RedactPatterns)
+		if err != nil {
+			panic(fmt.Sprintf("invalid debug redact pattern: %s", err))
+		}
+		log.Println("debug logging of the inspected request bodies is enabled")
+	}
+	evs := make(map[string]*evaluator.Evaluator)
+	for _, l := range cfgLnrs {
+		e := evaluator.New()
+		e.SlowThreshold = time.Duration(slow) * time.Microsecond
+		e.Errors = errs
+		e.Debug = debug
+		e.MemoSize = l.RuleMemoSize
+		if l.DefaultNodeGroup != "" {
+			e.Default = &evaluator.Action{NodeGroup: l.DefaultNodeGroup}
+		}
+		evs[l.Addr] = e
+	}
+	ids := make(map[string]bool)
 	for _, rCfg := range cfgRules {
-		r := &evaluator.Rule{
-			Priority: rCfg.Priority,
-			Listener: rCfg.Listener,
-			Action:   evaluator.Action(rCfg.Action),
-			Dynamic:  rCfg.Dynamic,
-		}
-		r.Conditions = make([]evaluator.Condition, 0, len(rCfg.Conditions))
-		for _, c := range rCfg.Conditions {
-			r.Conditions = append(r.Conditions, evaluator.Condition{
-				Not:       c.Not,
-				Type:      evaluator.CondType(c.Type),
-				Key:       c.Key,
-				Operation: evaluator.CondOp(c.Operation),
-				Value:     c.Value,
-			})
+		if rCfg.ID != "" && ids[rCfg.ID] {
+			panic(fmt.Sprintf("invalid rule %s: the id is already in use", rCfg.ID))
 		}
-		e.AddRule(r)
+		ids[rCfg.ID] = true
 	}
-	m.Chain(e.Handler)
+	for _, rCfg := range cfgRules {
+		r := newRule(rCfg)
+		if err := validateFileRule(r); err != nil {
+			panic(fmt.Sprintf("invalid rule with priority %d: %s", r.Priority, err))
+		}
+		e, ok := evs[r.Listener]
+		if !ok {
+			panic(fmt.Sprintf("invalid rule with priority %d: there is no listener %s", r.Priority, r.Listener))
+		}
+		if err := e.AddRule(r); err != nil {
+			panic(fmt.Sprintf("invalid rule %s: %s", r.ID, err))
+		}
+	}
+	return evs
 }
 
-func routerControl(m *Mux, cfgNgs []cfg.NodeGroup) {
-	rNgs := make([]*router.NodeGroup, 0, len(cfgNgs))
+// validateFileRule validates a rule of the configuration file. The rules whose
+// action doesn't have exactly one behaviour were accepted before the rules were
+// validated, so they are still accepted, with a deprecation warning, and
+// evaluated as before. The rules added through the admin listener must have
+// exactly one behaviour.
+func validateFileRule(r *evaluator.Rule) error {
+	err := r.Validate()
+	if errors.Is(err, evaluator.ErrActionBehaviours) {
+		log.Printf("deprecated rule with priority %d on listener %s: %s; it will be rejected by a future version", r.Priority, r.Listener, err)
+		return nil
+	}
+	return err
+}
+
+// quotaControl takes the quotas and returns the quota.Manager that enforces
+// them, or nil if there is no quota. It panics if a quota is invalid or if a rule
+// references an unknown quota.
+func quotaControl(cfgQuotas []cfg.Quota, file string, maxCounters int, cfgRules []cfg.Rule) *quota.Manager {
+	names := make(map[string]bool)
+	for _, q := range cfgQuotas {
+		names[q.Name] = true
+	}
+	for _, r := range cfgRules {
+		if r.Action.Quota != "" && !names[r.Action.Quota] {
+			panic(fmt.Sprintf("invalid rule with priority %d: there is no quota %s", r.Priority, r.Action.Quota))
+		}
+	}
+	if len(cfgQuotas) == 0 {
+		return nil
+	}
+
+	quotas := make([]*quota.Quota, 0, len(cfgQuotas))
+	for _, q := range cfgQuotas {
+		p, ok := quota.ParsePeriod(q.Period)
+		if !ok || q.Name == "" || q.Limit <= 0 {
+			panic(fmt.Sprintf("invalid quota %q", q.Name))
+		}
+		if q.Header != "" && len(q.Keys) == 0 {
+			panic(fmt.Sprintf("invalid quota %q: the header %s requires the known keys", q.Name, q.Header))
+		}
+		quotas = append(quotas, &quota.Quota{
+			Name:   q.Name,
+			Limit:  q.Limit,
+			Period: p,
+			Header: q.Header,
+			Keys:   q.Keys,
+
+			ByTenant: q.ByTenant,
+		})
+	}
+	qm := quota.NewManager(quotas, file)
+	qm.MaxCounters = maxCounters
+	go qm.Run(context.Background())
+	return qm
+}
+
+// cacheControl returns the cache of the responses of the node groups with a cache
+// policy, or nil if there is no such group. The expired responses of the groups
+// without node available are answered if the group serves stale. It panics if a
+// policy is invalid.
+func cacheControl(cfgNgs []cfg.NodeGroup, maxEntries int, r *router.Router) *cache.Cache {
+	policies := make(map[string]*cache.Policy)
 	for _, cfgNg := range cfgNgs {
-		var balancer router.Balancer
-
-		switch cfgNg.Algorithm {
-		case "rr":
-			balancer = algo.NewRR()
-		case "wrr":
-			balancer = algo.NewWRR()
-		case "lc":
-			balancer = algo.NewLC()
-		default:
-			panic(fmt.Sprintf("invalid load balancing algorithm %s", cfgNg.Algorithm))
+		if p := cfgNg.Cache; p != nil {
+			policies[cfgNg.Name] = &cache.Policy{
+				TTL:          p.TTL,
+				Key:          p.Key,
+				MaxBodyBytes: p.MaxBodyBytes,
+
+				StaleWhileRevalidate: p.StaleWhileRevalidate,
+				StaleIfError:         p.StaleIfError,
+			}
 		}
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	cc, err := cache.New(policies)
+	if err != nil {
+		panic(err)
+	}
+	cc.MaxEntries = maxEntries
+	cc.ServeStale = func(group string) bool {
+		ng, ok := r.NodeGroup(group)
+		return ok && ng.ServesStale()
+	}
+	return cc
+}
 
-		rNg := &router.NodeGroup{
-			Name:        cfgNg.Name,
-			HTTPS:       cfgNg.HTTPS,
-			Balancer:    balancer,
-			HealthCheck: router.HealthCheckConfig(cfgNg.HealthCheck),
+// idempotencyControl takes a slice of cfg.NodeGroup and returns the guard of the
+// groups with an idempotency policy, or nil if there is none.
+func idempotencyControl(cfgNgs []cfg.NodeGroup, maxEntries int) *idempotency.Guard {
+	policies := make(map[string]*idempotency.Policy)
+	for _, cfgNg := range cfgNgs {
+		if p := cfgNg.Idempotency; p != nil {
+			policies[cfgNg.Name] = &idempotency.Policy{
+				Header:       p.Header,
+				TTL:          p.TTL,
+				Require:      p.Require,
+				MaxBodyBytes: p.MaxBodyBytes,
+			}
 		}
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	ig := idempotency.New(policies)
+	ig.MaxEntries = maxEntries
+	return ig
+}
 
-		for _, n := range cfgNg.Nodes {
-			rNg.AddNode(&router.Node{
-				NodeKey: router.NodeKey{
-					Host: n.Host,
-					Port: n.Port,
-				},
-				Weight: n.Weight,
+// sloControl takes a slice of cfg.NodeGroup and starts the monitor of the
+// service level objectives of the groups, notifying the burn rate alerts to the
+// webhooks, if any. If there is no objective, nil is returned.
+func sloControl(cfgNgs []cfg.NodeGroup, r *router.Router, wh *webhook.Notifier) *slo.Monitor {
+	var objs []slo.Objective
+	for _, cfgNg := range cfgNgs {
+		for _, c := range cfgNg.SLOs {
+			kind, ok := slo.ParseKind(c.Kind)
+			if !ok {
+				panic(fmt.Sprintf("invalid SLO kind %q on group %s", c.Kind, cfgNg.Name))
+			}
+			obj := slo.Objective{
+				Group:            cfgNg.Name,
+				Kind:             kind,
+				Target:           c.Target / 100,
+				LatencyThreshold: time.Duration(c.LatencyThreshold) * time.Millisecond,
+				Window:           time.Duration(c.Window) * time.Second,
+			}
+			for _, a := range c.Alerts {
+				obj.Alerts = append(obj.Alerts, slo.Alert{
+					LongWindow:  time.Duration(a.LongWindow) * time.Second,
+					ShortWindow: time.Duration(a.ShortWindow) * time.Second,
+					BurnRate:    a.BurnRate,
+				})
+			}
+			objs = append(objs, obj)
+		}
+	}
+	if len(objs) == 0 {
+		return nil
+	}
+	m, err := slo.New(objs, r)
+	if err != nil {
+		panic(fmt.Sprintf("invalid SLO: %s", err))
+	}
+	m.OnAlert = func(e slo.Event) {
+		t, state := webhook.SLOBurnResolved, "resolved"
+		if e.Firing {
+			t, state = webhook.SLOBurn, "firing"
+		}
+		log.Printf("%s SLO of group %s burn rate alert %s: burn rate %.2f on %s", e.Objective.Kind, e.Objective.Group, state, e.BurnRate, e.Alert.LongWindow)
+		if wh != nil {
+			wh.Notify(webhook.Event{
+				Type:     t,
+				Group:    e.Objective.Group,
+				SLO:      e.Objective.Kind.String(),
+				Window:   e.Alert.LongWindow.String(),
+				BurnRate: e.BurnRate,
 			})
 		}
+	}
+	go m.Run()
+	return m
+}
+
+// sheddingControl sets the load shedding of the router, if configured, and
+// starts the monitor of the LB resources.
+func sheddingControl(ls *cfg.LoadShedding, r *router.Router) {
+	if ls == nil {
+		return
+	}
+	r.Shedding = &router.LoadShedding{
+		LowInFlight:    ls.LowInFlight,
+		NormalInFlight: ls.NormalInFlight,
+		RetryAfter:     ls.RetryAfter,
+	}
+	if o := ls.Overload; o != nil {
+		m := &overload.Monitor{
+			MaxGoroutines: o.MaxGoroutines,
+			MaxHeapBytes:  o.MaxHeapBytes,
+			MaxSchedDelay: time.Duration(o.MaxSchedulingDelay) * time.Microsecond,
+			Interval:      o.Interval,
+		}
+		go m.Run(context.Background())
+		r.Shedding.Overload = m
+	}
+}
+
+// newNode takes a cfg.Node and returns the router.Node described by it.
+func newNode(n cfg.Node) (*router.Node, error) {
+	sr, err := staticResponse(n.Static)
+	if err != nil {
+		return nil, err
+	}
+	for name, p := range n.Ports {
+		if name == "" || p == 0 {
+			return nil, fmt.Errorf("invalid named port %q of node %s:%d", name, n.Host, n.Port)
+		}
+	}
+	return &router.Node{
+		NodeKey: router.NodeKey{
+			Host: n.Host,
+			Port: n.Port,
+		},
+		Weight:   n.Weight,
+		Priority: n.Priority,
+		Static:   sr,
+		Ports:    n.Ports,
+	}, nil
+}
+
+// staticResponse takes a cfg.StaticResponse and returns the router.StaticResponse
+// described by it, loading the body file. If c is nil, nil is returned.
+func staticResponse(c *cfg.StaticResponse) (*router.StaticResponse, error) {
+	if c == nil {
+		return nil, nil
+	}
+	sr := &router.StaticResponse{
+		StatusCode: c.StatusCode,
+		Header:     make(http.Header),
+	}
+	for k, v := range c.Headers {
+		sr.Header.Set(k, v)
+	}
+	if c.BodyFile != "" {
+		b, err := os.ReadFile(c.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		sr.Body = b
+	}
+	return sr, nil
+}
+
+// requestSigning returns the router.RequestSigning described by the
+// cfg.RequestSigning, or nil if c is nil. An error is returned if it's invalid.
+func requestSigning(c *cfg.RequestSigning) (*router.RequestSigning, error) {
+	if c == nil {
+		return nil, nil
+	}
+	rs := &router.RequestSigning{
+		Key:             []byte(c.Key),
+		SignatureHeader: c.SignatureHeader,
+		TimestampHeader: c.TimestampHeader,
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		Region:          c.Region,
+		Service:         c.Service,
+	}
+	switch c.Type {
+	case "hmac":
+		if c.Key == "" {
+			return nil, errors.New("invalid hmac signing without key")
+		}
+		rs.Type = router.SigningHMAC
+	case "sigv4":
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" || c.Region == "" || c.Service == "" {
+			return nil, errors.New("invalid sigv4 signing without credentials, region or service")
+		}
+		rs.Type = router.SigningSigV4
+	default:
+		return nil, fmt.Errorf("invalid signing type %s", c.Type)
+	}
+	return rs, nil
+}
 
+// chBalancer returns the consistent-hashing balancer described by the hash of the
+// cfg.NodeGroup. An error is returned if the hash is invalid.
+func chBalancer(cfgNg cfg.NodeGroup) (*algo.CH, error) {
+	if cfgNg.Hash == nil {
+		return algo.NewCH(algo.HashClientIP, "", 0), nil
+	}
+	key, ok := algo.ParseHashKey(cfgNg.Hash.Key)
+	if !ok {
+		return nil, fmt.Errorf("invalid hash key %s on group %s", cfgNg.Hash.Key, cfgNg.Name)
+	}
+	if key != algo.HashClientIP && cfgNg.Hash.Name == "" {
+		return nil, fmt.Errorf("hash %s without name on group %s", cfgNg.Hash.Key, cfgNg.Name)
+	}
+	return algo.NewCH(key, cfgNg.Hash.Name, cfgNg.Hash.VirtualNodes), nil
+}
+
+// healthCheckConfig returns the router.HealthCheckConfig described by the health
+// check of the cfg.NodeGroup. An error is returned if the health check is
+// invalid.
+func healthCheckConfig(cfgNg cfg.NodeGroup) (router.HealthCheckConfig, error) {
+	hc := router.HealthCheckConfig{
+		Path:               cfgNg.HealthCheck.Path,
+		Interval:           cfgNg.HealthCheck.Interval,
+		Timeout:            cfgNg.HealthCheck.Timeout,
+		Headers:            cfgNg.HealthCheck.Headers,
+		UserAgent:          cfgNg.HealthCheck.UserAgent,
+		Scheme:             cfgNg.HealthCheck.Scheme,
+		InsecureSkipVerify: cfgNg.HealthCheck.InsecureSkipVerify,
+	}
+	switch hc.Scheme {
+	case "", "http", "https":
+	default:
+		return hc, fmt.Errorf("invalid health check scheme %q on group %s", hc.Scheme, cfgNg.Name)
+	}
+	if cc := cfgNg.HealthCheck.ClientCert; cc != nil {
+		cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+		if err != nil {
+			return hc, fmt.Errorf("failed to load the health check client certificate of group %s: %s", cfgNg.Name, err)
+		}
+		hc.ClientCert = &cert
+	}
+	for _, p := range cfgNg.HealthCheck.Probes {
+		rp := router.Probe{Path: p.Path, Port: p.Port, PortName: p.PortName}
+		switch p.Type {
+		case "", "http":
+			rp.Type = router.ProbeHTTP
+		case "tcp":
+			rp.Type = router.ProbeTCP
+		default:
+			return hc, fmt.Errorf("invalid health check probe type %q on group %s", p.Type, cfgNg.Name)
+		}
+		hc.Probes = append(hc.Probes, rp)
+	}
+	switch cfgNg.HealthCheck.Mode {
+	case "", "all":
+	case "any":
+		hc.Quorum = 1
+	case "quorum":
+		hc.Quorum = cfgNg.HealthCheck.Quorum
+		if hc.Quorum <= 0 {
+			hc.Quorum = len(hc.Probes)/2 + 1
+		}
+	default:
+		return hc, fmt.Errorf("invalid health check mode %q on group %s", cfgNg.HealthCheck.Mode, cfgNg.Name)
+	}
+	return hc, nil
+}
+
+// newNodeGroup returns the router.NodeGroup, without nodes, described by the
+// cfg.NodeGroup. An error is returned if the group is invalid.
+func newNodeGroup(cfgNg cfg.NodeGroup) (*router.NodeGroup, error) {
+	var balancer router.Balancer
+
+	switch cfgNg.Algorithm {
+	case "rr":
+		balancer = algo.NewRR()
+	case "wrr":
+		balancer = algo.NewWRR()
+	case "lc":
+		balancer = algo.NewLC()
+	case "ch":
+		var err error
+		balancer, err = chBalancer(cfgNg)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if cfgNg.Files == nil {
+			return nil, fmt.Errorf("invalid load balancing algorithm %s on group %s", cfgNg.Algorithm, cfgNg.Name)
+		}
+		// groups serving files have no nodes to balance.
+		balancer = algo.NewRR()
+	}
+
+	// each node of the group, even a static one, is health checked on the
+	// interval.
+	if cfgNg.Files == nil && cfgNg.HealthCheck.Interval <= 0 {
+		return nil, fmt.Errorf("invalid health check interval %d on group %s", cfgNg.HealthCheck.Interval, cfgNg.Name)
+	}
+
+	encoding, ok := router.ParseEncoding(cfgNg.Encoding)
+	if !ok {
+		return nil, fmt.Errorf("invalid encoding %s on group %s", cfgNg.Encoding, cfgNg.Name)
+	}
+	etag, ok := router.ParseETagMode(cfgNg.ETag)
+	if !ok {
+		return nil, fmt.Errorf("invalid etag %s on group %s", cfgNg.ETag, cfgNg.Name)
+	}
+	affinityDrain, ok := router.ParseAffinityDrain(cfgNg.AffinityDrain)
+	if !ok {
+		return nil, fmt.Errorf("invalid affinity drain %s on group %s", cfgNg.AffinityDrain, cfgNg.Name)
+	}
+	allDown := router.AllDownBadGateway
+	if ad := cfgNg.AllDown; ad != nil {
+		if allDown, ok = router.ParseAllDownPolicy(ad.Policy); !ok {
+			return nil, fmt.Errorf("invalid all down policy %s on group %s", ad.Policy, cfgNg.Name)
+		}
+	}
+	signing, err := requestSigning(cfgNg.Signing)
+	if err != nil {
+		return nil, fmt.Errorf("%s on group %s", err, cfgNg.Name)
+	}
+	healthCheck, err := healthCheckConfig(cfgNg)
+	if err != nil {
+		return nil, err
+	}
+	if cfgNg.LocalAddr != "" && net.ParseIP(cfgNg.LocalAddr) == nil {
+		return nil, fmt.Errorf("invalid local address %s on group %s", cfgNg.LocalAddr, cfgNg.Name)
+	}
+	if cfgNg.Proxy != "" {
+		if _, err := router.ParseProxy(cfgNg.Proxy); err != nil {
+			return nil, fmt.Errorf("%s on group %s", err, cfgNg.Name)
+		}
+	}
+
+	rNg := &router.NodeGroup{
+		Name:          cfgNg.Name,
+		HTTPS:         cfgNg.HTTPS,
+		Balancer:      balancer,
+		HealthCheck:   healthCheck,
+		WarmUpConns:   cfgNg.WarmUpConns,
+		LocalAddr:     cfgNg.LocalAddr,
+		FallbackDelay: cfgNg.FallbackDelay,
+		HeaderTimeout: cfgNg.HeaderTimeout,
+
+		TLSSessionCache: cfgNg.TLSSessionCache,
+		MaxConnAge:      cfgNg.MaxConnAge,
+		MaxConnRequests: cfgNg.MaxConnRequests,
+		ZeroCopy:        cfgNg.ZeroCopy,
+
+		Proxy:         cfgNg.Proxy,
+		Encoding:      encoding,
+		DisableRanges: cfgNg.DisableRanges,
+		ConnAffinity:  cfgNg.ConnAffinity,
+		Standby:       cfgNg.Standby,
+		Failover:      cfgNg.Failover,
+
+		MaxUploadRate:   cfgNg.MaxUploadRate,
+		MaxDownloadRate: cfgNg.MaxDownloadRate,
+		DetectProtocol:  cfgNg.DetectProtocol,
+		ETag:            etag,
+		Signing:         signing,
+		TraceAttempts:   cfgNg.TraceAttempts,
+
+		AffinityDrain:    affinityDrain,
+		AffinityDrainTTL: cfgNg.AffinityDrainTTL,
+		AllDown:          allDown,
+	}
+	if ad := cfgNg.AllDown; ad != nil {
+		rNg.AllDownRetryAfter = ad.RetryAfter
+		rNg.AllDownGroup = ad.Group
+	}
+	if cfgNg.Files != nil {
+		rNg.Files = &router.FileServerConfig{
+			Root:   cfgNg.Files.Root,
+			Index:  cfgNg.Files.Index,
+			MaxAge: cfgNg.Files.MaxAge,
+		}
+	}
+	return rNg, nil
+}
+
+// addNodes adds the nodes of the cfg.NodeGroup to the group. An error is returned
+// if a node is invalid or duplicated.
+func addNodes(rNg *router.NodeGroup, cfgNg cfg.NodeGroup) error {
+	for _, n := range cfgNg.Nodes {
+		rn, err := newNode(n)
+		if err != nil {
+			return err
+		}
+		if err := rNg.AddNode(rn); err != nil {
+			return fmt.Errorf("node %s on group %s: %w", rn.NodeKey, cfgNg.Name, err)
+		}
+	}
+	return nil
+}
+
+// routerControl takes a slice of cfg.NodeGroup, then create the router and add
+// the nodes of each group. The node health changes are notified to onHealth, if
+// not nil. An error is returned if a group or node is invalid or duplicated.
+func routerControl(cfgNgs []cfg.NodeGroup, onHealth func(router.HealthEvent)) (*router.Router, error) {
+	rNgs := make([]*router.NodeGroup, 0, len(cfgNgs))
+	for _, cfgNg := range cfgNgs {
+		rNg, err := newNodeGroup(cfgNg)
+		if err != nil {
+			return nil, err
+		}
 		rNgs = append(rNgs, rNg)
 	}
 
-	r := router.New(rNgs)
-	m.Chain(r.Handler)
+	r, err := router.New(rNgs)
+	if err != nil {
+		return nil, err
+	}
+	r.OnHealthChange = onHealth
+
+	// the nodes are added only after the router is created, so no health
+	// checker is started for an invalid configuration.
+	for i, cfgNg := range cfgNgs {
+		if err := addNodes(rNgs[i], cfgNg); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
 }
 
-// Start the statera load balancer.
-func Start(c *cfg.Config) {
-	m := NewMux()
-	evaluatorControl(m, c.Rules)
-	routerControl(m, c.NodeGroups)
+// xdsControl takes the xDS configuration and the router, then starts the xDS client
+// that keeps the node groups in sync with the management server. If there is no
+// xDS configuration, nothing is done.
+func xdsControl(cfgXDS *cfg.XDS, r *router.Router) {
+	if cfgXDS == nil || cfgXDS.Server == "" {
+		return
+	}
+	c := &xds.Client{
+		Server:   cfgXDS.Server,
+		NodeID:   cfgXDS.NodeID,
+		Cluster:  cfgXDS.Cluster,
+		Interval: cfgXDS.Interval,
+		Router:   r,
+	}
+	go c.Run(context.Background())
+}
+
+// udpControl takes the UDP configuration and returns the udprouter.Router of the
+// UDP groups, or nil if there is no UDP configuration. It panics if the
+// configuration is invalid.
+func udpControl(cfgUDP *cfg.UDP) *udprouter.Router {
+	if cfgUDP == nil {
+		return nil
+	}
+	groups := make([]*udprouter.Group, 0, len(cfgUDP.Groups))
+	for _, g := range cfgUDP.Groups {
+		ug := &udprouter.Group{Name: g.Name}
+		for _, n := range g.Nodes {
+			if n.Host == "" || n.Port <= 0 || n.Port > 65535 {
+				panic(fmt.Sprintf("invalid node %s:%d on udp group %s", n.Host, n.Port, g.Name))
+			}
+			ug.Nodes = append(ug.Nodes, &udprouter.Node{Host: n.Host, Port: n.Port})
+		}
+		if hc := g.HealthCheck; hc != nil {
+			t, ok := udprouter.ParseProbeType(hc.Type)
+			if !ok {
+				panic(fmt.Sprintf("invalid health check type %q on udp group %s", hc.Type, g.Name))
+			}
+			ug.HealthCheck = &udprouter.HealthCheck{
+				Type:     t,
+				Interval: hc.Interval,
+				Timeout:  hc.Timeout,
+				Payload:  []byte(hc.Payload),
+				Expect:   []byte(hc.Expect),
+			}
+		}
+		groups = append(groups, ug)
+	}
+	ur, err := udprouter.New(groups)
+	if err != nil {
+		panic(err)
+	}
+	return ur
+}
+
+// udpListeners takes the UDP configuration and returns the UDP listeners of the
+// groups of ur. It panics if a listener references an unknown group.
+func udpListeners(cfgUDP *cfg.UDP, ur *udprouter.Router) []listener {
+	if cfgUDP == nil {
+		return nil
+	}
+	lnrs := make([]listener, 0, len(cfgUDP.Listeners))
+	for _, l := range cfgUDP.Listeners {
+		g, ok := ur.Group(l.NodeGroup)
+		if !ok {
+			panic(fmt.Sprintf("invalid udp listener %s: there is no udp group %s", l.Addr, l.NodeGroup))
+		}
+		lnrs = append(lnrs, &udprouter.Listener{
+			Addr:           l.Addr,
+			Group:          g,
+			SessionTimeout: l.SessionTimeout,
+			MaxSessions:    l.MaxSessions,
+		})
+	}
+	return lnrs
+}
+
+// healthHook returns the func notified of the node health changes, that notifies
+// the webhooks and the health store. It returns nil if both are nil.
+func healthHook(wh *webhook.Notifier, hs *healthStore) func(router.HealthEvent) {
+	if wh == nil && hs == nil {
+		return nil
+	}
+	return func(e router.HealthEvent) {
+		if wh != nil {
+			t := webhook.NodeUnhealthy
+			if e.Healthy {
+				t = webhook.NodeHealthy
+			}
+			wh.Notify(webhook.Event{Type: t, Group: e.Group, Node: e.Node.String()})
+		}
+		if hs != nil {
+			hs.notify()
+		}
+	}
+}
+
+// healthStateControl restores the node health saved on the health state file, if
+// one, and starts saving it.
+func healthStateControl(hs *healthStore, r *router.Router) {
+	if hs == nil {
+		return
+	}
+	hs.restore(r)
+	go hs.run(r, healthStateInterval*time.Second)
+}
+
+// healthStateInterval is the interval in seconds between each save of the health
+// state file, besides the saves on each health change.
+const healthStateInterval = 10
+
+// webhookControl takes the webhooks configuration and starts the notifier of the
+// events. If there is no webhook, nil is returned.
+func webhookControl(cfgHooks []cfg.Webhook) *webhook.Notifier {
+	if len(cfgHooks) == 0 {
+		return nil
+	}
+	hooks := make([]*webhook.Hook, 0, len(cfgHooks))
+	for _, ch := range cfgHooks {
+		h := &webhook.Hook{
+			URL:     ch.URL,
+			Headers: ch.Headers,
+			Events:  ch.Events,
+			Retries: ch.Retries,
+		}
+		if ch.Template != "" {
+			h.Template = template.Must(template.New(ch.URL).Parse(ch.Template))
+		}
+		hooks = append(hooks, h)
+	}
+	n := webhook.NewNotifier(hooks, 0)
+	go n.Run(context.Background())
+	return n
+}
+
+// srvControl starts the discovery of the nodes of the node groups with SRV
+// records.
+func srvControl(cfgNgs []cfg.NodeGroup, r *router.Router) {
+	for _, cfgNg := range cfgNgs {
+		if cfgNg.SRV == nil || cfgNg.SRV.Name == "" {
+			continue
+		}
+		ng, _ := r.NodeGroup(cfgNg.Name)
+		c := &srv.Client{
+			Name:     cfgNg.SRV.Name,
+			Interval: cfgNg.SRV.Interval,
+			Group:    ng,
+		}
+		go c.Run(context.Background())
+	}
+}
+
+// adminControl takes the admin configuration and start the admin listener with
+// the operational endpoints. If there is no admin configuration, nil is returned.
+func adminControl(cfgAdm *cfg.Admin, lc *lifecycle, lf *logFiles, cp *controlPlane, rl *reloader) *admin.Server {
+	if cfgAdm == nil || cfgAdm.Addr == "" {
+		return nil
+	}
+	a := admin.New(cfgAdm.Addr)
+	if cfgAdm.TLS != nil {
+		a.TLS = &admin.TLS{
+			CertFile:     cfgAdm.TLS.CertFile,
+			KeyFile:      cfgAdm.TLS.KeyFile,
+			ClientCAFile: cfgAdm.TLS.ClientCAFile,
+		}
+	}
+	for _, t := range cfgAdm.Tokens {
+		role, ok := admin.ParseRole(t.Role)
+		if !ok || t.Token == "" {
+			panic(fmt.Sprintf("invalid admin token %q", t.Name))
+		}
+		a.Tokens = append(a.Tokens, admin.Token{Name: t.Name, Token: t.Token, Role: role})
+	}
+	if len(cfgAdm.Identities) > 0 {
+		a.ClientIdentities = make(map[string]admin.Role)
+		for _, id := range cfgAdm.Identities {
+			role, ok := admin.ParseRole(id.Role)
+			if !ok {
+				panic(fmt.Sprintf("invalid role of admin identity %q", id.CommonName))
+			}
+			a.ClientIdentities[id.CommonName] = role
+		}
+	}
+
+	a.HandleFunc("/readyz", admin.Public, lc.readyzHandler)
+	a.HandleFunc("/shutdown", admin.Manage, lc.shutdownStatusHandler)
+	a.HandleFunc("/logs/reopen", admin.Manage, lf.reopenHandler)
+	a.HandleFunc("/reload", admin.Manage, rl.reloadHandler)
+	a.HandleFunc("/rules", admin.Manage, cp.rulesHandler)
+	a.HandleFunc("/rules/enable", admin.Manage, cp.enableRuleHandler)
+	a.HandleFunc("/nodes", admin.Operate, cp.nodesHandler)
+	a.HandleFunc("/stream", admin.Manage, cp.streamHandler)
+	a.HandleFunc("/stats", admin.Manage, statsHandler(cp.r))
+	a.HandleFunc("/metrics", admin.Manage, cp.metricsHandler)
+	a.HandleFunc("/conditions", admin.Manage, cp.conditionsHandler)
+	a.HandleFunc("/balancer", admin.Manage, balancerHandler(cp.r))
+	a.HandleFunc("/nodes/drain", admin.Operate, cp.drainHandler)
+	a.HandleFunc("/groups/activate", admin.Operate, cp.activateHandler)
+	a.HandleFunc("/cache/purge", admin.Operate, cp.purgeHandler)
+	a.HandleFunc("/udp", admin.Manage, cp.udpHandler)
+	a.HandleFunc("/ha", admin.Manage, cp.haHandler)
+	a.HandleFunc("/slos", admin.Manage, cp.sloHandler)
+	rg := newRegistry(cfgAdm.Registration, cp)
+	// the reloads keep the registered nodes.
+	rl.mu.Lock()
+	rl.registry = rg
+	rl.mu.Unlock()
+	a.HandleFunc("/nodes/register", admin.Operate, rg.handler)
+	go rg.run()
+	a.Handle("/ui/", admin.Public, http.StripPrefix("/ui", admin.UIHandler()))
+	go func() {
+		if err := a.ListenAndServe(); err != nil {
+			panic(err)
+		}
+	}()
+	return a
+}
+
+// extdataControl starts the periodic refresh of the external data files loaded
+// by the components, as defined by the configuration c, wich may be nil.
+func extdataControl(c *cfg.ExternalData) {
+	var interval time.Duration
+	if c != nil {
+		if c.RefreshInterval < 0 {
+			panic("invalid external data refresh interval")
+		}
+		interval = time.Duration(c.RefreshInterval) * time.Second
+	}
+	go extdata.Run(interval)
+}
+
+// randomControl seeds the random decisions with the configured seed. If the seed
+// is zero, the decisions are not reproducible.
+func randomControl(seed int64) {
+	if seed == 0 {
+		return
+	}
+	random.Seed(seed)
+	log.Println("random decisions seeded with", seed)
+}
+
+// reloadControl returns the reloader of the configuration c, and reloads it on
+// each SIGHUP if it can be loaded again by load, wich may be nil.
+func reloadControl(c *cfg.Config, load func() (*cfg.Config, error), cp *controlPlane, lf *logFiles) *reloader {
+	rl := &reloader{load: load, cp: cp, sampler: lf.sampler, cur: c}
+	if load != nil {
+		go rl.run()
+	}
+	return rl
+}
+
+// Start the statera load balancer. It blocks until the load balancer is shut
+// down. The configuration is reloaded from load, if not nil, on each SIGHUP and
+// on the admin reload endpoint.
+//
+// An error is returned if the configuration is invalid. Start is moving from
+// panics to errors: the parts of the configuration that are not yet validated
+// this way still panic.
+func Start(c *cfg.Config, load func() (*cfg.Config, error)) error {
+	lf := logControl(c.Log)
+	randomControl(c.RandomSeed)
+	es := errorControl()
+	evs := evaluatorControl(c.Listeners, c.AllRules(), c.SlowConditionThreshold, c.Log.Debug, es.bus)
+	extdataControl(c.ExternalData)
+	qm := quotaControl(c.Quotas, c.QuotaFile, c.QuotaMaxCounters, c.AllRules())
+	wh := webhookControl(c.Webhooks)
+	hs := newHealthStore(c.HealthState)
+	r, err := routerControl(c.NodeGroups, healthHook(wh, hs))
+	if err != nil {
+		return err
+	}
+	r.Errors = es.bus
+	traceSamplingControl(lf.sampler, r)
+	exemplarsControl(c.Exemplars, r)
+	healthStateControl(hs, r)
+	sheddingControl(c.LoadShedding, r)
+	xdsControl(c.XDS, r)
+	cc := cacheControl(c.NodeGroups, c.CacheMaxEntries, r)
+	ig := idempotencyControl(c.NodeGroups, c.IdempotencyMaxEntries)
+	sm := sloControl(c.NodeGroups, r, wh)
+	srvControl(c.NodeGroups, r)
+	ur := udpControl(c.UDP)
+
+	lc := newLifecycle(r)
+	ts := tenant.NewStats()
+	ts.MaxTenants = c.MaxTenants
+	rc := &recovery{}
+	ls := &listenerSet{build: func() []listener {
+		return append(listenerControl(c.Listeners, rc, lf, ts, evs, qm, ig, cc, r, es.bus), udpListeners(c.UDP, ur)...)
+	}}
+	// the listeners are built once before the election, so an invalid
+	// configuration panics on the start even on the backup.
+	ls.build()
+	e := haControl(c.HA, ls, c.Shutdown)
+	cp := &controlPlane{evs: evs, r: r, cache: cc, idempotency: ig, quota: qm, tenants: ts, udp: ur, errors: es, audit: lf.auditLog(), ha: e, recovery: rc, slo: sm}
+	rl := reloadControl(c, load, cp, lf)
+	a := adminControl(c.Admin, lc, lf, cp, rl)
+	haCtx, haCancel := context.WithCancel(context.Background())
+	haDone := make(chan struct{})
+	if e != nil {
+		go func() {
+			defer close(haDone)
+			if err := e.Run(haCtx); err != nil {
+				panic(err)
+			}
+		}()
+	} else {
+		close(haDone)
+	}
+
+	// shutdownControl blocks until server shutdown...
+	shutdownControl(c.Shutdown, lc, ls, a)
+	// with the listeners closed, the master resigns so the peer takes over
+	// right away.
+	haCancel()
+	<-haDone
+	if ur != nil {
+		ur.Stop()
+	}
+	if qm != nil {
+		if err := qm.Save(); err != nil {
+			log.Println("failed to save the quota counters:", err)
+		}
+	}
 
-	// listenerControl blocks until server shutdown...
-	listenerControl(m, c.Listeners)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lf.close(ctx)
+	return nil
 }
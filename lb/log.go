@@ -0,0 +1,233 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/audit"
+	"github.com/mhef/statera/lb/logger"
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/sampling"
+)
+
+var errInvalidLogSink = errors.New("lb/log: log sink must have exactly one of syslog or http")
+
+// Syslog severities of the shipped logs.
+const (
+	syslogSeverityError = 3
+	syslogSeverityInfo  = 6
+)
+
+// defaultSyslogFacility is the local0 syslog facility.
+const defaultSyslogFacility = 16
+
+// logFiles hold the log files opened by the load balancer.
+type logFiles struct {
+	access *logger.File
+	error  *logger.File
+	audit  *logger.File
+
+	// shippers hold the shippers of the logs with a remote sink.
+	shippers []*logger.Shipper
+
+	// accessLog is the access log handler chained on each listener, or nil if
+	// the access log is disabled.
+	accessLog func(http.Handler) http.Handler
+
+	// sampler decides wich requests are logged and traced. It may be nil.
+	sampler *sampling.Sampler
+}
+
+// close ships the remaining lines of the shipped logs, waiting until the context
+// is done.
+func (lf *logFiles) close(ctx context.Context) {
+	for _, s := range lf.shippers {
+		if err := s.Close(ctx); err != nil {
+			log.Println("failed to ship the remaining log lines:", err)
+		}
+	}
+}
+
+// newShipper takes a cfg.LogSink and returns the shipper described by it. severity
+// define the syslog severity of the lines.
+func newShipper(cfgSink *cfg.LogSink, severity int) (*logger.Shipper, error) {
+	var sink logger.Sink
+	batchSize := cfgSink.BatchSize
+	switch {
+	case cfgSink.Syslog != nil && cfgSink.HTTP == nil:
+		sl := cfgSink.Syslog
+		if sl.Network != "udp" && sl.Network != "tcp" && sl.Network != "tls" {
+			return nil, errInvalidLogSink
+		}
+		facility := sl.Facility
+		if facility == 0 {
+			facility = defaultSyslogFacility
+		}
+		tag := sl.Tag
+		if tag == "" {
+			tag = "statera"
+		}
+		sink = &logger.SyslogSink{
+			Network:  sl.Network,
+			Addr:     sl.Addr,
+			Tag:      tag,
+			Priority: facility*8 + severity,
+		}
+	case cfgSink.HTTP != nil && cfgSink.Syslog == nil:
+		sink = &logger.HTTPSink{
+			URL:     cfgSink.HTTP.URL,
+			Headers: cfgSink.HTTP.Headers,
+			Retries: cfgSink.HTTP.Retries,
+		}
+		if batchSize == 0 {
+			batchSize = 100
+		}
+	default:
+		return nil, errInvalidLogSink
+	}
+	flushInterval := time.Duration(cfgSink.FlushInterval) * time.Millisecond
+	return logger.NewShipper(sink, cfgSink.BufferSize, batchSize, flushInterval), nil
+}
+
+// auditLog returns the audit log writing on the audit log file, or nil if the
+// audit log is disabled.
+func (lf *logFiles) auditLog() *audit.Log {
+	if lf.audit == nil {
+		return nil
+	}
+	return audit.New(lf.audit)
+}
+
+// reopen closes and reopens all the log files.
+func (lf *logFiles) reopen() error {
+	for _, f := range []*logger.File{lf.access, lf.error, lf.audit} {
+		if f == nil {
+			continue
+		}
+		if err := f.Reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reopenHandler reopens the log files when a POST request is received.
+func (lf *logFiles) reopenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := lf.reopen(); err != nil {
+		log.Println("failed to reopen log files:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// logControl takes the log configuration, then opens the log files, starts the
+// shippers of the logs with a remote sink and creates the access log handler.
+//
+// The log files are reopened when the SIGUSR1 signal is received.
+func logControl(cfgLog cfg.Log) *logFiles {
+	lf := &logFiles{}
+	var errorW io.Writer = os.Stderr
+	if cfgLog.ErrorLog != "" {
+		f, err := logger.OpenFile(cfgLog.ErrorLog)
+		if err != nil {
+			panic(err)
+		}
+		errorW = f
+		lf.error = f
+	}
+	if cfgLog.ErrorSink != nil {
+		s, err := newShipper(cfgLog.ErrorSink, syslogSeverityError)
+		if err != nil {
+			panic(err)
+		}
+		errorW = io.MultiWriter(errorW, s)
+		lf.shippers = append(lf.shippers, s)
+	}
+	log.SetOutput(errorW)
+
+	var accessW []io.Writer
+	if cfgLog.AccessLog != "" {
+		f, err := logger.OpenFile(cfgLog.AccessLog)
+		if err != nil {
+			panic(err)
+		}
+		accessW = append(accessW, f)
+		lf.access = f
+	}
+	if cfgLog.AccessSink != nil {
+		s, err := newShipper(cfgLog.AccessSink, syslogSeverityInfo)
+		if err != nil {
+			panic(err)
+		}
+		accessW = append(accessW, s)
+		lf.shippers = append(lf.shippers, s)
+	}
+	if sp := cfgLog.Sampling; sp != nil {
+		if sp.SuccessPercent < 0 || sp.SuccessPercent > 100 {
+			panic("invalid log sampling: success_percent must be from 0 to 100")
+		}
+		lf.sampler = &sampling.Sampler{SuccessPercent: sp.SuccessPercent, Tags: make(map[string]bool)}
+		for _, t := range sp.Tags {
+			lf.sampler.Tags[t] = true
+		}
+	}
+	if len(accessW) > 0 {
+		lf.accessLog = logger.AccessLog(io.MultiWriter(accessW...), lf.sampler)
+	}
+	if cfgLog.AuditLog != "" {
+		f, err := logger.OpenFile(cfgLog.AuditLog)
+		if err != nil {
+			panic(err)
+		}
+		lf.audit = f
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGUSR1)
+		for range sig {
+			if err := lf.reopen(); err != nil {
+				log.Println("failed to reopen log files:", err)
+				continue
+			}
+			log.Println("log files reopened")
+		}
+	}()
+	return lf
+}
+
+// exemplarsControl makes the router record the exemplars of the latencies, if
+// the configuration c is not nil.
+func exemplarsControl(c *cfg.Exemplars, r *router.Router) {
+	if c == nil {
+		return
+	}
+	r.TraceHeader = c.TraceHeader
+	if r.TraceHeader == "" {
+		r.TraceHeader = router.TraceParentHeader
+	}
+}
+
+// traceSamplingControl makes the attempt traces of the node groups sampled as the
+// access log, if there is a sampler.
+func traceSamplingControl(s *sampling.Sampler, r *router.Router) {
+	if s == nil {
+		return
+	}
+	for _, ng := range r.NodeGroups() {
+		ng.TraceSampler = s
+	}
+}
@@ -0,0 +1,178 @@
+// Package logger implements the access and error logging of statera. The log
+// files can be reopened at runtime, allowing the usual logrotate workflow of
+// moving the file and then asking the application to reopen it. The logs can
+// also be shipped to a remote syslog server or HTTP endpoint.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/sampling"
+	"github.com/mhef/statera/lb/server"
+	"github.com/mhef/statera/lb/tenant"
+)
+
+// File is a log file that can be safely reopened while other goroutines are
+// writing on it.
+type File struct {
+	path string
+	f    *os.File
+	mu   sync.Mutex // guards f
+}
+
+// OpenFile opens, or creates if it doesn't exist, the log file on path in
+// append mode.
+func OpenFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		path: path,
+		f:    f,
+	}, nil
+}
+
+// Write writes p to the log file.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Write(p)
+}
+
+// Reopen closes the log file and opens it again on the same path. Writes that
+// happen during the reopening wait for it to finish, so no line is lost.
+//
+// If the file can't be opened again, the old file is kept.
+func (lf *File) Reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	lf.f.Close()
+	lf.f = f
+	return nil
+}
+
+// Close closes the log file.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Close()
+}
+
+// responseRecorder wraps a http.ResponseWriter to record the status code and the
+// number of bytes written to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if rr.status == 0 {
+		rr.status = statusCode
+	}
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom implements the io.ReaderFrom interface, so the files are still sent
+// with sendfile(2) when the wrapped ResponseWriter supports it.
+func (rr *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := io.Copy(rr.ResponseWriter, src)
+	rr.bytes += n
+	return n, err
+}
+
+// Flush implements the http.Flusher interface, if the wrapped ResponseWriter
+// supports it.
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// AccessLog returns a handler that writes a line to w for each request that
+// passes through the chain, after the rest of the chain has handled it.
+//
+// The line has the format:
+//
+//	remote_addr [time] listener "method uri proto" status bytes duration_ms tenant attempts rule upstream
+//
+// The tenant is "-" if the request has no tenant. The rule is the ID of the
+// matched rule, or "-" if no rule matched. The upstream is the node group and
+// the node that served the request, or "-" if no node was selected. The attempts are the quoted
+// router.AttemptsHeader of the response, or "-" if the node group doesn't trace
+// them.
+//
+// If s is not nil, only the requests sampled by it are logged.
+func AccessLog(w io.Writer, s *sampling.Sampler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &responseRecorder{ResponseWriter: rw}
+			r = router.TrackUpstream(evaluator.TrackRule(tenant.Track(r)))
+			next.ServeHTTP(rec, r)
+			if !s.Sample(rec.status, evaluator.MatchedTags(r)) {
+				return
+			}
+
+			t := tenant.FromRequest(r)
+			if t == "" {
+				t = "-"
+			}
+			attempts := "-"
+			if a := rw.Header().Get(router.AttemptsHeader); a != "" {
+				attempts = strconv.Quote(a)
+			}
+			rule := evaluator.MatchedRule(r)
+			if rule == "" {
+				rule = "-"
+			}
+			upstream := "-"
+			if u, ok := router.UpstreamFromRequest(r); ok {
+				upstream = u.String()
+			}
+
+			lnr, _ := server.ListenerFromRequest(r)
+			fmt.Fprintf(w, "%s [%s] %s \"%s %s %s\" %d %d %d %s %s %s %s\n",
+				r.RemoteAddr,
+				start.Format(time.RFC3339),
+				lnr,
+				r.Method,
+				r.RequestURI,
+				r.Proto,
+				rec.status,
+				rec.bytes,
+				time.Since(start).Milliseconds(),
+				t,
+				attempts,
+				rule,
+				upstream,
+			)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,304 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultBufferSize is the number of lines held by a Shipper when BufferSize is
+// not set.
+const defaultBufferSize = 10000
+
+// Sink is a remote endpoint where log lines are shipped to.
+type Sink interface {
+	// Send ships the batch of lines. Each line is sent without the trailing
+	// newline.
+	Send(lines [][]byte) error
+
+	// Close releases the resources of the sink.
+	Close() error
+}
+
+// Shipper is a log writer that ships each written line to a Sink. The lines are
+// held on a buffer and sent by a background goroutine, so writers are never
+// blocked by a slow or unavailable sink. When the buffer is full, new lines are
+// dropped and counted.
+type Shipper struct {
+	sink Sink
+
+	// batchSize define the maximum number of lines sent on each batch.
+	batchSize int
+
+	// flushInterval define the maximum time a line waits for the batch to be
+	// filled before it's sent.
+	flushInterval time.Duration
+
+	lines   chan []byte
+	dropped int64
+	done    chan struct{}
+
+	closed   bool
+	closedMu sync.RWMutex // guards closed and the closing of lines
+}
+
+// NewShipper returns a Shipper that sends the lines to sink on batches of up to
+// batchSize lines, waiting up to flushInterval for a batch to be filled. Up to
+// bufferSize lines are held while the sink is busy.
+func NewShipper(sink Sink, bufferSize, batchSize int, flushInterval time.Duration) *Shipper {
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	s := &Shipper{
+		sink:          sink,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		lines:         make(chan []byte, bufferSize),
+		done:          make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write enqueues p, as one log line, to be shipped. It never blocks: if the
+// buffer is full, or the Shipper is closed, the line is dropped.
+func (s *Shipper) Write(p []byte) (int, error) {
+	line := bytes.TrimRight(p, "\n")
+	cp := make([]byte, len(line))
+	copy(cp, line)
+
+	s.closedMu.RLock()
+	defer s.closedMu.RUnlock()
+	if s.closed {
+		atomic.AddInt64(&s.dropped, 1)
+		return len(p), nil
+	}
+	select {
+	case s.lines <- cp:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of lines dropped because the buffer was full.
+func (s *Shipper) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// run sends the buffered lines to the sink until the Shipper is closed.
+func (s *Shipper) run() {
+	defer close(s.done)
+	t := time.NewTicker(s.flushInterval)
+	defer t.Stop()
+
+	batch := make([][]byte, 0, s.batchSize)
+	var reported int64
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.sink.Send(batch); err != nil {
+			// the error log may be shipped by this same Shipper, so the
+			// failure is reported on the standard error.
+			fmt.Fprintf(os.Stderr, "lb/logger: failed to ship %d log lines: %v\n", len(batch), err)
+		}
+		batch = batch[:0]
+		if d := s.Dropped(); d != reported {
+			fmt.Fprintf(os.Stderr, "lb/logger: %d log lines dropped, the sink is too slow\n", d-reported)
+			reported = d
+		}
+	}
+
+	for {
+		select {
+		case l, ok := <-s.lines:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, l)
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+// Close ships the buffered lines and closes the sink. It waits for the lines to
+// be shipped until the context is done. Lines written after Close are dropped.
+func (s *Shipper) Close(ctx context.Context) error {
+	s.closedMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.lines)
+	}
+	s.closedMu.Unlock()
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.sink.Close()
+}
+
+// SyslogSink sends each line as a RFC 5424 syslog message over UDP, TCP or TLS.
+// Over TCP and TLS, the messages are framed with octet counting (RFC 6587).
+type SyslogSink struct {
+	// Network define the transport: "udp", "tcp" or "tls".
+	Network string
+
+	// Addr define the address of the syslog server, in the form "host:port".
+	Addr string
+
+	// Tag define the APP-NAME of the messages.
+	Tag string
+
+	// Priority define the PRI of the messages, the facility multiplied by 8
+	// plus the severity.
+	Priority int
+
+	hostname string
+	conn     net.Conn
+}
+
+// dial connects to the syslog server, if not connected yet.
+func (s *SyslogSink) dial() error {
+	if s.conn != nil {
+		return nil
+	}
+	if s.hostname == "" {
+		s.hostname, _ = os.Hostname()
+		if s.hostname == "" {
+			s.hostname = "-"
+		}
+	}
+	var err error
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	if s.Network == "tls" {
+		s.conn, err = tls.DialWithDialer(d, "tcp", s.Addr, nil)
+	} else {
+		s.conn, err = d.Dial(s.Network, s.Addr)
+	}
+	return err
+}
+
+// Send implements the Sink interface. On a write error, the connection is closed
+// and dialed again on the next batch.
+func (s *SyslogSink) Send(lines [][]byte) error {
+	if err := s.dial(); err != nil {
+		return err
+	}
+	pid := os.Getpid()
+	for _, l := range lines {
+		msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+			s.Priority,
+			time.Now().Format(time.RFC3339Nano),
+			s.hostname,
+			s.Tag,
+			pid,
+			l,
+		)
+		if s.Network != "udp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := s.conn.Write([]byte(msg)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements the Sink interface.
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// HTTPSink sends each batch of lines on the body of a POST request, one line per
+// row of the body. Failed batches are retried with exponential backoff.
+type HTTPSink struct {
+	// URL define the endpoint that receives the batches.
+	URL string
+
+	// Headers are added to each request, e.g. to authenticate on the sink.
+	Headers map[string]string
+
+	// Retries define how many times a failed batch is retried before being
+	// dropped.
+	Retries int
+
+	// Client is the client used to send the batches. If nil, a client with a
+	// 10 seconds timeout is used.
+	Client *http.Client
+}
+
+// defaultSinkClient is the client used by a HTTPSink without Client.
+var defaultSinkClient = &http.Client{Timeout: 10 * time.Second}
+
+// Send implements the Sink interface.
+func (s *HTTPSink) Send(lines [][]byte) error {
+	body := append(bytes.Join(lines, []byte("\n")), '\n')
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = s.post(body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// post does one attempt of sending the body to the sink.
+func (s *HTTPSink) post(body []byte) error {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	c := s.Client
+	if c == nil {
+		c = defaultSinkClient
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("lb/logger: http sink answered %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Close implements the Sink interface.
+func (s *HTTPSink) Close() error {
+	return nil
+}
@@ -0,0 +1,348 @@
+// Package metrics implements the metric types used by statera components to
+// measure themselves, and the writer used to expose them on the Prometheus text
+// format or on the OpenMetrics format, with the exemplars of the histograms.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OpenMetricsContentType is the content type of the OpenMetrics format, the only
+// one where the exemplars are written.
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// maxExemplarTraceID is the maximum length of the trace ID of an exemplar. The
+// OpenMetrics format limits the labels of an exemplar to 128 characters.
+const maxExemplarTraceID = 100
+
+// Counter is a metric that only increases. It is safe for concurrent use.
+type Counter struct {
+	v int64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// DefaultBuckets are the upper bounds, in seconds, of the histogram buckets used
+// to measure latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is a metric that counts observations on buckets of configurable
+// upper bounds. It is safe for concurrent use.
+type Histogram struct {
+	bounds []float64
+
+	// counts hold the number of observations of each bucket, not cumulative.
+	// The last position is the +Inf bucket.
+	counts []int64
+
+	count int64
+
+	// sum hold the float64 bits of the sum of the observations.
+	sum uint64
+
+	// exemplars hold the last Exemplar of each bucket, if any.
+	exemplars []atomic.Value
+}
+
+// Exemplar is an observation of a histogram with the ID of the trace of the
+// request observed, linking the metrics to example traces.
+type Exemplar struct {
+	TraceID string
+	Value   float64
+	Time    time.Time
+}
+
+// NewHistogram returns a Histogram with the provided bucket upper bounds, that
+// must be sorted on increasing order.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds:    bounds,
+		counts:    make([]int64, len(bounds)+1),
+		exemplars: make([]atomic.Value, len(bounds)+1),
+	}
+}
+
+// Observe adds an observation on the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.observe(sort.SearchFloat64s(h.bounds, v), v)
+}
+
+// ObserveWithExemplar adds an observation on the histogram, keeping it as the
+// exemplar of it's bucket with the traceID. If traceID is blank or too long, it
+// is the same as Observe.
+func (h *Histogram) ObserveWithExemplar(v float64, traceID string) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	if traceID != "" && len(traceID) <= maxExemplarTraceID {
+		h.exemplars[i].Store(Exemplar{TraceID: traceID, Value: v, Time: time.Now()})
+	}
+	h.observe(i, v)
+}
+
+// observe adds the observation v on the bucket i.
+func (h *Histogram) observe(i int, v float64) {
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		nv := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, nv) {
+			return
+		}
+	}
+}
+
+// Snapshot returns the current state of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]int64, len(h.counts)),
+		Count:  atomic.LoadInt64(&h.count),
+		Sum:    math.Float64frombits(atomic.LoadUint64(&h.sum)),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	for i := range h.exemplars {
+		if e, ok := h.exemplars[i].Load().(Exemplar); ok {
+			if s.Exemplars == nil {
+				s.Exemplars = make([]*Exemplar, len(h.counts))
+			}
+			s.Exemplars[i] = &e
+		}
+	}
+	return s
+}
+
+// HistogramSnapshot is the state of a histogram on a point in time.
+type HistogramSnapshot struct {
+	// Bounds hold the upper bounds of the buckets.
+	Bounds []float64 `json:"bounds"`
+
+	// Counts hold the number of observations of each bucket, not cumulative.
+	// It has one position more than Bounds, for the +Inf bucket.
+	Counts []int64 `json:"counts"`
+
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+
+	// Exemplars hold the last exemplar of each bucket, or nil if the bucket
+	// has none. It's nil if no bucket has an exemplar.
+	Exemplars []*Exemplar `json:"-"`
+}
+
+// Sub returns the observations made between the prev snapshot and s. Both must
+// be from the same histogram.
+func (s HistogramSnapshot) Sub(prev HistogramSnapshot) HistogramSnapshot {
+	ret := HistogramSnapshot{
+		Bounds: s.Bounds,
+		Counts: make([]int64, len(s.Counts)),
+		Count:  s.Count - prev.Count,
+		Sum:    s.Sum - prev.Sum,
+	}
+	for i := range s.Counts {
+		ret.Counts[i] = s.Counts[i]
+		if i < len(prev.Counts) {
+			ret.Counts[i] -= prev.Counts[i]
+		}
+	}
+	return ret
+}
+
+// Quantile estimates the q quantile (0 <= q <= 1) of the observations, using
+// linear interpolation inside the bucket where the quantile falls. Observations
+// on the +Inf bucket are estimated as the highest bound.
+//
+// Returns zero if there is no observation.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	var cum int64
+	for i, c := range s.Counts {
+		if c == 0 || float64(cum+c) < rank {
+			cum += c
+			continue
+		}
+		if i == len(s.Bounds) {
+			return s.Bounds[len(s.Bounds)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = s.Bounds[i-1]
+		}
+		return lower + (s.Bounds[i]-lower)*(rank-float64(cum))/float64(c)
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+// CountBelow estimates the number of observations lower than or equal to v,
+// using linear interpolation inside the bucket where v falls. Observations on the
+// +Inf bucket are never counted, as their values are unknown.
+func (s HistogramSnapshot) CountBelow(v float64) float64 {
+	var cum int64
+	for i, c := range s.Counts {
+		if i == len(s.Bounds) {
+			return float64(cum)
+		}
+		if v >= s.Bounds[i] {
+			cum += c
+			continue
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = s.Bounds[i-1]
+		}
+		if v <= lower {
+			return float64(cum)
+		}
+		return float64(cum) + float64(c)*(v-lower)/(s.Bounds[i]-lower)
+	}
+	return float64(cum)
+}
+
+// Labels are the labels of a metric series.
+type Labels map[string]string
+
+// String returns the labels on the Prometheus text format, ordered by name.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(l[k])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// with returns a copy of the labels with the label k set to v.
+func (l Labels) with(k, v string) Labels {
+	ret := make(Labels, len(l)+1)
+	for lk, lv := range l {
+		ret[lk] = lv
+	}
+	ret[k] = v
+	return ret
+}
+
+// Writer writes metrics on the Prometheus text format. The HELP and TYPE lines
+// of a metric family are written only on the first series of the family, so all
+// the series of a family must be written in sequence.
+type Writer struct {
+	w    io.Writer
+	seen map[string]bool
+
+	// openMetrics define that the metrics are written on the OpenMetrics
+	// format.
+	openMetrics bool
+}
+
+// NewWriter returns a Writer that writes on w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:    w,
+		seen: make(map[string]bool),
+	}
+}
+
+// NewOpenMetricsWriter returns a Writer that writes on w on the OpenMetrics
+// format, with the exemplars of the histograms. Close must be called after the
+// last metric.
+func NewOpenMetricsWriter(w io.Writer) *Writer {
+	mw := NewWriter(w)
+	mw.openMetrics = true
+	return mw
+}
+
+// AcceptsOpenMetrics returns if the Accept header of a scrape asks for the
+// OpenMetrics format.
+func AcceptsOpenMetrics(accept string) bool {
+	return strings.Contains(accept, "application/openmetrics-text")
+}
+
+// Close ends the metrics, as required by the OpenMetrics format.
+func (mw *Writer) Close() {
+	if mw.openMetrics {
+		io.WriteString(mw.w, "# EOF\n")
+	}
+}
+
+// header writes the HELP and TYPE lines of the family, if not written yet.
+func (mw *Writer) header(name, help, typ string) {
+	if mw.seen[name] {
+		return
+	}
+	mw.seen[name] = true
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Counter writes a counter series.
+func (mw *Writer) Counter(name, help string, l Labels, v int64) {
+	if mw.openMetrics {
+		// the OpenMetrics counter families are named without the _total
+		// suffix of their series.
+		family := strings.TrimSuffix(name, "_total")
+		mw.header(family, help, "counter")
+		fmt.Fprintf(mw.w, "%s_total%s %d\n", family, l, v)
+		return
+	}
+	mw.header(name, help, "counter")
+	fmt.Fprintf(mw.w, "%s%s %d\n", name, l, v)
+}
+
+// Gauge writes a gauge series.
+func (mw *Writer) Gauge(name, help string, l Labels, v float64) {
+	mw.header(name, help, "gauge")
+	fmt.Fprintf(mw.w, "%s%s %g\n", name, l, v)
+}
+
+// Histogram writes a histogram series.
+func (mw *Writer) Histogram(name, help string, l Labels, s HistogramSnapshot) {
+	mw.header(name, help, "histogram")
+	var cum int64
+	for i, b := range s.Bounds {
+		cum += s.Counts[i]
+		fmt.Fprintf(mw.w, "%s_bucket%s %d%s\n", name, l.with("le", fmt.Sprintf("%g", b)), cum, mw.exemplar(s, i))
+	}
+	fmt.Fprintf(mw.w, "%s_bucket%s %d%s\n", name, l.with("le", "+Inf"), s.Count, mw.exemplar(s, len(s.Bounds)))
+	fmt.Fprintf(mw.w, "%s_sum%s %g\n", name, l, s.Sum)
+	fmt.Fprintf(mw.w, "%s_count%s %d\n", name, l, s.Count)
+}
+
+// exemplar returns the exemplar of the bucket i of the histogram, to be written
+// after it's value, or a blank string if the bucket has no exemplar or the
+// format doesn't support them.
+func (mw *Writer) exemplar(s HistogramSnapshot, i int) string {
+	if !mw.openMetrics || i >= len(s.Exemplars) || s.Exemplars[i] == nil {
+		return ""
+	}
+	e := s.Exemplars[i]
+	ts := float64(e.Time.UnixNano()) / 1e9
+	return fmt.Sprintf(" # %s %g %.3f", Labels{"trace_id": e.TraceID}, e.Value, ts)
+}
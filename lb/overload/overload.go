@@ -0,0 +1,199 @@
+// Package overload implements the self-protection of the load balancer. It
+// monitors the resources of the statera process itself and reports when the LB
+// is the bottleneck, so the load can be shed before the process degrades for
+// every request.
+package overload
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// defaultInterval is the sampling interval in milliseconds used when
+// Monitor.Interval is not set.
+const defaultInterval = 1000
+
+// Level is the pressure level of the process.
+type Level int
+
+// Pressure levels, from the lowest.
+const (
+	// LevelNormal means that every signal is below it's limit.
+	LevelNormal Level = iota
+
+	// LevelElevated means that some signal is above it's limit. The low
+	// priority requests should be shed.
+	LevelElevated
+
+	// LevelCritical means that some signal is above twice it's limit. The
+	// normal priority requests should also be shed.
+	LevelCritical
+)
+
+// String returns the name of the level.
+func (l Level) String() string {
+	switch l {
+	case LevelElevated:
+		return "elevated"
+	case LevelCritical:
+		return "critical"
+	}
+	return "normal"
+}
+
+// recoverRatio is the fraction of the limit below wich the signals must be for
+// the level to be lowered, so the level doesn't flap around the limits.
+const recoverRatio = 0.8
+
+// Signals hold a sample of the resources of the process.
+type Signals struct {
+	// Goroutines is the number of goroutines.
+	Goroutines int
+
+	// HeapBytes is the size in bytes of the allocated heap objects.
+	HeapBytes uint64
+
+	// SchedDelay is the time a new goroutine waited to be scheduled. It grows
+	// when the process doesn't have enough CPU.
+	SchedDelay time.Duration
+}
+
+// Monitor samples the signals of the process on an interval and computes the
+// pressure level from the configured limits. A zero limit disables the signal.
+type Monitor struct {
+	// MaxGoroutines define the goroutine count limit.
+	MaxGoroutines int
+
+	// MaxHeapBytes define the heap size limit in bytes.
+	MaxHeapBytes uint64
+
+	// MaxSchedDelay define the scheduling delay limit.
+	MaxSchedDelay time.Duration
+
+	// Interval define the interval in milliseconds between each sample.
+	//
+	// The default Interval is 1000 milliseconds.
+	Interval int
+
+	level   Level
+	signals Signals
+	mu      sync.RWMutex // guards level and signals
+}
+
+// Level returns the current pressure level. A nil Monitor is always on
+// LevelNormal.
+func (m *Monitor) Level() Level {
+	if m == nil {
+		return LevelNormal
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.level
+}
+
+// Signals returns the last sample of the signals.
+func (m *Monitor) Signals() Signals {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.signals
+}
+
+// Run samples the signals until the context is done.
+func (m *Monitor) Run(ctx context.Context) {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	t := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			m.update(sample())
+		}
+	}
+}
+
+// sample measures the signals of the process.
+func sample() Signals {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	// the scheduling delay is the time a new goroutine takes to run.
+	start := time.Now()
+	ch := make(chan time.Duration)
+	go func() {
+		ch <- time.Since(start)
+	}()
+	return Signals{
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  ms.HeapAlloc,
+		SchedDelay: <-ch,
+	}
+}
+
+// update sets the signals and the level computed from them.
+func (m *Monitor) update(s Signals) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signals = s
+
+	ratio := 0.0
+	for _, r := range []float64{
+		limitRatio(float64(s.Goroutines), float64(m.MaxGoroutines)),
+		limitRatio(float64(s.HeapBytes), float64(m.MaxHeapBytes)),
+		limitRatio(float64(s.SchedDelay), float64(m.MaxSchedDelay)),
+	} {
+		if r > ratio {
+			ratio = r
+		}
+	}
+
+	level := LevelNormal
+	switch {
+	case ratio >= 2:
+		level = LevelCritical
+	case ratio >= 1:
+		level = LevelElevated
+	}
+	// the level is lowered only when the signals are clearly below the limit
+	// ratio of the current level, wich is the level itself.
+	if level < m.level && ratio >= float64(m.level)*recoverRatio {
+		level = m.level
+	}
+	if level != m.level {
+		log.Printf("overload level changed from %s to %s (%d goroutines, %d heap bytes, %s scheduling delay)",
+			m.level, level, s.Goroutines, s.HeapBytes, s.SchedDelay)
+		m.level = level
+	}
+}
+
+// limitRatio returns v divided by the limit, or zero if there is no limit.
+func limitRatio(v, limit float64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	return v / limit
+}
+
+// WriteMetrics writes the monitor metrics on mw.
+func (m *Monitor) WriteMetrics(mw *metrics.Writer) {
+	m.mu.RLock()
+	s, level := m.signals, m.level
+	m.mu.RUnlock()
+	mw.Gauge("statera_overload_level", "Pressure level of the LB process: 0 normal, 1 elevated, 2 critical.",
+		nil, float64(level))
+	mw.Gauge("statera_goroutines", "Goroutines of the LB process on the last overload sample.",
+		nil, float64(s.Goroutines))
+	mw.Gauge("statera_heap_bytes", "Allocated heap bytes of the LB process on the last overload sample.",
+		nil, float64(s.HeapBytes))
+	mw.Gauge("statera_scheduling_delay_seconds", "Goroutine scheduling delay on the last overload sample.",
+		nil, s.SchedDelay.Seconds())
+}
@@ -0,0 +1,318 @@
+// Package quota implements the request quotas of statera. A quota limits the
+// number of requests of each client, identified by the IP or by an API key
+// header, on each hour, day or month. The counters are persisted on a local file,
+// so they survive the restarts.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/atomicfile"
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/metrics"
+	"github.com/mhef/statera/lb/server"
+)
+
+// Period is the time bucket of a quota. The buckets start on the UTC hour, day
+// or month.
+type Period int
+
+// Periods of the quotas.
+const (
+	PeriodHour Period = iota
+	PeriodDay
+	PeriodMonth
+)
+
+// ParsePeriod returns the period with the name, e.g. "day".
+func ParsePeriod(s string) (Period, bool) {
+	switch s {
+	case "hour":
+		return PeriodHour, true
+	case "day":
+		return PeriodDay, true
+	case "month":
+		return PeriodMonth, true
+	}
+	return 0, false
+}
+
+// bucket returns the start of the bucket holding t and the start of the next
+// one.
+func (p Period) bucket(t time.Time) (start, next time.Time) {
+	t = t.UTC()
+	switch p {
+	case PeriodDay:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	case PeriodMonth:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start = t.Truncate(time.Hour)
+	return start, start.Add(time.Hour)
+}
+
+// Quota define the maximum number of requests of each client on each period.
+type Quota struct {
+	// Name define the name of the quota, referenced by the rules.
+	Name string
+
+	// Limit define the number of requests of each client on each period.
+	Limit int64
+
+	// Period define the time bucket of the limit.
+	Period Period
+
+	// Header define, if not blank, the header that identifies the client, e.g.
+	// "X-Api-Key". The requests without the header, and all requests if
+	// blank, are identified by the client IP.
+	Header string
+
+	// Keys hold the known values of the Header. The requests with an unknown
+	// value are identified by the client IP, so a made up key doesn't get a
+	// fresh limit.
+	Keys []string
+
+	// ByTenant define that the requests with a tenant are identified by the
+	// tenant, so all the clients of a tenant share the limit. The requests
+	// without tenant are identified as defined by Header.
+	ByTenant bool
+
+	keys map[string]bool
+}
+
+// clientKey returns the key that identifies the client of the request. tenant is
+// the tenant of the request, if one.
+func (q *Quota) clientKey(r *http.Request, tenant string) string {
+	if q.ByTenant && tenant != "" {
+		return "tenant:" + tenant
+	}
+	if q.Header != "" {
+		if v := r.Header.Get(q.Header); v != "" && q.keys[v] {
+			return "key:" + v
+		}
+	}
+	if a, ok := server.SourceAddrFromRequest(r); ok {
+		return "ip:" + a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// counter hold the requests of a client on a bucket.
+type counter struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+}
+
+const (
+	// defaultSaveInterval is the interval in seconds between the saves of the
+	// counters file.
+	defaultSaveInterval = 10
+
+	defaultMaxCounters = 100000
+)
+
+// Manager enforces the quotas referenced by the rules.
+type Manager struct {
+	// File define, if not blank, the path of the file where the counters are
+	// persisted.
+	File string
+
+	// MaxCounters define the maximum number of counters held. The requests of
+	// the clients without a counter while there are MaxCounters are not
+	// limited, until the counters of the past buckets are dropped, so a flood
+	// of made up clients doesn't exhaust the quota of the known ones.
+	//
+	// The default MaxCounters is 100000.
+	MaxCounters int
+
+	quotas   map[string]*Quota
+	counters map[string]*counter // by quota name and client key
+	full     bool                // if a client was not counted since the last prune
+	mu       sync.Mutex          // guards counters and full
+
+	untracked metrics.Counter
+}
+
+// NewManager returns a Manager of the quotas. The counters are loaded from the
+// file, if one.
+func NewManager(quotas []*Quota, file string) *Manager {
+	m := &Manager{
+		File:     file,
+		quotas:   make(map[string]*Quota),
+		counters: make(map[string]*counter),
+	}
+	for _, q := range quotas {
+		q.keys = make(map[string]bool, len(q.Keys))
+		for _, k := range q.Keys {
+			q.keys[k] = true
+		}
+		m.quotas[q.Name] = q
+	}
+	if file != "" {
+		m.load()
+	}
+	return m
+}
+
+// take counts a request of the client on the quota and returns the requests
+// remaining on the bucket, and when the next bucket starts. ok is false if the
+// quota is exhausted, in wich case the request is not counted.
+//
+// If the client has no counter and there are MaxCounters, the request is not
+// counted and ok is true, with the whole Limit remaining.
+func (m *Manager) take(q *Quota, client string) (remaining int64, reset time.Time, ok bool) {
+	start, next := q.Period.bucket(time.Now())
+	key := q.Name + "|" + client
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, found := m.counters[key]
+	if !found && len(m.counters) >= m.maxCounters() {
+		if !m.full {
+			log.Printf("lb/quota: the maximum of %d counters was reached, the requests of the new clients are not limited", m.maxCounters())
+		}
+		m.full = true
+		m.untracked.Inc()
+		return q.Limit, next, true
+	}
+	if !found || !c.Start.Equal(start) {
+		c = &counter{Start: start}
+		m.counters[key] = c
+	}
+	if c.Count >= q.Limit {
+		return 0, next, false
+	}
+	c.Count++
+	return q.Limit - c.Count, next, true
+}
+
+// maxCounters returns the MaxCounters, or the default if not positive.
+func (m *Manager) maxCounters() int {
+	if m.MaxCounters <= 0 {
+		return defaultMaxCounters
+	}
+	return m.MaxCounters
+}
+
+// Handler enforces the quota of the matched rule on the request, if one. The
+// answers have the X-Quota-Limit, X-Quota-Remaining and X-Quota-Reset headers,
+// and the requests above the quota are answered with 429. It must be chained
+// after the evaluator handler.
+func (m *Manager) Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		e, ok := evaluator.EvaluationResultFromRequest(r)
+		if !ok || e.Quota == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		q, ok := m.quotas[e.Quota]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		remaining, reset, ok := m.take(q, q.clientKey(r, e.Tenant))
+		resetIn := int64(time.Until(reset).Seconds()) + 1
+		h := w.Header()
+		h.Set("X-Quota-Limit", strconv.FormatInt(q.Limit, 10))
+		h.Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+		h.Set("X-Quota-Reset", strconv.FormatInt(resetIn, 10))
+		if !ok {
+			h.Set("Retry-After", strconv.FormatInt(resetIn, 10))
+			server.WriteError(w, http.StatusTooManyRequests, "quota exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// WriteMetrics writes the metrics of the quotas on mw.
+func (m *Manager) WriteMetrics(mw *metrics.Writer) {
+	mw.Counter("statera_quota_untracked_total", "Requests not limited by the quotas, because the maximum number of counters was held.",
+		nil, m.untracked.Value())
+}
+
+// Run drops the counters of the past buckets and saves the counters, if there
+// is a File, on each interval until the context is done.
+func (m *Manager) Run(ctx context.Context) {
+	t := time.NewTicker(defaultSaveInterval * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			m.prune()
+			if err := m.Save(); err != nil {
+				log.Println("lb/quota: failed to save the counters:", err)
+			}
+		}
+	}
+}
+
+// prune drops the counters of the past buckets and of unknown quotas.
+func (m *Manager) prune() {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, c := range m.counters {
+		name, _, _ := strings.Cut(key, "|")
+		q, ok := m.quotas[name]
+		if !ok {
+			delete(m.counters, key)
+			continue
+		}
+		if start, _ := q.Period.bucket(now); !c.Start.Equal(start) {
+			delete(m.counters, key)
+		}
+	}
+	m.full = false
+}
+
+// load reads the counters from the file. A missing file is not an error.
+func (m *Manager) load() {
+	b, err := os.ReadFile(m.File)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &m.counters)
+	}
+	if err != nil {
+		log.Println("lb/quota: failed to load the counters:", err)
+	}
+	if m.counters == nil {
+		m.counters = make(map[string]*counter)
+	}
+}
+
+// Save writes the counters on the file, if there is a File. The file is
+// replaced atomically.
+func (m *Manager) Save() error {
+	if m.File == "" {
+		return nil
+	}
+	m.mu.Lock()
+	b, err := json.Marshal(m.counters)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(m.File, b)
+}
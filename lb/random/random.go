@@ -0,0 +1,54 @@
+// Package random is the source of the random numbers used by statera, like the
+// fault injection percentages. All the random decisions are taken from a single
+// seedable source, so the routing behaviour can be reproduced by using the same
+// seed.
+package random
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	src = rand.New(rand.NewSource(time.Now().UnixNano()))
+	mu  sync.Mutex // guards src
+)
+
+// Seed resets the source with the seed. Calls made after Seed return the same
+// sequence of numbers for the same seed.
+func Seed(s int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	src = rand.New(rand.NewSource(s))
+}
+
+// Float64 returns a number in [0.0, 1.0).
+func Float64() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return src.Float64()
+}
+
+// Intn returns a number in [0, n). It panics if n <= 0.
+func Intn(n int) int {
+	mu.Lock()
+	defer mu.Unlock()
+	return src.Intn(n)
+}
+
+// Int63n returns a number in [0, n). It panics if n <= 0.
+func Int63n(n int64) int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return src.Int63n(n)
+}
+
+// Jitter returns a random duration in [0, d). If d is not positive, zero is
+// returned.
+func Jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(Int63n(int64(d)))
+}
@@ -0,0 +1,115 @@
+// Package record implements the recording of the responses answered to the
+// clients, shared by the handlers that store the responses, like the response
+// cache and the idempotency guard.
+package record
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Recorder is the http.ResponseWriter that answers the client and records the
+// response, so it can be stored.
+type Recorder struct {
+	http.ResponseWriter
+
+	// Limit define the maximum size in bytes of the recorded body. The bigger
+	// bodies are answered but not recorded.
+	Limit int
+
+	// Exclude hold the headers answered to the client but not recorded.
+	Exclude []string
+
+	// OnHeader define, if not nil, a func called with the status and the
+	// header of the response before it's answered. It may change the header.
+	// If it returns false, the response is discarded: it's neither answered
+	// nor recorded.
+	OnHeader func(status int, h http.Header) bool
+
+	status      int
+	header      http.Header
+	body        []byte
+	overflow    bool
+	wroteHeader bool
+	discarded   bool
+}
+
+func (rec *Recorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	h := rec.ResponseWriter.Header()
+	if rec.OnHeader != nil && !rec.OnHeader(status, h) {
+		rec.discarded = true
+		return
+	}
+	rec.status = status
+	rec.header = h.Clone()
+	for _, k := range rec.Exclude {
+		rec.header.Del(k)
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *Recorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.discarded {
+		return len(b), nil
+	}
+	if !rec.overflow {
+		if len(rec.body)+len(b) > rec.Limit {
+			rec.overflow = true
+			rec.body = nil
+		} else {
+			rec.body = append(rec.body, b...)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush sends the buffered data to the client, if the client ResponseWriter
+// supports it.
+func (rec *Recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status returns the status of the recorded response.
+func (rec *Recorder) Status() int {
+	return rec.status
+}
+
+// RecordedHeader returns the header of the recorded response, without the
+// Exclude headers.
+func (rec *Recorder) RecordedHeader() http.Header {
+	return rec.header
+}
+
+// Body returns the recorded body. It's nil if the body is bigger than Limit.
+func (rec *Recorder) Body() []byte {
+	return rec.body
+}
+
+// WroteHeader returns if the header of the response was written, even if it was
+// discarded.
+func (rec *Recorder) WroteHeader() bool {
+	return rec.wroteHeader
+}
+
+// Discarded returns if the response was discarded by OnHeader.
+func (rec *Recorder) Discarded() bool {
+	return rec.discarded
+}
+
+// Complete returns if the whole response was recorded.
+func (rec *Recorder) Complete() bool {
+	if rec.overflow || !rec.wroteHeader || rec.discarded {
+		return false
+	}
+	cl := rec.header.Get("Content-Length")
+	return cl == "" || cl == strconv.Itoa(len(rec.body))
+}
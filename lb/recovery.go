@@ -0,0 +1,115 @@
+package lb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/mhef/statera/lb/metrics"
+	"github.com/mhef/statera/lb/server"
+)
+
+// RequestIDHeader is the header that identifies a request on the logs. If the
+// client doesn't send it, an ID is generated and set on the request, so it's
+// also fowarded to the node.
+const RequestIDHeader = "X-Request-Id"
+
+// requestID returns the ID of the request, generating it if the request has
+// none.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "-"
+	}
+	id := hex.EncodeToString(b)
+	r.Header.Set(RequestIDHeader, id)
+	return id
+}
+
+// recovery recovers the panics of the handlers chained after it, so a panic
+// fails only the request that caused it instead of the whole connection.
+type recovery struct {
+	panics metrics.Counter
+}
+
+// Handler is the first handler of the listener chains. When a handler of the
+// chain panics, the panic is logged with the stack trace, the request ID and
+// the client connection, and the client receives a 500. If the response was
+// already started, the connection is aborted, as the client can't tell the
+// response is incomplete otherwise.
+//
+// The http.ErrAbortHandler panics, used to abort a response on purpose, are
+// not recovered.
+func (rc *recovery) Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		rec := &statusWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			rc.panics.Inc()
+			listener, _ := server.ListenerFromRequest(r)
+			log.Printf("panic serving request %s from %s on listener %s: %v\n%s", id, r.RemoteAddr, listener, v, debug.Stack())
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			server.WriteError(w, http.StatusInternalServerError, "internal error")
+		}()
+		next.ServeHTTP(rec, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// WriteMetrics writes the panic counter on mw.
+func (rc *recovery) WriteMetrics(mw *metrics.Writer) {
+	mw.Counter("statera_panics_total", "Panics recovered from the request handlers.", nil, rc.panics.Value())
+}
+
+// statusWriter wraps a http.ResponseWriter to record if the response was
+// started.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(statusCode int) {
+	if sw.status == 0 {
+		sw.status = statusCode
+	}
+	sw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// ReadFrom implements the io.ReaderFrom interface, so the files are still sent
+// with sendfile(2) when the wrapped ResponseWriter supports it.
+func (sw *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return io.Copy(sw.ResponseWriter, src)
+}
+
+// Flush implements the http.Flusher interface, if the wrapped ResponseWriter
+// supports it.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,309 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/admin"
+	"github.com/mhef/statera/lb/router"
+)
+
+var (
+	errRegistrationNotFound = errors.New("lb/registry: registration not found")
+	errRegistrationGroup    = errors.New("lb/registry: node group doesn't accept registrations")
+)
+
+const (
+	// defaultRegistrationTTL is the TTL of the registrations that doesn't
+	// specify one, when the configuration doesn't define it.
+	defaultRegistrationTTL = 30 * time.Second
+
+	// defaultRegistrationMaxTTL is the maximum TTL of a registration, when the
+	// configuration doesn't define it.
+	defaultRegistrationMaxTTL = 300 * time.Second
+
+	// registrySweepInterval is the interval between the checks for expired
+	// registrations.
+	registrySweepInterval = time.Second
+
+	// registryActor identifies the registry on the audit log, when it removes
+	// an expired registration.
+	registryActor = "registry"
+)
+
+// registryKey identifies a registered node.
+type registryKey struct {
+	group string
+	router.NodeKey
+}
+
+// registration is a node announced by a backend on the registry endpoint.
+type registration struct {
+	Group    string `json:"group"`
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Priority int    `json:"priority"`
+
+	// Weight define the weight of the node. If zero, 1 is used.
+	Weight int `json:"weight"`
+
+	// TTL define the time in seconds that the node remains on the group
+	// without a heartbeat.
+	TTL int `json:"ttl"`
+
+	// Expires is the time the registration expires, set on the responses.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// registry hold the nodes registered by the backends themselves. A registered
+// node is added to it's group on the first registration and removed once it
+// stops heartbeating, while the nodes of the configuration are never touched.
+type registry struct {
+	cp *controlPlane
+
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+
+	// groups hold the groups that accept registrations. If nil, all groups
+	// accept them.
+	groups map[string]bool
+
+	mu sync.Mutex
+	// regs hold the registrations, by node.
+	regs map[registryKey]registration
+}
+
+// newRegistry returns a registry that applies the registrations on the control
+// plane, as defined by the configuration c, wich may be nil.
+func newRegistry(c *cfg.Registration, cp *controlPlane) *registry {
+	rg := &registry{
+		cp:         cp,
+		defaultTTL: defaultRegistrationTTL,
+		maxTTL:     defaultRegistrationMaxTTL,
+		regs:       make(map[registryKey]registration),
+	}
+	if c == nil {
+		return rg
+	}
+	if c.DefaultTTL < 0 || c.MaxTTL < 0 {
+		panic("invalid registration TTL")
+	}
+	if c.DefaultTTL > 0 {
+		rg.defaultTTL = time.Duration(c.DefaultTTL) * time.Second
+	}
+	if c.MaxTTL > 0 {
+		rg.maxTTL = time.Duration(c.MaxTTL) * time.Second
+	}
+	if rg.defaultTTL > rg.maxTTL {
+		panic("the default registration TTL exceeds the maximum one")
+	}
+	if len(c.Groups) > 0 {
+		rg.groups = make(map[string]bool, len(c.Groups))
+		for _, g := range c.Groups {
+			if _, ok := cp.r.NodeGroup(g); !ok {
+				panic("invalid registration group " + g)
+			}
+			rg.groups[g] = true
+		}
+	}
+	return rg
+}
+
+// ttl returns the TTL of the registration, bounded by the maximum one.
+func (rg *registry) ttl(reg registration) time.Duration {
+	if reg.TTL <= 0 {
+		return rg.defaultTTL
+	}
+	ttl := time.Duration(reg.TTL) * time.Second
+	if ttl > rg.maxTTL {
+		return rg.maxTTL
+	}
+	return ttl
+}
+
+// register adds the node of the registration to it's group, or refreshes the
+// registration if the node is already registered. It returns the registration
+// as stored.
+func (rg *registry) register(actor string, reg registration) (registration, error) {
+	if rg.groups != nil && !rg.groups[reg.Group] {
+		return reg, errRegistrationGroup
+	}
+	ng, ok := rg.cp.r.NodeGroup(reg.Group)
+	if !ok {
+		return reg, errGroupNotFound
+	}
+	if reg.Weight == 0 {
+		reg.Weight = 1
+	}
+	k := registryKey{group: reg.Group, NodeKey: router.NodeKey{Host: reg.Host, Port: reg.Port}}
+
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	// a registered node may have been deleted by an operator, in wich case
+	// the heartbeat adds it back.
+	if _, ok := rg.regs[k]; !ok || !hasNode(ng, k.NodeKey) {
+		u := update{
+			Op:    opAddNode,
+			Group: reg.Group,
+			Node:  &cfg.Node{Host: reg.Host, Port: reg.Port, Weight: reg.Weight, Priority: reg.Priority},
+		}
+		if err := rg.cp.applyAudited(actor, u); err != nil {
+			return reg, err
+		}
+	}
+	ttl := rg.ttl(reg)
+	reg.TTL = int(ttl / time.Second)
+	reg.Expires = time.Now().Add(ttl)
+	rg.regs[k] = reg
+	return reg, nil
+}
+
+// deregister deletes the registered node of the group.
+func (rg *registry) deregister(actor string, reg registration) error {
+	k := registryKey{group: reg.Group, NodeKey: router.NodeKey{Host: reg.Host, Port: reg.Port}}
+
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	if _, ok := rg.regs[k]; !ok {
+		return errRegistrationNotFound
+	}
+	delete(rg.regs, k)
+	err := rg.cp.applyAudited(actor, update{
+		Op:    opDeleteNode,
+		Group: reg.Group,
+		Node:  &cfg.Node{Host: reg.Host, Port: reg.Port},
+	})
+	// the node may have been deleted by an operator already.
+	if err == router.ErrNodeNotFound {
+		return nil
+	}
+	return err
+}
+
+// registered reports whether the node of the group was registered by a backend.
+// A nil registry has no registrations.
+func (rg *registry) registered(group string, nk router.NodeKey) bool {
+	if rg == nil {
+		return false
+	}
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	_, ok := rg.regs[registryKey{group: group, NodeKey: nk}]
+	return ok
+}
+
+// sweep deletes the registered nodes whose registration expired.
+func (rg *registry) sweep(now time.Time) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	for k, reg := range rg.regs {
+		if now.Before(reg.Expires) {
+			continue
+		}
+		delete(rg.regs, k)
+		err := rg.cp.applyAudited(registryActor, update{
+			Op:    opDeleteNode,
+			Group: k.group,
+			Node:  &cfg.Node{Host: k.Host, Port: k.Port},
+		})
+		if err != nil && err != router.ErrNodeNotFound {
+			log.Println("failed to delete expired node registration:", err)
+			continue
+		}
+		log.Printf("node %s:%d of group %s removed: registration expired", k.Host, k.Port, k.group)
+	}
+}
+
+// run sweeps the expired registrations periodically. It never returns.
+func (rg *registry) run() {
+	t := time.NewTicker(registrySweepInterval)
+	defer t.Stop()
+	for now := range t.C {
+		rg.sweep(now)
+	}
+}
+
+// registrations returns the current registrations, ordered by group and node.
+func (rg *registry) registrations() []registration {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	regs := make([]registration, 0, len(rg.regs))
+	for _, reg := range rg.regs {
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		if regs[i].Group != regs[j].Group {
+			return regs[i].Group < regs[j].Group
+		}
+		if regs[i].Host != regs[j].Host {
+			return regs[i].Host < regs[j].Host
+		}
+		return regs[i].Port < regs[j].Port
+	})
+	return regs
+}
+
+// handler lists the registrations on GET, registers or heartbeats the node on
+// the body on POST and deregisters it on DELETE.
+func (rg *registry) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		admin.WriteJSON(w, http.StatusOK, rg.registrations())
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reg registration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reg.Host == "" || reg.Port == 0 {
+		http.Error(w, "invalid node", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := rg.deregister(actorFromRequest(r), reg); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+	reg, err := rg.register(actorFromRequest(r), reg)
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, reg)
+}
+
+// writeRegistryError writes the error returned by the registry to the client.
+func writeRegistryError(w http.ResponseWriter, err error) {
+	switch err {
+	case errRegistrationNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errRegistrationGroup:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		writeUpdateError(w, err)
+	}
+}
+
+// hasNode reports whether the group has the node.
+func hasNode(ng *router.NodeGroup, nk router.NodeKey) bool {
+	for _, n := range ng.Nodes() {
+		if n.NodeKey == nk {
+			return true
+		}
+	}
+	return false
+}
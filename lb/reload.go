@@ -0,0 +1,426 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/audit"
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/sampling"
+)
+
+var errReloadUnavailable = errors.New("lb/reload: the configuration can't be reloaded, it was not loaded from a file")
+
+// reloader applies a new configuration to the running load balancer, without
+// restarting the listeners or dropping the in-flight requests. The rules of each
+// listener are replaced at once, the node groups are added and deleted and the
+// nodes of the groups are added, updated and deleted to match the new
+// configuration.
+//
+// The other changes, e.g. on the listeners or on the settings of an existing
+// group, are only logged, as they need a restart. The rules and the nodes
+// changed through the admin endpoints are replaced by the ones of the new
+// configuration, while the nodes registered by the backends are kept.
+type reloader struct {
+	// load returns the new configuration. If nil, the configuration is not
+	// reloaded.
+	load func() (*cfg.Config, error)
+
+	cp      *controlPlane
+	sampler *sampling.Sampler
+
+	// registry hold the nodes registered by the backends. It may be nil.
+	registry *registry
+
+	mu  sync.Mutex // serializes the reloads, guarding cur
+	cur *cfg.Config
+}
+
+// reloadPlan hold the changes of a reload, built and validated before any of
+// them is applied.
+type reloadPlan struct {
+	// added hold the new groups, with their configuration.
+	added    []*router.NodeGroup
+	addedCfg []cfg.NodeGroup
+
+	// deleted hold the names of the groups deleted.
+	deleted []string
+
+	// nodes hold the changes of the nodes of the existing groups.
+	nodes []update
+
+	// rules hold the new rules, by listener address.
+	rules map[string][]*evaluator.Rule
+
+	// restart hold the changes that are not applied until a restart.
+	restart []string
+}
+
+// partialReloadError is returned by apply when some changes failed after the
+// others were applied, e.g. because a node was changed through the admin
+// endpoints while the reload was planned.
+type partialReloadError struct {
+	errs []error
+}
+
+func (e *partialReloadError) Error() string {
+	msgs := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("the configuration was partially reloaded, %d changes failed: %s", len(e.errs), strings.Join(msgs, "; "))
+}
+
+// run reloads the configuration on each SIGHUP. It never returns.
+func (rl *reloader) run() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		// a partial reload is already logged by reload.
+		var partial *partialReloadError
+		if err := rl.reload("SIGHUP"); err != nil && !errors.As(err, &partial) {
+			log.Println("failed to reload the configuration, keeping the current one:", err)
+		}
+	}
+}
+
+// reload loads the new configuration and applies it, on behalf of the actor. If
+// the new configuration is invalid, nothing is applied and an error is returned.
+// If some changes failed to be applied, the others are kept and a
+// *partialReloadError is returned.
+func (rl *reloader) reload(actor string) error {
+	if rl.load == nil {
+		return errReloadUnavailable
+	}
+	c, err := rl.load()
+	if err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	p, err := rl.plan(c)
+	if err != nil {
+		return err
+	}
+	applyErr := rl.apply(p)
+	var partial *partialReloadError
+	if applyErr != nil && !errors.As(applyErr, &partial) {
+		return applyErr
+	}
+	// the applied changes are kept, and the failed node changes are planned
+	// again by the next reload, as the nodes are planned from the running
+	// ones.
+	rl.cur = c
+
+	for _, s := range p.restart {
+		log.Printf("configuration reloaded without %s, wich needs a restart", s)
+	}
+	op, summary := "reload", map[string]any{
+		"groups_added":   len(p.added),
+		"groups_deleted": len(p.deleted),
+		"node_changes":   len(p.nodes),
+		"listeners":      len(p.rules),
+	}
+	if partial != nil {
+		op = "partial_reload"
+		failed := make([]string, 0, len(partial.errs))
+		for _, err := range partial.errs {
+			failed = append(failed, err.Error())
+		}
+		summary["failed"] = failed
+		log.Println(partial)
+	} else {
+		log.Printf("configuration reloaded: %d groups added, %d groups deleted, %d node changes, rules of %d listeners replaced",
+			len(p.added), len(p.deleted), len(p.nodes), len(p.rules))
+	}
+	err = rl.cp.audit.Record(audit.Entry{
+		Actor:  actor,
+		Op:     op,
+		Target: "config",
+		After:  summary,
+	})
+	if err != nil {
+		log.Println("failed to record audit entry:", err)
+	}
+	return applyErr
+}
+
+// plan builds the changes from the current configuration to c. An error is
+// returned if c is invalid. The builders shared with the start panic on some
+// invalid configurations, so the panics are returned as errors.
+func (rl *reloader) plan(c *cfg.Config) (p *reloadPlan, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	p = &reloadPlan{rules: make(map[string][]*evaluator.Rule)}
+
+	if !reflect.DeepEqual(rl.cur.Listeners, c.Listeners) {
+		p.restart = append(p.restart, "the changes of the listeners")
+	}
+	rest, cur := *c, *rl.cur
+	rest.NodeGroups, rest.Rules, rest.RuleGroups, rest.Listeners = nil, nil, nil, nil
+	cur.NodeGroups, cur.Rules, cur.RuleGroups, cur.Listeners = nil, nil, nil, nil
+	if !reflect.DeepEqual(rest, cur) {
+		p.restart = append(p.restart, "the changes outside the rules and the node groups")
+	}
+
+	groups := make(map[string]bool, len(c.NodeGroups))
+	oldGroups := make(map[string]cfg.NodeGroup, len(rl.cur.NodeGroups))
+	for _, g := range rl.cur.NodeGroups {
+		oldGroups[g.Name] = g
+	}
+	for _, g := range c.NodeGroups {
+		if groups[g.Name] {
+			return nil, fmt.Errorf("%w: %s", router.ErrDuplicateNodeGroup, g.Name)
+		}
+		groups[g.Name] = true
+		old, ok := oldGroups[g.Name]
+		if !ok {
+			if err := rl.planGroup(p, g); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := rl.planNodes(p, old, g); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range rl.cur.NodeGroups {
+		if !groups[g.Name] {
+			p.deleted = append(p.deleted, g.Name)
+		}
+	}
+	// the settings of the existing groups are kept, so the groups deleted
+	// must not be their failover or their all down fallback, nor the one of
+	// the new groups.
+	kept := append(append([]*router.NodeGroup(nil), rl.cp.r.NodeGroups()...), p.added...)
+	for _, ng := range kept {
+		if !groups[ng.Name] {
+			continue
+		}
+		if ng.Failover != "" && !groups[ng.Failover] || ng.AllDown == router.AllDownFallback && !groups[ng.AllDownGroup] {
+			return nil, fmt.Errorf("invalid node group %s: %w", ng.Name, router.ErrNodeGroupInUse)
+		}
+	}
+
+	quotas := make(map[string]bool, len(rl.cur.Quotas))
+	for _, q := range rl.cur.Quotas {
+		quotas[q.Name] = true
+	}
+	ids := make(map[string]bool)
+	for l := range rl.cp.evs {
+		p.rules[l] = []*evaluator.Rule{}
+	}
+	for _, rCfg := range c.AllRules() {
+		r := newRule(rCfg)
+		if err := validateFileRule(r); err != nil {
+			return nil, fmt.Errorf("invalid rule with priority %d: %w", r.Priority, err)
+		}
+		if _, ok := rl.cp.evs[r.Listener]; !ok {
+			return nil, fmt.Errorf("invalid rule with priority %d: there is no listener %s", r.Priority, r.Listener)
+		}
+		if g := r.Action.NodeGroup; g != "" && !groups[g] {
+			return nil, fmt.Errorf("invalid rule with priority %d: there is no node group %s", r.Priority, g)
+		}
+		if q := r.Action.Quota; q != "" && !quotas[q] {
+			return nil, fmt.Errorf("invalid rule with priority %d: there is no quota %s", r.Priority, q)
+		}
+		if r.ID != "" {
+			if ids[r.ID] {
+				return nil, fmt.Errorf("invalid rule %s: the id is already in use", r.ID)
+			}
+			ids[r.ID] = true
+		}
+		p.rules[r.Listener] = append(p.rules[r.Listener], r)
+	}
+	for _, l := range c.Listeners {
+		if l.DefaultNodeGroup != "" && !groups[l.DefaultNodeGroup] {
+			return nil, fmt.Errorf("invalid listener %s: there is no node group %s", l.Addr, l.DefaultNodeGroup)
+		}
+	}
+	// the listeners are only changed by a restart, so the running ones keep
+	// using their groups until then.
+	for _, l := range rl.cur.Listeners {
+		if g := listenerGroup(l, groups); g != "" {
+			return nil, fmt.Errorf("invalid node group deletion: the group %s is used by the running listener %s", g, l.Addr)
+		}
+	}
+	return p, nil
+}
+
+// listenerGroup returns the first group used by the listener l that is not on
+// groups: it's default group, it's SSH group or the group of a SNI route.
+// Returns a blank string if all of them are on groups.
+func listenerGroup(l cfg.Listener, groups map[string]bool) string {
+	used := []string{l.DefaultNodeGroup, l.SSHNodeGroup}
+	for _, rt := range l.SNIRoutes {
+		used = append(used, rt.NodeGroup)
+	}
+	for _, g := range used {
+		if g != "" && !groups[g] {
+			return g
+		}
+	}
+	return ""
+}
+
+// planGroup plans the addition of the new group g.
+func (rl *reloader) planGroup(p *reloadPlan, g cfg.NodeGroup) error {
+	ng, err := newNodeGroup(g)
+	if err != nil {
+		return err
+	}
+	seen := make(map[router.NodeKey]bool, len(g.Nodes))
+	for _, n := range g.Nodes {
+		if _, err := newNode(n); err != nil {
+			return fmt.Errorf("node %s:%d on group %s: %w", n.Host, n.Port, g.Name, err)
+		}
+		nk := router.NodeKey{Host: n.Host, Port: n.Port}
+		if seen[nk] {
+			return fmt.Errorf("node %s on group %s: %w", nk, g.Name, router.ErrDuplicateNode)
+		}
+		seen[nk] = true
+	}
+	if g.Cache != nil || g.Idempotency != nil || len(g.SLOs) > 0 {
+		p.restart = append(p.restart, fmt.Sprintf("the cache, the idempotency and the SLOs of the new group %s", g.Name))
+	}
+	p.added = append(p.added, ng)
+	p.addedCfg = append(p.addedCfg, g)
+	return nil
+}
+
+// planNodes plans the changes of the nodes of the existing group, from old to
+// g. The nodes of the groups discovered through SRV records and the nodes
+// registered by the backends are kept.
+func (rl *reloader) planNodes(p *reloadPlan, old, g cfg.NodeGroup) error {
+	oldNodes := make(map[router.NodeKey]cfg.Node, len(old.Nodes))
+	for _, n := range old.Nodes {
+		oldNodes[router.NodeKey{Host: n.Host, Port: n.Port}] = n
+	}
+	settings, oldSettings := g, old
+	settings.Nodes, oldSettings.Nodes = nil, nil
+	if !reflect.DeepEqual(settings, oldSettings) {
+		p.restart = append(p.restart, fmt.Sprintf("the changes of the settings of the group %s", g.Name))
+	}
+	if g.SRV != nil || rl.cur.XDS != nil {
+		return nil
+	}
+
+	ng, _ := rl.cp.r.NodeGroup(g.Name)
+	running := make(map[router.NodeKey]*router.Node)
+	for _, n := range ng.Nodes() {
+		running[n.NodeKey] = n
+	}
+	want := make(map[router.NodeKey]bool, len(g.Nodes))
+	for i := range g.Nodes {
+		n := &g.Nodes[i]
+		if _, err := newNode(*n); err != nil {
+			return fmt.Errorf("node %s:%d on group %s: %w", n.Host, n.Port, g.Name, err)
+		}
+		nk := router.NodeKey{Host: n.Host, Port: n.Port}
+		if want[nk] {
+			return fmt.Errorf("node %s on group %s: %w", nk, g.Name, router.ErrDuplicateNode)
+		}
+		want[nk] = true
+		rn, ok := running[nk]
+		if !ok {
+			p.nodes = append(p.nodes, update{Op: opAddNode, Group: g.Name, Node: n})
+			continue
+		}
+		// the nodes whose settings other than the weight and the priority
+		// changed are added again.
+		if on, ok := oldNodes[nk]; ok {
+			on.Weight, on.Priority = n.Weight, n.Priority
+			if !reflect.DeepEqual(on, *n) {
+				p.nodes = append(p.nodes,
+					update{Op: opDeleteNode, Group: g.Name, Node: n},
+					update{Op: opAddNode, Group: g.Name, Node: n})
+				continue
+			}
+		}
+		if rn.CurrentWeight() != n.Weight || rn.Priority != n.Priority {
+			p.nodes = append(p.nodes, update{Op: opUpdateNode, Group: g.Name, Node: n})
+		}
+	}
+	for nk := range running {
+		if !want[nk] && !rl.registry.registered(g.Name, nk) {
+			p.nodes = append(p.nodes, update{Op: opDeleteNode, Group: g.Name, Node: &cfg.Node{Host: nk.Host, Port: nk.Port}})
+		}
+	}
+	return nil
+}
+
+// apply applies the plan: the new groups are added before the rules that route
+// to them are replaced, and the deleted groups are deleted after the rules that
+// routed to them. An error is returned, and nothing is applied, if the new
+// groups can't be added.
+//
+// The other changes were validated by plan, but the nodes may still be changed
+// concurrently through the admin endpoints. Each failed change is skipped and
+// returned on a *partialReloadError, once the others are applied.
+func (rl *reloader) apply(p *reloadPlan) error {
+	r := rl.cp.r
+	for _, ng := range p.added {
+		ng.TraceSampler = rl.sampler
+	}
+	if err := r.AddNodeGroups(p.added...); err != nil {
+		return err
+	}
+	var errs []error
+	for i, ng := range p.added {
+		if err := addNodes(ng, p.addedCfg[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	srvControl(p.addedCfg, r)
+	for _, u := range p.nodes {
+		if err := rl.cp.apply(u); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s:%d on group %s: %w", u.Op, u.Node.Host, u.Node.Port, u.Group, err))
+		}
+	}
+	for l, rules := range p.rules {
+		if err := rl.cp.evs[l].ReplaceRules(rules); err != nil {
+			errs = append(errs, fmt.Errorf("rules of the listener %s: %w", l, err))
+		}
+	}
+	for _, name := range p.deleted {
+		if err := r.DeleteNodeGroup(name); err != nil {
+			errs = append(errs, fmt.Errorf("delete the group %s: %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return &partialReloadError{errs: errs}
+	}
+	return nil
+}
+
+// reloadHandler reloads the configuration on POST.
+func (rl *reloader) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := rl.reload(actorFromRequest(r)); err != nil {
+		code := http.StatusBadRequest
+		var partial *partialReloadError
+		if errors.As(err, &partial) {
+			code = http.StatusInternalServerError
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,122 @@
+package router
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mhef/statera/lb/server"
+)
+
+// AffinityDrain define what happens to the client connections pinned to a node
+// when the node is drained, on groups with ConnAffinity. The drained node
+// doesn't receive new pins on any policy.
+type AffinityDrain int
+
+const (
+	// AffinityDrainHonor keeps the pinned connections on the drained node,
+	// until the group AffinityDrainTTL, so the sessions of the node are not
+	// all lost at once.
+	AffinityDrainHonor AffinityDrain = iota
+
+	// AffinityDrainRepin pins the connections to another node on their next
+	// request, so the node is drained as soon as possible.
+	AffinityDrainRepin
+)
+
+// ParseAffinityDrain returns the AffinityDrain with the name: "honor" (or
+// blank) or "repin".
+func ParseAffinityDrain(s string) (d AffinityDrain, ok bool) {
+	switch s {
+	case "", "honor":
+		return AffinityDrainHonor, true
+	case "repin":
+		return AffinityDrainRepin, true
+	}
+	return 0, false
+}
+
+// pinnedConn is the node connection to wich a client connection is pinned on
+// groups with ConnAffinity.
+type pinnedConn struct {
+	n *Node
+
+	// transport has a single connection to the node, used only by the client
+	// connection.
+	transport *http.Transport
+}
+
+// pinnedNode returns the node and the transport to wich the client connection
+// of the request is pinned. On the first request of the connection, or if the
+// pinned node is no longer healthy or on the group, or is drained and the group
+// AffinityDrain doesn't keep the pin, the node is chosen by the Balancer and
+// the connection is pinned to it.
+//
+// ok is false if the request has no client connection, in wich case the request
+// is balanced as usual.
+func (ng *NodeGroup) pinnedNode(r *http.Request) (n *Node, t http.RoundTripper, ok bool) {
+	c, ok := server.ConnectionFromRequest(r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	ng.pinnedMu.Lock()
+	defer ng.pinnedMu.Unlock()
+	if ng.pinned == nil {
+		ng.pinned = make(map[*server.Connection]*pinnedConn)
+	}
+	if p, found := ng.pinned[c]; found {
+		if ng.hasNode(p.n) && p.n.Healthy() && !ng.repin(p.n) {
+			return p.n, p.transport, true
+		}
+		p.transport.CloseIdleConnections()
+		delete(ng.pinned, c)
+	}
+
+	n = ng.Balancer.Balance(r)
+	if n == nil {
+		return nil, nil, true
+	}
+	tr := ng.newTransport()
+	tr.MaxConnsPerHost = 1
+	tr.MaxIdleConnsPerHost = 1
+	p := &pinnedConn{n: n, transport: tr}
+	ng.pinned[c] = p
+	c.OnClose(func() {
+		ng.pinnedMu.Lock()
+		if ng.pinned[c] == p {
+			delete(ng.pinned, c)
+		}
+		ng.pinnedMu.Unlock()
+		p.transport.CloseIdleConnections()
+	})
+	return n, tr, true
+}
+
+// repin returns if the connections pinned to the node must be pinned to another
+// node, because the node is draining and the AffinityDrain of the group doesn't
+// honor the pins, or already honored them for AffinityDrainTTL.
+func (ng *NodeGroup) repin(n *Node) bool {
+	draining, since := n.drainState()
+	if !draining {
+		return false
+	}
+	if ng.AffinityDrain == AffinityDrainRepin {
+		return true
+	}
+	return ng.AffinityDrainTTL > 0 && time.Since(since) >= time.Duration(ng.AffinityDrainTTL)*time.Second
+}
+
+// hasNode returns if the node n is on the group.
+func (ng *NodeGroup) hasNode(n *Node) bool {
+	ng.nodesMu.RLock()
+	defer ng.nodesMu.RUnlock()
+	return ng.nodes[n.NodeKey] == n
+}
+
+// PinnedConns returns the number of client connections currently pinned to a
+// node connection.
+func (ng *NodeGroup) PinnedConns() int {
+	ng.pinnedMu.Lock()
+	defer ng.pinnedMu.Unlock()
+	return len(ng.pinned)
+}
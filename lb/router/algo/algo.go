@@ -1,4 +1,4 @@
 // Package algo implements load balancing algorithms that satisfy the router.Balancer
-// interface. The current implemented algorithms are round-robin, least-connections and
-// weighted round-robin.
+// interface. The current implemented algorithms are round-robin, least-connections,
+// weighted round-robin and consistent hashing.
 package algo
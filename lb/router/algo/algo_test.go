@@ -0,0 +1,157 @@
+package algo_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/router/algo"
+	"github.com/mhef/statera/lb/router/algo/algotest"
+)
+
+// balancers are the algorithms compared by the scenarios and the benchmarks.
+var balancers = []struct {
+	name string
+	new  func() router.Balancer
+}{
+	{"RR", func() router.Balancer { return algo.NewRR() }},
+	{"WRR", func() router.Balancer { return algo.NewWRR() }},
+	{"LC", func() router.Balancer { return algo.NewLC() }},
+	{"CH", func() router.Balancer { return algo.NewCH(algo.HashClientIP, "", 0) }},
+}
+
+// evenNodes are 4 nodes of the same weight and latency.
+var evenNodes = []algotest.NodeSpec{
+	{Latency: 100 * time.Microsecond},
+	{Latency: 100 * time.Microsecond},
+	{Latency: 100 * time.Microsecond},
+	{Latency: 100 * time.Microsecond},
+}
+
+func TestEvenDistribution(t *testing.T) {
+	for _, b := range balancers {
+		t.Run(b.name, func(t *testing.T) {
+			res := algotest.Run(b.new(), algotest.Scenario{
+				Nodes:       evenNodes,
+				Requests:    4000,
+				Concurrency: 8,
+				Seed:        1,
+			})
+			algotest.AssertBalanced(t, res)
+			algotest.AssertShares(t, res, algotest.WeightedShares(evenNodes), 0.05)
+			t.Logf("counts %v, cv %.3f, %.0f req/s", res.Counts, res.CV(), res.Throughput())
+		})
+	}
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	nodes := []algotest.NodeSpec{{Weight: 1}, {Weight: 2}, {Weight: 3}, {Weight: 4}}
+	res := algotest.Run(algo.NewWRR(), algotest.Scenario{
+		Nodes:       nodes,
+		Requests:    10000,
+		Concurrency: 4,
+	})
+	algotest.AssertBalanced(t, res)
+	algotest.AssertShares(t, res, algotest.WeightedShares(nodes), 0.01)
+}
+
+func TestSlowNode(t *testing.T) {
+	nodes := []algotest.NodeSpec{
+		{Latency: 5 * time.Millisecond},
+		{Latency: 200 * time.Microsecond},
+		{Latency: 200 * time.Microsecond},
+		{Latency: 200 * time.Microsecond},
+	}
+	res := algotest.Run(algo.NewLC(), algotest.Scenario{
+		Nodes:       nodes,
+		Requests:    2000,
+		Concurrency: 8,
+		Seed:        1,
+	})
+	algotest.AssertBalanced(t, res)
+	// the slow node holds it's requests longer, so the least-connections
+	// balancer sends it less than an even share.
+	if s := res.Shares()[0]; s > 0.15 {
+		t.Errorf("the slow node received %.3f of the requests, want at most 0.15 (counts %v)", s, res.Counts)
+	}
+}
+
+func TestChurn(t *testing.T) {
+	for _, b := range balancers {
+		t.Run(b.name, func(t *testing.T) {
+			res := algotest.Run(b.new(), algotest.Scenario{
+				Nodes:       evenNodes,
+				Requests:    3000,
+				Concurrency: 8,
+				Events: []algotest.Event{
+					{At: 1000, Node: 1},
+					{At: 2000, Node: 1, Add: true},
+				},
+				Seed: 1,
+			})
+			algotest.AssertBalanced(t, res)
+			// node1 is out of the pool for a third of the requests.
+			if s := res.Shares()[1]; s > 0.22 || s < 0.1 {
+				t.Errorf("the churned node received %.3f of the requests, want 1/6 (counts %v)", s, res.Counts)
+			}
+		})
+	}
+}
+
+func TestCHConsistency(t *testing.T) {
+	b := algo.NewCH(algo.HashClientIP, "", 0)
+	nodes := algotest.Nodes(evenNodes)
+	for _, n := range nodes {
+		b.AddNode(n)
+	}
+	const clients = 2000
+	before := make([]*router.Node, clients)
+	for i := range before {
+		before[i] = b.Balance(algotest.Request(context.Background(), i))
+		if n := b.Balance(algotest.Request(context.Background(), i)); n != before[i] {
+			t.Fatalf("client %d was balanced to %s, then to %s", i, before[i].NodeKey, n.NodeKey)
+		}
+	}
+
+	// only the clients of the deleted node are moved.
+	b.DeleteNode(nodes[1].NodeKey)
+	for i, prev := range before {
+		n := b.Balance(algotest.Request(context.Background(), i))
+		if prev != nodes[1] && n != prev {
+			t.Errorf("client %d moved from %s to %s, but it's node was not deleted", i, prev.NodeKey, n.NodeKey)
+		}
+	}
+
+	// and they are moved back when it's added back.
+	b.AddNode(nodes[1])
+	for i, prev := range before {
+		if n := b.Balance(algotest.Request(context.Background(), i)); n != prev {
+			t.Errorf("client %d was balanced to %s after the node was added back, want %s", i, n.NodeKey, prev.NodeKey)
+		}
+	}
+}
+
+// benchmarkNodes are the pool sizes of the benchmarks.
+var benchmarkNodes = []int{4, 64}
+
+func BenchmarkBalance(b *testing.B) {
+	for _, bal := range balancers {
+		for _, n := range benchmarkNodes {
+			b.Run(fmt.Sprintf("%s/nodes=%d", bal.name, n), func(b *testing.B) {
+				algotest.Benchmark(b, bal.new, n)
+			})
+		}
+	}
+}
+
+func BenchmarkBalanceChurn(b *testing.B) {
+	for _, bal := range balancers {
+		for _, n := range benchmarkNodes {
+			b.Run(fmt.Sprintf("%s/nodes=%d", bal.name, n), func(b *testing.B) {
+				algotest.BenchmarkChurn(b, bal.new, n)
+			})
+		}
+	}
+}
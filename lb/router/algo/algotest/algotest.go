@@ -0,0 +1,388 @@
+// Package algotest implements a simulation harness for the load balancing
+// algorithms. It runs synthetic request streams against a router.Balancer, with
+// configurable node latencies and churn events, and measures how the requests
+// were distributed, so the algorithms can be compared on the same scenarios.
+package algotest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mhef/statera/lb/random"
+	"github.com/mhef/statera/lb/router"
+)
+
+// NodeSpec define a simulated node.
+type NodeSpec struct {
+	// Weight define the weight of the node. If zero, 1 is used.
+	Weight int
+
+	// Latency define the time that the node takes to answer a request.
+	Latency time.Duration
+
+	// Jitter define the maximum random time added to the Latency of each
+	// request.
+	Jitter time.Duration
+}
+
+// Event define a churn event, that removes a node from the balancer or adds it
+// back.
+type Event struct {
+	// At define the number of the request before wich the event happens.
+	At int
+
+	// Node define the index of the node on Scenario.Nodes.
+	Node int
+
+	// Add define if the node is added back. If false, the node is removed.
+	Add bool
+}
+
+// Scenario define a simulation.
+type Scenario struct {
+	// Nodes define the simulated nodes. All nodes start on the balancer.
+	Nodes []NodeSpec
+
+	// Requests define the number of requests of the stream.
+	Requests int
+
+	// Concurrency define the number of clients sending the requests at the same
+	// time. If zero, 1 is used.
+	Concurrency int
+
+	// Events define the churn events of the simulation.
+	Events []Event
+
+	// Seed define the seed of the latency jitter and of the random package, so
+	// a simulation of a balancer that takes random decisions can be reproduced.
+	// The seed of the random package is changed for the whole process.
+	Seed int64
+}
+
+// Result is the outcome of a simulation.
+type Result struct {
+	// Counts hold the number of requests sent to each node, by the index of
+	// the node on Scenario.Nodes.
+	Counts []int
+
+	// Unbalanced count the requests for wich the balancer returned no node.
+	Unbalanced int
+
+	// Duration is the time the simulation took.
+	Duration time.Duration
+}
+
+// Throughput returns the requests answered per second during the simulation.
+func (res Result) Throughput() float64 {
+	if res.Duration <= 0 {
+		return 0
+	}
+	total := 0
+	for _, c := range res.Counts {
+		total += c
+	}
+	return float64(total) / res.Duration.Seconds()
+}
+
+// Shares returns the fraction of the balanced requests sent to each node.
+func (res Result) Shares() []float64 {
+	total := 0
+	for _, c := range res.Counts {
+		total += c
+	}
+	shares := make([]float64, len(res.Counts))
+	if total == 0 {
+		return shares
+	}
+	for i, c := range res.Counts {
+		shares[i] = float64(c) / float64(total)
+	}
+	return shares
+}
+
+// CV returns the coefficient of variation of the request counts: the standard
+// deviation divided by the mean. Zero means that the requests were spread
+// evenly.
+func (res Result) CV() float64 {
+	if len(res.Counts) == 0 {
+		return 0
+	}
+	mean := 0.0
+	for _, c := range res.Counts {
+		mean += float64(c)
+	}
+	mean /= float64(len(res.Counts))
+	if mean == 0 {
+		return 0
+	}
+	variance := 0.0
+	for _, c := range res.Counts {
+		d := float64(c) - mean
+		variance += d * d
+	}
+	variance /= float64(len(res.Counts))
+	return math.Sqrt(variance) / mean
+}
+
+// Nodes returns the router nodes of the specs, named "node0", "node1", ...
+func Nodes(specs []NodeSpec) []*router.Node {
+	nodes := make([]*router.Node, len(specs))
+	for i, s := range specs {
+		w := s.Weight
+		if w == 0 {
+			w = 1
+		}
+		nodes[i] = &router.Node{
+			NodeKey: router.NodeKey{Host: fmt.Sprintf("node%d", i), Port: 80},
+			Weight:  w,
+		}
+	}
+	return nodes
+}
+
+// Request returns the request number n of a stream, with the context. Each
+// request comes from a different client address, so the balancers that hash the
+// client spread the requests as the others.
+func Request(ctx context.Context, n int) *http.Request {
+	r, _ := http.NewRequestWithContext(ctx, "GET", "http://statera/", nil)
+	r.RemoteAddr = clientAddr(n)
+	return r
+}
+
+// clientAddr returns the address of the client of the request number n.
+func clientAddr(n int) string {
+	return fmt.Sprintf("10.%d.%d.%d:%d", byte(n>>16), byte(n>>8), byte(n), 1024+n%60000)
+}
+
+// Run simulates the scenario on the balancer b, wich must be empty. Each request
+// holds it's node for the node latency, and is done when it's context is
+// canceled, as the requests fowarded by the router.
+func Run(b router.Balancer, s Scenario) Result {
+	nodes := Nodes(s.Nodes)
+	index := make(map[router.NodeKey]int, len(nodes))
+	for i, n := range nodes {
+		index[n.NodeKey] = i
+		b.AddNode(n)
+	}
+	events := make(map[int][]Event)
+	for _, e := range s.Events {
+		events[e.At] = append(events[e.At], e)
+	}
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	res := Result{Counts: make([]int, len(nodes))}
+	rnd := rand.New(rand.NewSource(s.Seed))
+	random.Seed(s.Seed)
+	next := 0
+	var mu sync.Mutex // guards res, rnd and next
+
+	// take takes the next request of the stream, applying the events that
+	// happen before it. It returns false when the stream is over.
+	take := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if next >= s.Requests {
+			return 0, false
+		}
+		num := next
+		next++
+		for _, e := range events[num] {
+			if e.Add {
+				b.AddNode(nodes[e.Node])
+			} else {
+				b.DeleteNode(nodes[e.Node].NodeKey)
+			}
+		}
+		return num, true
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				num, ok := take()
+				if !ok {
+					return
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				n := b.Balance(Request(ctx, num))
+				if n == nil {
+					cancel()
+					mu.Lock()
+					res.Unbalanced++
+					mu.Unlock()
+					continue
+				}
+
+				ni := index[n.NodeKey]
+				spec := s.Nodes[ni]
+				mu.Lock()
+				res.Counts[ni]++
+				d := spec.Latency
+				if spec.Jitter > 0 {
+					d += time.Duration(rnd.Int63n(int64(spec.Jitter)))
+				}
+				mu.Unlock()
+				if d > 0 {
+					time.Sleep(d)
+				}
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	res.Duration = time.Since(start)
+	return res
+}
+
+// WeightedShares returns the fraction of the requests that each node should
+// receive if the requests were distributed by the node weights.
+func WeightedShares(specs []NodeSpec) []float64 {
+	total := 0
+	for _, s := range specs {
+		w := s.Weight
+		if w == 0 {
+			w = 1
+		}
+		total += w
+	}
+	shares := make([]float64, len(specs))
+	for i, s := range specs {
+		w := s.Weight
+		if w == 0 {
+			w = 1
+		}
+		shares[i] = float64(w) / float64(total)
+	}
+	return shares
+}
+
+// AssertShares fails the test if the share of the requests of any node differs
+// from the wanted share by more than tolerance, e.g. 0.02 for two percentage
+// points.
+func AssertShares(t testing.TB, res Result, want []float64, tolerance float64) {
+	t.Helper()
+	if len(want) != len(res.Counts) {
+		t.Fatalf("algotest: %d wanted shares for %d nodes", len(want), len(res.Counts))
+	}
+	for i, got := range res.Shares() {
+		if math.Abs(got-want[i]) > tolerance {
+			t.Errorf("node%d received %.3f of the requests, want %.3f ± %.3f", i, got, want[i], tolerance)
+		}
+	}
+}
+
+// AssertCV fails the test if the coefficient of variation of the request counts
+// is greater than limit.
+func AssertCV(t testing.TB, res Result, limit float64) {
+	t.Helper()
+	if cv := res.CV(); cv > limit {
+		t.Errorf("requests coefficient of variation is %.3f, want at most %.3f (counts %v)", cv, limit, res.Counts)
+	}
+}
+
+// AssertBalanced fails the test if any request was not balanced.
+func AssertBalanced(t testing.TB, res Result) {
+	t.Helper()
+	if res.Unbalanced > 0 {
+		t.Errorf("%d requests were not balanced", res.Unbalanced)
+	}
+}
+
+// benchmarkClients is the number of distinct client addresses of the requests
+// of Benchmark.
+const benchmarkClients = 1024
+
+// Benchmark measures the time taken by the balancer returned by newBalancer to
+// balance a request among the nodes, with the requests done right away. The
+// requests are balanced in parallel, by GOMAXPROCS goroutines, so the
+// contention between them is measured when run with -cpu on a multi-core
+// machine. It is meant to be called by the benchmark of each algorithm, so they
+// are comparable.
+func Benchmark(b *testing.B, newBalancer func() router.Balancer, nodes int) {
+	bal := newBalancer()
+	for _, n := range Nodes(make([]NodeSpec, nodes)) {
+		bal.AddNode(n)
+	}
+	addrs := make([]string, benchmarkClients)
+	for i := range addrs {
+		addrs[i] = clientAddr(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ctx, cancel := context.WithCancel(context.Background())
+			r, _ := http.NewRequestWithContext(ctx, "GET", "http://statera/", nil)
+			r.RemoteAddr = addrs[i%len(addrs)]
+			i++
+			bal.Balance(r)
+			cancel()
+		}
+	})
+}
+
+// churnInterval is the interval between the pool changes of BenchmarkChurn, far
+// shorter than the one of the health checks and the service discovery.
+const churnInterval = 100 * time.Microsecond
+
+// BenchmarkChurn measures the time taken to balance a request, as Benchmark,
+// while a node is added to and deleted from the balancer on each churnInterval,
+// as by the health checks and the service discovery. It shows how much the
+// changes of the pool block the requests.
+func BenchmarkChurn(b *testing.B, newBalancer func() router.Balancer, nodes int) {
+	bal := newBalancer()
+	for _, n := range Nodes(make([]NodeSpec, nodes)) {
+		bal.AddNode(n)
+	}
+	churned := &router.Node{NodeKey: router.NodeKey{Host: "churned", Port: 80}, Weight: 1}
+	addrs := make([]string, benchmarkClients)
+	for i := range addrs {
+		addrs[i] = clientAddr(i)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			bal.AddNode(churned)
+			time.Sleep(churnInterval)
+			bal.DeleteNode(churned.NodeKey)
+			time.Sleep(churnInterval)
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ctx, cancel := context.WithCancel(context.Background())
+			r, _ := http.NewRequestWithContext(ctx, "GET", "http://statera/", nil)
+			r.RemoteAddr = addrs[i%len(addrs)]
+			i++
+			bal.Balance(r)
+			cancel()
+		}
+	})
+	b.StopTimer()
+	close(done)
+	<-stopped
+}
@@ -0,0 +1,200 @@
+package algo
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/server"
+)
+
+// DefaultVirtualNodes is the number of virtual nodes of each node of weight 1 on
+// the ring, when NewCH is called with zero.
+const DefaultVirtualNodes = 160
+
+// HashKey define the part of the request hashed by the consistent-hashing
+// balancer.
+type HashKey int
+
+const (
+	// HashClientIP hashes the client IP: the original source resolved by the
+	// listener, if known, or the peer address.
+	HashClientIP HashKey = iota
+
+	// HashHeader hashes the value of a request header.
+	HashHeader
+
+	// HashCookie hashes the value of a request cookie.
+	HashCookie
+)
+
+// ParseHashKey returns the HashKey with the name: "client_ip" (or blank),
+// "header" or "cookie".
+func ParseHashKey(s string) (k HashKey, ok bool) {
+	switch s {
+	case "", "client_ip":
+		return HashClientIP, true
+	case "header":
+		return HashHeader, true
+	case "cookie":
+		return HashCookie, true
+	}
+	return 0, false
+}
+
+// point is a virtual node on the ring.
+type point struct {
+	hash uint64
+	node *router.Node
+}
+
+// CH define the consistent-hashing load balancing algorithm implementation. Each
+// node is placed on a ring as a number of virtual nodes proportional to it's
+// weight, and each request is sent to the node of the first virtual node after
+// the hash of it's key. So the requests with the same key are sent to the same
+// node, and adding or removing a node only moves the keys of that node.
+type CH struct {
+	key HashKey
+	// name hold the name of the header or the cookie hashed.
+	name string
+	// vnodes hold the number of virtual nodes of each node of weight 1.
+	vnodes int
+
+	// ring hold the []point of the virtual nodes of all the nodes, ordered by
+	// hash. It's replaced, rather than modified, when a node is added or
+	// deleted, so Balance doesn't lock.
+	ring atomic.Value
+
+	// nodes hold the nodes being currently balanced, in the order they were
+	// added. It's guarded by mu.
+	nodes []*router.Node
+	mu    sync.Mutex
+}
+
+// NewCH return an initialized consistent-hashing balancer, that hashes the key
+// of the requests. name is the name of the header or the cookie, for the
+// HashHeader and HashCookie keys. If vnodes is zero, DefaultVirtualNodes is
+// used.
+func NewCH(key HashKey, name string, vnodes int) *CH {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	c := &CH{
+		key:    key,
+		name:   name,
+		vnodes: vnodes,
+	}
+	c.ring.Store([]point(nil))
+	return c
+}
+
+// AddNode takes a node and adds it to the ring.
+func (c *CH) AddNode(n *router.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes = appendNode(c.nodes, n)
+	c.build()
+}
+
+// DeleteNode removes the node from the ring.
+func (c *CH) DeleteNode(k router.NodeKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes, ok := deleteNode(c.nodes, k)
+	if !ok {
+		return
+	}
+	c.nodes = nodes
+	c.build()
+}
+
+// build places the virtual nodes of the nodes on a new ring. c.mu must be held.
+func (c *CH) build() {
+	var ring []point
+	for _, n := range c.nodes {
+		w := n.CurrentWeight()
+		if w < 1 {
+			w = 1
+		}
+		id := n.NodeKey.String() + "#"
+		for i := 0; i < w*c.vnodes; i++ {
+			ring = append(ring, point{hash: hashKey(id + strconv.Itoa(i)), node: n})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	c.ring.Store(ring)
+}
+
+// Balance return the node for wich the request should be sent.
+func (c *CH) Balance(r *http.Request) *router.Node {
+	ring := c.ring.Load().([]point)
+	if len(ring) == 0 {
+		return nil
+	}
+	h := hashKey(c.requestKey(r))
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].node
+}
+
+// Nodes implements the router.NodeLister interface.
+func (c *CH) Nodes() []router.NodeStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make([]router.NodeStatus, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		ret = append(ret, router.NodeStatus{NodeKey: n.NodeKey, Weight: n.CurrentWeight()})
+	}
+	return ret
+}
+
+// requestKey returns the key of the request that is hashed. The requests
+// without the header or the cookie are hashed by the client IP.
+func (c *CH) requestKey(r *http.Request) string {
+	switch c.key {
+	case HashHeader:
+		if v := r.Header.Get(c.name); v != "" {
+			return v
+		}
+	case HashCookie:
+		if ck, err := r.Cookie(c.name); err == nil && ck.Value != "" {
+			return ck.Value
+		}
+	}
+	if a, ok := server.SourceAddrFromRequest(r); ok {
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr) // remove the port
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Parameters of the 64-bit FNV-1a hash.
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// hashKey returns the position of s on the ring. The FNV-1a hash is mixed, so
+// the similar keys, like the IDs of the virtual nodes, are spread evenly.
+func hashKey(s string) uint64 {
+	x := uint64(fnvOffset)
+	for i := 0; i < len(s); i++ {
+		x ^= uint64(s[i])
+		x *= fnvPrime
+	}
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
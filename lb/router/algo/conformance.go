@@ -0,0 +1,214 @@
+package algo
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mhef/statera/lb/router"
+)
+
+// Parameters of the distribution check of TestBalancerConformance.
+const (
+	conformanceNodes     = 4
+	conformanceRequests  = 4000
+	conformanceTolerance = 0.05
+)
+
+// TestBalancerConformance checks that the balancers returned by newBalancer
+// hold the invariants required by the router.Balancer interface. It's meant to
+// be called by the tests of each implementation, including the custom ones,
+// and should be run with the race detector:
+//
+//	func TestConformance(t *testing.T) {
+//		algo.TestBalancerConformance(t, func() router.Balancer { return NewMyBalancer() })
+//	}
+//
+// The checks are:
+//
+//   - Balance returns nil when the pool is empty, before any node is added and
+//     after all of them are deleted.
+//   - Balance returns only nodes of the pool, never a node after DeleteNode,
+//     and a deleted node again after it's added back.
+//   - AddNode, DeleteNode and Balance are safe for concurrent use.
+//   - The requests are spread evenly across nodes of the same weight: while
+//     the requests are in flight, each node receives it's share within 5
+//     percentage points. Each request comes from a different client address,
+//     so the balancers that hash the client are checked too.
+func TestBalancerConformance(t *testing.T, newBalancer func() router.Balancer) {
+	t.Helper()
+	t.Run("EmptyPool", func(t *testing.T) { conformanceEmptyPool(t, newBalancer()) })
+	t.Run("DeleteNode", func(t *testing.T) { conformanceDeleteNode(t, newBalancer()) })
+	t.Run("Concurrency", func(t *testing.T) { conformanceConcurrency(t, newBalancer()) })
+	t.Run("Distribution", func(t *testing.T) { conformanceDistribution(t, newBalancer()) })
+}
+
+// conformanceNodeSet returns n nodes of weight 1.
+func conformanceNodeSet(n int) []*router.Node {
+	nodes := make([]*router.Node, n)
+	for i := range nodes {
+		nodes[i] = &router.Node{
+			NodeKey: router.NodeKey{Host: fmt.Sprintf("node%d", i), Port: 80},
+			Weight:  1,
+		}
+	}
+	return nodes
+}
+
+// conformanceClients counts the requests built by conformanceRequest. It must be
+// accessed atomically.
+var conformanceClients uint32
+
+// conformanceRequest returns a request with the context, from a client address
+// that differs on each call, so the balancers that hash the client spread the
+// requests as the others.
+func conformanceRequest(ctx context.Context) *http.Request {
+	n := atomic.AddUint32(&conformanceClients, 1)
+	r, _ := http.NewRequestWithContext(ctx, "GET", "http://statera/", nil)
+	r.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:%d", byte(n>>16), byte(n>>8), byte(n), 1024+n%60000)
+	return r
+}
+
+// balanceDone balances a request that is done as soon as it's balanced.
+func balanceDone(b router.Balancer) *router.Node {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	return b.Balance(conformanceRequest(ctx))
+}
+
+func conformanceEmptyPool(t *testing.T, b router.Balancer) {
+	if n := balanceDone(b); n != nil {
+		t.Fatalf("Balance returned %s on an empty pool, want nil", n.NodeKey)
+	}
+	nodes := conformanceNodeSet(2)
+	for _, n := range nodes {
+		b.AddNode(n)
+	}
+	if n := balanceDone(b); n == nil {
+		t.Fatal("Balance returned nil with nodes on the pool")
+	}
+	for _, n := range nodes {
+		b.DeleteNode(n.NodeKey)
+	}
+	if n := balanceDone(b); n != nil {
+		t.Fatalf("Balance returned %s after all nodes were deleted, want nil", n.NodeKey)
+	}
+}
+
+func conformanceDeleteNode(t *testing.T, b router.Balancer) {
+	nodes := conformanceNodeSet(3)
+	for _, n := range nodes {
+		b.AddNode(n)
+	}
+	deleted := nodes[1]
+	b.DeleteNode(deleted.NodeKey)
+	pool := map[*router.Node]bool{nodes[0]: true, nodes[2]: true}
+	for i := 0; i < 100; i++ {
+		n := balanceDone(b)
+		if n == nil {
+			t.Fatal("Balance returned nil with nodes on the pool")
+		}
+		if n.NodeKey == deleted.NodeKey {
+			t.Fatalf("Balance returned the deleted node %s", n.NodeKey)
+		}
+		if !pool[n] {
+			t.Fatalf("Balance returned %s, wich is not a node of the pool", n.NodeKey)
+		}
+	}
+
+	b.AddNode(deleted)
+	for i := 0; i < 100; i++ {
+		if balanceDone(b) == deleted {
+			return
+		}
+	}
+	t.Fatalf("Balance never returned %s after it was added back", deleted.NodeKey)
+}
+
+func conformanceConcurrency(t *testing.T, b router.Balancer) {
+	nodes := conformanceNodeSet(conformanceNodes)
+	for _, n := range nodes[:2] {
+		b.AddNode(n)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				balanceDone(b)
+			}
+		}()
+	}
+	// the last nodes are added and deleted while the first ones stay on
+	// the pool, so Balance never has an excuse to return nil.
+	for i := 2; i < len(nodes); i++ {
+		wg.Add(1)
+		go func(n *router.Node) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				b.AddNode(n)
+				b.DeleteNode(n.NodeKey)
+			}
+		}(nodes[i])
+	}
+	var nils int
+	var mu sync.Mutex // guards nils
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if balanceDone(b) == nil {
+					mu.Lock()
+					nils++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if nils > 0 {
+		t.Errorf("Balance returned nil %d times with nodes on the pool", nils)
+	}
+}
+
+func conformanceDistribution(t *testing.T, b router.Balancer) {
+	nodes := conformanceNodeSet(conformanceNodes)
+	index := make(map[*router.Node]int, len(nodes))
+	for i, n := range nodes {
+		b.AddNode(n)
+		index[n] = i
+	}
+
+	// the requests are kept in flight until the end, so the balancers that
+	// account the in flight requests see the same state as the others.
+	counts := make([]int, len(nodes))
+	cancels := make([]context.CancelFunc, 0, conformanceRequests)
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	for i := 0; i < conformanceRequests; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		n := b.Balance(conformanceRequest(ctx))
+		if n == nil {
+			t.Fatal("Balance returned nil with nodes on the pool")
+		}
+		counts[index[n]]++
+	}
+
+	want := 1 / float64(len(nodes))
+	for i, c := range counts {
+		got := float64(c) / conformanceRequests
+		if math.Abs(got-want) > conformanceTolerance {
+			t.Errorf("node%d received %.3f of the requests, want %.3f ± %.3f (counts %v)", i, got, want, conformanceTolerance, counts)
+		}
+	}
+}
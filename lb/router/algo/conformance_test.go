@@ -0,0 +1,28 @@
+package algo_test
+
+import (
+	"testing"
+
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/router/algo"
+)
+
+// The conformance checks are meant to be run with the race detector:
+//
+//	go test -race ./lb/router/algo
+
+func TestRRConformance(t *testing.T) {
+	algo.TestBalancerConformance(t, func() router.Balancer { return algo.NewRR() })
+}
+
+func TestWRRConformance(t *testing.T) {
+	algo.TestBalancerConformance(t, func() router.Balancer { return algo.NewWRR() })
+}
+
+func TestLCConformance(t *testing.T) {
+	algo.TestBalancerConformance(t, func() router.Balancer { return algo.NewLC() })
+}
+
+func TestCHConformance(t *testing.T) {
+	algo.TestBalancerConformance(t, func() router.Balancer { return algo.NewCH(algo.HashClientIP, "", 0) })
+}
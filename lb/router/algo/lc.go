@@ -1,125 +1,141 @@
 package algo
 
 import (
-	"container/heap"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mhef/statera/lb/router"
 )
 
 // nodeWR is a type that hold a node along with it's current number of on-fly
-// requests and it's index on the heap.
+// requests.
 type nodeWR struct {
-	node *router.Node
-
-	// reqs hold the number of requests currently on-fly to the node
-	reqs int
-
-	// index hold the index of the node item in the heap.
-	index int
-}
-
-// nodeHeap implements the heap.Interface. It is a heap binary tree that holds
-// the nodes ordered by the number of on-fly requests.
-type nodeHeap []*nodeWR
-
-// Len return the current len of the heap.
-func (nh nodeHeap) Len() int { return len(nh) }
-
-// Less takes two node indexes from the heap and return if the first node has
-// less on-fly requests than the other.
-func (nh nodeHeap) Less(i, j int) bool {
-	return nh[i].reqs < nh[j].reqs
-}
-
-// Swap takes two node indexes from the heap and swap them on the heap array.
-func (nh nodeHeap) Swap(i, j int) {
-	nh[i], nh[j] = nh[j], nh[i]
-	nh[i].index = i
-	nh[j].index = j
-}
+	// reqs hold the number of requests currently on-fly to the node. It must be
+	// accessed atomically.
+	reqs int64
 
-// Push takes a nodeWR and pushes it to the end of the heap array.
-func (nh *nodeHeap) Push(x any) {
-	n := len(*nh)
-	item := x.(*nodeWR)
-	item.index = n
-	*nh = append(*nh, item)
+	node *router.Node
 }
 
-// Pop return and remove the last element of the heap array.
-func (nh *nodeHeap) Pop() any {
-	old := *nh
-	n := len(old)
-	item := old[n-1]
-	old[n-1] = nil
-	item.index = -1
-	*nh = old[0 : n-1]
-	return item
+// finish accounts a request to the node as finished. The node may be already
+// removed from the balancer.
+func (n *nodeWR) finish() {
+	for {
+		reqs := atomic.LoadInt64(&n.reqs)
+		if reqs <= 0 || atomic.CompareAndSwapInt64(&n.reqs, reqs, reqs-1) {
+			return
+		}
+	}
 }
 
 // LC define the least-connections load balancing algorithm implementation.
+//
+// Balance doesn't lock: the nodes are held on a slice that is replaced, rather
+// than modified, when a node is added or deleted, and the on-fly requests of
+// each node are counted atomically. The node with the least on-fly requests is
+// found by scanning the nodes, so concurrent requests may select the same node
+// when they are balanced at the same time.
 type LC struct {
-	nodes nodeHeap
-	mu    sync.Mutex
+	// nodes hold the []*nodeWR being currently balanced.
+	nodes atomic.Value
+
+	mu sync.Mutex // serializes the changes of nodes
 }
 
 // NewLC return an initialized least-connections balancer.
 func NewLC() *LC {
-	return &LC{
-		nodes: make(nodeHeap, 0),
-	}
+	l := &LC{}
+	l.nodes.Store([]*nodeWR(nil))
+	return l
+}
+
+// load returns the nodes being currently balanced.
+func (l *LC) load() []*nodeWR {
+	return l.nodes.Load().([]*nodeWR)
 }
 
 // AddNode takes a node and adds it in the balancing list.
 func (l *LC) AddNode(n *router.Node) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	nwr := &nodeWR{
-		node:  n,
-		reqs:  0,
-		index: -1,
-	}
-	heap.Push(&l.nodes, nwr)
+	nodes := l.load()
+	ret := make([]*nodeWR, len(nodes), len(nodes)+1)
+	copy(ret, nodes)
+	l.nodes.Store(append(ret, &nodeWR{node: n}))
 }
 
 // DeleteNode removes the node from the balance list.
 func (l *LC) DeleteNode(k router.NodeKey) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	for _, v := range l.nodes {
+	nodes := l.load()
+	for i, v := range nodes {
 		if k != v.node.NodeKey {
 			continue
 		}
-		heap.Remove(&l.nodes, v.index)
+		ret := make([]*nodeWR, 0, len(nodes)-1)
+		ret = append(ret, nodes[:i]...)
+		l.nodes.Store(append(ret, nodes[i+1:]...))
 		return
 	}
 }
 
 // Balance return the node for wich the next request should be sent.
 func (l *LC) Balance(r *http.Request) *router.Node {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	if l.nodes.Len() == 0 {
+	nodes := l.load()
+	if len(nodes) == 0 {
 		return nil
 	}
 
-	selected := l.nodes[0]
-	selected.reqs++
-	heap.Fix(&l.nodes, 0)
-	go l.monitorRequestFinish(r, selected)
+	selected := nodes[0]
+	least := atomic.LoadInt64(&selected.reqs)
+	for _, v := range nodes[1:] {
+		if reqs := atomic.LoadInt64(&v.reqs); reqs < least {
+			selected, least = v, reqs
+		}
+	}
+	atomic.AddInt64(&selected.reqs, 1)
+	if !router.CompletedByRouter(r) {
+		go l.monitorRequestFinish(r, selected)
+	}
 	return selected.node
 }
 
+// Complete implements the router.Completer interface. The request stops being
+// accounted as on-fly to the node when the node finishes it, rather than when
+// the client request is done, so long downloads are accounted until the body is
+// fully copied.
+func (l *LC) Complete(r *http.Request, n *router.Node) {
+	for _, v := range l.load() {
+		if v.node != n {
+			continue
+		}
+		v.finish()
+		return
+	}
+}
+
+// Nodes implements the router.NodeLister interface.
+func (l *LC) Nodes() []router.NodeStatus {
+	nodes := l.load()
+	ret := make([]router.NodeStatus, 0, len(nodes))
+	for _, v := range nodes {
+		ret = append(ret, router.NodeStatus{
+			NodeKey:  v.node.NodeKey,
+			Weight:   v.node.CurrentWeight(),
+			InFlight: int(atomic.LoadInt64(&v.reqs)),
+		})
+	}
+	return ret
+}
+
+// monitorRequestFinish waits for the request context to be done to account the
+// request as finished, for the requests not completed by the router.
 func (l *LC) monitorRequestFinish(r *http.Request, n *nodeWR) {
 	done := r.Context().Done()
 	if done != nil {
 		<-done
 	}
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	n.reqs--
-	heap.Fix(&l.nodes, n.index)
+	n.finish()
 }
@@ -1,80 +1,94 @@
 package algo
 
 import (
-	"container/list"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mhef/statera/lb/router"
 )
 
 // RR define the round-robin load balancing algorithm implementation.
+//
+// Balance doesn't lock: the nodes are held on a slice that is replaced, rather
+// than modified, when a node is added or deleted, and the next node is selected
+// by an atomic counter.
 type RR struct {
-	// nodes is a linked list that hold the nodes
-	nodes *list.List
-	// cur is a cursor that hold the next node that will be returned by the algorithm.
-	cur *list.Element
+	// next hold the number of requests balanced, wich appoints the next node
+	// that will be returned by the algorithm. It must be accessed atomically.
+	next uint64
 
-	mu sync.Mutex
+	// nodes hold the []*router.Node being currently balanced.
+	nodes atomic.Value
+
+	mu sync.Mutex // serializes the changes of nodes
 }
 
 // NewRR return an initialized round-robin balancer.
 func NewRR() *RR {
-	return &RR{
-		nodes: list.New(),
-	}
+	r := &RR{}
+	r.nodes.Store([]*router.Node(nil))
+	return r
 }
 
 // AddNode takes a node and adds it to the balance list.
 func (r *RR) AddNode(n *router.Node) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.nodes.PushBack(n)
+	r.nodes.Store(appendNode(r.load(), n))
 }
 
 // DeleteNode removes the node from the balance list.
 func (r *RR) DeleteNode(k router.NodeKey) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	for e := r.nodes.Front(); e != nil; e = e.Next() {
-		v := e.Value.(*router.Node)
-		if k != v.NodeKey {
-			continue
-		}
-
-		// if the element to be deleted is the element to wich the cursor is
-		// appointing, the cursor need to be updated.
-		if e == r.cur {
-			if r.nodes.Len() == 1 {
-				r.cur = nil
-			} else {
-				if e.Next() == nil {
-					r.cur = r.nodes.Front()
-				} else {
-					r.cur = e.Next()
-				}
-			}
-		}
-
-		r.nodes.Remove(e)
-		return
+	if nodes, ok := deleteNode(r.load(), k); ok {
+		r.nodes.Store(nodes)
 	}
 }
 
+// load returns the nodes being currently balanced.
+func (r *RR) load() []*router.Node {
+	return r.nodes.Load().([]*router.Node)
+}
+
 // Balance return the node for wich the next request should be sent.
 func (r *RR) Balance(*http.Request) *router.Node {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if r.nodes.Len() == 0 {
+	nodes := r.load()
+	if len(nodes) == 0 {
 		return nil
 	}
+	i := atomic.AddUint64(&r.next, 1) - 1
+	return nodes[i%uint64(len(nodes))]
+}
 
-	if r.cur == nil {
-		r.cur = r.nodes.Front()
+// Nodes implements the router.NodeLister interface.
+func (r *RR) Nodes() []router.NodeStatus {
+	nodes := r.load()
+	ret := make([]router.NodeStatus, 0, len(nodes))
+	for _, n := range nodes {
+		ret = append(ret, router.NodeStatus{NodeKey: n.NodeKey, Weight: n.CurrentWeight()})
 	}
+	return ret
+}
 
-	v := r.cur
-	r.cur = r.cur.Next()
-	return v.Value.(*router.Node)
+// appendNode returns a copy of nodes with n appended.
+func appendNode(nodes []*router.Node, n *router.Node) []*router.Node {
+	ret := make([]*router.Node, len(nodes), len(nodes)+1)
+	copy(ret, nodes)
+	return append(ret, n)
+}
+
+// deleteNode returns a copy of nodes without the node with the key k, and if it
+// was found.
+func deleteNode(nodes []*router.Node, k router.NodeKey) ([]*router.Node, bool) {
+	for i, n := range nodes {
+		if k != n.NodeKey {
+			continue
+		}
+		ret := make([]*router.Node, 0, len(nodes)-1)
+		ret = append(ret, nodes[:i]...)
+		return append(ret, nodes[i+1:]...), true
+	}
+	return nodes, false
 }
@@ -1,108 +1,103 @@
 package algo
 
 import (
-	"container/list"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mhef/statera/lb/router"
 )
 
+// wrrState hold the nodes being balanced by a WRR, with the cumulative weights
+// used to find the node of each request.
+type wrrState struct {
+	nodes []*router.Node
+
+	// bounds hold, for each node, the sum of the weights of the node and of all
+	// the nodes before it. Each node receives the requests from the bound of the
+	// previous node up to it's own.
+	bounds []uint64
+}
+
 // WRR define the weighted round-robin load balancing algorithm implementation.
+// Each node receives a number of consecutive requests equal to it's weight.
+//
+// Balance doesn't lock: the state is replaced, rather than modified, when a
+// node is added or deleted, and the next node is selected by an atomic counter.
 type WRR struct {
-	// nodes is a linked list that hold the nodes being currently balanced by this
-	// algorithm.
-	nodes *list.List
+	// next hold the number of requests balanced, wich appoints the next node
+	// that will be returned by the algorithm. It must be accessed atomically.
+	next uint64
 
-	// cur is a cursor that hold the next node that will be returned by the algorithm.
-	cur *list.Element
+	// state hold the current *wrrState.
+	state atomic.Value
 
-	// reqCredit hold the current number of requests available for the node
-	// appointed to by cur.
-	reqCredit int
-
-	mu sync.Mutex
+	// nodes hold the nodes being currently balanced. It's guarded by mu.
+	nodes []*router.Node
+	mu    sync.Mutex
 }
 
 // NewWRR return an initialized weighted round-robin balancer.
 func NewWRR() *WRR {
-	return &WRR{
-		nodes: list.New(),
-	}
+	r := &WRR{}
+	r.state.Store(&wrrState{})
+	return r
 }
 
 // AddNode takes a node and adds it to the balancing list.
 func (r *WRR) AddNode(n *router.Node) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.nodes.PushBack(n)
+	r.nodes = appendNode(r.nodes, n)
+	r.build()
 }
 
 // DeleteNode removes a node from the balancing list.
 func (r *WRR) DeleteNode(k router.NodeKey) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	for e := r.nodes.Front(); e != nil; e = e.Next() {
-		v := e.Value.(*router.Node)
-		if k != v.NodeKey {
-			continue
-		}
+	nodes, ok := deleteNode(r.nodes, k)
+	if !ok {
+		return
+	}
+	r.nodes = nodes
+	r.build()
+}
 
-		// if the element to be deleted is the element to wich the cursor is
-		// appointing, the cursor need to be updated.
-		if e == r.cur {
-			if r.nodes.Len() == 1 {
-				r.cur = nil
-			} else {
-				if e.Next() == nil {
-					r.cur = r.nodes.Front()
-					r.reqCredit = r.cur.Value.(*router.Node).Weight
-				} else {
-					r.cur = r.cur.Next()
-					r.reqCredit = r.cur.Value.(*router.Node).Weight
-				}
-			}
+// build stores the state of the current nodes. The nodes with weight lower than
+// 1 are balanced as if their weight was 1. r.mu must be held.
+func (r *WRR) build() {
+	s := &wrrState{nodes: r.nodes, bounds: make([]uint64, len(r.nodes))}
+	var sum uint64
+	for i, n := range r.nodes {
+		if w := n.CurrentWeight(); w > 1 {
+			sum += uint64(w)
+		} else {
+			sum++
 		}
-
-		r.nodes.Remove(e)
-		return
+		s.bounds[i] = sum
 	}
+	r.state.Store(s)
 }
 
 // Balance return the node for wich the next request should be sent.
 func (r *WRR) Balance(*http.Request) *router.Node {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if r.nodes.Len() == 0 {
+	s := r.state.Load().(*wrrState)
+	if len(s.nodes) == 0 {
 		return nil
 	}
+	p := (atomic.AddUint64(&r.next, 1) - 1) % s.bounds[len(s.bounds)-1]
+	i := sort.Search(len(s.bounds), func(i int) bool { return s.bounds[i] > p })
+	return s.nodes[i]
+}
 
-	if r.cur == nil {
-		if r.nodes.Front().Value.(*router.Node).Weight <= 1 {
-			r.cur = r.nodes.Front().Next()
-			if r.cur != nil {
-				r.reqCredit = r.cur.Value.(*router.Node).Weight
-			} else {
-				r.reqCredit = 0
-			}
-		} else {
-			r.cur = r.nodes.Front()
-			r.reqCredit = r.nodes.Front().Value.(*router.Node).Weight - 1
-		}
-
-		return r.nodes.Front().Value.(*router.Node)
-	}
-
-	v := r.cur
-	r.reqCredit--
-	if r.reqCredit < 1 {
-		r.cur = r.cur.Next()
-		if r.cur != nil {
-			r.reqCredit = r.cur.Value.(*router.Node).Weight
-		} else {
-			r.reqCredit = 0
-		}
+// Nodes implements the router.NodeLister interface.
+func (r *WRR) Nodes() []router.NodeStatus {
+	s := r.state.Load().(*wrrState)
+	ret := make([]router.NodeStatus, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		ret = append(ret, router.NodeStatus{NodeKey: n.NodeKey, Weight: n.CurrentWeight()})
 	}
-	return v.Value.(*router.Node)
+	return ret
 }
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/mhef/statera/lb/server"
+)
+
+// ErrInvalidAllDownGroup is returned by New when the AllDownGroup of a group
+// with AllDownFallback is not an other group of the router.
+var ErrInvalidAllDownGroup = errors.New("lb/router: the all down fallback group must be an other group")
+
+// defaultAllDownRetryAfter is the Retry-After in seconds of the groups without
+// AllDownRetryAfter.
+const defaultAllDownRetryAfter = 5
+
+// AllDownPolicy define what a group answers when it has no node available.
+type AllDownPolicy int
+
+const (
+	// AllDownBadGateway answers 502.
+	AllDownBadGateway AllDownPolicy = iota
+
+	// AllDownUnavailable answers 503 with a Retry-After header, so the
+	// clients know the failure is temporary.
+	AllDownUnavailable
+
+	// AllDownStale answers the responses cached for the group, even if
+	// expired after the stale-if-error time, or 503 with a Retry-After
+	// header if the response is not cached.
+	AllDownStale
+
+	// AllDownFallback fowards the requests to the AllDownGroup.
+	AllDownFallback
+
+	// AllDownFailOpen fowards the requests to the node that was healthy most
+	// recently anyway, for nodes that fail the health checks but may still
+	// serve some requests.
+	AllDownFailOpen
+)
+
+// ParseAllDownPolicy returns the AllDownPolicy with the name: "bad_gateway" (or
+// blank), "unavailable", "stale", "fallback" or "fail_open".
+func ParseAllDownPolicy(s string) (p AllDownPolicy, ok bool) {
+	switch s {
+	case "", "bad_gateway":
+		return AllDownBadGateway, true
+	case "unavailable":
+		return AllDownUnavailable, true
+	case "stale":
+		return AllDownStale, true
+	case "fallback":
+		return AllDownFallback, true
+	case "fail_open":
+		return AllDownFailOpen, true
+	}
+	return 0, false
+}
+
+// ServesStale returns if the responses cached for the group must be answered
+// even if expired, because the group has no node available and it's AllDown
+// policy is AllDownStale.
+func (ng *NodeGroup) ServesStale() bool {
+	return ng.AllDown == AllDownStale && !ng.hasPool()
+}
+
+// lastKnownNode returns the node that was healthy most recently, for the groups
+// with AllDownFailOpen, or nil if no node of the group was ever healthy. The
+// draining nodes are not considered.
+func (ng *NodeGroup) lastKnownNode() *Node {
+	ng.nodesMu.RLock()
+	defer ng.nodesMu.RUnlock()
+	var last *Node
+	var lastSince int64
+	for _, n := range ng.nodes {
+		draining, _ := n.drainState()
+		since := n.HealthSince()
+		if draining || since.IsZero() {
+			continue
+		}
+		if last == nil || since.UnixNano() > lastSince {
+			last, lastSince = n, since.UnixNano()
+		}
+	}
+	return last
+}
+
+// writeAllDown answers a request to the group without node available with 503
+// and Retry-After.
+func (ng *NodeGroup) writeAllDown(w http.ResponseWriter) {
+	ra := ng.AllDownRetryAfter
+	if ra <= 0 {
+		ra = defaultAllDownRetryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(ra))
+	server.WriteError(w, http.StatusServiceUnavailable, "service unavailable")
+}
+
+// validateAllDown returns ErrInvalidAllDownGroup if the AllDownGroup of a group
+// with AllDownFallback is not an other group of ngs.
+func validateAllDown(ngs map[string]*NodeGroup) error {
+	for _, ng := range ngs {
+		if ng.AllDown != AllDownFallback {
+			continue
+		}
+		fb, ok := ngs[ng.AllDownGroup]
+		if !ok || fb == ng {
+			return ErrInvalidAllDownGroup
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mhef/statera/lb/sampling"
+)
+
+// AttemptsHeader is the response header listing the attempts made to foward a
+// request, on the groups with TraceAttempts.
+const AttemptsHeader = "X-Statera-Attempts"
+
+// Attempt is an attempt to foward a request to a node.
+type Attempt struct {
+	// Node is the node of the attempt.
+	Node NodeKey
+
+	// Status is the status code answered by the node, or zero if the attempt
+	// failed.
+	Status int
+
+	// Err is the error of the failed attempt.
+	Err error
+
+	// Duration is the time until the node answered the response header, or
+	// until the attempt failed.
+	Duration time.Duration
+}
+
+// String returns the attempt on the format of the AttemptsHeader, e.g.
+// `10.0.0.1:8080 200 12ms` or `10.0.0.1:8080 error="dial tcp: i/o timeout" 15s`.
+func (a Attempt) String() string {
+	d := a.Duration.Round(time.Microsecond)
+	if a.Err != nil {
+		return fmt.Sprintf("%s error=%q %s", a.Node, a.Err.Error(), d)
+	}
+	return fmt.Sprintf("%s %d %s", a.Node, a.Status, d)
+}
+
+// attemptTrace hold the attempts made to foward a request.
+type attemptTrace struct {
+	attempts []Attempt
+
+	// sampler decides if the attempts are set on the response. It may be nil.
+	sampler *sampling.Sampler
+
+	// tags are the tags of the rule matched by the request.
+	tags []string
+}
+
+// ctxAttemptTraceKey is the type used to define the attempt trace key.
+type ctxAttemptTraceKey struct{}
+
+// attemptTraceKey is the key that holds the attempt trace of a request.
+var attemptTraceKey ctxAttemptTraceKey
+
+// withAttemptTrace returns the context with a new attempt trace, sampled by s
+// with the tags of the matched rule.
+func withAttemptTrace(ctx context.Context, s *sampling.Sampler, tags []string) (context.Context, *attemptTrace) {
+	t := &attemptTrace{sampler: s, tags: tags}
+	return context.WithValue(ctx, attemptTraceKey, t), t
+}
+
+// recordAttempt records the attempt on the trace of the request, if one.
+func recordAttempt(r *http.Request, a Attempt) {
+	if t, ok := r.Context().Value(attemptTraceKey).(*attemptTrace); ok {
+		t.attempts = append(t.attempts, a)
+	}
+}
+
+// setHeader sets the AttemptsHeader with the attempts, if any, on h, if the
+// response with the status is sampled.
+func (t *attemptTrace) setHeader(h http.Header, status int) {
+	if t == nil || len(t.attempts) == 0 || !t.sampler.Sample(status, t.tags) {
+		return
+	}
+	s := make([]string, 0, len(t.attempts))
+	for _, a := range t.attempts {
+		s = append(s, a.String())
+	}
+	h.Set(AttemptsHeader, strings.Join(s, ", "))
+}
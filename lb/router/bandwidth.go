@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// tokenBucket limits the bytes transferred per second. The bucket holds up to
+// one second of tokens, and the transfers that take more tokens than available
+// wait for them to be refilled.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex // guards tokens and last
+}
+
+// newTokenBucket returns a tokenBucket of rate bytes per second, or nil if the
+// rate is not positive.
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take takes n tokens from the bucket, waiting until they are available or the
+// context is done.
+func (tb *tokenBucket) take(ctx context.Context, n int) error {
+	if tb == nil || n <= 0 {
+		return nil
+	}
+
+	tb.mu.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+	// the tokens are taken right away, so the concurrent transfers wait on
+	// the order they arrived.
+	tb.tokens -= float64(n)
+	wait := time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	tb.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// meteredBody wraps a request or response body to count the bytes read from it
+// and to limit the rate at wich it's read.
+type meteredBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	bytes *metrics.Counter
+	limit *tokenBucket
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes.Add(int64(n))
+	if werr := b.limit.take(b.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
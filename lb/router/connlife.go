@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// lifetimeConn is a connection to a node whose age and number of requests are
+// tracked, so it's retired once it reaches the MaxConnAge or MaxConnRequests of
+// the group.
+type lifetimeConn struct {
+	net.Conn
+	created  time.Time
+	requests int64
+}
+
+// limitsConnLifetime returns if the connections of the group have a limited
+// lifetime.
+func (ng *NodeGroup) limitsConnLifetime() bool {
+	return ng.MaxConnAge > 0 || ng.MaxConnRequests > 0
+}
+
+// lifetimeDial wraps dial so the connections it returns are lifetimeConns.
+func lifetimeDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &lifetimeConn{Conn: c, created: time.Now()}, nil
+	}
+}
+
+// withConnLifetime returns the request to be sent in place of r, wich retires the
+// connection that carries it if the connection reached the limits of the group.
+// The request to retire the connection is sent with "Connection: close", so the
+// node closes it after the response and the next requests open new ones.
+//
+// If the connections of the group have no limit, r is returned.
+func (ng *NodeGroup) withConnLifetime(r *http.Request) *http.Request {
+	if !ng.limitsConnLifetime() {
+		return r
+	}
+	// the copy is the one retired, so the retries of r are not affected. The
+	// transport may copy the request itself, but the copies share the header.
+	rr := new(http.Request)
+	header := r.Header.Clone()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := info.Conn
+			if tc, ok := c.(*tls.Conn); ok {
+				c = tc.NetConn()
+			}
+			lc, ok := c.(*lifetimeConn)
+			if !ok {
+				return
+			}
+			n := atomic.AddInt64(&lc.requests, 1)
+			if (ng.MaxConnRequests > 0 && n >= int64(ng.MaxConnRequests)) ||
+				(ng.MaxConnAge > 0 && time.Since(lc.created) >= time.Duration(ng.MaxConnAge)*time.Second) {
+				rr.Close = true
+				header.Set("Connection", "close")
+				ng.stats.ConnsRetired.Inc()
+			}
+		},
+	}
+	*rr = *r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+	rr.Header = header
+	return rr
+}
+
+// tlsConfig returns the TLS configuration of the connections to the nodes, or
+// nil if the default one is used.
+func (ng *NodeGroup) tlsConfig() *tls.Config {
+	if ng.TLSSessionCache <= 0 {
+		return nil
+	}
+	return &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(ng.TLSSessionCache)}
+}
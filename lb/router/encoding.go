@@ -0,0 +1,150 @@
+package router
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Encoding define how the Accept-Encoding of the requests fowarded to a node group
+// is negotiated with the nodes.
+type Encoding int
+
+const (
+	// EncodingPassthrough fowards the Accept-Encoding of the client unchanged.
+	EncodingPassthrough Encoding = iota
+
+	// EncodingIdentity asks the nodes for uncompressed responses.
+	EncodingIdentity
+
+	// EncodingGzip asks the nodes for gzip responses, regardless of the client.
+	// The responses are decompressed for clients that don't accept gzip.
+	EncodingGzip
+)
+
+// ParseEncoding returns the Encoding with the name: "passthrough" (or blank),
+// "identity" or "gzip".
+func ParseEncoding(s string) (e Encoding, ok bool) {
+	switch s {
+	case "", "passthrough":
+		return EncodingPassthrough, true
+	case "identity":
+		return EncodingIdentity, true
+	case "gzip":
+		return EncodingGzip, true
+	}
+	return 0, false
+}
+
+type plaintextKey struct{}
+
+// RequirePlaintext returns a copy of the request marking that it's response must
+// reach the handlers uncompressed. Handlers that inspect or change the response
+// body, like a cache or a body rewrite, call it before the router so the
+// decompression is done once, by the router.
+func RequirePlaintext(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), plaintextKey{}, true))
+}
+
+// plaintextRequired returns if the response of the request must be uncompressed.
+func plaintextRequired(r *http.Request) bool {
+	v, _ := r.Context().Value(plaintextKey{}).(bool)
+	return v
+}
+
+// setAcceptEncoding sets the Accept-Encoding of the request fowarded to the node,
+// according to the group Encoding.
+//
+// A partial gzip response can't be decompressed, so range requests of clients
+// that don't accept gzip ask for the uncompressed representation. The requests
+// whose response must be uncompressed only accept gzip, the coding decoded by
+// the router, so the nodes don't answer an other coding.
+func (ng *NodeGroup) setAcceptEncoding(r *http.Request) {
+	if plaintextRequired(r) && ng.Encoding != EncodingIdentity {
+		if r.Header.Get("Range") != "" {
+			r.Header.Set("Accept-Encoding", "identity")
+			return
+		}
+		r.Header.Set("Accept-Encoding", "gzip")
+		return
+	}
+	switch ng.Encoding {
+	case EncodingIdentity:
+		r.Header.Set("Accept-Encoding", "identity")
+	case EncodingGzip:
+		if r.Header.Get("Range") != "" && !acceptsGzip(r.Header) {
+			r.Header.Set("Accept-Encoding", "identity")
+			return
+		}
+		r.Header.Set("Accept-Encoding", "gzip")
+	}
+}
+
+// acceptsGzip returns if the Accept-Encoding header accepts gzip responses.
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+				continue
+			}
+			params = strings.TrimSpace(params)
+			if !strings.HasPrefix(params, "q=") {
+				return true
+			}
+			if f, err := strconv.ParseFloat(params[2:], 64); err != nil || f > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gzipBody decompresses the gzip body, closing the original body on Close.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// decodeResponse decompresses the gzip response of the node when the client
+// doesn't accept gzip or when the response must be uncompressed to the handlers.
+// The response headers are adjusted to describe the uncompressed body.
+func decodeResponse(r *http.Request, res *http.Response) error {
+	if !strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	switch {
+	case r.Method == http.MethodHead, res.StatusCode == http.StatusNoContent, res.StatusCode == http.StatusNotModified:
+		// there is no body to be decompressed.
+		return nil
+	case res.StatusCode == http.StatusPartialContent:
+		// a range of the gzip stream can't be decompressed on it's own, so the
+		// response is fowarded as it is.
+		return nil
+	}
+	if acceptsGzip(r.Header) && !plaintextRequired(r) {
+		return nil
+	}
+	zr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		return err
+	}
+	res.Body = &gzipBody{Reader: zr, body: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	if etag := res.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the uncompressed body is not byte-for-byte the tagged one.
+		res.Header.Set("Etag", "W/"+etag)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// UpstreamErrorClass is the class of an error to connect to a node, or to read
+// it's response, so the certificate and the network problems can be told apart
+// from the capacity ones.
+type UpstreamErrorClass string
+
+// Upstream error classes.
+const (
+	// UpstreamRefused means the node refused the connection, e.g. nothing
+	// listens on the port.
+	UpstreamRefused UpstreamErrorClass = "refused"
+
+	// UpstreamReset means the node reset or closed the connection before the
+	// response was complete.
+	UpstreamReset UpstreamErrorClass = "reset"
+
+	// UpstreamTimeout means the node didn't answer in time, or the dial timed
+	// out.
+	UpstreamTimeout UpstreamErrorClass = "timeout"
+
+	// UpstreamCert means the certificate of the node was rejected, e.g. it's
+	// expired or signed by an unknown authority.
+	UpstreamCert UpstreamErrorClass = "cert"
+
+	// UpstreamTLS means the TLS handshake with the node failed for other
+	// reasons than the certificate, e.g. no common protocol version.
+	UpstreamTLS UpstreamErrorClass = "tls"
+
+	// UpstreamDNS means the host of the node could not be resolved.
+	UpstreamDNS UpstreamErrorClass = "dns"
+
+	// UpstreamOther is any other error.
+	UpstreamOther UpstreamErrorClass = "other"
+)
+
+// upstreamErrorClasses hold all the classes, on the order of the metrics.
+var upstreamErrorClasses = []UpstreamErrorClass{
+	UpstreamRefused, UpstreamReset, UpstreamTimeout, UpstreamCert, UpstreamTLS, UpstreamDNS, UpstreamOther,
+}
+
+// Retryable returns if the requests that failed with the class can be retried
+// on another node even if not idempotent, because the request never reached
+// the node: the connection was refused, the host was not resolved or the TLS
+// handshake failed.
+func (c UpstreamErrorClass) Retryable() bool {
+	switch c {
+	case UpstreamRefused, UpstreamDNS, UpstreamCert, UpstreamTLS:
+		return true
+	}
+	return false
+}
+
+// ClassifyUpstreamError returns the class of an error returned by the requests
+// or the connections to a node.
+func ClassifyUpstreamError(err error) UpstreamErrorClass {
+	var dnsErr *net.DNSError
+	var timeout *ErrUpstreamTimeout
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var record tls.RecordHeaderError
+	switch {
+	case errors.As(err, &dnsErr):
+		return UpstreamDNS
+	case errors.As(err, &timeout), isTimeout(err):
+		return UpstreamTimeout
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalidCert), errors.As(err, &hostname):
+		return UpstreamCert
+	case errors.As(err, &record), strings.Contains(err.Error(), "tls: "):
+		return UpstreamTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return UpstreamRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return UpstreamReset
+	}
+	return UpstreamOther
+}
+
+// countUpstreamError counts the error on the group stats by it's class. The
+// errors of the requests canceled by the client are not counted.
+func (ng *NodeGroup) countUpstreamError(ctx context.Context, err error) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	ng.stats.UpstreamErrors[ClassifyUpstreamError(err)].Inc()
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ETagMode define if the router generates the ETag of the responses of a node
+// group that have no validator.
+type ETagMode int
+
+const (
+	// ETagOff answers the responses as the nodes answer them.
+	ETagOff ETagMode = iota
+
+	// ETagStrong generates strong ETags, for responses that are byte for byte
+	// the same.
+	ETagStrong
+
+	// ETagWeak generates weak ETags, for responses that are only semantically
+	// the same, e.g. when the nodes compress them differently.
+	ETagWeak
+)
+
+// ParseETagMode returns the ETagMode with the name: "off" (or blank), "strong" or
+// "weak".
+func ParseETagMode(s string) (m ETagMode, ok bool) {
+	switch s {
+	case "", "off":
+		return ETagOff, true
+	case "strong":
+		return ETagStrong, true
+	case "weak":
+		return ETagWeak, true
+	}
+	return 0, false
+}
+
+// etagMaxBodyBytes is the maximum size of a response body hashed to generate
+// the ETag. Bigger responses, and the ones of unknown size, are answered without
+// ETag, as the whole body must be held before the answer.
+const etagMaxBodyBytes = 1 << 20
+
+// setETag generates the ETag of the response from the hash of it's body, if the
+// group generates ETags and the node answered a complete response without ETag
+// and Last-Modified, with a Content-Length up to etagMaxBodyBytes. The event
+// streams are never held. It returns the reader of the body to be answered and
+// if the client already holds the response, in wich case it must be answered
+// with 304.
+func (ng *NodeGroup) setETag(r *http.Request, res *http.Response, body io.Reader) (io.Reader, bool) {
+	if ng.ETag == ETagOff || r.Method != http.MethodGet || res.StatusCode != http.StatusOK {
+		return body, false
+	}
+	if res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != "" {
+		return body, false
+	}
+	if res.ContentLength < 0 || res.ContentLength > etagMaxBodyBytes {
+		return body, false
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return body, false
+	}
+
+	b, err := io.ReadAll(io.LimitReader(body, etagMaxBodyBytes+1))
+	if err != nil || len(b) > etagMaxBodyBytes {
+		return io.MultiReader(bytes.NewReader(b), body), false
+	}
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if ng.ETag == ETagWeak {
+		etag = "W/" + etag
+	}
+	res.Header.Set("ETag", etag)
+	return bytes.NewReader(b), NoneMatch(r, etag)
+}
+
+// NoneMatch returns if the If-None-Match of the request matches the etag, using
+// the weak comparison, meaning that the client already holds the response.
+func NoneMatch(r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(inm) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(inm, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
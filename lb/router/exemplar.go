@@ -0,0 +1,51 @@
+package router
+
+import (
+	"net/http"
+	"strings"
+)
+
+// TraceParentHeader is the W3C Trace Context header, the default TraceHeader of
+// the exemplars.
+const TraceParentHeader = "traceparent"
+
+// traceID returns the ID of the trace of the request, to be attached as an
+// exemplar to the latency observations, or a blank string if the router doesn't
+// record exemplars or the request is not traced.
+//
+// The traceparent header is parsed as defined by the W3C Trace Context, and only
+// the sampled traces are returned, as the others are not recorded by the
+// tracing backend. The value of any other header is the trace ID itself.
+func (rtr *Router) traceID(r *http.Request) string {
+	if rtr == nil || rtr.TraceHeader == "" {
+		return ""
+	}
+	v := r.Header.Get(rtr.TraceHeader)
+	if !strings.EqualFold(rtr.TraceHeader, TraceParentHeader) {
+		return v
+	}
+	// version-traceid-parentid-flags, e.g.
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[3]) != 2 {
+		return ""
+	}
+	if parts[1] == "00000000000000000000000000000000" || !isHex(parts[1]) {
+		return ""
+	}
+	// the sampled flag is the least significant bit of the flags.
+	if !isHex(parts[3]) || !strings.ContainsRune("13579bdfBDF", rune(parts[3][1])) {
+		return ""
+	}
+	return parts[1]
+}
+
+// isHex returns if s has only hexadecimal digits.
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
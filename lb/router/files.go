@@ -0,0 +1,114 @@
+package router
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileServerConfig define the configuration of a node group that serves the files
+// of a local directory instead of fowarding the requests to nodes.
+type FileServerConfig struct {
+	// Root define the path of the directory whose files will be served.
+	Root string
+
+	// Index define the name of the file served when a directory is requested.
+	//
+	// The default Index is "index.html".
+	Index string
+
+	// MaxAge define the value in seconds of the Cache-Control max-age directive
+	// sent with the files. If zero, no Cache-Control header is sent.
+	MaxAge int
+}
+
+// serveFile answers the request with the file from the group Files.Root pointed
+// by the request path. Range and conditional requests are supported. Directory
+// listing is not supported: requests to directories are answered with the Index
+// file of the directory.
+func (ng *NodeGroup) serveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	index := ng.Files.Index
+	if index == "" {
+		index = "index.html"
+	}
+
+	// path.Clean on a rooted path removes any ".." element, so the file is
+	// always inside Root.
+	p := path.Clean("/" + r.URL.Path)
+	name := filepath.Join(ng.Files.Root, filepath.FromSlash(p))
+
+	f, err := os.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if fi.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		f.Close()
+		f, err = os.Open(filepath.Join(name, index))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err = f.Stat()
+		if err != nil || fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if ng.Files.MaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", ng.Files.MaxAge))
+	}
+	if ng.DisableRanges {
+		r = r.Clone(r.Context())
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+		w = noRangesWriter{w}
+	}
+	// the response writer sends an *os.File with sendfile(2), so the file is
+	// hidden unless the group has zero-copy.
+	var content io.ReadSeeker = f
+	if !ng.ZeroCopy {
+		content = struct{ io.ReadSeeker }{f}
+	}
+	// ServeContent handles the Range, If-Modified-Since and If-None-Match
+	// headers, and sets Last-Modified and Content-Type.
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+}
+
+// noRangesWriter answers the responses with "Accept-Ranges: none", replacing the
+// header set by http.ServeContent.
+type noRangesWriter struct {
+	http.ResponseWriter
+}
+
+func (w noRangesWriter) WriteHeader(code int) {
+	w.Header().Set("Accept-Ranges", "none")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w noRangesWriter) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(w.ResponseWriter, src)
+}
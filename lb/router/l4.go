@@ -0,0 +1,97 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errStaticNodeDial = errors.New("lb/router: static nodes can't be dialed")
+
+// nodeConn is a raw connection to a node. The connection stops being counted as
+// in flight to the node when it's closed.
+type nodeConn struct {
+	net.Conn
+	n    *Node
+	done func()
+	once sync.Once
+}
+
+func (c *nodeConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.n.inFlight, -1)
+		c.done()
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the connection, if the underlying
+// connection supports it.
+func (c *nodeConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// TCPConn returns the TCP connection to the node, so the data can be copied with
+// the zero-copy system calls. It returns nil if the connection is not TCP.
+func (c *nodeConn) TCPConn() *net.TCPConn {
+	tc, _ := c.Conn.(*net.TCPConn)
+	return tc
+}
+
+// DialNode opens a raw TCP connection to a node of the group, selected by the
+// group Balancer, for the layer 4 listeners that foward whole connections. r is
+// passed to the Balancer, so it can be a synthetic request describing the client
+// connection. The node is dialed on the named port of the evaluation result of r,
+// if one.
+//
+// The connection is counted as in flight to the node until it's closed.
+func (ng *NodeGroup) DialNode(ctx context.Context, r *http.Request) (net.Conn, error) {
+	if !ng.Active() {
+		ng.publishError(ErrStandbyInactive)
+		return nil, ErrStandbyInactive
+	}
+	ng.stats.Requests.Inc()
+	n, done := ng.balance(r)
+	if n == nil {
+		ng.stats.Errors.Inc()
+		ng.publishError(ErrNoHealthyNode)
+		return nil, ErrNoHealthyNode
+	}
+	if n.Static != nil {
+		done()
+		ng.stats.Errors.Inc()
+		return nil, errStaticNodeDial
+	}
+
+	port, err := requestPort(r, n)
+	if err != nil {
+		done()
+		ng.stats.Errors.Inc()
+		ng.publishError(err)
+		return nil, err
+	}
+
+	atomic.AddInt64(&n.inFlight, 1)
+	dialer := ng.newDialer(time.Second * routerDialTimeout)
+	c, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", n.Host, port))
+	if err != nil {
+		atomic.AddInt64(&n.inFlight, -1)
+		done()
+		ng.stats.Errors.Inc()
+		ng.countUpstreamError(ctx, err)
+		if isTimeout(err) {
+			err = &ErrUpstreamTimeout{Group: ng.Name, Node: n.NodeKey, Err: err}
+		}
+		ng.publishError(err)
+		return nil, err
+	}
+	return &nodeConn{Conn: c, n: n, done: done}, nil
+}
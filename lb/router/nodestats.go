@@ -0,0 +1,48 @@
+package router
+
+import (
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// NodeStats hold the traffic statistics of a node, measured on each attempt to
+// foward a request to it.
+type NodeStats struct {
+	// Requests count the attempts to foward a request to the node.
+	Requests metrics.Counter
+
+	// Errors count the attempts that failed or that were answered with a 5xx
+	// status code.
+	Errors metrics.Counter
+
+	// Latency measure the time in seconds until the node answers the response
+	// header, on the attempts that didn't fail.
+	Latency *metrics.Histogram
+}
+
+// Stats returns the traffic statistics of the node.
+//
+// The Latency is cumulative since the node was created. The adaptive balancers
+// get the latency of a recent window subtracting two snapshots, e.g. to prefer
+// the nodes with the lower p99:
+//
+//	cur := n.Stats().Latency.Snapshot()
+//	p99 := cur.Sub(prev).Quantile(.99)
+func (n *Node) Stats() *NodeStats {
+	n.statsOnce.Do(func() {
+		n.stats = &NodeStats{Latency: metrics.NewHistogram(metrics.DefaultBuckets)}
+	})
+	return n.stats
+}
+
+// observe records an attempt answered with the status in the seconds, or failed
+// if status is zero. The traceID, if not blank, is kept as the exemplar of the
+// latency.
+func (s *NodeStats) observe(status int, seconds float64, traceID string) {
+	s.Requests.Inc()
+	if status == 0 || status >= 500 {
+		s.Errors.Inc()
+	}
+	if status != 0 {
+		s.Latency.ObserveWithExemplar(seconds, traceID)
+	}
+}
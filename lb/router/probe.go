@@ -0,0 +1,108 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ProbeType is the type of a health check probe.
+type ProbeType int
+
+// Probe types.
+const (
+	// ProbeHTTP sends a GET request to the probe path and passes if the node
+	// answers 200.
+	ProbeHTTP ProbeType = iota
+
+	// ProbeTCP opens a TCP connection to the probe port and passes if the
+	// connection is established.
+	ProbeTCP
+)
+
+// Probe define one of the probes of a health check.
+type Probe struct {
+	// Type define the type of the probe.
+	Type ProbeType
+
+	// Path define the path to wich the requests of a HTTP probe should be
+	// sent.
+	//
+	// The default Path is "/"
+	Path string
+
+	// Port define the port of the node probed, e.g. the port of a health
+	// endpoint that is not the data port. If zero, the node port is probed.
+	Port uint16
+
+	// PortName define, if not blank, the named port of the node probed,
+	// instead of Port. The probe fails on the nodes without the port.
+	PortName string
+}
+
+// port returns the port of the node probed, and false if the node doesn't have
+// the named port of the probe.
+func (p Probe) port(n *Node) (uint16, bool) {
+	if p.PortName != "" {
+		return n.NamedPort(p.PortName)
+	}
+	if p.Port == 0 {
+		return n.Port, true
+	}
+	return p.Port, true
+}
+
+// runProbes does the health check probes of the node concurrently and returns
+// if at least the quorum of them passed.
+func (ng *NodeGroup) runProbes(ctx context.Context, n *Node) bool {
+	probes := ng.HealthCheck.Probes
+	quorum := ng.HealthCheck.Quorum
+	if quorum <= 0 || quorum > len(probes) {
+		quorum = len(probes)
+	}
+
+	var passed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(probes))
+	for _, p := range probes {
+		go func(p Probe) {
+			defer wg.Done()
+			if ng.runProbe(ctx, n, p) {
+				mu.Lock()
+				passed++
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return passed >= quorum
+}
+
+// runProbe does one probe of the node and returns if it passed.
+func (ng *NodeGroup) runProbe(ctx context.Context, n *Node, p Probe) bool {
+	port, ok := p.port(n)
+	if !ok {
+		return false
+	}
+	if p.Type == ProbeTCP {
+		d := ng.newDialer(ng.healthCheckTimeout())
+		conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", n.Host, port))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	req := ng.newHealthCheckRequest(ctx, n, p)
+	res, err := ng.healthTransport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	// the body must be completely read to allow the connection reuse.
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode == 200
+}
@@ -0,0 +1,161 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Protocol is the protocol spoken by a node.
+type Protocol int32
+
+// Protocols of the nodes.
+const (
+	// ProtocolUnknown means that the protocol of the node was not detected,
+	// and the group HTTPS define the protocol used.
+	ProtocolUnknown Protocol = iota
+
+	// ProtocolHTTP1 means that the node speaks plain HTTP/1.1.
+	ProtocolHTTP1
+
+	// ProtocolHTTPS means that the node speaks HTTP over TLS.
+	ProtocolHTTPS
+
+	// ProtocolH2C means that the node speaks only HTTP/2 without TLS (h2c),
+	// with prior knowledge. The router can't forward requests to such nodes,
+	// so they are kept unhealthy.
+	ProtocolH2C
+)
+
+// String returns the name of the protocol.
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolHTTP1:
+		return "http/1.1"
+	case ProtocolHTTPS:
+		return "https"
+	case ProtocolH2C:
+		return "h2c"
+	}
+	return "unknown"
+}
+
+// Protocol returns the protocol detected for the node.
+func (n *Node) Protocol() Protocol {
+	return Protocol(atomic.LoadInt32(&n.protocol))
+}
+
+// scheme returns the URL scheme of the requests to the node.
+func (ng *NodeGroup) scheme(n *Node) string {
+	switch n.Protocol() {
+	case ProtocolHTTPS:
+		return "https"
+	case ProtocolUnknown:
+		if ng.HTTPS {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+// detectProtocol detects the protocol of the node, if the group detects the
+// protocols and it was not detected yet, and returns if the node can be
+// health checked.
+func (ng *NodeGroup) detectProtocol(ctx context.Context, n *Node) bool {
+	if !ng.DetectProtocol || n.Static != nil {
+		return true
+	}
+	switch n.Protocol() {
+	case ProtocolH2C:
+		return false
+	case ProtocolUnknown:
+	default:
+		return true
+	}
+
+	ctxT, cancel := context.WithTimeout(ctx, ng.healthCheckTimeout())
+	defer cancel()
+	p, err := ng.probeProtocol(ctxT, n)
+	if err != nil {
+		return false
+	}
+	atomic.StoreInt32(&n.protocol, int32(p))
+	log.Println(n.NodeKey, "speaks", p)
+	return p != ProtocolH2C
+}
+
+// h2Preface is the connection preface of HTTP/2, followed by an empty SETTINGS
+// frame.
+var h2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04\x00\x00\x00\x00\x00")
+
+// probeProtocol detects the protocol of the node. A TLS handshake is attempted
+// first, then a plain HTTP/1.1 request and then the HTTP/2 preface. An error is
+// returned if the node can't be reached or speaks none of them.
+func (ng *NodeGroup) probeProtocol(ctx context.Context, n *Node) (Protocol, error) {
+	d := ng.newDialer(ng.healthCheckTimeout())
+	addr := fmt.Sprintf("%s:%d", n.Host, n.Port)
+	deadline, _ := ctx.Deadline()
+
+	// the handshake only tells if the node speaks TLS, the certificate is
+	// verified later by the requests.
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return ProtocolUnknown, err
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: n.Host, InsecureSkipVerify: true})
+	tc.SetDeadline(deadline)
+	err = tc.Handshake()
+	conn.Close()
+	if err == nil {
+		return ProtocolHTTPS, nil
+	}
+
+	conn, err = d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return ProtocolUnknown, err
+	}
+	conn.SetDeadline(deadline)
+	req := ng.newHealthCheckRequest(ctx, n, Probe{Path: ng.HealthCheck.Path})
+	req.URL.Scheme = "http"
+	err = req.Write(conn)
+	if err == nil {
+		var res *http.Response
+		res, err = http.ReadResponse(bufio.NewReader(conn), req)
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+	conn.Close()
+	if err == nil {
+		return ProtocolHTTP1, nil
+	}
+
+	conn, err = d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return ProtocolUnknown, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(h2Preface); err != nil {
+		return ProtocolUnknown, err
+	}
+	// the server preface is a SETTINGS frame, the type is the fourth byte of
+	// the frame header.
+	var h [9]byte
+	if _, err := io.ReadFull(conn, h[:]); err != nil {
+		return ProtocolUnknown, err
+	}
+	if h[3] == 0x4 {
+		return ProtocolH2C, nil
+	}
+	return ProtocolUnknown, errUnknownProtocol
+}
+
+// errUnknownProtocol is returned when the protocol of a node is not detected.
+var errUnknownProtocol = errors.New("lb/router: unknown node protocol")
@@ -0,0 +1,77 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/overload"
+	"github.com/mhef/statera/lb/server"
+)
+
+// defaultShedRetryAfter is the Retry-After in seconds answered to the shed
+// requests when LoadShedding.RetryAfter is not set.
+const defaultShedRetryAfter = 5
+
+// LoadShedding define when the router sheds the requests, by their priority
+// class, to keep the high priority requests responsive under pressure. The
+// pressure is measured by the requests in flight to the nodes and, if there is
+// an Overload monitor, by the resources of the LB itself. The shed requests are
+// answered with 503 and Retry-After.
+type LoadShedding struct {
+	// LowInFlight define the number of requests in flight from wich the low
+	// priority requests are shed. If zero, they are shed only with the normal
+	// priority ones.
+	LowInFlight int64
+
+	// NormalInFlight define the number of requests in flight from wich the
+	// normal and low priority requests are shed. If zero, the normal priority
+	// requests are never shed.
+	NormalInFlight int64
+
+	// RetryAfter define the Retry-After in seconds answered to the shed
+	// requests.
+	//
+	// The default RetryAfter is 5 seconds.
+	RetryAfter int
+
+	// Overload define, if not nil, the monitor of the LB resources. On the
+	// elevated level the low priority requests are shed, and on the critical
+	// level the normal priority requests are also shed.
+	Overload *overload.Monitor
+}
+
+// shouldShed returns if a request of the priority class should be shed with the
+// current in flight requests.
+func (ls *LoadShedding) shouldShed(p evaluator.PriorityClass, inFlight int64) bool {
+	if ls == nil {
+		return false
+	}
+	level := ls.Overload.Level()
+	switch p {
+	case evaluator.PriorityLow:
+		if ls.LowInFlight > 0 && inFlight >= ls.LowInFlight {
+			return true
+		}
+		if level >= overload.LevelElevated {
+			return true
+		}
+		fallthrough
+	case evaluator.PriorityNormal:
+		if ls.NormalInFlight > 0 && inFlight >= ls.NormalInFlight {
+			return true
+		}
+		return level >= overload.LevelCritical
+	}
+	return false
+}
+
+// writeShed answers a shed request.
+func (ls *LoadShedding) writeShed(w http.ResponseWriter) {
+	ra := ls.RetryAfter
+	if ra <= 0 {
+		ra = defaultShedRetryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(ra))
+	server.WriteError(w, http.StatusServiceUnavailable, "service overloaded")
+}
@@ -0,0 +1,206 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigningType is the type of the signature of the requests fowarded to a node
+// group.
+type SigningType int
+
+const (
+	// SigningHMAC signs the method, the path with query and a timestamp with
+	// HMAC-SHA256.
+	SigningHMAC SigningType = iota
+
+	// SigningSigV4 signs the requests with the AWS Signature Version 4.
+	SigningSigV4
+)
+
+// Default headers of the HMAC signatures.
+const (
+	defaultSignatureHeader = "X-Statera-Signature"
+	defaultTimestampHeader = "X-Statera-Timestamp"
+)
+
+// RequestSigning define the signature added to the requests fowarded to the nodes
+// of a group, so the nodes can verify that the requests passed through the LB and
+// reject the direct access.
+//
+// The HMAC signature is the hex HMAC-SHA256, with Key, of the method, the path
+// with query and the unix timestamp of the request, joined by "\n". The
+// timestamp is sent on the TimestampHeader, so the nodes can also reject the old
+// requests.
+type RequestSigning struct {
+	Type SigningType
+
+	// Key define the secret of the HMAC signatures.
+	Key []byte
+
+	// SignatureHeader define the header of the HMAC signature.
+	//
+	// The default SignatureHeader is "X-Statera-Signature".
+	SignatureHeader string
+
+	// TimestampHeader define the header of the timestamp of the HMAC
+	// signature.
+	//
+	// The default TimestampHeader is "X-Statera-Timestamp".
+	TimestampHeader string
+
+	// AccessKeyID, SecretAccessKey and SessionToken define the AWS credentials
+	// of the SigV4 signatures. SessionToken is only needed by temporary
+	// credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Region and Service define the AWS region and service of the SigV4
+	// signatures, e.g. "us-east-1" and "execute-api".
+	Region  string
+	Service string
+}
+
+// sign adds the signature to the request. The URL of the request must already
+// point to the node.
+func (rs *RequestSigning) sign(r *http.Request, now time.Time) {
+	if rs.Type == SigningSigV4 {
+		rs.signSigV4(r, now)
+		return
+	}
+
+	sh, th := rs.SignatureHeader, rs.TimestampHeader
+	if sh == "" {
+		sh = defaultSignatureHeader
+	}
+	if th == "" {
+		th = defaultTimestampHeader
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, rs.Key)
+	mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + ts))
+	r.Header.Set(th, ts)
+	r.Header.Set(sh, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// unsignedPayload is the payload hash of the SigV4 signatures of the requests
+// with body, whose body is not hashed to not hold it before fowarding.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// signSigV4 adds the AWS Signature Version 4 to the request, on the
+// Authorization header. The host, the date, the payload hash and the session
+// token, if one, are the signed headers.
+func (rs *RequestSigning) signSigV4(r *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := unsignedPayload
+	if r.Body == nil || r.Body == http.NoBody {
+		payloadHash = hashHex(nil)
+	}
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if rs.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", rs.SessionToken)
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	if rs.SessionToken != "" {
+		headers["x-amz-security-token"] = rs.SessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		path,
+		canonicalQuery(r.URL.Query()),
+		ch.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + rs.Region + "/" + rs.Service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+rs.SecretAccessKey), date)
+	key = hmacSHA256(key, rs.Region)
+	key = hmacSHA256(key, rs.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+rs.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery returns the query of the SigV4 canonical request: the params
+// sorted by name and value, encoded as RFC 3986.
+func canonicalQuery(q url.Values) string {
+	params := make([][2]string, 0, len(q))
+	for k, vv := range q {
+		for _, v := range vv {
+			params = append(params, [2]string{awsEscape(k), awsEscape(v)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	var b strings.Builder
+	for i, p := range params {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(p[0] + "=" + p[1])
+	}
+	return b.String()
+}
+
+// awsEscape encodes s as RFC 3986, as required by the SigV4 canonical query.
+func awsEscape(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.ReplaceAll(s, "+", "%20")
+	return strings.ReplaceAll(s, "%7E", "~")
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,101 @@
+package router
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+var (
+	// ErrNotStandby is returned when a group that is not a standby group is
+	// activated or deactivated.
+	ErrNotStandby = errors.New("lb/router: the node group is not a standby group")
+
+	// ErrInvalidFailover is returned by New when the Failover of a group is not
+	// an other group in standby.
+	ErrInvalidFailover = errors.New("lb/router: the failover group must be an other standby group")
+
+	// ErrStandbyInactive is returned when a connection is fowarded to a standby
+	// group that is not active.
+	ErrStandbyInactive = errors.New("lb/router: the standby node group is not active")
+)
+
+// Activate makes the standby group serve the requests routed to it, and the
+// requests of the groups that fail over to it. It takes effect on the next
+// request, as the nodes of the group are already health checked.
+func (ng *NodeGroup) Activate() error {
+	if !ng.Standby {
+		return ErrNotStandby
+	}
+	if atomic.SwapInt32(&ng.active, 1) == 0 {
+		log.Println("standby node group", ng.Name, "activated")
+	}
+	return nil
+}
+
+// Deactivate puts the standby group back on standby.
+func (ng *NodeGroup) Deactivate() error {
+	if !ng.Standby {
+		return ErrNotStandby
+	}
+	if atomic.SwapInt32(&ng.active, 0) == 1 {
+		log.Println("standby node group", ng.Name, "deactivated")
+	}
+	return nil
+}
+
+// Active returns if the group serves requests. The groups that are not on
+// standby are always active.
+func (ng *NodeGroup) Active() bool {
+	return !ng.Standby || atomic.LoadInt32(&ng.active) == 1
+}
+
+// hasPool returns if the group has any node on it's Balancer.
+func (ng *NodeGroup) hasPool() bool {
+	ng.nodesMu.RLock()
+	defer ng.nodesMu.RUnlock()
+	for _, n := range ng.nodes {
+		if n.pooled {
+			return true
+		}
+	}
+	return false
+}
+
+// serving returns the group that serves the requests routed to ng: it's Failover
+// group when active, or when ng has no node available and the failover has,
+// then it's AllDownGroup when ng has no node available and the AllDownFallback
+// policy, otherwise ng itself. Returns nil if ng is an inactive standby group.
+func (rtr *Router) serving(ng *NodeGroup) *NodeGroup {
+	ngs := rtr.groups()
+	if ng.Failover != "" {
+		fo := ngs[ng.Failover]
+		if fo.Active() || (!ng.hasPool() && fo.hasPool()) {
+			return fo
+		}
+	}
+	if ng.AllDown == AllDownFallback && !ng.hasPool() {
+		if fb := ngs[ng.AllDownGroup]; fb.Active() {
+			return fb
+		}
+	}
+	if !ng.Active() {
+		return nil
+	}
+	return ng
+}
+
+// validateFailover returns ErrInvalidFailover if the Failover of a group is not
+// an other standby group of ngs.
+func validateFailover(ngs map[string]*NodeGroup) error {
+	for _, ng := range ngs {
+		if ng.Failover == "" {
+			continue
+		}
+		fo, ok := ngs[ng.Failover]
+		if !ok || fo == ng || !fo.Standby {
+			return ErrInvalidFailover
+		}
+	}
+	return nil
+}
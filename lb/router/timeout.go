@@ -0,0 +1,81 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/server"
+)
+
+// Timeout budgets reported on the 504 responses.
+const (
+	// budgetPerTry is the time of a single attempt to answer the response
+	// header, limited by the group HeaderTimeout.
+	budgetPerTry = "per_try"
+
+	// budgetTotal is the time of the whole request, limited by the timeout of
+	// the matched rule or the RequestTimeout of the listener.
+	budgetTotal = "total"
+
+	// budgetConnect is the time to connect to the node.
+	budgetConnect = "connect"
+)
+
+// timeoutReport is the body of the 504 responses in JSON, describing the budget
+// exceeded by the request, so the application teams can tell wich timeout must
+// be raised.
+type timeoutReport struct {
+	Error string `json:"error"`
+
+	// Budget is the budget exceeded: "per_try", "total" or "connect".
+	Budget string `json:"budget"`
+
+	// Source is where the budget is configured: "group", "rule", "listener"
+	// or "router" for the fixed connect timeout.
+	Source string `json:"source"`
+
+	// LimitMS is the configured limit of the budget, in milliseconds.
+	LimitMS int64 `json:"limit_ms"`
+}
+
+// timeoutReport returns the report of the budget exceeded by the request r to
+// the node, with the evaluation e, that failed with the timeout err.
+func (ng *NodeGroup) timeoutReport(r *http.Request, e evaluator.EvaluationResult, err *ErrUpstreamTimeout) timeoutReport {
+	rep := timeoutReport{Error: "gateway timeout"}
+	switch {
+	case err.Header:
+		rep.Budget, rep.Source = budgetPerTry, "group"
+		rep.LimitMS = int64(ng.HeaderTimeout)
+	case errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		rep.Budget, rep.Source = budgetTotal, "rule"
+		limit := time.Duration(e.Timeout) * time.Second
+		if lt, ok := server.RequestTimeoutFromRequest(r); ok && (e.Timeout <= 0 || lt < limit) {
+			rep.Source, limit = "listener", lt
+		}
+		rep.LimitMS = limit.Milliseconds()
+	default:
+		rep.Budget, rep.Source = budgetConnect, "router"
+		rep.LimitMS = routerDialTimeout * 1000
+	}
+	return rep
+}
+
+// writeTimeout writes the 504 response of a request that timed out, with the
+// report of the exceeded budget as JSON if the client accepts it, or on the
+// error page otherwise.
+func writeTimeout(w http.ResponseWriter, r *http.Request, rep timeoutReport) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(rep)
+		return
+	}
+	server.WriteError(w, http.StatusGatewayTimeout, fmt.Sprintf("gateway timeout: the %s budget of %dms set by the %s was exceeded",
+		strings.Replace(rep.Budget, "_", "-", 1), rep.LimitMS, rep.Source))
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"context"
+	"net/http"
+)
+
+// UpstreamHeader is the response header with the node group and the node that
+// served the request, set on the listeners that expose it.
+const UpstreamHeader = "X-Statera-Upstream"
+
+// Upstream is the node group and the node selected to serve a request.
+type Upstream struct {
+	Group string
+	Node  NodeKey
+}
+
+// String returns the upstream on the format of the UpstreamHeader, e.g.
+// `web/10.0.0.1:8080`.
+func (u Upstream) String() string {
+	return u.Group + "/" + u.Node.String()
+}
+
+// ctxUpstreamSlotKey is the type used to define the upstream slot key.
+type ctxUpstreamSlotKey struct{}
+
+// upstreamSlotKey is the key that holds the slot of the upstream of a request.
+var upstreamSlotKey ctxUpstreamSlotKey
+
+// upstreamSlot hold the upstream selected for a tracked request.
+type upstreamSlot struct {
+	upstream Upstream
+	set      bool
+
+	// expose define if the UpstreamHeader is set on the response.
+	expose bool
+}
+
+// TrackUpstream returns the request with a slot for the upstream on it's
+// context, if it has none yet. The router tracks the requests it handles, so
+// the handlers chained after it get the upstream; the handlers that need the
+// upstream after the rest of the chain handles the request, e.g. the access
+// log, must track the request before it reaches the router.
+func TrackUpstream(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(upstreamSlotKey).(*upstreamSlot); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), upstreamSlotKey, &upstreamSlot{}))
+}
+
+// UpstreamFromRequest returns the upstream of the request.
+//
+// The ok bool is false if the request is not tracked or no node was selected,
+// e.g. the group has no healthy node or serves files.
+func UpstreamFromRequest(r *http.Request) (u Upstream, ok bool) {
+	if s, found := r.Context().Value(upstreamSlotKey).(*upstreamSlot); found && s.set {
+		return s.upstream, true
+	}
+	return Upstream{}, false
+}
+
+// ExposeUpstream is a handler that makes the router set the UpstreamHeader on
+// the responses of the requests that pass through it. It must be chained
+// before the router.
+func ExposeUpstream(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		r = TrackUpstream(r)
+		r.Context().Value(upstreamSlotKey).(*upstreamSlot).expose = true
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// setUpstream define the upstream of the request, if the request is tracked.
+func setUpstream(r *http.Request, group string, n *Node) {
+	if s, ok := r.Context().Value(upstreamSlotKey).(*upstreamSlot); ok {
+		s.upstream, s.set = Upstream{Group: group, Node: n.NodeKey}, true
+	}
+}
+
+// setUpstreamHeader sets the UpstreamHeader on h, if the request has an
+// upstream and is exposing it.
+func setUpstreamHeader(h http.Header, r *http.Request) {
+	if s, ok := r.Context().Value(upstreamSlotKey).(*upstreamSlot); ok && s.set && s.expose {
+		h.Set(UpstreamHeader, s.upstream.String())
+	}
+}
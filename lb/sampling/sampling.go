@@ -0,0 +1,37 @@
+// Package sampling decides wich requests are recorded by the access log and the
+// attempt traces, keeping the cost of the observability reasonable on high
+// request rates: the errors are always recorded, while only a percentage of the
+// successful requests is.
+package sampling
+
+import "github.com/mhef/statera/lb/random"
+
+// Sampler decides if a request is recorded, after it's answered. A nil Sampler
+// records every request.
+type Sampler struct {
+	// SuccessPercent define the percentage of the successful requests, those
+	// answered with a status below 400, that are recorded. The requests
+	// answered with an error status are always recorded.
+	SuccessPercent float64
+
+	// Tags define the rule tags whose requests are always recorded, e.g. the
+	// tag of the rules of a critical API.
+	Tags map[string]bool
+}
+
+// Sample returns if the request answered with the status, that matched a rule
+// with the tags, is recorded.
+func (s *Sampler) Sample(status int, tags []string) bool {
+	if s == nil || status >= 400 {
+		return true
+	}
+	for _, t := range tags {
+		if s.Tags[t] {
+			return true
+		}
+	}
+	if s.SuccessPercent <= 0 {
+		return false
+	}
+	return s.SuccessPercent >= 100 || random.Float64()*100 < s.SuccessPercent
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// Delays between the retries of a failed Accept.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// AcceptBackoff spaces the retries of the Accept calls that fail with a
+// temporary error, e.g. when the process runs out of file descriptors, as the
+// http.Server does. The zero value is ready to use.
+type AcceptBackoff struct {
+	delay time.Duration
+}
+
+// Retry returns if the Accept error is temporary, in wich case it's logged and
+// Retry sleeps before returning, doubling the delay of each consecutive error
+// up to one second. Other errors, e.g. the listener was closed, return false.
+func (b *AcceptBackoff) Retry(err error) bool {
+	ne, ok := err.(net.Error)
+	if !ok || !(ne.Timeout() || ne.Temporary()) {
+		return false
+	}
+	b.delay *= 2
+	if b.delay == 0 {
+		b.delay = minAcceptDelay
+	}
+	if b.delay > maxAcceptDelay {
+		b.delay = maxAcceptDelay
+	}
+	log.Printf("lb/server: accept error: %v; retrying in %v", err, b.delay)
+	time.Sleep(b.delay)
+	return true
+}
+
+// Reset resets the delay after an Accept succeeds.
+func (b *AcceptBackoff) Reset() {
+	b.delay = 0
+}
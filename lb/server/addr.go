@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// resolveAddrs returns the original source and destination addresses of the
+// request. The PROXY protocol addresses are already the ones of the connection,
+// so only the forwarded headers, if trusted, are applied over them. If the
+// listener sets the forwarded headers, they are set on r.
+func (l *Listener) resolveAddrs(r *http.Request) (src, dst *net.TCPAddr) {
+	src = parseTCPAddr(r.RemoteAddr)
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ta, ok := la.(*net.TCPAddr); ok {
+			// the local address is shared by the requests of the
+			// connection, so it's copied before being changed.
+			c := *ta
+			dst = &c
+		} else {
+			dst = parseTCPAddr(la.String())
+		}
+	}
+	peer := src
+	var peerIP net.IP
+	if peer != nil {
+		peerIP = peer.IP
+	}
+	trusted := l.TrustForwarded && l.trustedProxy(peerIP)
+
+	xff := forwardedFor(r.Header)
+	i := l.clientIndex(peerIP, xff)
+	if i < len(xff) {
+		src = &net.TCPAddr{IP: parseForwardedIP(xff[i])}
+	}
+	if trusted {
+		if p, err := strconv.ParseUint(r.Header.Get("X-Forwarded-Port"), 10, 16); err == nil && dst != nil {
+			dst.Port = int(p)
+		}
+	}
+	if l.ForwardedHeaders {
+		setForwardedHeaders(r, xff[i:], peer, dst, trusted)
+	}
+	return src, dst
+}
+
+// forwardedFor returns the addresses of the X-Forwarded-For headers, from the
+// client to the nearest proxy.
+func forwardedFor(h http.Header) []string {
+	var ret []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, a := range strings.Split(v, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				ret = append(ret, a)
+			}
+		}
+	}
+	return ret
+}
+
+// clientIndex returns the index on xff of the client address, for the peer
+// with the IP. Each proxy
+// appends the address of it's peer, so, from the peer of the listener, the
+// addresses are walked to the left while they are of trusted proxies, up to the
+// trusted hops. The addresses at the left of the client are sent by the clients
+// and can't be trusted. If the client is the peer, len(xff) is returned.
+func (l *Listener) clientIndex(ip net.IP, xff []string) int {
+	i := len(xff)
+	if !l.TrustForwarded {
+		return i
+	}
+	hops := l.TrustedHops
+	if hops <= 0 {
+		hops = 1
+	}
+	for ; hops > 0 && i > 0; hops-- {
+		if !l.trustedProxy(ip) {
+			break
+		}
+		if ip = parseForwardedIP(xff[i-1]); ip == nil {
+			break
+		}
+		i--
+	}
+	return i
+}
+
+// trustedProxy returns if the proxy with the IP is trusted to set the forwarded
+// headers.
+func (l *Listener) trustedProxy(ip net.IP) bool {
+	if len(l.TrustedProxies) == 0 {
+		return true
+	}
+	for _, n := range l.TrustedProxies {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders sets the forwarded headers of r. xff are the trusted
+// X-Forwarded-For addresses, from the client, to wich the peer address is
+// appended. The other headers are kept only if set by a trusted peer.
+func setForwardedHeaders(r *http.Request, xff []string, peer, dst *net.TCPAddr, trusted bool) {
+	if peer != nil {
+		xff = append(xff[:len(xff):len(xff)], peer.IP.String())
+	}
+	if len(xff) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(xff, ", "))
+	} else {
+		r.Header.Del("X-Forwarded-For")
+	}
+	if !trusted || r.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if !trusted || r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if !trusted || r.Header.Get("X-Forwarded-Port") == "" {
+		if dst != nil {
+			r.Header.Set("X-Forwarded-Port", strconv.Itoa(dst.Port))
+		} else {
+			r.Header.Del("X-Forwarded-Port")
+		}
+	}
+}
+
+// parseTCPAddr parses an address in the form "host:port", where host is an IP.
+// It returns nil if the address is invalid.
+func parseTCPAddr(s string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
+
+// parseForwardedIP parses an IP of the X-Forwarded-For header, wich some proxies
+// send with the port.
+func parseForwardedIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mhef/statera/lb/errevent"
+)
+
+// defaultCertReloadInterval is the interval in seconds used to check the
+// certificate files for changes when TLS.ReloadInterval is not set.
+const defaultCertReloadInterval = 60
+
+// certFileState hold the state of a certificate and key file pair on the last
+// time they were loaded.
+type certFileState struct {
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// certStore hold the loaded certificates of a listener and allows them to be
+// swapped atomically when the files on disk change, without restarting the
+// listener.
+type certStore struct {
+	files []Certificate
+
+	// certs hold the currently loaded []tls.Certificate.
+	certs atomic.Value
+
+	// state hold the modification times of the files of each certificate. It
+	// is only accessed by the watcher goroutine after the first load.
+	state []certFileState
+}
+
+// newCertStore loads the certificate files and returns a certStore holding them.
+func newCertStore(files []Certificate) (*certStore, error) {
+	cs := &certStore{
+		files: files,
+		state: make([]certFileState, len(files)),
+	}
+	if _, err := cs.reload(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// reload verifies if any certificate file changed since the last load and, if
+// so, loads all the certificates again and swap them in.
+//
+// Returns a bool indicating if the certificates were swapped.
+func (cs *certStore) reload() (bool, error) {
+	state := make([]certFileState, len(cs.files))
+	changed := false
+	for i, f := range cs.files {
+		ci, err := os.Stat(f.CertFile)
+		if err != nil {
+			return false, err
+		}
+		ki, err := os.Stat(f.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		state[i] = certFileState{certMod: ci.ModTime(), keyMod: ki.ModTime()}
+		if state[i] != cs.state[i] {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	certs := make([]tls.Certificate, 0, len(cs.files))
+	for _, f := range cs.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		certs = append(certs, cert)
+	}
+	cs.certs.Store(certs)
+	cs.state = state
+	return true, nil
+}
+
+// watch checks the certificate files for changes on each interval and reloads
+// them when needed. Reload failures are logged and published on errs, and the
+// previous certificates are kept.
+//
+// This func blocks until the context is done.
+func (cs *certStore) watch(ctx context.Context, interval time.Duration, errs *errevent.Bus) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			ok, err := cs.reload()
+			if err != nil {
+				errs.Publish("server", err)
+				log.Println("lb/server: failed to reload certificates:", err)
+				continue
+			}
+			if ok {
+				log.Println("lb/server: certificates reloaded")
+			}
+		}
+	}
+}
+
+var errNoCertificate = errors.New("lb/server: no certificate available")
+
+// getCertificate implements the tls.Config.GetCertificate func. It returns the
+// first loaded certificate that supports the client hello, or the first one if
+// none of them does.
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := cs.certs.Load().([]tls.Certificate)
+	if len(certs) == 0 {
+		return nil, errNoCertificate
+	}
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
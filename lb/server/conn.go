@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Connection hold the state of a client connection, shared by all the requests
+// received through it.
+type Connection struct {
+	// rate is the connection tracked by the transfer rate monitor, if one.
+	rate *rateConn
+
+	// requests hold the number of requests received through the connection.
+	// It must be accessed atomically.
+	requests int64
+
+	onClose []func()
+	closed  bool
+	mu      sync.Mutex // guards onClose and closed
+}
+
+// OnClose registers f to be called when the client connection is closed or
+// hijacked. If the connection is already closed, f is called right away.
+func (c *Connection) OnClose(f func()) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		f()
+		return
+	}
+	c.onClose = append(c.onClose, f)
+	c.mu.Unlock()
+}
+
+// countRequest counts a request received through the connection and returns
+// the number of requests received so far.
+func (c *Connection) countRequest() int64 {
+	return atomic.AddInt64(&c.requests, 1)
+}
+
+// close marks the connection as closed and calls the registered funcs.
+func (c *Connection) close() {
+	c.mu.Lock()
+	fs := c.onClose
+	c.onClose = nil
+	c.closed = true
+	c.mu.Unlock()
+	for _, f := range fs {
+		f()
+	}
+}
+
+// ctxConnectionKey is the type used to define the Connection key.
+type ctxConnectionKey struct{}
+
+// connectionKey is the key that holds the Connection through which the request
+// arrived.
+var connectionKey ctxConnectionKey
+
+// ConnectionFromRequest returns the client Connection through which the request
+// arrived, if one.
+//
+// The ok bool must be checked before using the connection.
+func ConnectionFromRequest(r *http.Request) (c *Connection, ok bool) {
+	c, ok = r.Context().Value(connectionKey).(*Connection)
+	return
+}
+
+// connTracker hold the Connection of each client connection of a listener.
+type connTracker struct {
+	// rate is the transfer rate monitor of the listener, if one.
+	rate *rateMonitor
+
+	conns map[net.Conn]*Connection
+	mu    sync.Mutex // guards conns
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]*Connection)}
+}
+
+// baseConn returns the accepted connection of c, unwrapping the TLS connections.
+// The connections of the listeners with sniffing are the sniffed connections,
+// wrapped by the rate monitor, if one.
+func baseConn(c net.Conn) net.Conn {
+	if tc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		return tc.NetConn()
+	}
+	return c
+}
+
+// connContext must be set as the http.Server ConnContext hook. It adds a new
+// Connection to the context of the connection.
+func (t *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	conn := &Connection{}
+	if rc, ok := baseConn(c).(*rateConn); ok && t.rate != nil {
+		conn.rate = rc
+		conn.OnClose(func() { t.rate.remove(rc) })
+	}
+	t.mu.Lock()
+	t.conns[baseConn(c)] = conn
+	t.mu.Unlock()
+	return context.WithValue(ctx, connectionKey, conn)
+}
+
+// connState must be set as the http.Server ConnState hook. It closes the
+// Connection of the closed and hijacked connections.
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	bc := baseConn(c)
+	t.mu.Lock()
+	conn, ok := t.conns[bc]
+	delete(t.conns, bc)
+	t.mu.Unlock()
+	if ok {
+		conn.close()
+	}
+}
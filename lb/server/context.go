@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"time"
 )
 
 // ctxListenerKey is the type used to define the Listener key.
@@ -20,3 +23,70 @@ func ListenerFromRequest(r *http.Request) (listener string, ok bool) {
 	listener, ok = r.Context().Value(listenerKey).(string)
 	return
 }
+
+// ContextWithListener returns a copy of ctx holding the listener, as the
+// Listener does for each request that arrives through it.
+func ContextWithListener(ctx context.Context, listener string) context.Context {
+	return context.WithValue(ctx, listenerKey, listener)
+}
+
+// ctxRequestTimeoutKey is the type used to define the request timeout key.
+type ctxRequestTimeoutKey struct{}
+
+// requestTimeoutKey is the key that holds the RequestTimeout of the listener
+// through which the request arrived.
+var requestTimeoutKey ctxRequestTimeoutKey
+
+// RequestTimeoutFromRequest returns the RequestTimeout of the listener through
+// which the request arrived, if the listener has one.
+func RequestTimeoutFromRequest(r *http.Request) (timeout time.Duration, ok bool) {
+	timeout, ok = r.Context().Value(requestTimeoutKey).(time.Duration)
+	return
+}
+
+// ctxAddrsKey is the type used to define the addresses key.
+type ctxAddrsKey struct{}
+
+// addrsKey is the key that holds the resolved addresses of the request.
+var addrsKey ctxAddrsKey
+
+// addrs hold the original source and destination addresses of a request.
+type addrs struct {
+	src, dst *net.TCPAddr
+}
+
+// SourceAddrFromRequest returns the original source address of the request, as
+// resolved by the listener through wich it arrived: the source of the PROXY
+// protocol header, if one, or of the X-Forwarded-For header, if trusted, or the
+// peer address. The port is zero if unknown, as when resolved from the
+// X-Forwarded-For header.
+//
+// The ok bool must be checked before using the address.
+func SourceAddrFromRequest(r *http.Request) (addr *net.TCPAddr, ok bool) {
+	a, ok := r.Context().Value(addrsKey).(addrs)
+	if !ok || a.src == nil {
+		return nil, false
+	}
+	return a.src, true
+}
+
+// DestinationAddrFromRequest returns the original destination address of the
+// request, as resolved by the listener through wich it arrived: the destination
+// of the PROXY protocol header, if one, or the local address of the connection.
+// If the X-Forwarded-Port header is trusted, it overrides the port.
+//
+// The ok bool must be checked before using the address.
+func DestinationAddrFromRequest(r *http.Request) (addr *net.TCPAddr, ok bool) {
+	a, ok := r.Context().Value(addrsKey).(addrs)
+	if !ok || a.dst == nil {
+		return nil, false
+	}
+	return a.dst, true
+}
+
+// ContextWithAddrs returns a copy of ctx holding the original source and
+// destination addresses, as the Listener does for each request that arrives
+// through it. Any of them may be nil.
+func ContextWithAddrs(ctx context.Context, src, dst *net.TCPAddr) context.Context {
+	return context.WithValue(ctx, addrsKey, addrs{src: src, dst: dst})
+}
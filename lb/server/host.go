@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// normalizeHost rewrites the requests with an absolute-URI target, e.g.
+// "GET http://example.com/ HTTP/1.0", to the origin form with the host of the
+// target, and sets the defaultHost, if not blank, on the requests without a
+// host, so the requests of legacy clients are evaluated like any other. The
+// hosts are lowercased.
+func normalizeHost(r *http.Request, defaultHost string) {
+	if r.URL.IsAbs() || r.URL.Host != "" {
+		// the host of an absolute-URI target takes precedence over the Host
+		// header, as required by RFC 7230.
+		if r.URL.Host != "" {
+			r.Host = r.URL.Host
+		}
+		r.URL.Scheme = ""
+		r.URL.Host = ""
+		r.RequestURI = r.URL.RequestURI()
+	}
+	if r.Host == "" {
+		r.Host = defaultHost
+	}
+	r.Host = strings.ToLower(r.Host)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// listen binds addr, or the Interfaces addresses on it's port, and the Addrs of
+// the listener. If more than one address is bound, the returned listener
+// accepts the connections of all of them.
+func (l *Listener) listen(addr string) (net.Listener, error) {
+	addrs := []string{addr}
+	if len(l.Interfaces) > 0 {
+		var err error
+		if addrs, err = interfaceAddrs(addr, l.Interfaces); err != nil {
+			return nil, err
+		}
+	}
+	addrs = append(addrs, l.Addrs...)
+
+	lns := make([]net.Listener, 0, len(addrs))
+	for _, a := range addrs {
+		ln, err := net.Listen("tcp", a)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	if len(lns) == 1 {
+		return lns[0], nil
+	}
+	return newMultiListener(lns), nil
+}
+
+// interfaceAddrs returns the unicast addresses of the network interfaces, on the
+// port of addr.
+func interfaceAddrs(addr string, ifaces []string) ([]string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, name := range ifaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ifAddrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range ifAddrs {
+			ipn, ok := a.(*net.IPNet)
+			// the link-local addresses would need the zone of the
+			// interface, and are not reachable by the clients anyway.
+			if !ok || ipn.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(ipn.IP.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("lb/server: no address to bind on the interfaces %v", ifaces)
+	}
+	return addrs, nil
+}
+
+// multiListener is a net.Listener that accepts the connections of several
+// listeners, so a single HTTP server serves all of them.
+type multiListener struct {
+	lns []net.Listener
+
+	conns     chan net.Conn
+	err       chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newMultiListener returns a multiListener for the connections accepted by lns,
+// and starts accepting them.
+func newMultiListener(lns []net.Listener) *multiListener {
+	l := &multiListener{
+		lns:   lns,
+		conns: make(chan net.Conn),
+		err:   make(chan error, len(lns)),
+		done:  make(chan struct{}),
+	}
+	for _, ln := range lns {
+		go l.acceptLoop(ln)
+	}
+	return l
+}
+
+// acceptLoop accepts the connections of ln and hands them to Accept.
+func (l *multiListener) acceptLoop(ln net.Listener) {
+	var b AcceptBackoff
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if b.Retry(err) {
+				continue
+			}
+			l.err <- err
+			return
+		}
+		b.Reset()
+		select {
+		case l.conns <- c:
+		case <-l.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+// Accept waits for and returns the next connection of any of the listeners. If
+// one of the listeners fails, it's error is returned, and the HTTP server closes
+// all of them.
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.err:
+		// keep the error for the next calls.
+		l.err <- err
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes all listeners.
+func (l *multiListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		for _, ln := range l.lns {
+			if cerr := ln.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (l *multiListener) Addr() net.Addr {
+	return l.lns[0].Addr()
+}
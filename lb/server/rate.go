@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mhef/statera/lb/errevent"
+)
+
+// defaultRateGracePeriod is the grace period in seconds used when
+// Listener.RateGracePeriod is not set.
+const defaultRateGracePeriod = 10
+
+// rateCheckInterval is the interval between each check of the transfer rate of
+// the connections.
+const rateCheckInterval = time.Second
+
+// rateWindow hold the state of the measurement of a transfer direction of a
+// connection. The window begins when the connection starts waiting on the
+// direction and is reset after each grace period.
+type rateWindow struct {
+	start time.Time
+	base  int64
+}
+
+// check verifies if the direction transferred at least rate bytes per second
+// since the window began. It returns false if the rate was not reached within
+// the grace period.
+func (w *rateWindow) check(now time.Time, waiting bool, bytes int64, rate int, grace time.Duration) bool {
+	if !waiting || rate <= 0 {
+		w.start = time.Time{}
+		return true
+	}
+	if w.start.IsZero() {
+		w.start, w.base = now, bytes
+		return true
+	}
+	elapsed := now.Sub(w.start)
+	if elapsed < grace {
+		return true
+	}
+	if float64(bytes-w.base) < float64(rate)*elapsed.Seconds() {
+		return false
+	}
+	w.start, w.base = now, bytes
+	return true
+}
+
+// rateConn is a net.Conn that counts the bytes transferred on each direction,
+// so it's transfer rates can be checked by the rateMonitor.
+type rateConn struct {
+	net.Conn
+
+	// read and written count the transferred bytes. Accessed atomically.
+	read    int64
+	written int64
+
+	// writing is the number of Write calls in progress. Accessed atomically.
+	writing int32
+
+	// readingBody is the number of request body Read calls in progress.
+	// Accessed atomically. The connection reads are not used, since the HTTP
+	// server keeps a read in progress on idle and processing connections.
+	readingBody int32
+
+	upload   rateWindow
+	download rateWindow
+}
+
+func (c *rateConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *rateConn) Write(p []byte) (int, error) {
+	atomic.AddInt32(&c.writing, 1)
+	defer atomic.AddInt32(&c.writing, -1)
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// abort closes the connection discarding the data not sent yet, so a client that
+// reads slowly doesn't keep receiving the buffered response.
+func (c *rateConn) abort() {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Conn.Close()
+}
+
+// rateBody wraps a request body to signal the rateConn while the body is being
+// read.
+type rateBody struct {
+	io.ReadCloser
+	c *rateConn
+}
+
+func (b *rateBody) Read(p []byte) (int, error) {
+	atomic.AddInt32(&b.c.readingBody, 1)
+	defer atomic.AddInt32(&b.c.readingBody, -1)
+	return b.ReadCloser.Read(p)
+}
+
+// rateMonitor is a net.Listener that tracks the accepted connections and
+// closes the ones transferring below the minimum rates for longer than the
+// grace period.
+type rateMonitor struct {
+	net.Listener
+
+	minUpload   int
+	minDownload int
+	grace       time.Duration
+
+	conns map[*rateConn]struct{}
+	mu    sync.Mutex // guards conns
+
+	// errs is, if not nil, the bus where the closed connections are published.
+	errs *errevent.Bus
+}
+
+// ErrSlowConnection is published when a connection is closed for transferring
+// below the minimum rates.
+type ErrSlowConnection struct {
+	RemoteAddr net.Addr
+
+	// Upload define if the connection was below the minimum upload rate,
+	// otherwise it was below the minimum download rate.
+	Upload bool
+}
+
+func (e *ErrSlowConnection) Error() string {
+	if e.Upload {
+		return fmt.Sprintf("lb/server: connection from %s closed below the minimum upload rate", e.RemoteAddr)
+	}
+	return fmt.Sprintf("lb/server: connection from %s closed below the minimum download rate", e.RemoteAddr)
+}
+
+// newRateMonitor returns a rateMonitor for the connections accepted by ln.
+func newRateMonitor(ln net.Listener, minUpload, minDownload, grace int) *rateMonitor {
+	if grace <= 0 {
+		grace = defaultRateGracePeriod
+	}
+	return &rateMonitor{
+		Listener:    ln,
+		minUpload:   minUpload,
+		minDownload: minDownload,
+		grace:       time.Duration(grace) * time.Second,
+		conns:       make(map[*rateConn]struct{}),
+	}
+}
+
+func (m *rateMonitor) Accept() (net.Conn, error) {
+	c, err := m.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	rc := &rateConn{Conn: c}
+	m.mu.Lock()
+	m.conns[rc] = struct{}{}
+	m.mu.Unlock()
+	return rc, nil
+}
+
+// remove stops tracking the connection c.
+func (m *rateMonitor) remove(c *rateConn) {
+	m.mu.Lock()
+	delete(m.conns, c)
+	m.mu.Unlock()
+}
+
+// watch checks the transfer rate of the connections until the context is done.
+func (m *rateMonitor) watch(ctx context.Context) {
+	t := time.NewTicker(rateCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			m.check(now)
+		}
+	}
+}
+
+// check closes the connections that transferred below the minimum rates.
+func (m *rateMonitor) check(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c := range m.conns {
+		upOk := c.upload.check(now, atomic.LoadInt32(&c.readingBody) > 0, atomic.LoadInt64(&c.read), m.minUpload, m.grace)
+		downOk := c.download.check(now, atomic.LoadInt32(&c.writing) > 0, atomic.LoadInt64(&c.written), m.minDownload, m.grace)
+		if !upOk || !downOk {
+			log.Println("server: closing connection from", c.RemoteAddr(), "transferring below the minimum rate")
+			m.errs.Publish("server", &ErrSlowConnection{RemoteAddr: c.RemoteAddr(), Upload: !upOk})
+			c.abort()
+			delete(m.conns, c)
+		}
+	}
+}
+
+// trackBody wraps the body of the request to be tracked by the rateConn of the
+// request, if one.
+func trackBody(r *http.Request) {
+	c, ok := ConnectionFromRequest(r)
+	if !ok || c.rate == nil || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	r.Body = &rateBody{r.Body, c.rate}
+}
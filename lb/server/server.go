@@ -7,14 +7,13 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 	"time"
-)
 
-const shutdownTimeout = 30
+	"github.com/mhef/statera/lb/errevent"
+)
 
 // Certificate define a type that hold the certificate and key files for use on
 // TLS.
@@ -35,6 +34,13 @@ type TLS struct {
 	// MaxTLSVersion define the maximum TLS version supported by the listener.
 	// If zero, TLS 1.3 is the default.
 	MaxTLSVersion uint16
+
+	// ReloadInterval define the interval in seconds between each check of the
+	// certificate files for changes. Changed certificates are swapped in without
+	// restarting the listener.
+	//
+	// The default ReloadInterval is 60 seconds.
+	ReloadInterval int
 }
 
 // Listener is, essentially, a opened port on the server that will wait for
@@ -45,6 +51,16 @@ type Listener struct {
 	// for TLS listeners.
 	Addr string
 
+	// Addrs define additional TCP addresses bound by the listener. The
+	// connections accepted on them are served as the ones of Addr, including
+	// the Addr on the request context.
+	Addrs []string
+
+	// Interfaces define, if not empty, the network interfaces whose unicast
+	// addresses are bound on the port of Addr, instead of the host of Addr.
+	// The IPv6 link-local addresses are skipped.
+	Interfaces []string
+
 	// Handler define the handler to invoke when responding to HTTP requests.
 	Handler http.Handler
 
@@ -59,86 +75,314 @@ type Listener struct {
 	// If no certificate is supplied, HTTP/2 will not be enabled.
 	TLS *TLS
 
-	server *http.Server
+	// RequestTimeout define the total time in seconds that each request has to be
+	// answered. The deadline is set on the request context.
+	//
+	// If zero, there is no deadline.
+	RequestTimeout int
+
+	// MaxHeaderBytes define the maximum size in bytes of the request header,
+	// including the request line. Requests with a bigger header are answered
+	// with 431.
+	//
+	// If zero, http.DefaultMaxHeaderBytes (1 MB) is used.
+	MaxHeaderBytes int
+
+	// MaxHeaderCount define the maximum number of header fields of a request.
+	// Requests with more fields are answered with 431, before any rule is
+	// evaluated.
+	//
+	// If zero, there is no limit.
+	MaxHeaderCount int
+
+	// MinUploadRate define the minimum rate in bytes per second at wich the
+	// clients must send the request bodies. Connections sending below the rate
+	// for longer than RateGracePeriod are closed.
+	//
+	// If zero, there is no minimum upload rate.
+	MinUploadRate int
+
+	// MinDownloadRate define the minimum rate in bytes per second at wich the
+	// clients must read the responses. Connections reading below the rate for
+	// longer than RateGracePeriod are closed.
+	//
+	// If zero, there is no minimum download rate.
+	MinDownloadRate int
+
+	// RateGracePeriod define the time in seconds that a connection can transfer
+	// below the minimum rates before being closed.
+	//
+	// The default RateGracePeriod is 10 seconds.
+	RateGracePeriod int
+
+	// DisableKeepAlives define that each connection is closed after it's first
+	// request.
+	DisableKeepAlives bool
+
+	// MaxConnRequests define the maximum number of HTTP/1.x requests answered
+	// through each connection. The connection is closed after the response of
+	// the last request, so the clients open new connections, e.g. to be
+	// rebalanced by a L4 balancer in front of the listener.
+	//
+	// If zero, there is no limit.
+	MaxConnRequests int
+
+	// RejectHTTP10 define that the HTTP/1.0 requests are answered with 505.
+	RejectHTTP10 bool
+
+	// DefaultHost define the host of the requests without one, e.g. the
+	// HTTP/1.0 requests without the Host header, so they are evaluated by the
+	// host conditions and fowarded with it. The requests with an absolute-URI
+	// target are always rewritten to the origin form with the host of the
+	// target.
+	//
+	// If blank, the requests without a host are kept without one.
+	DefaultHost string
+
+	// Sniff define that the protocol of each connection is detected from it's
+	// first bytes, so the TLS and the plaintext HTTP connections are served on
+	// the same port. The TLS connections are closed if the listener has no
+	// certificate.
+	Sniff bool
+
+	// ProxyProtocol define that the connections may begin with a PROXY protocol
+	// v1 or v2 header, whose source address is used as the client address. It
+	// must only be enabled when the listener is reached through trusted
+	// proxies.
+	ProxyProtocol bool
+
+	// TrustForwarded define that the X-Forwarded-For and X-Forwarded-Port
+	// headers are trusted to resolve the original source and destination
+	// addresses of the requests, on top of the PROXY protocol ones. It must
+	// only be enabled when the listener is reached through trusted proxies
+	// that set the headers.
+	TrustForwarded bool
+
+	// TrustedHops define, with TrustForwarded, the number of proxies in front
+	// of the listener. The original source is the address appended to the
+	// X-Forwarded-For header by the outermost of them. If zero, 1 is used.
+	TrustedHops int
+
+	// TrustedProxies define, with TrustForwarded, the networks of the proxies
+	// trusted to set the forwarded headers. The X-Forwarded-For addresses are
+	// walked, from the peer, only while they are of trusted proxies, up to
+	// TrustedHops. If empty, all the proxies are trusted.
+	TrustedProxies []*net.IPNet
+
+	// ForwardedHeaders define that the X-Forwarded-For, X-Forwarded-Proto,
+	// X-Forwarded-Host and X-Forwarded-Port headers of the requests are set by
+	// the listener: the X-Forwarded-For addresses not trusted are dropped and
+	// the peer address is appended, and the other headers are replaced unless
+	// set by a trusted peer.
+	ForwardedHeaders bool
+
+	// SSH handles, on the listeners with Sniff, the connections detected as
+	// SSH. It takes the ownership of the connection. If nil, such connections
+	// are closed.
+	SSH func(net.Conn)
+
+	// Errors is, if not nil, the bus where the errors of the connections are
+	// published, e.g. *ErrSlowConnection and the certificate reload failures.
+	Errors *errevent.Bus
+
+	server   *http.Server
+	closed   bool       // define that Shutdown was called
+	serverMu sync.Mutex // guards server and closed
+
+	// certWatcherCancel stops the certificate watcher goroutine.
+	certWatcherCancel context.CancelFunc
+
+	// rateMonitorCancel stops the transfer rate monitor goroutine.
+	rateMonitorCancel context.CancelFunc
 }
 
-// handler wraps Listener.Handler to add the Listener addr on the request context.
+// handler wraps Listener.Handler to enforce the protocol and header count
+// limits and the requests per connection, to normalize the request host, to add
+// the Listener addr, the resolved addresses and the request deadline on the
+// request context and to track the request body upload rate.
 func (l *Listener) handler() http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		if l.RejectHTTP10 && r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+			WriteError(w, http.StatusHTTPVersionNotSupported, "HTTP/1.0 is not supported")
+			return
+		}
+		if l.MaxHeaderCount > 0 && headerCount(r.Header) > l.MaxHeaderCount {
+			WriteError(w, http.StatusRequestHeaderFieldsTooLarge, "too many header fields")
+			return
+		}
+		if l.MaxConnRequests > 0 && r.ProtoMajor == 1 {
+			// the server closes the connection after a response with the
+			// "Connection: close" header.
+			if c, ok := ConnectionFromRequest(r); ok && c.countRequest() >= int64(l.MaxConnRequests) {
+				w.Header().Set("Connection", "close")
+			}
+		}
+
+		normalizeHost(r, l.DefaultHost)
+
 		ctx := r.Context()
-		ctx = context.WithValue(ctx, listenerKey, l.Addr)
-		l.Handler.ServeHTTP(w, r.WithContext(ctx))
+		if l.RequestTimeout > 0 {
+			var cancel context.CancelFunc
+			timeout := time.Duration(l.RequestTimeout) * time.Second
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			ctx = context.WithValue(ctx, requestTimeoutKey, timeout)
+		}
+		ctx = ContextWithListener(ctx, l.Addr)
+		src, dst := l.resolveAddrs(r)
+		ctx = ContextWithAddrs(ctx, src, dst)
+		r = r.WithContext(ctx)
+		if l.MinUploadRate > 0 {
+			trackBody(r)
+		}
+		l.Handler.ServeHTTP(w, r)
 	}
 	return http.HandlerFunc(fn)
 }
 
+// headerCount returns the number of header fields of h. Each value of a repeated
+// field is counted.
+func headerCount(h http.Header) int {
+	n := 0
+	for _, v := range h {
+		n += len(v)
+	}
+	return n
+}
+
 // ListenAndServe will setup and start a HTTP server for the listener and will
 // begin to serve to requests.
 //
-// This func blocks until a shutdown signal is received by the application.
+// This func blocks until the listener is shut down through Shutdown.
 func (l *Listener) ListenAndServe() error {
+	l.serverMu.Lock()
+	closed := l.closed
+	l.serverMu.Unlock()
+	if closed {
+		return nil
+	}
+
 	// setup TLS config
 	tCfg := &tls.Config{}
-	if l.TLS != nil && l.TLS.Certs != nil {
+	useTLS := l.TLS != nil && len(l.TLS.Certs) > 0
+	if useTLS {
 		tCfg.MinVersion = l.TLS.MinTLSVersion
 		tCfg.MaxVersion = l.TLS.MaxTLSVersion
 
-		for _, c := range l.TLS.Certs {
-			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
-			if err != nil {
-				return err
-			}
-			tCfg.Certificates = append(tCfg.Certificates, cert)
+		cs, err := newCertStore(l.TLS.Certs)
+		if err != nil {
+			return err
+		}
+		tCfg.GetCertificate = cs.getCertificate
+
+		interval := l.TLS.ReloadInterval
+		if interval <= 0 {
+			interval = defaultCertReloadInterval
 		}
+		ctx, cancel := context.WithCancel(context.Background())
+		l.certWatcherCancel = cancel
+		go cs.watch(ctx, time.Duration(interval)*time.Second, l.Errors)
 	}
 
-	l.server = &http.Server{
-		Addr:      l.Addr,
-		Handler:   l.handler(),
-		TLSConfig: tCfg,
+	srv := &http.Server{
+		Addr:           l.Addr,
+		Handler:        l.handler(),
+		TLSConfig:      tCfg,
+		MaxHeaderBytes: l.MaxHeaderBytes,
 	}
 
 	if !l.HTTP2 {
 		// Disable the HTTP2 support for the server.
-		l.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	if l.DisableKeepAlives {
+		srv.SetKeepAlivesEnabled(false)
 	}
 
-	go func() {
-		if len(tCfg.Certificates) > 0 {
-			if err := l.server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
-				panic(err)
-			}
-			return
+	addr := l.Addr
+	if addr == "" {
+		addr = ":http"
+		if useTLS {
+			addr = ":https"
 		}
+	}
+	ln, err := l.listen(addr)
+	if err != nil {
+		return err
+	}
+	ct := newConnTracker()
+	srv.ConnState = ct.connState
+	srv.ConnContext = ct.connContext
+	sniffing := l.Sniff || l.ProxyProtocol
+	if sniffing {
+		ln = newSniffListener(ln, l.Sniff, useTLS, l.ProxyProtocol, l.SSH)
+	}
+	if l.MinUploadRate > 0 || l.MinDownloadRate > 0 {
+		m := newRateMonitor(ln, l.MinUploadRate, l.MinDownloadRate, l.RateGracePeriod)
+		m.errs = l.Errors
+		ct.rate = m
+		ctx, cancel := context.WithCancel(context.Background())
+		l.rateMonitorCancel = cancel
+		go m.watch(ctx)
+		ln = m
+	}
 
-		if err := l.server.ListenAndServe(); err != http.ErrServerClosed {
-			panic(err)
-		}
-	}()
+	l.serverMu.Lock()
+	if l.closed {
+		// Shutdown was called before the server was set, so it's not
+		// started at all.
+		l.serverMu.Unlock()
+		l.stopWatchers()
+		return ln.Close()
+	}
+	l.server = srv
+	l.serverMu.Unlock()
 
-	if err := l.waitForShutdown(); err != nil {
+	if sniffing && useTLS {
+		// the TLS is started by the tlsListener only on the connections
+		// sniffed as TLS, so the server is served as plaintext.
+		tCfg.NextProtos = []string{"http/1.1"}
+		if l.HTTP2 {
+			tCfg.NextProtos = []string{"h2", "http/1.1"}
+		}
+		err = srv.Serve(&tlsListener{Listener: ln, config: tCfg})
+	} else if useTLS {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		return err
 	}
 	return nil
 }
 
-// waitForShutdown waits for an interrupt signal and gracefully shutdown
-// the HTTP server of the listener when one occurs.
+// Shutdown gracefully shuts down the HTTP server of the listener. The listener
+// stops accepting new connections and waits for the active ones to become idle.
 //
-// The func blocks and only return when the HTTP server has been completely shut
-// down.
-func (l *Listener) waitForShutdown() error {
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-
-	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout*time.Second)
-	defer cancel()
-
+// The func blocks until the HTTP server has been completely shut down or the
+// context is done. If the listener is not serving yet, ListenAndServe returns
+// without serving.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.serverMu.Lock()
+	defer l.serverMu.Unlock()
+	l.closed = true
+	if l.server == nil {
+		// ListenAndServe returns right away when it sets up the server.
+		return nil
+	}
+	l.stopWatchers()
 	l.server.SetKeepAlivesEnabled(false)
+	return l.server.Shutdown(ctx)
+}
 
-	if err := l.server.Shutdown(ctx); err != nil {
-		panic(err)
+// stopWatchers stops the certificate watcher and the transfer rate monitor
+// goroutines, if started.
+func (l *Listener) stopWatchers() {
+	if l.certWatcherCancel != nil {
+		l.certWatcherCancel()
+	}
+	if l.rateMonitorCancel != nil {
+		l.rateMonitorCancel()
 	}
-	return nil
 }
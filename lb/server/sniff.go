@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidProxyHeader  = errors.New("lb/server: invalid PROXY protocol header")
+	errSniffListenerClosed = errors.New("lb/server: listener closed")
+)
+
+// sniffTimeout is the time that a client has to send the first bytes of the
+// connection, including the PROXY protocol header, if one.
+const sniffTimeout = 10 * time.Second
+
+// proxyV2Signature is the signature of the PROXY protocol v2 headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// sniffedConn is a connection whose first bytes were peeked to detect it's
+// protocol. The peeked bytes are read again before the rest of the connection.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// isTLS define if the connection was detected as TLS.
+	isTLS bool
+
+	// src and dst hold the addresses from the PROXY protocol header, if one.
+	src, dst net.Addr
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the source address of the PROXY protocol header, if one,
+// or the address of the peer.
+func (c *sniffedConn) RemoteAddr() net.Addr {
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the PROXY protocol header, if
+// one, or the local address of the connection.
+func (c *sniffedConn) LocalAddr() net.Addr {
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// sniffListener is a net.Listener that detects the protocol of each accepted
+// connection from it's first bytes, before handing it to the HTTP server. It
+// parses the PROXY protocol headers and separates the TLS, the plaintext HTTP
+// and the SSH connections.
+//
+// The connections are sniffed concurrently, so a slow client doesn't hold the
+// others.
+type sniffListener struct {
+	net.Listener
+
+	// sniff define if the protocol is detected. If false, the connections are
+	// TLS if useTLS is set.
+	sniff  bool
+	useTLS bool
+
+	// proxyProtocol define if the PROXY protocol headers are parsed.
+	proxyProtocol bool
+
+	// ssh handles the connections detected as SSH. If nil, they are closed.
+	ssh func(net.Conn)
+
+	conns     chan net.Conn
+	err       chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newSniffListener returns a sniffListener for the connections accepted by ln,
+// and starts accepting them.
+func newSniffListener(ln net.Listener, sniff, useTLS, proxyProtocol bool, ssh func(net.Conn)) *sniffListener {
+	l := &sniffListener{
+		Listener:      ln,
+		sniff:         sniff,
+		useTLS:        useTLS,
+		proxyProtocol: proxyProtocol,
+		ssh:           ssh,
+		conns:         make(chan net.Conn),
+		err:           make(chan error, 1),
+		done:          make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts the connections and sniffs each one on it's own goroutine.
+func (l *sniffListener) acceptLoop() {
+	var b AcceptBackoff
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if b.Retry(err) {
+				continue
+			}
+			l.err <- err
+			return
+		}
+		b.Reset()
+		go l.handle(c)
+	}
+}
+
+// handle sniffs the connection and hands it to Accept, or to the ssh handler.
+func (l *sniffListener) handle(c net.Conn) {
+	sc, isSSH, err := l.sniffConn(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	if isSSH {
+		if l.ssh == nil {
+			c.Close()
+			return
+		}
+		l.ssh(sc)
+		return
+	}
+	select {
+	case l.conns <- sc:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// sniffConn reads the PROXY protocol header, if enabled, and peeks the first
+// bytes of the connection to detect it's protocol.
+func (l *sniffListener) sniffConn(c net.Conn) (sc *sniffedConn, isSSH bool, err error) {
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	sc = &sniffedConn{Conn: c, r: bufio.NewReader(c), isTLS: l.useTLS}
+	if l.proxyProtocol {
+		if err := sc.readProxyHeader(); err != nil {
+			return nil, false, err
+		}
+	}
+	if !l.sniff {
+		return sc, false, nil
+	}
+	b, err := sc.r.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case b[0] == 0x16:
+		// TLS handshake record.
+		if !l.useTLS {
+			return nil, false, errors.New("lb/server: TLS connection on a listener without certificates")
+		}
+		sc.isTLS = true
+		return sc, false, nil
+	case b[0] == 'S':
+		if p, err := sc.r.Peek(4); err == nil && string(p) == "SSH-" {
+			return sc, true, nil
+		}
+	}
+	sc.isTLS = false
+	return sc, false, nil
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header of the connection, if
+// one. The connections without the header are served with the peer address.
+func (c *sniffedConn) readProxyHeader() error {
+	// the first byte is peeked before the signatures, so the short requests
+	// don't wait for bytes that won't be sent.
+	b, err := c.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	switch b[0] {
+	case '\r':
+		if b, err := c.r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+			return c.readProxyV2()
+		}
+		return nil
+	case 'P':
+		if b, err := c.r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	// the v1 header is a single line of at most 107 bytes.
+	var line []byte
+	for len(line) < 107 {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errInvalidProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errInvalidProxyHeader
+	}
+	src, err := proxyAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := proxyAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.src, c.dst = src, dst
+	return nil
+}
+
+// proxyAddr parses the ip and port of a PROXY protocol v1 header.
+func proxyAddr(ip, port string) (*net.TCPAddr, error) {
+	a := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if a == nil || err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+// readProxyV2 reads the PROXY protocol v2 header of the connection. The LOCAL
+// command and the unsupported address families keep the peer address.
+func (c *sniffedConn) readProxyV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return errInvalidProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+	if hdr[12]&0x0f == 0 {
+		// LOCAL command, e.g. the health checks of the proxy.
+		return nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return errInvalidProxyHeader
+		}
+		c.src = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		c.dst = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return errInvalidProxyHeader
+		}
+		c.src = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		c.dst = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	}
+	return nil
+}
+
+// Accept returns the next sniffed connection that isn't SSH.
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.err:
+		// keep the error for the next calls.
+		l.err <- err
+		return nil, err
+	case <-l.done:
+		return nil, errSniffListenerClosed
+	}
+}
+
+// Close closes the listener. The connections being sniffed are closed.
+func (l *sniffListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// tlsListener is a net.Listener that starts the TLS server side of the
+// connections sniffed as TLS. It must be on top of the sniffListener, after the
+// rate monitor, if one.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	inner := c
+	if rc, ok := c.(*rateConn); ok {
+		inner = rc.Conn
+	}
+	if sc, ok := inner.(*sniffedConn); ok && sc.isTLS {
+		return tls.Server(c, l.config), nil
+	}
+	return c, nil
+}
@@ -0,0 +1,152 @@
+package lb
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/admin"
+	"github.com/mhef/statera/lb/router"
+)
+
+// Lifecycle phases of the load balancer, in the order they happen.
+const (
+	phaseRunning  = "running"
+	phasePreStop  = "pre_stop"
+	phaseDraining = "draining"
+	phaseStopped  = "stopped"
+)
+
+// defaultDrainTimeout is the time in seconds used when cfg.Shutdown.DrainTimeout
+// is not set.
+const defaultDrainTimeout = 30
+
+// lifecycle hold the current lifecycle phase of the load balancer. It is used by
+// the admin endpoints to report the readiness and the shutdown progress.
+type lifecycle struct {
+	rtr *router.Router
+
+	phase      string
+	phaseSince time.Time
+	mu         sync.RWMutex // guards phase and phaseSince
+}
+
+// newLifecycle returns a lifecycle on the running phase.
+func newLifecycle(rtr *router.Router) *lifecycle {
+	return &lifecycle{
+		rtr:        rtr,
+		phase:      phaseRunning,
+		phaseSince: time.Now(),
+	}
+}
+
+// setPhase moves the lifecycle to the phase p.
+func (lc *lifecycle) setPhase(p string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.phase = p
+	lc.phaseSince = time.Now()
+	log.Println("lifecycle phase changed to", p)
+}
+
+// readyzHandler answers 200 while the load balancer is running and 503 once the
+// shutdown has begun, signaling external load balancers to stop sending traffic.
+func (lc *lifecycle) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	if lc.phase != phaseRunning {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// shutdownStatus is the response of the shutdown status endpoint.
+type shutdownStatus struct {
+	Phase    string    `json:"phase"`
+	Since    time.Time `json:"since"`
+	InFlight int64     `json:"in_flight"`
+}
+
+// shutdownStatusHandler reports the current lifecycle phase and the number of
+// in-flight upstream requests.
+func (lc *lifecycle) shutdownStatusHandler(w http.ResponseWriter, r *http.Request) {
+	lc.mu.RLock()
+	st := shutdownStatus{
+		Phase: lc.phase,
+		Since: lc.phaseSince,
+	}
+	lc.mu.RUnlock()
+	if lc.rtr != nil {
+		st.InFlight = lc.rtr.InFlight()
+	}
+	admin.WriteJSON(w, http.StatusOK, st)
+}
+
+// shutdownControl waits for an interrupt signal and then gracefully shuts down
+// the load balancer. The shutdown happens in phases:
+//
+//  1. The load balancer is marked as not ready on the /readyz endpoint.
+//  2. It waits cfg.Shutdown.PreStopDelay seconds, so external load balancers and
+//     DNS stop sending traffic.
+//  3. The listeners stop accepting new connections and it waits for the in-flight
+//     requests, up to cfg.Shutdown.DrainTimeout seconds.
+//
+// This func blocks until the listeners and the admin server are shut down.
+func shutdownControl(sCfg cfg.Shutdown, lc *lifecycle, ls *listenerSet, adm *admin.Server) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	lc.setPhase(phasePreStop)
+	if sCfg.PreStopDelay > 0 {
+		log.Printf("waiting %ds before stop accepting connections", sCfg.PreStopDelay)
+		time.Sleep(time.Duration(sCfg.PreStopDelay) * time.Second)
+	}
+
+	lc.setPhase(phaseDraining)
+	drainTimeout := sCfg.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+	defer cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		ls.close(ctx)
+		close(drained)
+	}()
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for wait := true; wait; {
+		select {
+		case <-drained:
+			wait = false
+		case <-t.C:
+			log.Println("draining,", lc.rtr.InFlight(), "in-flight requests")
+		}
+	}
+	if n := lc.rtr.InFlight(); n > 0 {
+		log.Println("drain timeout reached,", n, "in-flight requests were dropped")
+	}
+
+	lc.setPhase(phaseStopped)
+	if adm != nil {
+		// the long-lived admin requests, e.g. the update streams, are not
+		// waited for more than the drain timeout.
+		actx, acancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+		defer acancel()
+		if err := adm.Shutdown(actx); err != nil {
+			log.Println("admin shutdown:", err)
+			adm.Close()
+		}
+	}
+}
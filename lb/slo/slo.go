@@ -0,0 +1,419 @@
+// Package slo implements the service level objectives of the node groups. The
+// objectives are measured from the group metrics of the router, and the rate at
+// wich their error budget is spent, the burn rate, is alerted when it's too high
+// on both a long and a short window, as the multiwindow alerts of the Google SRE
+// workbook.
+package slo
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/metrics"
+	"github.com/mhef/statera/lb/router"
+)
+
+// Kind is the kind of an objective.
+type Kind int
+
+// Kinds of objectives.
+const (
+	// Availability measures the ratio of the requests that are not failed or
+	// answered with a 5xx status code.
+	Availability Kind = iota
+
+	// Latency measures the ratio of the requests answered within the
+	// LatencyThreshold of the objective.
+	Latency
+)
+
+// ParseKind returns the Kind named s: "availability" or "latency". ok is false if
+// s is not a kind name.
+func ParseKind(s string) (k Kind, ok bool) {
+	switch s {
+	case "availability":
+		return Availability, true
+	case "latency":
+		return Latency, true
+	}
+	return 0, false
+}
+
+// String returns the name of the kind: "availability" or "latency".
+func (k Kind) String() string {
+	if k == Latency {
+		return "latency"
+	}
+	return "availability"
+}
+
+// Defaults of the objectives.
+const (
+	defaultWindow = 30 * 24 * time.Hour
+
+	// sampleInterval is the interval between the samples of the group
+	// metrics used by the alerts.
+	sampleInterval = 10 * time.Second
+
+	// budgetSamples is the number of samples of the group metrics kept for
+	// the objective window.
+	budgetSamples = 720
+)
+
+// DefaultAlerts are the alerts of the objectives without alerts: a fast burn,
+// that spends 2% of a 30 days budget in an hour, and a slow burn, that spends 5%
+// of it in 6 hours.
+var DefaultAlerts = []Alert{
+	{LongWindow: time.Hour, ShortWindow: 5 * time.Minute, BurnRate: 14.4},
+	{LongWindow: 6 * time.Hour, ShortWindow: 30 * time.Minute, BurnRate: 6},
+}
+
+// Alert define when the burn rate of an objective is alerted: when it's at or
+// above BurnRate on both the LongWindow and the ShortWindow. The short window
+// makes the alert resolve soon after the burn stops.
+type Alert struct {
+	LongWindow  time.Duration
+	ShortWindow time.Duration
+	BurnRate    float64
+}
+
+// Objective is a service level objective of a node group.
+type Objective struct {
+	Group string
+	Kind  Kind
+
+	// Target define the ratio of good requests, e.g. 0.999.
+	Target float64
+
+	// LatencyThreshold define, on the Latency objectives, the time to answer
+	// a good request. The ratio is estimated from the latency histogram of the
+	// group, so a threshold equal to a bucket bound is exact.
+	LatencyThreshold time.Duration
+
+	// Window define the window of the objective.
+	//
+	// The default Window is 30 days.
+	Window time.Duration
+
+	// Alerts define the burn rate alerts.
+	//
+	// The default Alerts are DefaultAlerts.
+	Alerts []Alert
+}
+
+var (
+	// ErrGroupNotFound is returned by New when the group of an objective
+	// doesn't exist.
+	ErrGroupNotFound = errors.New("lb/slo: node group not found")
+
+	errInvalidTarget    = errors.New("lb/slo: the target must be between 0 and 1")
+	errInvalidThreshold = errors.New("lb/slo: the latency objectives require a latency threshold")
+	errInvalidAlert     = errors.New("lb/slo: invalid alert, the windows and the burn rate must be positive and the short window must not exceed the long one")
+)
+
+// validate verifies if the objective is well formed.
+func (o *Objective) validate() error {
+	if o.Target <= 0 || o.Target >= 1 {
+		return errInvalidTarget
+	}
+	if o.Kind == Latency && o.LatencyThreshold <= 0 {
+		return errInvalidThreshold
+	}
+	if o.Window < 0 {
+		return errors.New("lb/slo: the window can't be negative")
+	}
+	for _, a := range o.Alerts {
+		if a.LongWindow <= 0 || a.ShortWindow <= 0 || a.ShortWindow > a.LongWindow || a.BurnRate <= 0 {
+			return errInvalidAlert
+		}
+	}
+	return nil
+}
+
+// sample is a sample of the cumulative number of requests of a group, and of the
+// bad ones.
+type sample struct {
+	t          time.Time
+	total, bad float64
+}
+
+// series is a ring of samples taken on an interval.
+type series struct {
+	interval time.Duration
+	samples  []sample
+	next     int
+	n        int
+}
+
+// newSeries returns a series that holds the samples of the span.
+func newSeries(interval, span time.Duration) *series {
+	return &series{interval: interval, samples: make([]sample, int(span/interval)+2)}
+}
+
+// add adds the sample, if the interval passed since the last one.
+func (s *series) add(smp sample) {
+	if s.n > 0 {
+		last := s.samples[(s.next+len(s.samples)-1)%len(s.samples)]
+		if smp.t.Sub(last.t) < s.interval {
+			return
+		}
+	}
+	s.samples[s.next] = smp
+	s.next = (s.next + 1) % len(s.samples)
+	if s.n < len(s.samples) {
+		s.n++
+	}
+}
+
+// badRatio returns the ratio of bad requests on the window before cur, or zero if
+// there was no request. The window begins on the newest sample taken at or before
+// it's start, or on the oldest sample if the series doesn't span the whole
+// window.
+func (s *series) badRatio(cur sample, window time.Duration) float64 {
+	from := cur.t.Add(-window)
+	var base *sample
+	for i := 0; i < s.n; i++ {
+		smp := &s.samples[(s.next-s.n+i+len(s.samples))%len(s.samples)]
+		if base != nil && smp.t.After(from) {
+			break
+		}
+		base = smp
+	}
+	if base == nil {
+		return 0
+	}
+	total := cur.total - base.total
+	if total <= 0 {
+		return 0
+	}
+	return (cur.bad - base.bad) / total
+}
+
+// objective is an Objective being monitored.
+type objective struct {
+	Objective
+	ng *router.NodeGroup
+
+	// alerts hold the samples of the alert windows, and budget the ones of
+	// the objective window.
+	alerts *series
+	budget *series
+	firing []bool
+}
+
+// measure returns the current sample of the group metrics.
+func (o *objective) measure(now time.Time) sample {
+	st := o.ng.Stats()
+	if o.Kind == Latency {
+		h := st.Latency.Snapshot()
+		good := h.CountBelow(o.LatencyThreshold.Seconds())
+		return sample{t: now, total: float64(h.Count), bad: float64(h.Count) - good}
+	}
+	return sample{t: now, total: float64(st.Requests.Value()), bad: float64(st.Errors.Value())}
+}
+
+// burnRate returns the burn rate on the window: the rate at wich the error
+// budget is spent, where 1 spends the whole budget in the objective window.
+func (o *objective) burnRate(cur sample, window time.Duration) float64 {
+	return o.alerts.badRatio(cur, window) / (1 - o.Target)
+}
+
+// Event is a change of an alert of an objective.
+type Event struct {
+	Objective *Objective
+	Alert     Alert
+	Firing    bool
+
+	// BurnRate is the burn rate on the long window of the alert.
+	BurnRate float64
+}
+
+// Monitor monitors the objectives. It's safe for concurrent use.
+type Monitor struct {
+	// OnAlert is called, if not nil, when an alert starts or stops firing. It
+	// must not block.
+	OnAlert func(Event)
+
+	objectives []*objective
+	mu         sync.Mutex // guards the objectives samples and alerts
+}
+
+// New returns a Monitor of the objectives, whose groups are found on r. The
+// objectives without Window or Alerts get the defaults.
+func New(objectives []Objective, r *router.Router) (*Monitor, error) {
+	m := &Monitor{}
+	for _, obj := range objectives {
+		if err := obj.validate(); err != nil {
+			return nil, err
+		}
+		ng, ok := r.NodeGroup(obj.Group)
+		if !ok {
+			return nil, ErrGroupNotFound
+		}
+		if obj.Window == 0 {
+			obj.Window = defaultWindow
+		}
+		if len(obj.Alerts) == 0 {
+			obj.Alerts = DefaultAlerts
+		}
+		var span time.Duration
+		for _, a := range obj.Alerts {
+			if a.LongWindow > span {
+				span = a.LongWindow
+			}
+		}
+		budgetInterval := obj.Window / budgetSamples
+		if budgetInterval < sampleInterval {
+			budgetInterval = sampleInterval
+		}
+		m.objectives = append(m.objectives, &objective{
+			Objective: obj,
+			ng:        ng,
+			alerts:    newSeries(sampleInterval, span),
+			budget:    newSeries(budgetInterval, obj.Window),
+			firing:    make([]bool, len(obj.Alerts)),
+		})
+	}
+	m.sample(time.Now())
+	return m, nil
+}
+
+// sample samples the metrics of the objectives, and notifies the alerts that
+// changed.
+func (m *Monitor) sample(now time.Time) {
+	var events []Event
+	m.mu.Lock()
+	for _, o := range m.objectives {
+		cur := o.measure(now)
+		o.alerts.add(cur)
+		o.budget.add(cur)
+		for i, a := range o.Alerts {
+			long := o.burnRate(cur, a.LongWindow)
+			firing := long >= a.BurnRate && o.burnRate(cur, a.ShortWindow) >= a.BurnRate
+			if firing == o.firing[i] {
+				continue
+			}
+			o.firing[i] = firing
+			events = append(events, Event{Objective: &o.Objective, Alert: a, Firing: firing, BurnRate: long})
+		}
+	}
+	m.mu.Unlock()
+	if m.OnAlert != nil {
+		for _, e := range events {
+			m.OnAlert(e)
+		}
+	}
+}
+
+// Run samples the metrics of the objectives periodically. It never returns.
+func (m *Monitor) Run() {
+	t := time.NewTicker(sampleInterval)
+	defer t.Stop()
+	for now := range t.C {
+		m.sample(now)
+	}
+}
+
+// AlertStatus is the state of an alert of an objective.
+type AlertStatus struct {
+	LongWindow      int     `json:"long_window"`
+	ShortWindow     int     `json:"short_window"`
+	BurnRate        float64 `json:"burn_rate"`
+	LongWindowRate  float64 `json:"long_window_rate"`
+	ShortWindowRate float64 `json:"short_window_rate"`
+	Firing          bool    `json:"firing"`
+}
+
+// Status is the state of an objective.
+type Status struct {
+	Group  string  `json:"group"`
+	Kind   string  `json:"kind"`
+	Target float64 `json:"target"`
+
+	// LatencyThreshold is the threshold of the Latency objectives, in
+	// milliseconds.
+	LatencyThreshold int64 `json:"latency_threshold,omitempty"`
+
+	// Window is the window of the objective, in seconds.
+	Window int64 `json:"window"`
+
+	// SLI is the ratio of good requests on the window, or 1 if there was no
+	// request.
+	SLI float64 `json:"sli"`
+
+	// ErrorBudgetRemaining is the ratio of the error budget of the window not
+	// spent yet. It's negative when the objective is not met.
+	ErrorBudgetRemaining float64 `json:"error_budget_remaining"`
+
+	Alerts []AlertStatus `json:"alerts"`
+}
+
+// Status returns the state of the objectives.
+func (m *Monitor) Status() []Status {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]Status, 0, len(m.objectives))
+	for _, o := range m.objectives {
+		cur := o.measure(now)
+		bad := o.budget.badRatio(cur, o.Window)
+		st := Status{
+			Group:                o.Group,
+			Kind:                 o.Kind.String(),
+			Target:               o.Target,
+			LatencyThreshold:     o.LatencyThreshold.Milliseconds(),
+			Window:               int64(o.Window / time.Second),
+			SLI:                  1 - bad,
+			ErrorBudgetRemaining: 1 - bad/(1-o.Target),
+		}
+		for i, a := range o.Alerts {
+			st.Alerts = append(st.Alerts, AlertStatus{
+				LongWindow:      int(a.LongWindow / time.Second),
+				ShortWindow:     int(a.ShortWindow / time.Second),
+				BurnRate:        a.BurnRate,
+				LongWindowRate:  o.burnRate(cur, a.LongWindow),
+				ShortWindowRate: o.burnRate(cur, a.ShortWindow),
+				Firing:          o.firing[i],
+			})
+		}
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+// WriteMetrics writes the state of the objectives on mw.
+func (m *Monitor) WriteMetrics(mw *metrics.Writer) {
+	sts := m.Status()
+	for _, st := range sts {
+		mw.Gauge("statera_slo_error_budget_remaining", "Ratio of the error budget of the objective window not spent yet.",
+			metrics.Labels{"group": st.Group, "slo": st.Kind}, st.ErrorBudgetRemaining)
+	}
+	for _, st := range sts {
+		// the windows shared by several alerts are written once.
+		seen := make(map[int]bool)
+		for _, a := range st.Alerts {
+			for _, w := range []struct {
+				window int
+				rate   float64
+			}{{a.LongWindow, a.LongWindowRate}, {a.ShortWindow, a.ShortWindowRate}} {
+				if seen[w.window] {
+					continue
+				}
+				seen[w.window] = true
+				mw.Gauge("statera_slo_burn_rate", "Rate at wich the error budget of the objective is spent, on the window.",
+					metrics.Labels{"group": st.Group, "slo": st.Kind, "window": (time.Duration(w.window) * time.Second).String()}, w.rate)
+			}
+		}
+	}
+	for _, st := range sts {
+		for _, a := range st.Alerts {
+			v := 0.0
+			if a.Firing {
+				v = 1
+			}
+			mw.Gauge("statera_slo_alert_firing", "If the burn rate alert of the objective is firing (1) or not (0).",
+				metrics.Labels{"group": st.Group, "slo": st.Kind, "window": (time.Duration(a.LongWindow) * time.Second).String()}, v)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package srv implements the discovery of the nodes of a node group through DNS
+// SRV records. The target, port, weight and priority published on each record
+// are imported as a node of the group.
+package srv
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mhef/statera/lb/router"
+)
+
+// defaultInterval is the lookup interval in seconds used when Client.Interval is
+// not set.
+const defaultInterval = 30
+
+// Client looks up the SRV records of a name and keeps the nodes of a node group
+// in sync with them.
+type Client struct {
+	// Name define the SRV name looked up, e.g. "_http._tcp.api.example.com".
+	Name string
+
+	// Interval define the interval in seconds between each lookup.
+	//
+	// The default Interval is 30 seconds.
+	Interval int
+
+	// Group is the node group that will be synced.
+	Group *router.NodeGroup
+
+	// Resolver is the resolver used on the lookups. If nil, the default
+	// resolver is used.
+	Resolver *net.Resolver
+}
+
+// Run looks up the records on each interval and syncs the node group.
+//
+// This func blocks until the context is done.
+func (c *Client) Run(ctx context.Context) {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	t := time.NewTicker(time.Duration(interval) * time.Second)
+	defer t.Stop()
+	for {
+		if err := c.sync(ctx); err != nil {
+			log.Println("lb/srv: lookup of", c.Name, "failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// srvNode is the node described by a SRV record.
+type srvNode struct {
+	weight   int
+	priority int
+}
+
+// sync looks up the records and adds, updates and deletes the group nodes to
+// match them. If the lookup fails, the group is not changed.
+func (c *Client) sync(ctx context.Context) error {
+	r := c.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	_, addrs, err := r.LookupSRV(ctx, "", "", c.Name)
+	if err != nil {
+		return err
+	}
+
+	want := make(map[router.NodeKey]srvNode)
+	for _, a := range addrs {
+		// the weight zero is published for targets that should be chosen only
+		// rarely, wich is the lowest weight a node can have.
+		w := int(a.Weight)
+		if w == 0 {
+			w = 1
+		}
+		nk := router.NodeKey{Host: strings.TrimSuffix(a.Target, "."), Port: a.Port}
+		want[nk] = srvNode{weight: w, priority: int(a.Priority)}
+	}
+
+	ng := c.Group
+	for _, n := range ng.Nodes() {
+		sn, ok := want[n.NodeKey]
+		if !ok {
+			ng.DeleteNode(n.NodeKey)
+			continue
+		}
+		if n.CurrentWeight() != sn.weight {
+			ng.SetNodeWeight(n.NodeKey, sn.weight)
+		}
+		if n.Priority != sn.priority {
+			ng.SetNodePriority(n.NodeKey, sn.priority)
+		}
+		delete(want, n.NodeKey)
+	}
+	for nk, sn := range want {
+		if err := ng.AddNode(&router.Node{NodeKey: nk, Weight: sn.weight, Priority: sn.priority}); err != nil {
+			log.Println("lb/srv: failed to add node", nk, "on group", ng.Name, err)
+		}
+	}
+	return nil
+}
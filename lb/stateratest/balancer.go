@@ -0,0 +1,101 @@
+package stateratest
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/mhef/statera/lb/router"
+)
+
+// Balancer is a fake router.Balancer that holds the nodes of it's pool on the
+// order they were added and returns the node chosen by Pick.
+type Balancer struct {
+	// Pick define the node returned by Balance among the nodes of the pool,
+	// wich is never empty. If nil, the first node is returned.
+	Pick func(r *http.Request, nodes []*router.Node) *router.Node
+
+	nodes    []*router.Node
+	balanced int
+	mu       sync.Mutex // guards nodes and balanced
+}
+
+// AddNode adds the node on the pool. A node already on the pool is replaced.
+func (b *Balancer) AddNode(n *router.Node) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, v := range b.nodes {
+		if v.NodeKey == n.NodeKey {
+			b.nodes[i] = n
+			return
+		}
+	}
+	b.nodes = append(b.nodes, n)
+}
+
+// DeleteNode removes the node from the pool.
+func (b *Balancer) DeleteNode(nk router.NodeKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, v := range b.nodes {
+		if v.NodeKey == nk {
+			b.nodes = append(b.nodes[:i], b.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Balance returns the node chosen by Pick, or nil if the pool is empty.
+func (b *Balancer) Balance(r *http.Request) *router.Node {
+	b.mu.Lock()
+	b.balanced++
+	nodes := make([]*router.Node, len(b.nodes))
+	copy(nodes, b.nodes)
+	b.mu.Unlock()
+	if len(nodes) == 0 {
+		return nil
+	}
+	if b.Pick == nil {
+		return nodes[0]
+	}
+	return b.Pick(r, nodes)
+}
+
+// Nodes implements the router.NodeLister interface.
+func (b *Balancer) Nodes() []router.NodeStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ns := make([]router.NodeStatus, 0, len(b.nodes))
+	for _, n := range b.nodes {
+		ns = append(ns, router.NodeStatus{NodeKey: n.NodeKey, Weight: n.CurrentWeight()})
+	}
+	return ns
+}
+
+// Balanced returns the number of calls to Balance.
+func (b *Balancer) Balanced() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.balanced
+}
+
+// Sequence returns a Pick func that returns the nodes with the keys on order,
+// starting again after the last one. The keys that are not on the pool are
+// skipped; if none is, the first node of the pool is returned.
+func Sequence(keys ...router.NodeKey) func(*http.Request, []*router.Node) *router.Node {
+	next := 0
+	var mu sync.Mutex // guards next
+	return func(r *http.Request, nodes []*router.Node) *router.Node {
+		mu.Lock()
+		defer mu.Unlock()
+		for range keys {
+			nk := keys[next%len(keys)]
+			next++
+			for _, n := range nodes {
+				if n.NodeKey == nk {
+					return n
+				}
+			}
+		}
+		return nodes[0]
+	}
+}
@@ -0,0 +1,95 @@
+package stateratest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// ErrListenerClosed is returned by the Listener after it's closed.
+var ErrListenerClosed = errors.New("stateratest: listener closed")
+
+// memAddr is the address of the Listener.
+type memAddr struct{}
+
+func (memAddr) Network() string { return "memory" }
+func (memAddr) String() string  { return ListenerAddr }
+
+// Listener is an in-memory net.Listener, whose connections are opened by Dial
+// through net.Pipe.
+type Listener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener returns an in-memory Listener.
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for the next connection opened by Dial.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the listener. The connections already accepted are kept.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the address of the listener, wich is ListenerAddr.
+func (l *Listener) Addr() net.Addr {
+	return memAddr{}
+}
+
+// Dial opens a connection to the listener. It has the signature of the
+// http.Transport DialContext, so the network and the address are ignored.
+func (l *Listener) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, srv := net.Pipe()
+	select {
+	case l.conns <- srv:
+		return client, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Client returns a http.Client whose requests, to any URL, are sent through
+// the listener.
+func (l *Listener) Client() *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: l.Dial}}
+}
+
+// Serve serves h on a new in-memory Listener, with the ListenerAddr on the
+// context of the requests, and returns a client connected to it. The server is
+// closed when the test ends.
+func Serve(t testing.TB, h http.Handler) *http.Client {
+	l := NewListener()
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, WithListener(r, ListenerAddr))
+		}),
+	}
+	go srv.Serve(l)
+	c := l.Client()
+	t.Cleanup(func() {
+		c.CloseIdleConnections()
+		srv.Close()
+	})
+	return c
+}
@@ -0,0 +1,166 @@
+package stateratest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/router"
+)
+
+// ErrUnknownNode is returned by the Transport for the requests to a node it
+// doesn't hold.
+var ErrUnknownNode = errors.New("stateratest: unknown node")
+
+// Node is a fake node, whose requests are answered in memory by a Transport.
+type Node struct {
+	router.NodeKey
+
+	// Handler answers the requests to the node. If nil, the requests are
+	// answered with 200 and an empty body.
+	Handler http.Handler
+
+	// Latency define the time the node takes to answer each request. The
+	// request fails earlier if it's context is done.
+	Latency time.Duration
+
+	// Err define, if not nil, the error returned for the requests to the
+	// node, e.g. to simulate a refused connection.
+	Err error
+
+	// Health define the scripted results of the health checks of the node:
+	// the nth check is answered by Health[n], and the last result is repeated
+	// after the script is over. If empty, the node is always healthy.
+	Health []bool
+
+	requests int
+	checks   int
+	mu       sync.Mutex // guards Health, requests and checks
+}
+
+// RouterNode returns the router.Node with the key of the fake node, to be
+// added on a group using the Transport.
+func (n *Node) RouterNode() *router.Node {
+	return &router.Node{NodeKey: n.NodeKey, Weight: 1}
+}
+
+// SetHealth replaces the scripted health check results of the node.
+func (n *Node) SetHealth(health ...bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Health = health
+	n.checks = 0
+}
+
+// Requests returns the number of requests answered by the node, without the
+// health checks.
+func (n *Node) Requests() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.requests
+}
+
+// healthy returns the result of the next health check of the script.
+func (n *Node) healthy() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.Health) == 0 {
+		return true
+	}
+	i := n.checks
+	if i >= len(n.Health) {
+		i = len(n.Health) - 1
+	}
+	n.checks++
+	return n.Health[i]
+}
+
+// Transport is a http.RoundTripper that answers the requests of a node group
+// with it's fake nodes, to be set as the NodeGroup Transport.
+type Transport struct {
+	// HealthPath define the path of the group health checks, without the
+	// leading slash, as on router.HealthCheckConfig. The requests to it are
+	// answered by the scripted Health of the nodes.
+	HealthPath string
+
+	nodes map[router.NodeKey]*Node
+	mu    sync.RWMutex // guards nodes
+}
+
+// NewTransport returns a Transport answering with the nodes.
+func NewTransport(healthPath string, nodes ...*Node) *Transport {
+	t := &Transport{HealthPath: healthPath, nodes: make(map[router.NodeKey]*Node)}
+	for _, n := range nodes {
+		t.nodes[n.NodeKey] = n
+	}
+	return t
+}
+
+// AddNode adds a fake node to the Transport.
+func (t *Transport) AddNode(n *Node) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes[n.NodeKey] = n
+}
+
+// RoundTrip answers the request with the fake node of it's URL host.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	port, _ := strconv.ParseUint(r.URL.Port(), 10, 16)
+	nk := router.NodeKey{Host: r.URL.Hostname(), Port: uint16(port)}
+	t.mu.RLock()
+	n, ok := t.nodes[nk]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownNode
+	}
+
+	if n.Latency > 0 {
+		timer := time.NewTimer(n.Latency)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		}
+	}
+	if n.Err != nil {
+		return nil, n.Err
+	}
+
+	rec := httptest.NewRecorder()
+	if r.URL.Path == "/"+strings.TrimPrefix(t.HealthPath, "/") {
+		if !n.healthy() {
+			rec.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return rec.Result(), nil
+	}
+	n.mu.Lock()
+	n.requests++
+	n.mu.Unlock()
+	if n.Handler != nil {
+		n.Handler.ServeHTTP(rec, r)
+	}
+	res := rec.Result()
+	res.Request = r
+	return res, nil
+}
+
+// NewNodeGroup returns a node group with the name, balanced by b, whose
+// requests and health checks are answered by the fake nodes. The nodes are
+// checked each second, on the "health" path, and must be added on the group
+// through RouterNode after the group is added on a router.
+func NewNodeGroup(name string, b router.Balancer, nodes ...*Node) *router.NodeGroup {
+	return &router.NodeGroup{
+		Name:        name,
+		Balancer:    b,
+		HealthCheck: router.HealthCheckConfig{Path: "health", Interval: 1},
+		Transport:   NewTransport("health", nodes...),
+	}
+}
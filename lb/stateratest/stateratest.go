@@ -0,0 +1,43 @@
+// Package stateratest implements fixtures to test the custom balancers and
+// middlewares of statera without standing up real servers: request builders
+// with the listener and evaluation context of the LB, a fake Balancer, fake
+// nodes answering through an in-memory Transport, with scripted health and
+// latency, and an in-memory listener.
+package stateratest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/server"
+)
+
+// ListenerAddr is the listener address set on the context of the requests built
+// by NewRequest and served by Serve.
+const ListenerAddr = "127.0.0.1:8080"
+
+// NewRequest returns a request suitable to be passed to a http.Handler, as
+// httptest.NewRequest, that arrived through ListenerAddr.
+func NewRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	return WithListener(r, ListenerAddr)
+}
+
+// NewGroupRequest returns a request built by NewRequest, evaluated to be
+// fowarded to the node group, as the router expects.
+func NewGroupRequest(method, target string, body io.Reader, group string) *http.Request {
+	return WithEvaluation(NewRequest(method, target, body), evaluator.EvaluationResult{NodeGroup: group})
+}
+
+// WithListener returns a shallow copy of r arrived through the listener.
+func WithListener(r *http.Request, listener string) *http.Request {
+	return r.WithContext(server.ContextWithListener(r.Context(), listener))
+}
+
+// WithEvaluation returns a shallow copy of r holding the evaluation result, as
+// if a rule had matched it.
+func WithEvaluation(r *http.Request, e evaluator.EvaluationResult) *http.Request {
+	return r.WithContext(evaluator.ContextWithEvaluationResult(r.Context(), e))
+}
@@ -0,0 +1,330 @@
+package lb
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/mhef/statera/lb/admin"
+	"github.com/mhef/statera/lb/evaluator"
+	"github.com/mhef/statera/lb/extdata"
+	"github.com/mhef/statera/lb/metrics"
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/slo"
+)
+
+// groupStatsView is the representation of the statistics of a node group on the
+// stats endpoint.
+type groupStatsView struct {
+	Name          string                    `json:"name"`
+	Requests      int64                     `json:"requests"`
+	Errors        int64                     `json:"errors"`
+	Aborted       int64                     `json:"aborted"`
+	UploadBytes   int64                     `json:"upload_bytes"`
+	DownloadBytes int64                     `json:"download_bytes"`
+	Shed          int64                     `json:"shed"`
+	Standby       bool                      `json:"standby"`
+	Active        bool                      `json:"active"`
+	Latency       metrics.HistogramSnapshot `json:"latency"`
+	Nodes         []nodeView                `json:"nodes"`
+}
+
+// statsView is the response of the stats endpoint.
+type statsView struct {
+	InFlight int64            `json:"in_flight"`
+	Groups   []groupStatsView `json:"groups"`
+}
+
+// statsHandler answers the traffic statistics and the node health of each node
+// group, as JSON.
+func statsHandler(rtr *router.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sv := statsView{
+			InFlight: rtr.InFlight(),
+			Groups:   make([]groupStatsView, 0),
+		}
+		for _, ng := range rtr.NodeGroups() {
+			st := ng.Stats()
+			gv := groupStatsView{
+				Name:          ng.Name,
+				Requests:      st.Requests.Value(),
+				Errors:        st.Errors.Value(),
+				Aborted:       st.Aborted.Value(),
+				UploadBytes:   st.UploadBytes.Value(),
+				DownloadBytes: st.DownloadBytes.Value(),
+				Shed:          st.Shed.Value(),
+				Standby:       ng.Standby,
+				Active:        ng.Active(),
+				Latency:       st.Latency.Snapshot(),
+				Nodes:         make([]nodeView, 0),
+			}
+			for _, n := range ng.Nodes() {
+				gv.Nodes = append(gv.Nodes, newNodeView(ng.Name, n))
+			}
+			sv.Groups = append(sv.Groups, gv)
+		}
+		admin.WriteJSON(w, http.StatusOK, sv)
+	}
+}
+
+// balancerNodeView is the representation of a node on the balancing pool of a
+// node group balancer.
+type balancerNodeView struct {
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Weight   int    `json:"weight"`
+	InFlight int    `json:"in_flight"`
+}
+
+// balancerView is the representation of the balancer of a node group on the
+// balancer endpoint.
+type balancerView struct {
+	Group string `json:"group"`
+
+	// Supported is false if the balancer can't report it's balancing pool.
+	Supported bool               `json:"supported"`
+	Nodes     []balancerNodeView `json:"nodes"`
+
+	// Desync hold the nodes whose presence on the balancing pool doesn't match
+	// their health and draining state.
+	Desync []string `json:"desync"`
+}
+
+// balancerHandler answers the nodes each balancer is currently considering, of
+// all groups or of the group on the group query parameter, as JSON.
+func balancerHandler(rtr *router.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := r.URL.Query().Get("group")
+		views := make([]balancerView, 0)
+		for _, ng := range rtr.NodeGroups() {
+			if group != "" && ng.Name != group {
+				continue
+			}
+			bv := balancerView{
+				Group:  ng.Name,
+				Nodes:  make([]balancerNodeView, 0),
+				Desync: make([]string, 0),
+			}
+			ns, ok := ng.BalancerNodes()
+			if ok {
+				bv.Supported = true
+				for _, st := range ns {
+					bv.Nodes = append(bv.Nodes, balancerNodeView{
+						Host:     st.Host,
+						Port:     st.Port,
+						Weight:   st.Weight,
+						InFlight: st.InFlight,
+					})
+				}
+				nks, _ := ng.BalancerDesync()
+				for _, nk := range nks {
+					bv.Desync = append(bv.Desync, nk.String())
+				}
+			}
+			views = append(views, bv)
+		}
+		admin.WriteJSON(w, http.StatusOK, views)
+	}
+}
+
+// udpNodeView is the representation of a UDP node on the udp endpoint.
+type udpNodeView struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Healthy  bool   `json:"healthy"`
+	Sessions int64  `json:"sessions"`
+}
+
+// udpGroupView is the representation of a UDP group on the udp endpoint.
+type udpGroupView struct {
+	Name     string        `json:"name"`
+	Received int64         `json:"received"`
+	Relayed  int64         `json:"relayed"`
+	Dropped  int64         `json:"dropped"`
+	Rejected int64         `json:"rejected"`
+	Nodes    []udpNodeView `json:"nodes"`
+}
+
+// udpHandler answers the traffic statistics and the node health of each UDP
+// group, as JSON.
+func (cp *controlPlane) udpHandler(w http.ResponseWriter, r *http.Request) {
+	views := make([]udpGroupView, 0)
+	if cp.udp != nil {
+		for _, g := range cp.udp.Groups() {
+			gv := udpGroupView{
+				Name:     g.Name,
+				Received: g.Received(),
+				Relayed:  g.Relayed(),
+				Dropped:  g.Dropped(),
+				Rejected: g.Rejected(),
+				Nodes:    make([]udpNodeView, 0, len(g.Nodes)),
+			}
+			for _, n := range g.Nodes {
+				gv.Nodes = append(gv.Nodes, udpNodeView{
+					Host:     n.Host,
+					Port:     n.Port,
+					Healthy:  n.Healthy(),
+					Sessions: n.Sessions(),
+				})
+			}
+			views = append(views, gv)
+		}
+	}
+	admin.WriteJSON(w, http.StatusOK, views)
+}
+
+// metricsHandler answers the metrics of the load balancer on the Prometheus text
+// format, or on the OpenMetrics format, with the exemplars, if the scraper
+// accepts it.
+func (cp *controlPlane) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var mw *metrics.Writer
+	if metrics.AcceptsOpenMetrics(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", metrics.OpenMetricsContentType)
+		mw = metrics.NewOpenMetricsWriter(w)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		mw = metrics.NewWriter(w)
+	}
+	defer mw.Close()
+	cp.r.WriteMetrics(mw)
+	if cp.cache != nil {
+		cp.cache.WriteMetrics(mw)
+	}
+	if cp.idempotency != nil {
+		cp.idempotency.WriteMetrics(mw)
+	}
+	if cp.quota != nil {
+		cp.quota.WriteMetrics(mw)
+	}
+	if cp.slo != nil {
+		cp.slo.WriteMetrics(mw)
+	}
+	cp.tenants.WriteMetrics(mw)
+	if cp.udp != nil {
+		cp.udp.WriteMetrics(mw)
+	}
+	cp.errors.WriteMetrics(mw)
+	cp.writeHAMetrics(mw)
+	cp.recovery.WriteMetrics(mw)
+	cp.writeConditionMetrics(mw)
+	cp.writeMemoMetrics(mw)
+	extdata.WriteMetrics(mw)
+}
+
+// sloHandler answers the state of the service level objectives of the node
+// groups.
+func (cp *controlPlane) sloHandler(w http.ResponseWriter, r *http.Request) {
+	if cp.slo == nil {
+		admin.WriteJSON(w, http.StatusOK, []slo.Status{})
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, cp.slo.Status())
+}
+
+// conditionReports returns the evaluation statistics of the conditions of all
+// rules, ordered by listener address and then by rule priority.
+func (cp *controlPlane) conditionReports() []evaluator.ConditionReport {
+	lnrs := make([]string, 0, len(cp.evs))
+	for l := range cp.evs {
+		lnrs = append(lnrs, l)
+	}
+	sort.Strings(lnrs)
+	reports := make([]evaluator.ConditionReport, 0)
+	for _, l := range lnrs {
+		reports = append(reports, cp.evs[l].ConditionReports()...)
+	}
+	return reports
+}
+
+// writeConditionMetrics writes the evaluation statistics of the rule conditions
+// on mw. The rules are identified by their ID.
+func (cp *controlPlane) writeConditionMetrics(mw *metrics.Writer) {
+	reports := cp.conditionReports()
+	labels := func(cr evaluator.ConditionReport) metrics.Labels {
+		return metrics.Labels{
+			"listener":  cr.Rule.Listener,
+			"rule":      cr.Rule.ID,
+			"condition": strconv.Itoa(cr.Index),
+		}
+	}
+	for _, cr := range reports {
+		mw.Histogram("statera_condition_duration_seconds", "Time to evaluate the rule condition.",
+			labels(cr), cr.Duration)
+	}
+	for _, cr := range reports {
+		mw.Counter("statera_condition_short_circuits_total", "Evaluations where the rule condition was not satisfied, skipping the rest of the rule.",
+			labels(cr), cr.ShortCircuits)
+	}
+	for _, cr := range reports {
+		v := 0.0
+		if cr.Slow {
+			v = 1
+		}
+		mw.Gauge("statera_condition_slow", "If the p99 evaluation time of the rule condition exceeds the slow threshold (1) or not (0).",
+			labels(cr), v)
+	}
+}
+
+// writeMemoMetrics writes the hits and misses of the rule evaluation memo of the
+// listeners that memoize the results on mw.
+func (cp *controlPlane) writeMemoMetrics(mw *metrics.Writer) {
+	lnrs := make([]string, 0, len(cp.evs))
+	for l, e := range cp.evs {
+		if e.MemoSize > 0 {
+			lnrs = append(lnrs, l)
+		}
+	}
+	sort.Strings(lnrs)
+	for _, l := range lnrs {
+		hits, _ := cp.evs[l].MemoStats()
+		mw.Counter("statera_rule_memo_hits_total", "Rule evaluations answered by the memo of the listener.",
+			metrics.Labels{"listener": l}, hits)
+	}
+	for _, l := range lnrs {
+		_, misses := cp.evs[l].MemoStats()
+		mw.Counter("statera_rule_memo_misses_total", "Rule evaluations of a memoizable rule set that missed the memo of the listener.",
+			metrics.Labels{"listener": l}, misses)
+	}
+}
+
+// conditionView is the representation of the evaluation statistics of a rule
+// condition on the conditions endpoint.
+type conditionView struct {
+	Rule          string  `json:"rule"`
+	Listener      string  `json:"listener"`
+	Priority      int     `json:"priority"`
+	Condition     int     `json:"condition"`
+	Type          int     `json:"type"`
+	Evaluations   int64   `json:"evaluations"`
+	ShortCircuits int64   `json:"short_circuits"`
+	P50           float64 `json:"p50"`
+	P99           float64 `json:"p99"`
+	Slow          bool    `json:"slow"`
+}
+
+// conditionsHandler answers the evaluation statistics of the rule conditions, as
+// JSON. If the slow query parameter is set, only the slow conditions are
+// answered.
+func (cp *controlPlane) conditionsHandler(w http.ResponseWriter, r *http.Request) {
+	onlySlow := r.URL.Query().Get("slow") != ""
+	reports := cp.conditionReports()
+	views := make([]conditionView, 0)
+	for _, cr := range reports {
+		if onlySlow && !cr.Slow {
+			continue
+		}
+		views = append(views, conditionView{
+			Rule:          cr.Rule.ID,
+			Listener:      cr.Rule.Listener,
+			Priority:      cr.Rule.Priority,
+			Condition:     cr.Index,
+			Type:          int(cr.Rule.Conditions[cr.Index].Type),
+			Evaluations:   cr.Duration.Count,
+			ShortCircuits: cr.ShortCircuits,
+			P50:           cr.Duration.Quantile(.5),
+			P99:           cr.Duration.Quantile(.99),
+			Slow:          cr.Slow,
+		})
+	}
+	admin.WriteJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,130 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mhef/statera/cfg"
+	"github.com/mhef/statera/lb/router"
+	"github.com/mhef/statera/lb/server"
+)
+
+// Version is the version of statera shown on the status page. It's set on the
+// build, e.g. with -ldflags "-X github.com/mhef/statera/lb.Version=1.2.0".
+var Version = "dev"
+
+// started is the time statera started, for the uptime of the status page.
+var started = time.Now()
+
+// defaultStatusPath is the path of the status page, when the configuration
+// doesn't define one.
+const defaultStatusPath = "/statera-status"
+
+// statusPage answers, on a traffic listener, a minimal status page with the
+// uptime, the version and the health of each node group, so the health of the
+// load balancer can be checked without the admin listener.
+type statusPage struct {
+	path  string
+	allow []*net.IPNet
+	r     *router.Router
+}
+
+// newStatusPage returns the status page described by c, or nil if c is nil.
+func newStatusPage(c *cfg.StatusPage, r *router.Router) *statusPage {
+	if c == nil {
+		return nil
+	}
+	sp := &statusPage{path: c.Path, r: r}
+	if sp.path == "" {
+		sp.path = defaultStatusPath
+	}
+	allow := c.Allow
+	if len(allow) == 0 {
+		allow = []string{"127.0.0.0/8", "::1/128"}
+	}
+	for _, a := range allow {
+		_, ipNet, err := net.ParseCIDR(a)
+		if err != nil {
+			panic(fmt.Sprintf("invalid status page allowed network %s", a))
+		}
+		sp.allow = append(sp.allow, ipNet)
+	}
+	return sp
+}
+
+// allowed returns if the client of the request may see the status page. The
+// client is the original source resolved by the listener.
+func (sp *statusPage) allowed(r *http.Request) bool {
+	src, ok := server.SourceAddrFromRequest(r)
+	if !ok {
+		return false
+	}
+	for _, n := range sp.allow {
+		if n.Contains(src.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler answers the requests to the status page path from the allowed
+// clients, and fowards the others to the next handler, so the path is routed
+// as usual for the other clients.
+func (sp *statusPage) Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != sp.path || !sp.allowed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write([]byte(sp.render(time.Now())))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// render returns the status page text, e.g.:
+//
+//	Statera dev
+//	Uptime: 3h12m5s
+//	Node groups: 2 (1 degraded)
+//	api: 3/3 nodes healthy, 12 in flight
+//	web: 1/2 nodes healthy, 0 in flight
+func (sp *statusPage) render(now time.Time) string {
+	ngs := sp.r.NodeGroups()
+	var b strings.Builder
+	lines := make([]string, 0, len(ngs))
+	degraded := 0
+	for _, ng := range ngs {
+		nodes := ng.Nodes()
+		healthy := 0
+		var inFlight int64
+		for _, n := range nodes {
+			if n.Healthy() {
+				healthy++
+			}
+			inFlight += n.InFlight()
+		}
+		if healthy < len(nodes) {
+			degraded++
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d/%d nodes healthy, %d in flight\n", ng.Name, healthy, len(nodes), inFlight))
+	}
+	fmt.Fprintf(&b, "Statera %s\n", Version)
+	fmt.Fprintf(&b, "Uptime: %s\n", now.Sub(started).Truncate(time.Second))
+	fmt.Fprintf(&b, "Node groups: %d (%d degraded)\n", len(ngs), degraded)
+	for _, l := range lines {
+		b.WriteString(l)
+	}
+	return b.String()
+}
@@ -0,0 +1,180 @@
+package tenant
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+// DefaultMaxTenants is the default maximum number of tenants measured by Stats.
+const DefaultMaxTenants = 1000
+
+// otherTenant is the tenant under wich the requests of the tenants above the
+// maximum are measured.
+const otherTenant = "other"
+
+// tenantStats hold the metrics of a tenant.
+type tenantStats struct {
+	// requests hold the number of answered requests by status class, e.g.
+	// "2xx".
+	requests map[string]*metrics.Counter
+	duration *metrics.Histogram
+}
+
+// Stats measures the requests of each tenant.
+type Stats struct {
+	// MaxTenants define the maximum number of tenants measured, so a client
+	// can't make the metrics grow without bound by sending random tenants. The
+	// requests of the tenants above the maximum are measured as "other".
+	//
+	// The default MaxTenants is DefaultMaxTenants.
+	MaxTenants int
+
+	tenants map[string]*tenantStats
+	mu      sync.Mutex
+}
+
+// NewStats returns a new instance of Stats.
+func NewStats() *Stats {
+	return &Stats{tenants: make(map[string]*tenantStats)}
+}
+
+// get returns the metrics of the tenant, creating them if needed.
+func (s *Stats) get(tenant string) *tenantStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts, ok := s.tenants[tenant]; ok {
+		return ts
+	}
+	maxTenants := s.MaxTenants
+	if maxTenants <= 0 {
+		maxTenants = DefaultMaxTenants
+	}
+	if len(s.tenants) >= maxTenants {
+		tenant = otherTenant
+		if ts, ok := s.tenants[tenant]; ok {
+			return ts
+		}
+	}
+	ts := &tenantStats{
+		requests: make(map[string]*metrics.Counter),
+		duration: metrics.NewHistogram(metrics.DefaultBuckets),
+	}
+	s.tenants[tenant] = ts
+	return ts
+}
+
+// observe measures a request of the tenant.
+func (s *Stats) observe(tenant string, status int, d time.Duration) {
+	ts := s.get(tenant)
+	class := strconv.Itoa(status/100) + "xx"
+	s.mu.Lock()
+	c, ok := ts.requests[class]
+	if !ok {
+		c = &metrics.Counter{}
+		ts.requests[class] = c
+	}
+	s.mu.Unlock()
+	c.Inc()
+	ts.duration.Observe(d.Seconds())
+}
+
+// Handler tracks the tenant of each request and measures the requests with a
+// tenant, after the rest of the chain handles them. It must be chained before
+// the evaluator handler.
+func (s *Stats) Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = Track(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if t := FromRequest(r); t != "" {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			s.observe(t, rec.status, time.Since(start))
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+// WriteMetrics writes the metrics of each tenant on mw.
+func (s *Stats) WriteMetrics(mw *metrics.Writer) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.tenants))
+	for t := range s.tenants {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	type series struct {
+		tenant, class string
+		v             int64
+	}
+	var reqs []series
+	durations := make([]metrics.HistogramSnapshot, 0, len(names))
+	for _, t := range names {
+		ts := s.tenants[t]
+		classes := make([]string, 0, len(ts.requests))
+		for c := range ts.requests {
+			classes = append(classes, c)
+		}
+		sort.Strings(classes)
+		for _, c := range classes {
+			reqs = append(reqs, series{t, c, ts.requests[c].Value()})
+		}
+		durations = append(durations, ts.duration.Snapshot())
+	}
+	s.mu.Unlock()
+
+	for _, sr := range reqs {
+		mw.Counter("statera_tenant_requests_total", "Requests answered by tenant and status class.",
+			metrics.Labels{"tenant": sr.tenant, "code": sr.class}, sr.v)
+	}
+	for i, t := range names {
+		mw.Histogram("statera_tenant_request_duration_seconds", "Time to answer the requests of the tenant.",
+			metrics.Labels{"tenant": t}, durations[i])
+	}
+}
+
+// statusRecorder wraps a http.ResponseWriter to record the status code of the
+// response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(statusCode int) {
+	if rec.status == 0 {
+		rec.status = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// ReadFrom implements the io.ReaderFrom interface, so the files are still sent
+// with sendfile(2) when the wrapped ResponseWriter supports it.
+func (rec *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return io.Copy(rec.ResponseWriter, src)
+}
+
+// Flush implements the http.Flusher interface, if the wrapped ResponseWriter
+// supports it.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
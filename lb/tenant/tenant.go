@@ -0,0 +1,170 @@
+// Package tenant identifies the tenant of each request, so the metrics, the
+// quotas and the access log of statera can be kept by tenant. The tenant is
+// derived, as defined by the matched rule, from a header, a JWT claim or the
+// hostname of the request.
+package tenant
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Source is the part of the request from wich the tenant is derived.
+type Source int
+
+// Currently implemented sources.
+const (
+	// SourceHeader uses the value of the Key header.
+	SourceHeader Source = iota
+
+	// SourceClaim uses the Key claim of the JWT on the Authorization bearer
+	// token.
+	SourceClaim
+
+	// SourceHost uses the request host, without the port and without the Key
+	// suffix, e.g. "acme" for "acme.example.com" with the ".example.com" Key.
+	SourceHost
+)
+
+// ParseSource returns the Source with the name: "header", "claim" or "host".
+func ParseSource(s string) (Source, bool) {
+	switch s {
+	case "header":
+		return SourceHeader, true
+	case "claim":
+		return SourceClaim, true
+	case "host":
+		return SourceHost, true
+	}
+	return 0, false
+}
+
+// String returns the name of the source.
+func (s Source) String() string {
+	switch s {
+	case SourceHeader:
+		return "header"
+	case SourceClaim:
+		return "claim"
+	case SourceHost:
+		return "host"
+	}
+	return fmt.Sprintf("Source(%d)", int(s))
+}
+
+// Extractor define how the tenant of a request is derived.
+type Extractor struct {
+	Source Source
+
+	// Key define the header name on SourceHeader, the claim name on
+	// SourceClaim and the suffix stripped from the host on SourceHost. A host
+	// without the suffix has no tenant.
+	Key string
+
+	// Default define the tenant of the requests from wich no tenant is
+	// derived. If blank, such requests have no tenant.
+	Default string
+}
+
+// Extract returns the tenant of the request, or Default if there is none.
+//
+// The JWT signature is not verified, as the LB doesn't hold the keys of the
+// issuers: the claim must only be used to key metrics and limits, and the nodes
+// must still verify the token.
+func (x *Extractor) Extract(r *http.Request) string {
+	var t string
+	switch x.Source {
+	case SourceHeader:
+		t = r.Header.Get(x.Key)
+	case SourceClaim:
+		t = bearerClaim(r, x.Key)
+	case SourceHost:
+		h := r.Host
+		if hp, _, err := net.SplitHostPort(h); err == nil {
+			h = hp
+		}
+		h = strings.ToLower(h)
+		if x.Key == "" {
+			t = h
+		} else if strings.HasSuffix(h, strings.ToLower(x.Key)) {
+			t = strings.TrimSuffix(h, strings.ToLower(x.Key))
+		}
+	}
+	if t == "" {
+		return x.Default
+	}
+	return t
+}
+
+// bearerClaim returns the claim of the JWT on the Authorization bearer token of
+// the request, formatted as a string. Returns a blank string if there is no
+// token, or no such claim.
+func bearerClaim(r *http.Request, claim string) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// ctxSlotKey is the type used to define the tenant slot key.
+type ctxSlotKey struct{}
+
+// slotKey is the key that holds the tenant slot of the request.
+var slotKey ctxSlotKey
+
+// slot hold the tenant of a request. It's added to the context before the
+// evaluation, so the handlers before the evaluator, like the access log, can
+// know the tenant after the request is handled.
+type slot struct {
+	tenant string
+}
+
+// Track returns the request with a tenant slot on it's context, if it has none
+// yet. It must be called before the request is evaluated by the handlers that
+// need the tenant after the rest of the chain handles the request.
+func Track(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(slotKey).(*slot); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), slotKey, &slot{}))
+}
+
+// Set define the tenant of the request, if the request is tracked.
+func Set(r *http.Request, tenant string) {
+	if s, ok := r.Context().Value(slotKey).(*slot); ok {
+		s.tenant = tenant
+	}
+}
+
+// FromRequest returns the tenant of the request, or a blank string if it has no
+// tenant or is not tracked.
+func FromRequest(r *http.Request) string {
+	if s, ok := r.Context().Value(slotKey).(*slot); ok {
+		return s.tenant
+	}
+	return ""
+}
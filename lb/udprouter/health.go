@@ -0,0 +1,196 @@
+package udprouter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// ProbeType is the type of the health check probes.
+type ProbeType int
+
+const (
+	// ProbeUDP sends the Payload to the node port. The node is healthy if it
+	// replies, or, without Expect, if the port isn't reported as unreachable
+	// until the timeout.
+	ProbeUDP ProbeType = iota
+
+	// ProbeICMP sends an ICMP echo request to the node host. It needs a raw
+	// socket, so statera must run with the CAP_NET_RAW capability. Only IPv4
+	// nodes are supported.
+	ProbeICMP
+)
+
+// ParseProbeType returns the ProbeType with the name: "udp" (or blank) or
+// "icmp".
+func ParseProbeType(s string) (ProbeType, bool) {
+	switch s {
+	case "", "udp":
+		return ProbeUDP, true
+	case "icmp":
+		return ProbeICMP, true
+	}
+	return 0, false
+}
+
+// Defaults of the HealthCheck.
+const (
+	defaultHealthCheckInterval = 5
+	defaultHealthCheckTimeout  = 2
+)
+
+var errICMPv6 = errors.New("lb/udprouter: the icmp probe only supports IPv4 nodes")
+
+// HealthCheck define the health check of the nodes of a group.
+type HealthCheck struct {
+	Type ProbeType
+
+	// Interval define the interval in seconds between each check.
+	//
+	// The default Interval is 5 seconds.
+	Interval int
+
+	// Timeout define the time in seconds that a node has to answer the probe.
+	//
+	// The default Timeout is 2 seconds.
+	Timeout int
+
+	// Payload define the datagram sent by the ProbeUDP, e.g. a DNS query.
+	Payload []byte
+
+	// Expect define, if not blank, the bytes that the reply of the ProbeUDP
+	// must contain.
+	Expect []byte
+}
+
+// run checks the node on each Interval until the context is done.
+func (hc *HealthCheck) run(ctx context.Context, g *Group, n *Node) {
+	interval := hc.Interval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	t := time.NewTicker(time.Duration(interval) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !n.setHealthy(hc.probe(n)) {
+			continue
+		}
+		if n.Healthy() {
+			log.Println(g.Name, n.addr(), "is healthy")
+		} else {
+			log.Println(g.Name, n.addr(), "is unhealthy")
+		}
+	}
+}
+
+// probe returns if the node answered the probe.
+func (hc *HealthCheck) probe(n *Node) bool {
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	var err error
+	if hc.Type == ProbeICMP {
+		err = probeICMP(n.Host, deadline)
+	} else {
+		err = hc.probeUDP(n, deadline)
+	}
+	return err == nil
+}
+
+// probeUDP sends the Payload to the node and waits for the reply.
+func (hc *HealthCheck) probeUDP(n *Node, deadline time.Time) error {
+	c, err := net.Dial("udp", n.addr())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+	if _, err := c.Write(hc.Payload); err != nil {
+		return err
+	}
+	buf := make([]byte, maxDatagramSize)
+	nr, err := c.Read(buf)
+	if err != nil {
+		// without an expected reply, the silence of the node is healthy: only
+		// the ICMP port unreachable, reported as a read error, is not.
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && len(hc.Expect) == 0 {
+			return nil
+		}
+		return err
+	}
+	if len(hc.Expect) > 0 && !bytes.Contains(buf[:nr], hc.Expect) {
+		return errors.New("lb/udprouter: unexpected health check reply")
+	}
+	return nil
+}
+
+// probeICMP sends an ICMP echo request to the host and waits for the echo
+// reply.
+func probeICMP(host string, deadline time.Time) error {
+	ip, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return err
+	}
+	if ip.IP.To4() == nil {
+		return errICMPv6
+	}
+	c, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+
+	id := uint16(os.Getpid())
+	seq := uint16(time.Now().UnixNano())
+	msg := []byte{8, 0, 0, 0, 0, 0, 0, 0, 's', 't', 'a', 't', 'e', 'r', 'a'}
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	if _, err := c.WriteTo(msg, ip); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		nr, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if a, ok := from.(*net.IPAddr); !ok || !a.IP.Equal(ip.IP) {
+			continue
+		}
+		// the echo replies of other probes, and other ICMP messages, are
+		// skipped.
+		if nr >= 8 && buf[0] == 0 && binary.BigEndian.Uint16(buf[4:]) == id && binary.BigEndian.Uint16(buf[6:]) == seq {
+			return nil
+		}
+	}
+}
+
+// icmpChecksum returns the internet checksum of the ICMP message.
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,241 @@
+package udprouter
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSessionTimeout is the default time in seconds that a client session
+// is kept without datagrams.
+const DefaultSessionTimeout = 60
+
+// DefaultMaxSessions is the default maximum number of client sessions of a
+// listener.
+const DefaultMaxSessions = 10000
+
+// maxDatagramSize is the maximum size of the relayed datagrams.
+const maxDatagramSize = 64 << 10
+
+// session is the relay of the datagrams of a client to a node. Each session has
+// it's own socket to the node, so the replies are relayed to the right client.
+type session struct {
+	client net.Addr
+	node   *Node
+	conn   net.Conn
+
+	// lastSeen hold the unix nano time of the last datagram of the session. It
+	// must be accessed atomically.
+	lastSeen int64
+}
+
+// Listener is a UDP listener that balances the datagrams of the clients across
+// the nodes of a Group.
+type Listener struct {
+	// Addr specifies the UDP address for the listener to listen on, in the form
+	// "host:port".
+	Addr string
+
+	// Group define the group to wich the datagrams are fowarded.
+	Group *Group
+
+	// SessionTimeout define the time in seconds that a client session is kept
+	// without datagrams. The next datagram of an expired client may be
+	// fowarded to another node.
+	//
+	// The default SessionTimeout is DefaultSessionTimeout.
+	SessionTimeout int
+
+	// MaxSessions define the maximum number of client sessions, each holding a
+	// socket to the node. The datagrams of new clients above it are dropped,
+	// until a session expires.
+	//
+	// The default MaxSessions is DefaultMaxSessions.
+	MaxSessions int
+
+	pc       net.PacketConn
+	sessions map[string]*session
+	closed   bool
+	mu       sync.Mutex // guards pc, sessions and closed
+	wg       sync.WaitGroup
+}
+
+// ListenAndServe listens on the Addr and fowards each received datagram.
+//
+// This func blocks until the listener is shut down through Shutdown.
+func (l *Listener) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", l.Addr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		pc.Close()
+		return nil
+	}
+	l.pc = pc
+	l.sessions = make(map[string]*session)
+	l.mu.Unlock()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		l.Group.received.Inc()
+		s, full := l.session(client)
+		if full {
+			l.Group.rejected.Inc()
+			continue
+		}
+		if s == nil {
+			l.Group.dropped.Inc()
+			continue
+		}
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+		if _, err := s.conn.Write(buf[:n]); err != nil {
+			log.Println("lb/udprouter:", err)
+		}
+	}
+}
+
+// session returns the session of the client, creating it if needed. A session
+// whose node became unhealthy is replaced. Returns nil if there is no node
+// available, and full if there are MaxSessions sessions.
+func (l *Listener) session(client net.Addr) (s *session, full bool) {
+	key := client.String()
+	l.mu.Lock()
+	s, ok := l.sessions[key]
+	n := len(l.sessions)
+	l.mu.Unlock()
+	if ok && s.node.Healthy() {
+		return s, false
+	}
+	if ok {
+		l.closeSession(key, s)
+	} else if n >= maxSessions(l.MaxSessions) {
+		return nil, true
+	}
+
+	host, _, err := net.SplitHostPort(key)
+	if err != nil {
+		host = key
+	}
+	node := l.Group.pick(host)
+	if node == nil {
+		log.Println(errNoNodeAvailable, l.Group.Name)
+		return nil, false
+	}
+	c, err := net.Dial("udp", node.addr())
+	if err != nil {
+		log.Println("lb/udprouter:", err)
+		return nil, false
+	}
+	s = &session{client: client, node: node, conn: c, lastSeen: time.Now().UnixNano()}
+	atomic.AddInt64(&node.sessions, 1)
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		c.Close()
+		atomic.AddInt64(&node.sessions, -1)
+		return nil, false
+	}
+	l.sessions[key] = s
+	l.wg.Add(1)
+	l.mu.Unlock()
+	go l.relay(key, s)
+	return s, false
+}
+
+// relay sends the replies of the node back to the client, until the session
+// expires or is closed.
+func (l *Listener) relay(key string, s *session) {
+	defer l.wg.Done()
+	timeout := sessionTimeout(l.SessionTimeout)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				last := time.Unix(0, atomic.LoadInt64(&s.lastSeen))
+				if time.Since(last) < timeout {
+					continue
+				}
+			}
+			l.closeSession(key, s)
+			return
+		}
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+		if _, err := l.pc.WriteTo(buf[:n], s.client); err != nil {
+			log.Println("lb/udprouter:", err)
+			continue
+		}
+		l.Group.relayed.Inc()
+	}
+}
+
+// closeSession closes the session and removes it, if it's still the session of
+// the key.
+func (l *Listener) closeSession(key string, s *session) {
+	l.mu.Lock()
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+		atomic.AddInt64(&s.node.sessions, -1)
+	}
+	l.mu.Unlock()
+	s.conn.Close()
+}
+
+// Shutdown stops receiving datagrams and closes the sessions. UDP has no
+// connections to drain, so it doesn't wait for the context.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	l.closed = true
+	if l.pc != nil {
+		l.pc.Close()
+	}
+	sessions := make(map[string]*session, len(l.sessions))
+	for key, s := range l.sessions {
+		sessions[key] = s
+	}
+	l.mu.Unlock()
+	for key, s := range sessions {
+		l.closeSession(key, s)
+	}
+	l.wg.Wait()
+	return nil
+}
+
+// maxSessions returns the maximum number of sessions, using the default if not
+// positive.
+func maxSessions(n int) int {
+	if n <= 0 {
+		return DefaultMaxSessions
+	}
+	return n
+}
+
+// sessionTimeout converts a timeout in seconds, using the default if not
+// positive.
+func sessionTimeout(s int) time.Duration {
+	if s <= 0 {
+		s = DefaultSessionTimeout
+	}
+	return time.Duration(s) * time.Second
+}
@@ -0,0 +1,208 @@
+// Package udprouter is the LB component in charge of balancing UDP datagrams,
+// e.g. DNS, syslog or game traffic, across node groups. The datagrams of a client
+// are kept on the same node, chosen by the hash of the client address, and the
+// replies of the node are relayed back to the client.
+package udprouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+
+	"github.com/mhef/statera/lb/metrics"
+)
+
+var (
+	// ErrDuplicateGroup is returned when two groups have the same name.
+	ErrDuplicateGroup = errors.New("lb/udprouter: duplicate group name")
+
+	// ErrInvalidGroupName is returned when a group has a blank name.
+	ErrInvalidGroupName = errors.New("lb/udprouter: group name must not be blank")
+
+	errNoNodeAvailable = errors.New("lb/udprouter: there is no node available on the group")
+)
+
+// Node define a node of a UDP group.
+type Node struct {
+	Host string
+	Port int
+
+	// healthy is 1 if the node is healthy. It must be accessed atomically.
+	healthy int32
+
+	// sessions hold the number of client sessions on the node. It must be
+	// accessed atomically.
+	sessions int64
+}
+
+// Healthy returns if the node is healthy.
+func (n *Node) Healthy() bool {
+	return atomic.LoadInt32(&n.healthy) == 1
+}
+
+// Sessions returns the number of client sessions on the node.
+func (n *Node) Sessions() int64 {
+	return atomic.LoadInt64(&n.sessions)
+}
+
+// addr returns the address of the node, in the form "host:port".
+func (n *Node) addr() string {
+	return net.JoinHostPort(n.Host, fmt.Sprint(n.Port))
+}
+
+// setHealthy sets the node health and returns if it changed.
+func (n *Node) setHealthy(healthy bool) bool {
+	v := int32(0)
+	if healthy {
+		v = 1
+	}
+	return atomic.SwapInt32(&n.healthy, v) != v
+}
+
+// Group define a group of nodes that receive the datagrams of the listeners.
+type Group struct {
+	Name  string
+	Nodes []*Node
+
+	// HealthCheck define the health check of the nodes. If nil, the nodes are
+	// always healthy.
+	HealthCheck *HealthCheck
+
+	// Datagrams received from the clients and relayed back from the nodes.
+	received metrics.Counter
+	relayed  metrics.Counter
+
+	// dropped hold the datagrams dropped because no node was available.
+	dropped metrics.Counter
+
+	// rejected hold the datagrams of new clients dropped because a listener
+	// held it's maximum number of sessions.
+	rejected metrics.Counter
+}
+
+// Received returns the number of datagrams received from the clients.
+func (g *Group) Received() int64 {
+	return g.received.Value()
+}
+
+// Relayed returns the number of datagrams relayed from the nodes to the clients.
+func (g *Group) Relayed() int64 {
+	return g.relayed.Value()
+}
+
+// Dropped returns the number of datagrams dropped because no node was available.
+func (g *Group) Dropped() int64 {
+	return g.dropped.Value()
+}
+
+// Rejected returns the number of datagrams of new clients dropped because a
+// listener held it's maximum number of sessions.
+func (g *Group) Rejected() int64 {
+	return g.rejected.Value()
+}
+
+// pick returns the healthy node of the client, using the rendezvous hashing of
+// the client address, so only the clients of a node that leaves the pool are
+// moved. Returns nil if there is no healthy node.
+func (g *Group) pick(client string) *Node {
+	var best *Node
+	var bestScore uint64
+	for _, n := range g.Nodes {
+		if !n.Healthy() {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(client))
+		h.Write([]byte{0})
+		h.Write([]byte(n.addr()))
+		if s := h.Sum64(); best == nil || s > bestScore {
+			best, bestScore = n, s
+		}
+	}
+	return best
+}
+
+// Router holds the UDP groups.
+type Router struct {
+	groups map[string]*Group
+	order  []*Group
+
+	cancel context.CancelFunc
+}
+
+// New returns a Router holding the groups and starts the health checks of their
+// nodes. The nodes start healthy.
+func New(groups []*Group) (*Router, error) {
+	r := &Router{groups: make(map[string]*Group)}
+	for _, g := range groups {
+		if g.Name == "" {
+			return nil, ErrInvalidGroupName
+		}
+		if _, ok := r.groups[g.Name]; ok {
+			return nil, ErrDuplicateGroup
+		}
+		r.groups[g.Name] = g
+		r.order = append(r.order, g)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	for _, g := range groups {
+		for _, n := range g.Nodes {
+			n.setHealthy(true)
+			if g.HealthCheck != nil {
+				go g.HealthCheck.run(ctx, g, n)
+			}
+		}
+	}
+	return r, nil
+}
+
+// Group returns the group with the name, if one.
+func (r *Router) Group(name string) (g *Group, ok bool) {
+	g, ok = r.groups[name]
+	return
+}
+
+// Groups returns the groups of the Router, on the order they were added.
+func (r *Router) Groups() []*Group {
+	return r.order
+}
+
+// Stop stops the health checks.
+func (r *Router) Stop() {
+	r.cancel()
+}
+
+// WriteMetrics writes the metrics of the groups on mw.
+func (r *Router) WriteMetrics(mw *metrics.Writer) {
+	for _, g := range r.order {
+		mw.Counter("statera_udp_datagrams_received_total", "Datagrams received from the clients.",
+			metrics.Labels{"group": g.Name}, g.Received())
+	}
+	for _, g := range r.order {
+		mw.Counter("statera_udp_datagrams_relayed_total", "Datagrams relayed from the nodes to the clients.",
+			metrics.Labels{"group": g.Name}, g.Relayed())
+	}
+	for _, g := range r.order {
+		mw.Counter("statera_udp_datagrams_dropped_total", "Datagrams dropped because no node was available.",
+			metrics.Labels{"group": g.Name}, g.Dropped())
+	}
+	for _, g := range r.order {
+		mw.Counter("statera_udp_datagrams_rejected_total", "Datagrams of new clients dropped because a listener held it's maximum number of sessions.",
+			metrics.Labels{"group": g.Name}, g.Rejected())
+	}
+	for _, g := range r.order {
+		for _, n := range g.Nodes {
+			v := 0.0
+			if n.Healthy() {
+				v = 1
+			}
+			mw.Gauge("statera_udp_node_healthy", "If the node is healthy.",
+				metrics.Labels{"group": g.Name, "node": n.addr()}, v)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package webhook implements the notification of the load balancer events, like
+// the node health transitions, to HTTP endpoints, so the alerting systems are
+// notified as soon as the events happen.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Event types.
+const (
+	// NodeHealthy is notified when a node becomes healthy.
+	NodeHealthy = "node_healthy"
+
+	// NodeUnhealthy is notified when a node becomes unhealthy.
+	NodeUnhealthy = "node_unhealthy"
+
+	// SLOBurn is notified when a burn rate alert of a service level
+	// objective of a group starts firing.
+	SLOBurn = "slo_burn"
+
+	// SLOBurnResolved is notified when a burn rate alert stops firing.
+	SLOBurnResolved = "slo_burn_resolved"
+)
+
+// defaultBufferSize is the number of events held by a Notifier when the
+// buffer size is not set.
+const defaultBufferSize = 1000
+
+// Event is an event notified to the hooks.
+type Event struct {
+	Type  string    `json:"type"`
+	Group string    `json:"group"`
+	Node  string    `json:"node"`
+	Time  time.Time `json:"time"`
+
+	// SLO, Window and BurnRate describe, on the SLO events, the objective
+	// kind, the long window of the alert and it's burn rate on the window.
+	SLO      string  `json:"slo,omitempty"`
+	Window   string  `json:"window,omitempty"`
+	BurnRate float64 `json:"burn_rate,omitempty"`
+}
+
+// Hook is a HTTP endpoint that receives the events on the body of POST
+// requests.
+type Hook struct {
+	// URL define the endpoint that receives the events.
+	URL string
+
+	// Headers are added to each request, e.g. to authenticate on the endpoint.
+	// The default Content-Type is "application/json".
+	Headers map[string]string
+
+	// Template define, if not nil, the body of the requests, executed with the
+	// Event, e.g. `{"text": "{{.Node}} of {{.Group}} is {{.Type}}"}`. If nil,
+	// the Event is sent as JSON.
+	Template *template.Template
+
+	// Events define the event types sent to the hook. If empty, all events are
+	// sent.
+	Events []string
+
+	// Retries define how many times a failed request is retried, with
+	// exponential backoff, before the event is dropped.
+	Retries int
+
+	// Client is the client used to send the events. If nil, a client with a 10
+	// seconds timeout is used.
+	Client *http.Client
+}
+
+// defaultClient is the client used by a Hook without Client.
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// wants returns if the hook receives the events of type t.
+func (h *Hook) wants(t string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// body returns the body of the request notifying the event.
+func (h *Hook) body(e Event) ([]byte, error) {
+	if h.Template == nil {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	if err := h.Template.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// send notifies the event to the hook, retrying the failed requests.
+func (h *Hook) send(e Event) error {
+	body, err := h.body(e)
+	if err != nil {
+		return err
+	}
+	backoff := 100 * time.Millisecond
+	for attempt := 0; attempt <= h.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = h.post(body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// post does one attempt of sending the body to the hook.
+func (h *Hook) post(body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	c := h.Client
+	if c == nil {
+		c = defaultClient
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("lb/webhook: %s answered %d", h.URL, res.StatusCode)
+	}
+	return nil
+}
+
+// Notifier sends the events to the hooks. The events are held on a buffer and
+// sent by a background goroutine, so the notifiers are never blocked by a slow
+// or unavailable hook. When the buffer is full, new events are dropped and
+// counted.
+type Notifier struct {
+	hooks   []*Hook
+	events  chan Event
+	dropped int64
+}
+
+// NewNotifier returns a Notifier that sends the events to the hooks, holding up
+// to bufferSize events while the hooks are busy.
+func NewNotifier(hooks []*Hook, bufferSize int) *Notifier {
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	return &Notifier{
+		hooks:  hooks,
+		events: make(chan Event, bufferSize),
+	}
+}
+
+// Notify queues the event to be sent. If the event has no Time, the current time
+// is used.
+func (n *Notifier) Notify(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case n.events <- e:
+	default:
+		atomic.AddInt64(&n.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (n *Notifier) Dropped() int64 {
+	return atomic.LoadInt64(&n.dropped)
+}
+
+// Run sends the queued events until the context is done.
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-n.events:
+			for _, h := range n.hooks {
+				if !h.wants(e.Type) {
+					continue
+				}
+				if err := h.send(e); err != nil {
+					log.Println("lb/webhook: failed to notify", e.Type, "of", e.Node, err)
+				}
+			}
+		}
+	}
+}
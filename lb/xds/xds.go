@@ -0,0 +1,227 @@
+// Package xds implements a client for the xDS discovery protocol, used by service
+// mesh control planes to distribute the cluster and endpoint configuration.
+//
+// Only a subset of the protocol is implemented: the clusters (CDS) and their
+// endpoints (EDS) are polled from the management server through the REST-JSON
+// transport, and each cluster is mapped to the node group with the same name.
+package xds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mhef/statera/lb/router"
+)
+
+// Resource type URLs of the implemented discovery services.
+const (
+	clusterTypeURL  = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	endpointTypeURL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+)
+
+// defaultInterval is the polling interval in seconds used when Client.Interval
+// is not set.
+const defaultInterval = 30
+
+// node identifies statera to the management server.
+type node struct {
+	ID      string `json:"id"`
+	Cluster string `json:"cluster"`
+}
+
+// discoveryRequest is the DiscoveryRequest message of the xDS protocol.
+type discoveryRequest struct {
+	VersionInfo   string   `json:"version_info,omitempty"`
+	Node          node     `json:"node"`
+	ResourceNames []string `json:"resource_names,omitempty"`
+	TypeURL       string   `json:"type_url"`
+}
+
+// discoveryResponse is the DiscoveryResponse message of the xDS protocol.
+type discoveryResponse struct {
+	VersionInfo string            `json:"version_info"`
+	Resources   []json.RawMessage `json:"resources"`
+	TypeURL     string            `json:"type_url"`
+}
+
+// cluster is the subset of the Cluster resource used by the client.
+type cluster struct {
+	Name string `json:"name"`
+}
+
+// clusterLoadAssignment is the subset of the ClusterLoadAssignment resource used
+// by the client.
+type clusterLoadAssignment struct {
+	ClusterName string `json:"cluster_name"`
+	Endpoints   []struct {
+		LbEndpoints []struct {
+			Endpoint struct {
+				Address struct {
+					SocketAddress struct {
+						Address   string `json:"address"`
+						PortValue uint16 `json:"port_value"`
+					} `json:"socket_address"`
+				} `json:"address"`
+			} `json:"endpoint"`
+			HealthStatus        string `json:"health_status"`
+			LoadBalancingWeight int    `json:"load_balancing_weight"`
+		} `json:"lb_endpoints"`
+	} `json:"endpoints"`
+}
+
+// Client polls the clusters and endpoints from a xDS management server and keeps
+// the nodes of the mapped node groups in sync with them.
+type Client struct {
+	// Server define the base URL of the management server REST-JSON API, e.g.
+	// "http://127.0.0.1:18000".
+	Server string
+
+	// NodeID and Cluster identify statera to the management server.
+	NodeID  string
+	Cluster string
+
+	// Interval define the interval in seconds between each poll.
+	//
+	// The default Interval is 30 seconds.
+	Interval int
+
+	// Router is the router holding the node groups that will be synced.
+	Router *router.Router
+
+	client http.Client
+}
+
+// Run polls the management server on each interval and syncs the node groups.
+//
+// This func blocks until the context is done.
+func (c *Client) Run(ctx context.Context) {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	t := time.NewTicker(time.Duration(interval) * time.Second)
+	defer t.Stop()
+	for {
+		if err := c.sync(ctx); err != nil {
+			log.Println("lb/xds: sync failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// fetch does a discovery request for the resources of typeURL and returns the
+// resources of the response.
+func (c *Client) fetch(ctx context.Context, typeURL string, service string, names []string) ([]json.RawMessage, error) {
+	body, err := json.Marshal(discoveryRequest{
+		Node:          node{ID: c.NodeID, Cluster: c.Cluster},
+		ResourceNames: names,
+		TypeURL:       typeURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Server+"/v3/discovery:"+service, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lb/xds: management server answered %d on %s", res.StatusCode, service)
+	}
+	var dr discoveryResponse
+	if err := json.NewDecoder(res.Body).Decode(&dr); err != nil {
+		return nil, err
+	}
+	return dr.Resources, nil
+}
+
+// sync fetches the clusters and the endpoints of the clusters mapped to a node
+// group, then adds, updates and deletes the group nodes to match the endpoints.
+func (c *Client) sync(ctx context.Context) error {
+	resources, err := c.fetch(ctx, clusterTypeURL, "clusters", nil)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(resources))
+	for _, raw := range resources {
+		var cl cluster
+		if err := json.Unmarshal(raw, &cl); err != nil {
+			return err
+		}
+		if _, ok := c.Router.NodeGroup(cl.Name); !ok {
+			continue
+		}
+		names = append(names, cl.Name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	resources, err = c.fetch(ctx, endpointTypeURL, "endpoints", names)
+	if err != nil {
+		return err
+	}
+	for _, raw := range resources {
+		var cla clusterLoadAssignment
+		if err := json.Unmarshal(raw, &cla); err != nil {
+			return err
+		}
+		ng, ok := c.Router.NodeGroup(cla.ClusterName)
+		if !ok {
+			continue
+		}
+		c.syncGroup(ng, cla)
+	}
+	return nil
+}
+
+// syncGroup makes the group nodes match the endpoints of the load assignment.
+// Endpoints reported as unhealthy or draining by the management server are not
+// kept on the group.
+func (c *Client) syncGroup(ng *router.NodeGroup, cla clusterLoadAssignment) {
+	want := make(map[router.NodeKey]int)
+	for _, le := range cla.Endpoints {
+		for _, lbe := range le.LbEndpoints {
+			if lbe.HealthStatus == "UNHEALTHY" || lbe.HealthStatus == "DRAINING" {
+				continue
+			}
+			sa := lbe.Endpoint.Address.SocketAddress
+			w := lbe.LoadBalancingWeight
+			if w == 0 {
+				w = 1
+			}
+			want[router.NodeKey{Host: sa.Address, Port: sa.PortValue}] = w
+		}
+	}
+
+	for _, n := range ng.Nodes() {
+		w, ok := want[n.NodeKey]
+		if !ok {
+			ng.DeleteNode(n.NodeKey)
+			continue
+		}
+		if n.CurrentWeight() != w {
+			ng.SetNodeWeight(n.NodeKey, w)
+		}
+		delete(want, n.NodeKey)
+	}
+	for nk, w := range want {
+		if err := ng.AddNode(&router.Node{NodeKey: nk, Weight: w}); err != nil {
+			log.Println("lb/xds: failed to add node", nk, "on group", ng.Name, err)
+		}
+	}
+}